@@ -28,4 +28,15 @@ const (
 	DeletePeer    Action = 33
 	Send          Action = 34
 	SendChannel   Action = 35
+	// 36 is SendMsg, which is local only
+	GetMsgStatus    Action = 37
+	GetMsgStatuses  Action = 38
+	GetPatches      Action = 39
+	AddPatch        Action = 40
+	Unpatch         Action = 41
+	SetPatches      Action = 42
+	SendMulti       Action = 43
+	SendSigned      Action = 44
+	SetQuota        Action = 45
+	SetChannelQuota Action = 46
 )
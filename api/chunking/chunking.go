@@ -2,34 +2,118 @@ package chunking
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"sort"
 
 	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/rsa"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/events"
 )
 
-// ChunkSize - calculates the minimum chunk size from all active transports
-func ChunkSize(node api.Node) uint32 {
-	var chunksize uint32 = 64 * 1024
+// ChunkSize - calculates the largest content that still fits the largest active transport,
+// once msg has been encrypted to its key and prefixed with its flags, channel name and TTL header.
+// Consumers picking up over smaller transports get the chunks split again into fragments, see Fragmenter.
+func ChunkSize(node api.Node, msg api.Msg) uint32 {
+	var limit uint32
 	policies := node.GetPolicies()
 	for _, p := range policies {
-		limit := uint32(p.GetTransport().ByteLimit())
-		if limit < chunksize {
-			chunksize = limit
+		l := uint32(p.GetTransport().ByteLimit())
+		if l > limit {
+			limit = l
 		}
 	}
-	if chunksize <= 132 {
+	if limit == 0 || limit > 64*1024 {
+		limit = 64 * 1024
+	}
+	prefix := uint32(1) // flags byte
+	if msg.IsChan {
+		prefix += 2 + uint32(len(msg.Name)) // channel name length and name
+	}
+	if msg.HasTTL() {
+		prefix += api.TTLHeaderSize
+	}
+	var chunksize uint32
+	if limit > prefix {
+		// largest content that fits, the encrypted length only grows with the content length
+		n := sort.Search(int(limit-prefix)+1, func(i int) bool { return contentLen(msg, uint32(i)) > limit-prefix })
+		if n > 0 {
+			chunksize = uint32(n - 1)
+		}
+	}
+	if chunksize <= 8 && len(msg.Recipients) == 0 { // SendChunked refuses the envelopes with too many recipients
 		events.Critical(node, "Transport has invalid low byte limit")
 	}
+	return chunksize
+}
+
+// contentLen - the length of n bytes of content once encrypted for the recipients of msg, at most
+func contentLen(msg api.Msg, n uint32) uint32 {
+	if len(msg.Recipients) == 0 {
+		return encryptedLen(msg.PubKey, n)
+	}
+	// multicast envelope: nonce, recipient count, a length and wrapped key and digest for each, then the payload
+	l := 32 + 2 + aesLen(n)
+	for _, pubkey := range msg.Recipients {
+		wrapped := uint32(32 + sha256.Size)
+		if msg.Signed {
+			wrapped += signatureLen(pubkey)
+		}
+		l += 2 + encryptedLen(pubkey, wrapped)
+	}
+	return l
+}
+
+// signatureLen - the length of the sender key and tag in a wrapped key of a signed envelope,
+// taking the sender's key to be of the same kind and size as the recipient's pubkey
+func signatureLen(pubkey bc.PubKey) uint32 {
+	switch k := pubkey.(type) {
+	case *rsa.PubKey:
+		return 2 + uint32(len(k.ToBytes())) + uint32(k.Pubkey.Size())
+	default:
+		// ECC: public key and HMAC
+		return 2 + 32 + 32
+	}
+}
 
-	return chunksize - 132 // todo: this is the overhead for ECC, what about RSA?
+// aesLen - the length of n bytes once AES encrypted, IV and PKCS7 padded ciphertext
+func aesLen(n uint32) uint32 {
+	return aes.BlockSize + (n/aes.BlockSize+1)*aes.BlockSize
+}
+
+// encryptedLen - the length of n bytes of content once encrypted to pubkey, at most
+func encryptedLen(pubkey bc.PubKey, n uint32) uint32 {
+	switch k := pubkey.(type) {
+	case *rsa.PubKey:
+		// OAEP encrypted session key header and the ciphertext, both PEM encoded
+		return pemLen("HEADS", uint32(k.Pubkey.Size())) + pemLen("TAILS", aesLen(n))
+	default:
+		// ECC: ephemeral public key, luggage tag, ciphertext and MAC
+		return 32 + 32 + aesLen(n) + 32
+	}
+}
+
+// pemLen - the length of n bytes once PEM encoded as a block of the given type
+func pemLen(blockType string, n uint32) uint32 {
+	b64 := (n + 2) / 3 * 4
+	lines := (b64 + 63) / 64
+	return uint32(len("-----BEGIN "+blockType+"-----\n")) + b64 + lines + uint32(len("-----END "+blockType+"-----\n"))
 }
 
 // SendChunked - utility function to break large messages into smaller ones for transports that can't handle arbitrarily large messages
 func SendChunked(node api.Node, chunkSize uint32, msg api.Msg) (err error) {
+	// chunks of messages without a priority wait behind other traffic
+	if msg.Priority == api.PriorityNormal {
+		msg.Priority = api.PriorityBulk
+	}
+	if chunkSize <= 8 {
+		return errors.New("No room left for content in the transport")
+	}
 	buf := msg.Content.Bytes()
 	buflen := uint32(len(buf))
 	chunkSizeMinusHeader := chunkSize - 8 // chunk header is two uint32's -> 8 bytes
@@ -47,16 +131,15 @@ func SendChunked(node api.Node, chunkSize uint32, msg api.Msg) (err error) {
 		if err != nil {
 			return
 		}
-		b := bytes.NewBuffer(streamID)                            // StreamID
-		binary.Write(b, binary.LittleEndian, uint32(totalChunks)) // NumChunks
-		if err = node.SendMsg(api.Msg{Name: msg.Name, Content: b, IsChan: msg.IsChan, PubKey: msg.PubKey, Chunked: true, StreamHeader: true}); err != nil {
+		digest := sha256.Sum256(buf)
+		if err = sendHeader(node, msg, streamID, totalChunks, uint64(buflen), digest[:]); err != nil {
 			return
 		}
 		for i := uint32(0); i < wholeLoops; i++ {
 			b := bytes.NewBuffer(streamID)                  // StreamID
 			binary.Write(b, binary.LittleEndian, uint32(i)) // ChunkNum
 			b.Write(buf[i*chunkSizeMinusHeader : (i*chunkSizeMinusHeader)+chunkSizeMinusHeader])
-			if err = node.SendMsg(api.Msg{Name: msg.Name, Content: b, IsChan: msg.IsChan, PubKey: msg.PubKey, Chunked: true}); err != nil {
+			if err = sendChunk(node, api.Msg{Name: msg.Name, Content: b, IsChan: msg.IsChan, PubKey: msg.PubKey, Recipients: msg.Recipients, Chunked: true, HopLimit: msg.HopLimit, Expires: msg.Expires, Priority: msg.Priority, ID: msg.ID}); err != nil {
 				return
 			}
 		}
@@ -64,7 +147,7 @@ func SendChunked(node api.Node, chunkSize uint32, msg api.Msg) (err error) {
 			b := bytes.NewBuffer(streamID)                           // StreamID
 			binary.Write(b, binary.LittleEndian, uint32(wholeLoops)) // ChunkNum
 			b.Write(buf[wholeLoops*chunkSizeMinusHeader:])
-			if err = node.SendMsg(api.Msg{Name: msg.Name, Content: b, IsChan: msg.IsChan, PubKey: msg.PubKey, Chunked: true}); err != nil {
+			if err = sendChunk(node, api.Msg{Name: msg.Name, Content: b, IsChan: msg.IsChan, PubKey: msg.PubKey, Recipients: msg.Recipients, Chunked: true, HopLimit: msg.HopLimit, Expires: msg.Expires, Priority: msg.Priority, ID: msg.ID}); err != nil {
 				return
 			}
 		}
@@ -72,6 +155,39 @@ func SendChunked(node api.Node, chunkSize uint32, msg api.Msg) (err error) {
 	return
 }
 
+// sendHeader - sends a stream header, the length and digest are left off if digest is nil.
+// Only the header of a signed message is signed, the digest in it covers the chunks.
+func sendHeader(node api.Node, msg api.Msg, streamID []byte, numChunks uint32, length uint64, digest []byte) error {
+	b := bytes.NewBuffer(append([]byte{}, streamID...))     // StreamID
+	binary.Write(b, binary.LittleEndian, uint32(numChunks)) // NumChunks
+	// direct streams carry our content key, so the receiver can NACK us
+	replyKey := ""
+	if !msg.IsChan {
+		cid, err := node.CID()
+		if err != nil {
+			return err
+		}
+		replyKey = cid.ToB64()
+	}
+	binary.Write(b, binary.LittleEndian, uint16(len(replyKey))) // ReplyKey length
+	b.WriteString(replyKey)                                     // ReplyKey
+	if digest != nil {
+		binary.Write(b, binary.LittleEndian, length) // Length
+		b.Write(digest)                              // Digest
+	}
+	_, err := node.SendMsg(api.Msg{Name: msg.Name, Content: b, IsChan: msg.IsChan, PubKey: msg.PubKey, Recipients: msg.Recipients, Chunked: true, HopLimit: msg.HopLimit, Expires: msg.Expires, Priority: msg.Priority, ID: msg.ID, StreamHeader: true, Signed: msg.Signed})
+	return err
+}
+
+// sendChunk - retains a chunk for retransmission, then sends it
+func sendChunk(node api.Node, msg api.Msg) error {
+	if err := node.RetainChunk(msg); err != nil {
+		return err
+	}
+	_, err := node.SendMsg(msg)
+	return err
+}
+
 // HandleChunked - shared handler for Nodes that deals with chunks and stream headers
 func HandleChunked(node api.Node, msg api.Msg) error {
 	if !msg.StreamHeader {
@@ -89,14 +205,58 @@ func HandleChunked(node api.Node, msg api.Msg) error {
 		return node.AddChunk(streamID, chunkNum, data[8:])
 	}
 	// save totalChunks by streamID
-	var streamID, totalChunks uint32
-	tmpb := bytes.NewBuffer(msg.Content.Bytes()[:8])
-	binary.Read(tmpb, binary.LittleEndian, &streamID)
-	binary.Read(tmpb, binary.LittleEndian, &totalChunks)
-	channel := ""
+	var stream api.StreamHeader
+	tmpb := bytes.NewBuffer(msg.Content.Bytes())
+	if tmpb.Len() < 8 {
+		return errors.New("Malformed stream header")
+	}
+	binary.Read(tmpb, binary.LittleEndian, &stream.StreamID)
+	binary.Read(tmpb, binary.LittleEndian, &stream.NumChunks)
 	if msg.IsChan {
-		channel = msg.Name
+		stream.ChannelName = msg.Name
 	}
-	events.Debug(node, fmt.Sprintf("adding stream: %x  totalChunks: %x (%d)", streamID, totalChunks, totalChunks))
-	return node.AddStream(streamID, totalChunks, channel)
+	// the rest is optional, older senders don't include it
+	if tmpb.Len() >= 2 {
+		var keyLen uint16
+		binary.Read(tmpb, binary.LittleEndian, &keyLen)
+		if tmpb.Len() < int(keyLen) {
+			return errors.New("Malformed stream header")
+		}
+		stream.ReplyKey = string(tmpb.Next(int(keyLen)))
+	}
+	if tmpb.Len() >= 8+sha256.Size {
+		var length uint64
+		binary.Read(tmpb, binary.LittleEndian, &length)
+		stream.Length = int64(length)
+		stream.Digest = append([]byte{}, tmpb.Next(sha256.Size)...)
+	}
+	// a signature on a header without a digest would not cover the chunks
+	if msg.Signed && msg.PubKey != nil && len(stream.Digest) > 0 {
+		stream.Signed = true
+		stream.ReplyKey = msg.PubKey.ToB64()
+	}
+	events.Debug(node, fmt.Sprintf("adding stream: %x  totalChunks: %x (%d)", stream.StreamID, stream.NumChunks, stream.NumChunks))
+	return node.AddStream(stream)
+}
+
+// Verify - checks a reassembled message against the length and digest from its stream header,
+// headers from older senders carry neither and are not checked
+func Verify(stream api.StreamHeader, data []byte) error {
+	if len(stream.Digest) == 0 {
+		return nil
+	}
+	if int64(len(data)) != stream.Length {
+		return fmt.Errorf("Reassembled stream is %d bytes, expected %d", len(data), stream.Length)
+	}
+	digest := sha256.Sum256(data)
+	if !bytes.Equal(digest[:], stream.Digest) {
+		return errors.New("Reassembled stream does not match its digest")
+	}
+	return nil
+}
+
+// Corrupted - reports a stream that failed Verify with a StreamCorrupted event
+func Corrupted(node api.Node, stream api.StreamHeader, err error) {
+	events.Error(node, fmt.Sprintf("dropping corrupted stream: %x  %s", stream.StreamID, err.Error()))
+	events.Emit(node, api.Error, api.StreamCorrupted, stream, err)
 }
@@ -0,0 +1,92 @@
+package chunking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet/api"
+)
+
+func Test_Verify_Digest_1(t *testing.T) {
+	data := []byte("the whole message")
+	digest := sha256.Sum256(data)
+	stream := api.StreamHeader{StreamID: 1, NumChunks: 1, Length: int64(len(data)), Digest: digest[:]}
+
+	if err := Verify(stream, data); err != nil {
+		t.Fatal("Intact stream failed to verify:", err)
+	}
+	tampered := append([]byte{}, data...)
+	tampered[0] ^= 0xFF
+	if err := Verify(stream, tampered); err == nil {
+		t.Error("Stream with the wrong digest verified")
+	}
+	if err := Verify(stream, data[1:]); err == nil {
+		t.Error("Stream with the wrong length verified")
+	}
+	// headers from older senders carry no digest
+	if err := Verify(api.StreamHeader{StreamID: 1, NumChunks: 1}, tampered); err != nil {
+		t.Error("Stream without a digest was checked:", err)
+	}
+}
+
+func Test_StreamReader_Digest_1(t *testing.T) {
+	data := []byte("the whole message")
+	digest := sha256.Sum256([]byte("some other message"))
+	stream := api.StreamHeader{StreamID: 1, NumChunks: 1, ReplyKey: "sender", Length: int64(len(data)), Digest: digest[:]}
+
+	result := make(chan error, 1)
+	readers := NewReaders(func() {})
+	readers.SetHandler(func(stream api.StreamHeader, r io.Reader) {
+		_, err := ioutil.ReadAll(r)
+		result <- err
+	})
+	store := chunkStore{0: data}
+	if _, done, err := readers.Feed(newTestNode(), stream, store.get, store.remove); !done || err == nil {
+		t.Fatal("Expected the stream to fail verification", done, err)
+	}
+	if err := <-result; err == nil {
+		t.Fatal("Reader of a corrupted stream did not get an error:", err)
+	}
+}
+
+func Test_HandleChunked_Signed_1(t *testing.T) {
+	sender, stranger := new(ecc.KeyPair), new(ecc.KeyPair)
+	sender.GenerateKey()
+	stranger.GenerateKey()
+	digest := sha256.Sum256([]byte("the whole message"))
+	header := func(replyKey string, withDigest bool) *bytes.Buffer {
+		b := bytes.NewBuffer([]byte{1, 0, 0, 0, 3, 0, 0, 0}) // StreamID, NumChunks
+		binary.Write(b, binary.LittleEndian, uint16(len(replyKey)))
+		b.WriteString(replyKey)
+		if withDigest {
+			binary.Write(b, binary.LittleEndian, uint64(17))
+			b.Write(digest[:])
+		}
+		return b
+	}
+
+	node := newTestNode()
+	msgs := []api.Msg{
+		// the checked signer is the one vouching for the stream, whatever key the header carries
+		{StreamHeader: true, Signed: true, PubKey: sender.GetPubKey(), Content: header(stranger.GetPubKey().ToB64(), true)},
+		// without a digest, the signature would not cover the chunks
+		{StreamHeader: true, Signed: true, PubKey: sender.GetPubKey(), Content: header(sender.GetPubKey().ToB64(), false)},
+		{StreamHeader: true, Content: header(sender.GetPubKey().ToB64(), true)},
+	}
+	for _, msg := range msgs {
+		if err := HandleChunked(node, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := node.streams[0]; !s.Signed || s.ReplyKey != sender.GetPubKey().ToB64() {
+		t.Error("Signed stream header was not kept with its signer")
+	}
+	if node.streams[1].Signed || node.streams[2].Signed {
+		t.Error("Stream header without a signed digest was marked as signed")
+	}
+}
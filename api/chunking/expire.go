@@ -0,0 +1,84 @@
+package chunking
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+)
+
+// DefaultStreamMaxAge - partially received streams that have made no progress for longer than this are discarded,
+// unless the node's NackTimer has been given another limit
+var DefaultStreamMaxAge = 30 * time.Minute
+
+// DefaultStreamMaxBytes - limit on the chunk data buffered for partially received streams,
+// the oldest streams are discarded first when it is exceeded, unless the node's NackTimer has been given another limit
+var DefaultStreamMaxBytes int64 = 64 * 1024 * 1024
+
+// Limits - returns how long a stream may go without progress and how many bytes of chunks may be buffered
+// before streams are discarded
+func (t *NackTimer) Limits() (maxAge time.Duration, maxBytes int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.maxAge, t.maxBytes
+}
+
+// SetLimits - sets how long a stream may go without progress and how many bytes of chunks may be buffered
+// before streams are discarded, zero restores the default
+func (t *NackTimer) SetLimits(maxAge time.Duration, maxBytes int64) {
+	if maxAge <= 0 {
+		maxAge = DefaultStreamMaxAge
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultStreamMaxBytes
+	}
+	t.mtx.Lock()
+	t.maxAge, t.maxBytes = maxAge, maxBytes
+	t.mtx.Unlock()
+}
+
+// Expired - returns the streams that should be discarded: every stream that was NACKed NackRetries times without
+// making progress, every stream idle for longer than the maximum age, then the longest idle of the rest
+// until no more than the maximum bytes are buffered.
+// Streams are aged by their LastSeen, so long transfers that are still arriving or being read are kept.
+func (t *NackTimer) Expired(streams []api.StreamHeader) []api.StreamHeader {
+	sorted := make([]api.StreamHeader, len(streams))
+	copy(sorted, streams)
+	lastSeen := make(map[uint32]int64, len(sorted))
+	for _, stream := range sorted {
+		lastSeen[stream.StreamID] = t.LastSeen(stream)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return lastSeen[sorted[i].StreamID] < lastSeen[sorted[j].StreamID] })
+
+	var total int64
+	for _, stream := range sorted {
+		total += stream.Buffered
+	}
+	maxAge, maxBytes := t.Limits()
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	var expired, kept []api.StreamHeader
+	for _, stream := range sorted {
+		if t.gaveUp(stream.StreamID) { // the sender no longer has the chunks we're missing
+			expired = append(expired, stream)
+			total -= stream.Buffered
+		} else {
+			kept = append(kept, stream)
+		}
+	}
+	for _, stream := range kept {
+		if lastSeen[stream.StreamID] >= cutoff && total <= maxBytes {
+			break
+		}
+		expired = append(expired, stream)
+		total -= stream.Buffered
+	}
+	return expired
+}
+
+// Abandoned - reports a discarded stream with a StreamAbandoned event
+func Abandoned(node api.Node, stream api.StreamHeader) {
+	events.Warning(node, fmt.Sprintf("abandoning stream: %x  buffered: %d", stream.StreamID, stream.Buffered))
+	events.Emit(node, api.Warning, api.StreamAbandoned, stream)
+}
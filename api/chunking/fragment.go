@@ -0,0 +1,283 @@
+package chunking
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+)
+
+// DefaultFragmentMaxAge - fragments that are not picked up, or not completed, within this long are discarded,
+// unless the Fragmenter or Defragmenter has been given another limit
+var DefaultFragmentMaxAge = 10 * time.Minute
+
+// DefaultFragmentMaxBytes - limit on the fragment data a Defragmenter buffers for incomplete messages,
+// the oldest are discarded first when it is exceeded
+var DefaultFragmentMaxBytes int64 = 16 * 1024 * 1024
+
+// DefaultFragmentMaxSets - limit on the number of incomplete messages a Defragmenter buffers, the oldest are discarded first
+var DefaultFragmentMaxSets = 1024
+
+// fragment header is the flags byte, the fragment ID, index and count
+const fragmentHeaderSize = 1 + 4 + 2 + 2
+
+// Fragmenter - send-side, per outbox consumer fragments of a message that was too big
+// for the transport the consumer picks up with.
+// Messages are chunked for the largest transport, and only split again at Pickup
+// for consumers that actually need smaller bundles.
+// Fragments are kept until the consumer comes back with a lastTime past them, like an outbox.PickupLog,
+// so a lost bundle is handed out again rather than leaving the consumer with a message it can never complete.
+type Fragmenter struct {
+	mtx    sync.Mutex
+	maxAge time.Duration
+	queues map[string]*fragmentQueue
+}
+
+type fragmentQueue struct {
+	fragments [][]byte
+	from      int64 // the lastTime the message was picked up with
+	until     int64 // the lastTime that goes out with the last fragment
+	sent      int   // fragments handed out, when there is no room for a lastTime per bundle
+	touched   time.Time
+}
+
+// marked - true if there is room for a lastTime per bundle between from and until,
+// bundles then go out with from plus the number of fragments handed out so far
+func (q *fragmentQueue) marked() bool {
+	return q.until-q.from > int64(len(q.fragments))
+}
+
+// NewFragmenter - returns a new instance of Fragmenter
+func NewFragmenter() *Fragmenter {
+	f := new(Fragmenter)
+	f.maxAge = DefaultFragmentMaxAge
+	f.queues = make(map[string]*fragmentQueue)
+	return f
+}
+
+// SetMaxAge - sets how long fragments are kept for a consumer that has stopped picking up, zero restores the default
+func (f *Fragmenter) SetMaxAge(maxAge time.Duration) {
+	if maxAge <= 0 {
+		maxAge = DefaultFragmentMaxAge
+	}
+	f.mtx.Lock()
+	f.maxAge = maxAge
+	f.mtx.Unlock()
+}
+
+// Split - breaks msg into fragments no bigger than maxBytes for consumer, replacing any it had pending.
+// from is the lastTime the consumer picked msg up with, until the lastTime it would have been given with msg.
+func (f *Fragmenter) Split(consumer string, msg []byte, maxBytes, from, until int64) error {
+	if maxBytes <= fragmentHeaderSize {
+		return errors.New("Byte limit too low to fragment message")
+	}
+	size := int(maxBytes - fragmentHeaderSize)
+	count := (len(msg) + size - 1) / size
+	if count > 0xFFFF {
+		return errors.New("Message too big to fragment on this transport")
+	}
+	idb, err := bc.GenerateRandomBytes(4)
+	if err != nil {
+		return err
+	}
+	var fragments [][]byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(msg) {
+			end = len(msg)
+		}
+		b := bytes.NewBuffer([]byte{api.FragmentFlag})      // flags
+		b.Write(idb)                                        // FragmentID
+		binary.Write(b, binary.LittleEndian, uint16(i))     // Index
+		binary.Write(b, binary.LittleEndian, uint16(count)) // Count
+		b.Write(msg[i*size : end])
+		fragments = append(fragments, b.Bytes())
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.expire()
+	f.queues[consumer] = &fragmentQueue{fragments: fragments, from: from, until: until, touched: time.Now()}
+	return nil
+}
+
+// Pending - returns as many of the fragments for consumer as fit in maxBytes, following the ones it confirmed
+// by coming back with lastTime, and the lastTime to hand it with them.
+// Returns no fragments and lastTime once the consumer is past them all, or has none.
+func (f *Fragmenter) Pending(consumer string, lastTime, maxBytes int64) ([][]byte, int64) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.expire()
+	q, ok := f.queues[consumer]
+	if !ok {
+		return nil, lastTime
+	}
+	start := q.sent
+	if q.marked() && lastTime >= q.from && lastTime < q.from+int64(len(q.fragments)) {
+		start = int(lastTime - q.from)
+	} else if q.marked() || lastTime != q.from {
+		delete(f.queues, consumer) // got the last fragment, or is picking up from somewhere else entirely
+		return nil, lastTime
+	}
+	end := start
+	var bytesRead int64
+	for end < len(q.fragments) && (end == start || bytesRead+int64(len(q.fragments[end])) <= maxBytes) {
+		bytesRead += int64(len(q.fragments[end]))
+		end++
+	}
+	q.touched = time.Now()
+	if end == len(q.fragments) {
+		if !q.marked() {
+			delete(f.queues, consumer)
+		}
+		return q.fragments[start:end], q.until
+	}
+	if !q.marked() {
+		q.sent = end
+		return q.fragments[start:end], q.from
+	}
+	return q.fragments[start:end], q.from + int64(end)
+}
+
+// expire - drops the queues of consumers that have stopped picking up, call with mtx held
+func (f *Fragmenter) expire() {
+	now := time.Now()
+	for consumer, q := range f.queues {
+		if now.Sub(q.touched) > f.maxAge {
+			delete(f.queues, consumer)
+		}
+	}
+}
+
+// Defragmenter - receive-side reassembly of fragmented messages, kept by the router
+type Defragmenter struct {
+	mtx       sync.Mutex
+	maxAge    time.Duration
+	maxBytes  int64
+	maxSets   int
+	fragments map[fragmentKey]*fragmentSet
+	buffered  int64
+}
+
+// fragmentKey - fragment IDs are picked by the sender, so they are only unique per peer
+type fragmentKey struct {
+	peer string
+	uri  string
+	id   uint32
+}
+
+type fragmentSet struct {
+	parts     map[uint16][]byte
+	count     uint16
+	size      int64
+	firstSeen time.Time
+}
+
+// NewDefragmenter - returns a new instance of Defragmenter
+func NewDefragmenter() *Defragmenter {
+	d := new(Defragmenter)
+	d.maxAge = DefaultFragmentMaxAge
+	d.maxBytes = DefaultFragmentMaxBytes
+	d.maxSets = DefaultFragmentMaxSets
+	d.fragments = make(map[fragmentKey]*fragmentSet)
+	return d
+}
+
+// SetLimits - sets how long incomplete messages are kept, and how many bytes and messages may be buffered,
+// zero restores the default
+func (d *Defragmenter) SetLimits(maxAge time.Duration, maxBytes int64, maxSets int) {
+	if maxAge <= 0 {
+		maxAge = DefaultFragmentMaxAge
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultFragmentMaxBytes
+	}
+	if maxSets <= 0 {
+		maxSets = DefaultFragmentMaxSets
+	}
+	d.mtx.Lock()
+	d.maxAge, d.maxBytes, d.maxSets = maxAge, maxBytes, maxSets
+	d.mtx.Unlock()
+}
+
+// Add - stores a fragment that came in from ingress, with the flags byte already removed,
+// returns the whole message once every fragment of it has arrived.
+// Incomplete messages are discarded after the maximum age, or oldest first once more than
+// the maximum bytes or messages are buffered.
+func (d *Defragmenter) Add(ingress api.Ingress, fragment []byte) ([]byte, error) {
+	if len(fragment) < fragmentHeaderSize-1 {
+		return nil, errors.New("Malformed fragment")
+	}
+	var id uint32
+	var index, count uint16
+	tmpb := bytes.NewBuffer(fragment)
+	binary.Read(tmpb, binary.LittleEndian, &id)
+	binary.Read(tmpb, binary.LittleEndian, &index)
+	binary.Read(tmpb, binary.LittleEndian, &count)
+	if index >= count {
+		return nil, errors.New("Malformed fragment")
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if int64(tmpb.Len()) > d.maxBytes {
+		return nil, errors.New("Fragment too big")
+	}
+	now := time.Now()
+	for key, s := range d.fragments {
+		if now.Sub(s.firstSeen) > d.maxAge {
+			d.remove(key)
+		}
+	}
+	key := fragmentKey{peer: ingress.Peer, uri: ingress.URI, id: id}
+	s, ok := d.fragments[key]
+	if !ok {
+		s = &fragmentSet{parts: make(map[uint16][]byte), count: count, firstSeen: now}
+		d.fragments[key] = s
+	} else if s.count != count {
+		return nil, errors.New("Fragment count does not match")
+	}
+	if old, ok := s.parts[index]; ok {
+		s.size -= int64(len(old))
+		d.buffered -= int64(len(old))
+	}
+	s.parts[index] = append([]byte{}, tmpb.Bytes()...)
+	s.size += int64(tmpb.Len())
+	d.buffered += int64(tmpb.Len())
+	if len(s.parts) == int(s.count) {
+		whole := make([][]byte, s.count)
+		for i := range whole {
+			whole[i] = s.parts[uint16(i)]
+		}
+		d.remove(key)
+		return bytes.Join(whole, nil), nil
+	}
+	for d.buffered > d.maxBytes || len(d.fragments) > d.maxSets {
+		d.remove(d.oldest())
+	}
+	return nil, nil
+}
+
+// oldest - the key of the incomplete message that has been buffered longest, call with mtx held
+func (d *Defragmenter) oldest() fragmentKey {
+	var oldest fragmentKey
+	var first time.Time
+	for key, s := range d.fragments {
+		if first.IsZero() || s.firstSeen.Before(first) {
+			oldest, first = key, s.firstSeen
+		}
+	}
+	return oldest
+}
+
+// remove - discards an incomplete message, call with mtx held
+func (d *Defragmenter) remove(key fragmentKey) {
+	if s, ok := d.fragments[key]; ok {
+		d.buffered -= s.size
+		delete(d.fragments, key)
+	}
+}
@@ -0,0 +1,66 @@
+package chunking
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Fragmenter_Resend_1(t *testing.T) {
+	f := NewFragmenter()
+	msg := bytes.Repeat([]byte("fragment me "), 10)
+	const from, until = 1000, 2000
+	if err := f.Split("consumer", msg, 40, from, until); err != nil {
+		t.Fatal(err)
+	}
+
+	first, time1 := f.Pending("consumer", from, 40)
+	if len(first) != 1 || time1 <= from || time1 >= until {
+		t.Fatalf("Expected one fragment and a lastTime between %d and %d, got %d and %d", from, until, len(first), time1)
+	}
+	// the bundle was lost, the consumer comes back with the old lastTime and gets it again
+	again, time2 := f.Pending("consumer", from, 40)
+	if len(again) != 1 || !bytes.Equal(again[0], first[0]) || time2 != time1 {
+		t.Fatal("Lost fragment was not handed out again")
+	}
+	// confirmed, the rest follow, the last with the lastTime of the whole message
+	var fragments [][]byte
+	lastTime := time1
+	for lastTime != until {
+		pending, next := f.Pending("consumer", lastTime, 40)
+		if len(pending) == 0 {
+			t.Fatal("Ran out of fragments before the end of the message")
+		}
+		fragments = append(fragments, pending...)
+		lastTime = next
+	}
+	if len(fragments)+1 != (len(msg)+40-fragmentHeaderSize-1)/(40-fragmentHeaderSize) {
+		t.Fatal("Expected every fragment once, got", len(fragments)+1)
+	}
+	if pending, next := f.Pending("consumer", until, 40); len(pending) != 0 || next != until {
+		t.Fatal("Fragments were kept after the consumer moved past them")
+	}
+}
+
+func Test_Fragmenter_Resend_2(t *testing.T) {
+	f := NewFragmenter()
+	msg := bytes.Repeat([]byte("fragment me "), 10)
+	// timestamps too close together to mark each bundle, fragments go out once without being confirmed
+	const from, until = 1000, 1001
+	if err := f.Split("consumer", msg, 40, from, until); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for {
+		pending, next := f.Pending("consumer", from, 40)
+		count += len(pending)
+		if next == until {
+			break
+		}
+		if len(pending) == 0 || next != from {
+			t.Fatal("Unexpected pending fragments", len(pending), next)
+		}
+	}
+	if pending, _ := f.Pending("consumer", from, 40); len(pending) != 0 {
+		t.Fatal("Fragments were handed out twice")
+	}
+}
@@ -0,0 +1,317 @@
+package chunking
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+)
+
+// NackInterval - how long an incomplete stream may go without receiving a chunk before the missing chunks are requested again
+var NackInterval = 5 * time.Second
+
+// NackRetries - how many NACKs are sent for a stream that makes no progress before giving up on it
+var NackRetries = 5
+
+// RetainTime - how long a sender keeps sent chunks around for retransmission
+var RetainTime = 10 * time.Minute
+
+// DefaultRetainWindow - bytes of each stream a sender keeps for retransmission, unless the Retainer has been given
+// another window.  Once a stream has sent more, the chunks sent first are dropped, so streams larger than memory can be sent.
+var DefaultRetainWindow int64 = 16 * 1024 * 1024
+
+// SendNack - asks the sender of a stream to retransmit the given chunks.
+// Channel streams are NACKed on the channel, direct streams are NACKed to the reply key from the stream header.
+func SendNack(node api.Node, stream api.StreamHeader, missing []uint32) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	cid, err := node.CID() // we need this for cloning
+	if err != nil {
+		return err
+	}
+	msg := api.Msg{Nack: true, PubKey: cid.Clone()}
+	if len(stream.ChannelName) > 0 {
+		chn, err := node.GetChannel(stream.ChannelName)
+		if err != nil {
+			return err
+		}
+		if err := msg.PubKey.FromB64(chn.Pubkey); err != nil {
+			return err
+		}
+		msg.Name = stream.ChannelName
+		msg.IsChan = true
+	} else if len(stream.ReplyKey) > 0 {
+		if err := msg.PubKey.FromB64(stream.ReplyKey); err != nil {
+			return err
+		}
+	} else {
+		return errors.New("No reply key for stream, cannot NACK")
+	}
+
+	// keep the NACK itself from being chunked, the rest get asked for next time
+	chunkSize := ChunkSize(node, msg)
+	if chunkSize <= 8 {
+		return errors.New("Transport too small for chunking")
+	}
+	max := (chunkSize - 8) / 4
+	if uint32(len(missing)) > max {
+		missing = missing[:max]
+	}
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, stream.StreamID)      // StreamID
+	binary.Write(b, binary.LittleEndian, uint32(len(missing))) // count
+	for _, chunkNum := range missing {
+		binary.Write(b, binary.LittleEndian, chunkNum) // ChunkNum
+	}
+	msg.Content = b
+	events.Debug(node, fmt.Sprintf("sending nack: %x  missing: %d", stream.StreamID, len(missing)))
+	_, err = node.SendMsg(msg)
+	return err
+}
+
+// HandleNack - shared handler for Nodes that deals with NACK messages
+func HandleNack(node api.Node, msg api.Msg) error {
+	data, err := ioutil.ReadAll(msg.Content)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 {
+		return errors.New("Malformed NACK")
+	}
+	var streamID, count uint32
+	tmpb := bytes.NewBuffer(data)
+	binary.Read(tmpb, binary.LittleEndian, &streamID)
+	binary.Read(tmpb, binary.LittleEndian, &count)
+	if uint32(tmpb.Len())/4 < count {
+		return errors.New("Malformed NACK")
+	}
+	chunkNums := make([]uint32, count)
+	binary.Read(tmpb, binary.LittleEndian, chunkNums)
+
+	events.Debug(node, fmt.Sprintf("received nack: %x  missing: %d", streamID, count))
+	return node.ResendChunks(streamID, chunkNums)
+}
+
+// MissingChunks - returns the chunk numbers of a stream from first onwards that are not in received
+func MissingChunks(first uint32, numChunks uint32, received []uint32) []uint32 {
+	have := make(map[uint32]bool, len(received))
+	for _, chunkNum := range received {
+		have[chunkNum] = true
+	}
+	var missing []uint32
+	for i := first; i < numChunks; i++ {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// NackTimer - receive-side bookkeeping that decides when an incomplete stream should be NACKed
+type NackTimer struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	maxAge   time.Duration
+	maxBytes int64
+	streams  map[uint32]*nackState
+}
+
+type nackState struct {
+	received int
+	changed  time.Time
+	progress time.Time // when received last changed
+	nacks    int
+}
+
+// NewNackTimer - returns a new instance of NackTimer
+func NewNackTimer() *NackTimer {
+	t := new(NackTimer)
+	t.interval = NackInterval
+	t.maxAge = DefaultStreamMaxAge
+	t.maxBytes = DefaultStreamMaxBytes
+	t.streams = make(map[uint32]*nackState)
+	return t
+}
+
+// Interval - returns how long a stream may go without progress before it is NACKed, NackInterval unless set
+func (t *NackTimer) Interval() time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.interval
+}
+
+// SetInterval - sets how long a stream may go without progress before it is NACKed
+func (t *NackTimer) SetInterval(interval time.Duration) {
+	t.mtx.Lock()
+	t.interval = interval
+	t.mtx.Unlock()
+}
+
+// Due - records how many chunks of a stream have been received so far,
+// returns true if the stream has made no progress for the Interval and should be NACKed
+func (t *NackTimer) Due(streamID uint32, received int) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	s, ok := t.streams[streamID]
+	if !ok || s.received != received {
+		t.streams[streamID] = &nackState{received: received, changed: now, progress: now}
+		return false
+	}
+	if s.nacks >= NackRetries || now.Sub(s.changed) < t.interval {
+		return false
+	}
+	s.changed = now // wait another interval before asking again
+	return true
+}
+
+// Nacked - records that missing chunks of a stream were asked for, once a stream has been NACKed
+// NackRetries times without making progress it is given up on, see Expired
+func (t *NackTimer) Nacked(streamID uint32) {
+	t.mtx.Lock()
+	if s, ok := t.streams[streamID]; ok {
+		s.nacks++
+	}
+	t.mtx.Unlock()
+}
+
+// gaveUp - true if a stream was NACKed NackRetries times and has made no progress for another interval since
+func (t *NackTimer) gaveUp(streamID uint32) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s, ok := t.streams[streamID]
+	return ok && s.nacks >= NackRetries && time.Since(s.changed) >= t.interval
+}
+
+// LastSeen - when a stream last made progress, counting chunks received and chunks read by a StreamHandler,
+// or when it was first seen if it has made none since this node started, UnixNano
+func (t *NackTimer) LastSeen(stream api.StreamHeader) int64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if s, ok := t.streams[stream.StreamID]; ok && s.progress.UnixNano() > stream.FirstSeen {
+		return s.progress.UnixNano()
+	}
+	return stream.FirstSeen
+}
+
+// Forget - stops tracking a stream, call when it completes or is discarded
+func (t *NackTimer) Forget(streamID uint32) {
+	t.mtx.Lock()
+	delete(t.streams, streamID)
+	t.mtx.Unlock()
+}
+
+// Retainer - send-side store of sent chunks, kept so they can be retransmitted when a receiver NACKs them
+type Retainer struct {
+	mtx     sync.Mutex
+	window  int64
+	streams map[uint32]*retainedStream
+}
+
+type retainedStream struct {
+	name       string
+	isChan     bool
+	pubKey     bc.PubKey
+	recipients []bc.PubKey
+	chunks     map[uint32][]byte
+	size       int64  // bytes of chunks retained
+	first      uint32 // no chunks below this one are retained
+	touched    time.Time
+}
+
+// NewRetainer - returns a new instance of Retainer
+func NewRetainer() *Retainer {
+	r := new(Retainer)
+	r.window = DefaultRetainWindow
+	r.streams = make(map[uint32]*retainedStream)
+	return r
+}
+
+// SetWindow - sets how many bytes of each stream are kept for retransmission, zero restores the default
+func (r *Retainer) SetWindow(window int64) {
+	if window <= 0 {
+		window = DefaultRetainWindow
+	}
+	r.mtx.Lock()
+	r.window = window
+	r.mtx.Unlock()
+}
+
+// Retain - keeps a copy of a chunk message, dropping any streams older than RetainTime,
+// and the first chunks of a stream once more than the window of it is retained
+func (r *Retainer) Retain(msg api.Msg) error {
+	data := msg.Content.Bytes()
+	if len(data) < 8 {
+		return errors.New("Malformed chunk")
+	}
+	var streamID, chunkNum uint32
+	tmpb := bytes.NewBuffer(data[:8])
+	binary.Read(tmpb, binary.LittleEndian, &streamID)
+	binary.Read(tmpb, binary.LittleEndian, &chunkNum)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	for id, s := range r.streams {
+		if now.Sub(s.touched) > RetainTime {
+			delete(r.streams, id)
+		}
+	}
+	s, ok := r.streams[streamID]
+	if !ok {
+		s = &retainedStream{name: msg.Name, isChan: msg.IsChan, pubKey: msg.PubKey, recipients: msg.Recipients, chunks: make(map[uint32][]byte)}
+		r.streams[streamID] = s
+	}
+	if chunkNum < s.first {
+		return nil // already dropped from the window
+	}
+	if old, ok := s.chunks[chunkNum]; ok {
+		s.size -= int64(len(old))
+	}
+	s.chunks[chunkNum] = append([]byte{}, data...)
+	s.size += int64(len(data))
+	for s.size > r.window && s.first < chunkNum {
+		if old, ok := s.chunks[s.first]; ok {
+			s.size -= int64(len(old))
+			delete(s.chunks, s.first)
+		}
+		s.first++
+	}
+	s.touched = now
+	return nil
+}
+
+// Resend - re-queues the requested chunks of a retained stream with the node,
+// each chunk is encrypted again so it is not dropped as a duplicate along the way
+func (r *Retainer) Resend(node api.Node, streamID uint32, chunkNums []uint32) error {
+	var msgs []api.Msg
+	r.mtx.Lock()
+	s, ok := r.streams[streamID]
+	if ok {
+		for _, chunkNum := range chunkNums {
+			if data, ok := s.chunks[chunkNum]; ok {
+				msgs = append(msgs, api.Msg{Name: s.name, Content: bytes.NewBuffer(data), IsChan: s.isChan, PubKey: s.pubKey, Recipients: s.recipients, Chunked: true,
+					Priority: api.PriorityBulk})
+			}
+		}
+		s.touched = time.Now()
+	}
+	r.mtx.Unlock()
+	if !ok {
+		return nil // not ours, or we've forgotten it
+	}
+	for _, msg := range msgs {
+		if _, err := node.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package chunking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+)
+
+// StreamReadAhead - how many chunks a StreamReader holds in memory, the rest stay in the node's chunk storage until read
+var StreamReadAhead = 4
+
+// ErrStreamAbandoned - returned by a StreamReader whose stream was discarded before it completed
+var ErrStreamAbandoned = errors.New("Stream abandoned")
+
+// Announced - true once a real header has arrived for a stream,
+// rather than the placeholder a node keeps for chunks that arrive before it
+func Announced(stream api.StreamHeader) bool {
+	return stream.NumChunks > 0 || len(stream.ChannelName) > 0 || len(stream.ReplyKey) > 0
+}
+
+// streamWriter - io.WriteCloser that chunks on the fly, see OpenStream
+type streamWriter struct {
+	node      api.Node
+	msg       api.Msg
+	streamID  []byte
+	chunkSize uint32
+	buf       []byte
+	next      uint32
+	length    uint64
+	hash      hash.Hash
+	closed    bool
+}
+
+// OpenStream - starts a chunked transfer to a contact, or a channel if channel is true.
+// The stream is announced right away and every full chunk is sent as it is written,
+// the final header with the chunk count, length and digest is sent by Close.
+// The returned writer has an ID() api.MsgID method, the MsgID the whole stream is tracked by in GetMsgStatus.
+// Only the most recently sent chunks of an open stream are retained for retransmission, see DefaultRetainWindow,
+// since it may be larger than memory.  A receiver missing older chunks gives up on the stream after NackRetries.
+func OpenStream(node api.Node, dest string, channel bool) (io.WriteCloser, error) {
+	cid, err := node.CID() // we need this for cloning
+	if err != nil {
+		return nil, err
+	}
+	msg := api.Msg{Name: dest, IsChan: channel, PubKey: cid.Clone()}
+	pubkey := ""
+	if channel {
+		chn, err := node.GetChannel(dest)
+		if err != nil {
+			return nil, err
+		} else if chn == nil {
+			return nil, errors.New("No public key for Channel")
+		}
+		pubkey = chn.Pubkey
+	} else {
+		contact, err := node.GetContact(dest)
+		if err != nil {
+			return nil, err
+		} else if contact == nil {
+			return nil, errors.New("Unknown Contact")
+		}
+		pubkey = contact.Pubkey
+	}
+	if err := msg.PubKey.FromB64(pubkey); err != nil {
+		return nil, err
+	}
+	if msg.ID, err = api.NewMsgID(); err != nil { // every chunk is tracked as the one stream
+		return nil, err
+	}
+	chunkSize := ChunkSize(node, msg)
+	if chunkSize <= 8 {
+		return nil, errors.New("Transport too small for chunking")
+	}
+	w := &streamWriter{node: node, msg: msg, chunkSize: chunkSize - 8, hash: sha256.New()}
+	if w.streamID, err = bc.GenerateRandomBytes(4); err != nil {
+		return nil, err
+	}
+	if err := sendHeader(node, msg, w.streamID, 0, 0, nil); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ID - the MsgID every chunk of the stream is sent with
+func (w *streamWriter) ID() api.MsgID {
+	return w.msg.ID
+}
+
+// Write - buffers p, sending every full chunk
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Write to closed stream")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		room := int(w.chunkSize) - len(w.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+		p = p[room:]
+		if uint32(len(w.buf)) == w.chunkSize {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *streamWriter) flush() error {
+	b := bytes.NewBuffer(append([]byte{}, w.streamID...)) // StreamID
+	binary.Write(b, binary.LittleEndian, w.next)          // ChunkNum
+	b.Write(w.buf)
+	if err := sendChunk(w.node, api.Msg{Name: w.msg.Name, Content: b, IsChan: w.msg.IsChan, PubKey: w.msg.PubKey, Chunked: true, Priority: api.PriorityBulk, ID: w.msg.ID}); err != nil {
+		return err
+	}
+	w.hash.Write(w.buf)
+	w.length += uint64(len(w.buf))
+	w.next++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close - sends the last partial chunk and the final stream header
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.buf) > 0 || w.next == 0 { // always at least one chunk, even if it's empty
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	return sendHeader(w.node, w.msg, w.streamID, w.next, w.length, w.hash.Sum(nil))
+}
+
+// StreamReader - io.Reader over an incoming chunked stream, fed in order by the node as chunks arrive
+type StreamReader struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	cur    []byte
+	next   uint32
+	length int64
+	hash   hash.Hash
+	err    error // io.EOF once the whole stream has been read and verified
+	wake   func()
+}
+
+// Read - implements io.Reader, blocks until the next chunk of the stream arrives
+func (r *StreamReader) Read(p []byte) (int, error) {
+	r.mtx.Lock()
+	popped := false
+	for len(r.cur) == 0 {
+		if len(r.queue) > 0 {
+			r.cur, r.queue = r.queue[0], r.queue[1:]
+			popped = true
+		} else if r.err != nil {
+			err := r.err
+			r.mtx.Unlock()
+			return 0, err
+		} else {
+			r.cond.Wait()
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	r.mtx.Unlock()
+	if popped {
+		r.wake() // there's room for more now
+	}
+	return n, nil
+}
+
+// feed - moves the chunks the reader is waiting for out of the node's storage, in order, until its read-ahead is full.
+// Returns true when the whole stream has been handed over and verified.
+func (r *StreamReader) feed(stream api.StreamHeader, get func(streamID, chunkNum uint32) ([]byte, bool, error), remove func(streamID, chunkNum uint32) error) (bool, error) {
+	for {
+		r.mtx.Lock()
+		next, full := r.next, len(r.queue) >= StreamReadAhead
+		r.mtx.Unlock()
+		if stream.NumChunks > 0 && next == stream.NumChunks {
+			return true, r.finish(stream)
+		}
+		if full {
+			return false, nil
+		}
+		data, ok, err := get(stream.StreamID, next)
+		if err != nil || !ok {
+			return false, err
+		}
+		if err := remove(stream.StreamID, next); err != nil {
+			return false, err
+		}
+		r.mtx.Lock()
+		r.queue = append(r.queue, data)
+		r.hash.Write(data)
+		r.length += int64(len(data))
+		r.next++
+		r.cond.Broadcast()
+		r.mtx.Unlock()
+	}
+}
+
+// finish - checks the length and digest of everything read against the final header
+func (r *StreamReader) finish(stream api.StreamHeader) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var err error
+	if len(stream.Digest) > 0 {
+		if r.length != stream.Length {
+			err = fmt.Errorf("Reassembled stream is %d bytes, expected %d", r.length, stream.Length)
+		} else if !bytes.Equal(r.hash.Sum(nil), stream.Digest) {
+			err = errors.New("Reassembled stream does not match its digest")
+		}
+	}
+	if err != nil {
+		r.err = err
+	} else {
+		r.err = io.EOF
+	}
+	r.cond.Broadcast()
+	return err
+}
+
+// abort - ends the stream with an error, unless it has already ended
+func (r *StreamReader) abort(err error) {
+	r.mtx.Lock()
+	if r.err == nil {
+		r.err = err
+		r.cond.Broadcast()
+	}
+	r.mtx.Unlock()
+}
+
+// Readers - receive-side bookkeeping for nodes that hand incoming streams to an api.StreamHandler
+type Readers struct {
+	mtx     sync.Mutex
+	handler api.StreamHandler
+	readers map[uint32]*StreamReader
+	wake    func()
+}
+
+// NewReaders - returns a new instance of Readers, wake is called when a reader has room for more chunks
+func NewReaders(wake func()) *Readers {
+	r := new(Readers)
+	r.readers = make(map[uint32]*StreamReader)
+	r.wake = wake
+	return r
+}
+
+// SetHandler - sets the handler that incoming streams are given to, nil goes back to reassembling them to Out()
+func (r *Readers) SetHandler(handler api.StreamHandler) {
+	r.mtx.Lock()
+	r.handler = handler
+	r.mtx.Unlock()
+}
+
+// Feed - hands whatever chunks are ready to the reader for a stream, starting the handler for it the first time.
+// get and remove read and delete a chunk in the node's storage.
+// reading is false if the stream is not being read by a handler and should be reassembled as usual,
+// done is true once it has been completely read, err is set if it failed verification.
+func (r *Readers) Feed(node api.Node, stream api.StreamHeader, get func(streamID, chunkNum uint32) ([]byte, bool, error), remove func(streamID, chunkNum uint32) error) (reading bool, done bool, err error) {
+	r.mtx.Lock()
+	reader, ok := r.readers[stream.StreamID]
+	if !ok {
+		if r.handler == nil || !Announced(stream) {
+			r.mtx.Unlock()
+			return false, false, nil
+		}
+		reader = &StreamReader{hash: sha256.New(), wake: r.wake}
+		reader.cond = sync.NewCond(&reader.mtx)
+		r.readers[stream.StreamID] = reader
+		events.Debug(node, fmt.Sprintf("reading stream: %x", stream.StreamID))
+		go r.handler(stream, reader)
+	}
+	r.mtx.Unlock()
+	done, err = reader.feed(stream, get, remove)
+	return true, done, err
+}
+
+// Next - the next chunk number the reader for a stream is waiting for, 0 if nothing is reading it
+func (r *Readers) Next(streamID uint32) uint32 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if reader, ok := r.readers[streamID]; ok {
+		reader.mtx.Lock()
+		defer reader.mtx.Unlock()
+		return reader.next
+	}
+	return 0
+}
+
+// Close - forgets the reader for a stream, ending it with ErrStreamAbandoned if it was not finished
+func (r *Readers) Close(streamID uint32) {
+	r.mtx.Lock()
+	reader, ok := r.readers[streamID]
+	delete(r.readers, streamID)
+	r.mtx.Unlock()
+	if ok {
+		reader.abort(ErrStreamAbandoned)
+	}
+}
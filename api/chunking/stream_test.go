@@ -0,0 +1,148 @@
+package chunking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// testNode - just enough of a node for the chunking helpers, the rest of api.Node panics if called
+type testNode struct {
+	api.Node
+	events  chan api.Event
+	sent    []api.Msg
+	streams []api.StreamHeader
+}
+
+func newTestNode() *testNode {
+	return &testNode{events: make(chan api.Event, 100)}
+}
+
+func (n *testNode) Events() chan api.Event { return n.events }
+
+func (n *testNode) SendMsg(msg api.Msg) (api.MsgID, error) {
+	n.sent = append(n.sent, msg)
+	return msg.ID, nil
+}
+
+func (n *testNode) AddStream(stream api.StreamHeader) error {
+	n.streams = append(n.streams, stream)
+	return nil
+}
+
+// chunkStore - a node's chunk storage, for feeding readers
+type chunkStore map[uint32][]byte
+
+func (c chunkStore) get(streamID, chunkNum uint32) ([]byte, bool, error) {
+	data, ok := c[chunkNum]
+	return data, ok, nil
+}
+
+func (c chunkStore) remove(streamID, chunkNum uint32) error {
+	delete(c, chunkNum)
+	return nil
+}
+
+func Test_StreamReader_OutOfOrder_1(t *testing.T) {
+	parts := [][]byte{[]byte("first "), []byte("second "), []byte("third")}
+	whole := bytes.Join(parts, nil)
+	digest := sha256.Sum256(whole)
+	stream := api.StreamHeader{StreamID: 1, ReplyKey: "sender"}
+
+	result := make(chan []byte, 1)
+	readers := NewReaders(func() {})
+	readers.SetHandler(func(stream api.StreamHeader, r io.Reader) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- b
+	})
+	node := newTestNode()
+	store := chunkStore{}
+
+	// the last chunk arrives first, nothing can be read until the first one is here
+	store[2] = parts[2]
+	if reading, done, err := readers.Feed(node, stream, store.get, store.remove); !reading || done || err != nil {
+		t.Fatal("Unexpected feed result", reading, done, err)
+	}
+	if next := readers.Next(stream.StreamID); next != 0 {
+		t.Fatal("Reader skipped ahead to chunk", next)
+	}
+	if _, ok := store[2]; !ok {
+		t.Fatal("Out of order chunk was taken out of storage early")
+	}
+	store[0] = parts[0]
+	readers.Feed(node, stream, store.get, store.remove)
+	if next := readers.Next(stream.StreamID); next != 1 {
+		t.Fatal("Expected the reader to wait for chunk 1, it waits for", next)
+	}
+
+	// then the gap is filled and the final header arrives
+	store[1] = parts[1]
+	stream.NumChunks, stream.Length, stream.Digest = 3, int64(len(whole)), digest[:]
+	if _, done, err := readers.Feed(node, stream, store.get, store.remove); !done || err != nil {
+		t.Fatal("Expected the stream to be done", done, err)
+	}
+	select {
+	case b := <-result:
+		if !bytes.Equal(b, whole) {
+			t.Errorf("Read %q, expected %q", b, whole)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream handler did not finish reading")
+	}
+}
+
+func Test_NackTimer_GiveUp_1(t *testing.T) {
+	timer := NewNackTimer()
+	timer.SetInterval(time.Millisecond)
+	stream := api.StreamHeader{StreamID: 1, NumChunks: 3, FirstSeen: time.Now().UnixNano()}
+
+	timer.Due(stream.StreamID, 1)
+	for i := 0; i < NackRetries; i++ {
+		time.Sleep(2 * time.Millisecond)
+		if !timer.Due(stream.StreamID, 1) {
+			t.Fatal("Expected NACK", i, "to be due")
+		}
+		timer.Nacked(stream.StreamID)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if timer.Due(stream.StreamID, 1) {
+		t.Fatal("NACKed more than NackRetries times")
+	}
+	if expired := timer.Expired([]api.StreamHeader{stream}); len(expired) != 1 {
+		t.Fatal("Expected the stream to be given up on long before its maximum age")
+	}
+
+	// progress starts the count again
+	timer.Due(stream.StreamID, 2)
+	if expired := timer.Expired([]api.StreamHeader{stream}); len(expired) != 0 {
+		t.Fatal("Gave up on a stream that made progress")
+	}
+}
+
+func Test_Retainer_Window_1(t *testing.T) {
+	r := NewRetainer()
+	r.SetWindow(20)
+	for i := uint32(0); i < 5; i++ {
+		b := bytes.NewBuffer([]byte{1, 0, 0, 0, byte(i), 0, 0, 0}) // StreamID, ChunkNum
+		b.Write(bytes.Repeat([]byte{byte(i)}, 10))
+		if err := r.Retain(api.Msg{Content: b, Chunked: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node := newTestNode()
+	if err := r.Resend(node, 1, []uint32{0, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	// each chunk is 18 bytes with its header, so only the last one fits in the window
+	if len(node.sent) != 1 || node.sent[0].Content.Bytes()[4] != 4 {
+		t.Fatalf("Expected only the last chunk to be retained, resent %d", len(node.sent))
+	}
+}
@@ -18,6 +18,14 @@ type EventType int
 //
 const (
 	Log EventType = iota
+	// StreamAbandoned - a partially received stream was discarded, Data holds its StreamHeader
+	StreamAbandoned
+	// StreamCorrupted - a reassembled stream failed verification and was dropped, Data holds its StreamHeader and the error
+	StreamCorrupted
+	// OutboxEvicted - a queued message was dropped to keep the outbox within its quota, Data holds its OutboxEntry
+	OutboxEvicted
+	// Delivered - a delivery receipt arrived for a message sent with SendReceipted, Data holds its MsgID
+	Delivered
 )
 
 // Event - Ratnet Events
@@ -0,0 +1,12 @@
+package events
+
+import "github.com/awgh/ratnet/api"
+
+// Emit - sends a non-log event to the node's Events channel, in every build.
+// The event is dropped rather than blocking the caller if nobody is reading events.
+func Emit(node api.Node, severity api.LogLevel, eventType api.EventType, args ...interface{}) {
+	select {
+	case node.Events() <- api.Event{Severity: severity, Type: eventType, Data: args}:
+	default:
+	}
+}
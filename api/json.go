@@ -29,6 +29,12 @@ type ExportedNode struct {
 	Peers    []Peer
 	Contacts []Contact
 	Router   Router
+
+	OutboxTTL         int64 // seconds, negative never expires, zero is the default
+	ChannelKeyOverlap int64 // seconds, negative never expires, zero is the default
+	Quota             OutboxQuota
+	ChannelQuotas     map[string]OutboxQuota
+	RouterKey         string `json:",omitempty"` // secret key of an api.SigningRouter, base64
 }
 
 // ImportedNode - Node Config structure for import
@@ -44,4 +50,10 @@ type ImportedNode struct {
 	Peers    []Peer
 	Contacts []Contact
 	Router   map[string]interface{}
+
+	OutboxTTL         int64 // seconds, negative never expires, zero is the default
+	ChannelKeyOverlap int64 // seconds, negative never expires, zero is the default
+	Quota             OutboxQuota
+	ChannelQuotas     map[string]OutboxQuota
+	RouterKey         string // secret key of an api.SigningRouter, base64
 }
@@ -2,6 +2,9 @@ package api
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 
 	"github.com/awgh/bencrypt/bc"
 )
@@ -14,4 +17,84 @@ type Msg struct {
 	PubKey       bc.PubKey
 	Chunked      bool
 	StreamHeader bool
+	Nack         bool
+
+	// HopLimit : hops this message may still take, relays do not forward it once it reaches 1, zero for no limit
+	HopLimit uint8
+	// Expires : UnixNano time after which relays stop forwarding this message, zero for never
+	Expires int64
+	// Priority : messages with higher priorities are picked up first, see PriorityNormal.
+	// It is carried to the next hops in the TTL header, unless it is the DefaultPriority.
+	Priority int8
+	// Receipt : this message is a delivery receipt or asks for one, see SendReceipted
+	Receipt bool
+	// ID : the MsgID SendMsg tracks this message by, a new one is made by SendMsg if this is zero
+	ID MsgID
+	// Ingress : where a received message came in from, zero if unknown, and for reassembled chunked
+	// messages, which may have come in from several peers
+	Ingress Ingress
+	// Recipients : content keys of the recipients of a direct message sent to several contacts at once,
+	// SendMsg seals it in one multi-recipient envelope for all of them instead of encrypting it to PubKey
+	Recipients []bc.PubKey
+	// Multicast : this message is a multi-recipient envelope, see package multicast
+	Multicast bool
+	// Signed : sign this direct message with our content key, so its recipients can check who sent it.
+	// On received messages, the sender's signature checked out, PubKey is the sender's content key,
+	// and Name is the name of the contact with that key, if there is one.
+	// Chunked messages only sign their stream header, whose digest covers the whole message.
+	Signed bool
+}
+
+// Ingress : describes where a routed message came in from, as far as the node that received it knows.
+// Fields are empty when unknown.  URI and Transport are the node's own, but Peer is only a claim
+// when the peer delivered the message itself with Dropoff: no transport authenticates the caller,
+// so a caller can name any routing key there.  Good enough for split horizon, not for deciding whom to trust.
+type Ingress struct {
+	// Peer : base64 routing key of the peer that delivered the message, unverified, see Ingress
+	Peer string
+	// URI : address of the peer, when a policy fetched the message from it
+	URI string
+	// Transport : Name of the transport the message came in on
+	Transport string
+}
+
+// MsgID : identifies a message sent with SendMsg in its MsgStatus and in its delivery receipt
+type MsgID [16]byte
+
+// String : returns the MsgID in hex
+func (id MsgID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// TTLHeaderSize : length of the TTL header, a hop limit byte, a big-endian int64 expiry time, then a priority byte
+const TTLHeaderSize = 10
+
+// DefaultPriority : the priority of msg when it has no TTL header, PriorityBulk for chunks and PriorityNormal otherwise
+func (msg Msg) DefaultPriority() int8 {
+	if msg.Chunked {
+		return PriorityBulk
+	}
+	return PriorityNormal
+}
+
+// HasTTL : returns true if msg needs a TTL header, for its hop limit, expiry time or a priority other than its default
+func (msg Msg) HasTTL() bool {
+	return msg.HopLimit > 0 || msg.Expires > 0 || msg.Priority != msg.DefaultPriority()
+}
+
+// AppendTTLHeader : appends the TTL header of msg to b
+func AppendTTLHeader(b []byte, msg Msg) []byte {
+	var h [TTLHeaderSize]byte
+	h[0] = msg.HopLimit
+	binary.BigEndian.PutUint64(h[1:9], uint64(msg.Expires))
+	h[9] = byte(msg.Priority)
+	return append(b, h[:]...)
+}
+
+// ParseTTLHeader : reads the hop limit, expiry time and priority from the TTL header at the start of b
+func ParseTTLHeader(b []byte) (hopLimit uint8, expires int64, priority int8, err error) {
+	if len(b) < TTLHeaderSize {
+		return 0, 0, 0, errors.New("TTL header too short")
+	}
+	return b[0], int64(binary.BigEndian.Uint64(b[1:9])), int8(b[9]), nil
 }
@@ -0,0 +1,210 @@
+// Package multicast - multi-recipient envelopes for direct messages, shared by the Nodes
+package multicast
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+)
+
+// envelope layout: random nonce, uint16 recipient count, then for each recipient a uint16 length
+// and the payload key and payload digest encrypted to its content key, then the AES encrypted payload.
+// The digest covers the nonce and the encrypted payload, so the wrapped keys authenticate the rest.
+// In signed envelopes, the payload key and digest are followed by a uint16 length and the sender's
+// public key, then the sender tag of the digest for that recipient, see tag.
+
+const (
+	nonceSize = 32 // same as a router's loop detection nonce
+	keySize   = 32 // AES-256 payload key
+)
+
+// Send - sends data to each of the named contacts in a single message, see Seal
+func Send(node api.Node, contactNames []string, data []byte) (api.MsgID, error) {
+	if len(contactNames) == 0 {
+		return api.MsgID{}, errors.New("No recipients")
+	}
+	cid, err := node.CID()
+	if err != nil {
+		return api.MsgID{}, err
+	}
+	recipients := make([]bc.PubKey, 0, len(contactNames))
+	for _, name := range contactNames {
+		contact, err := node.GetContact(name)
+		if err != nil {
+			return api.MsgID{}, err
+		}
+		key := cid.Clone()
+		if err := key.FromB64(contact.Pubkey); err != nil {
+			return api.MsgID{}, err
+		}
+		recipients = append(recipients, key)
+	}
+	return node.SendMsg(api.Msg{Name: contactNames[0], Content: bytes.NewBuffer(data), Recipients: recipients})
+}
+
+// SendSigned - sends data to the named contact, signed with our content key, see Seal
+func SendSigned(node api.Node, contactName string, data []byte) (api.MsgID, error) {
+	contact, err := node.GetContact(contactName)
+	if err != nil {
+		return api.MsgID{}, err
+	}
+	cid, err := node.CID()
+	if err != nil {
+		return api.MsgID{}, err
+	}
+	key := cid.Clone()
+	if err := key.FromB64(contact.Pubkey); err != nil {
+		return api.MsgID{}, err
+	}
+	return node.SendMsg(api.Msg{Name: contactName, Content: bytes.NewBuffer(data), PubKey: key, Signed: true})
+}
+
+// Seal - encrypts clear once with a new payload key, and wraps that key with key for each of the recipients.
+// If signed, each recipient can also check that it was sealed with key, see Open.
+func Seal(key bc.KeyPair, recipients []bc.PubKey, clear []byte, signed bool) ([]byte, error) {
+	if len(recipients) == 0 || len(recipients) > 0xFFFF {
+		return nil, errors.New("Invalid number of recipients")
+	}
+	nonce, err := bc.GenerateRandomBytes(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	payloadKey, err := bc.GenerateRandomBytes(keySize)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := bc.AesEncrypt(clear, payloadKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := digest(nonce, payload)
+	var senderKey []byte
+	if signed {
+		if senderKey = key.GetPubKey().ToBytes(); len(senderKey) > 0xFFFF {
+			return nil, errors.New("Sender key too long")
+		}
+	}
+
+	envelope := bytes.NewBuffer(nonce)
+	binary.Write(envelope, binary.BigEndian, uint16(len(recipients)))
+	for _, recipient := range recipients {
+		wrapped := bytes.NewBuffer(append(append([]byte{}, payloadKey...), sum...))
+		if signed {
+			t, err := tag(key, recipient, sum)
+			if err != nil {
+				return nil, err
+			}
+			binary.Write(wrapped, binary.BigEndian, uint16(len(senderKey)))
+			wrapped.Write(senderKey)
+			wrapped.Write(t)
+		}
+		w, err := key.EncryptMessage(wrapped.Bytes(), recipient)
+		if err != nil {
+			return nil, err
+		}
+		if len(w) > 0xFFFF {
+			return nil, errors.New("Wrapped key too long")
+		}
+		binary.Write(envelope, binary.BigEndian, uint16(len(w)))
+		envelope.Write(w)
+	}
+	envelope.Write(payload)
+	return envelope.Bytes(), nil
+}
+
+// Open - decrypts an envelope made by Seal, if one of its wrapped keys is for key.
+// Like DecryptMessage, returns false if none are, which is common.
+// For signed envelopes, also returns the public key of the sender, once its tag checks out.
+func Open(key bc.KeyPair, envelope []byte) (bool, []byte, bc.PubKey, error) {
+	errMalformed := errors.New("Malformed multicast envelope")
+	if len(envelope) < nonceSize+2 {
+		return false, nil, nil, errMalformed
+	}
+	nonce := envelope[:nonceSize]
+	count := int(binary.BigEndian.Uint16(envelope[nonceSize:]))
+	b := envelope[nonceSize+2:]
+	var wrapped []byte
+	for i := 0; i < count; i++ {
+		if len(b) < 2 {
+			return false, nil, nil, errMalformed
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			return false, nil, nil, errMalformed
+		}
+		if wrapped == nil {
+			if tagOK, clear, err := key.DecryptMessage(b[2 : 2+n]); tagOK {
+				if err != nil {
+					return true, nil, nil, err
+				}
+				wrapped = clear
+			}
+		}
+		b = b[2+n:]
+	}
+	if wrapped == nil {
+		return false, nil, nil, nil
+	}
+	payload := b
+	sum := digest(nonce, payload)
+	if len(wrapped) < keySize+sha256.Size || !bytes.Equal(wrapped[keySize:keySize+sha256.Size], sum) {
+		return true, nil, nil, errors.New("Multicast payload digest mismatch")
+	}
+	var sender bc.PubKey
+	if signature := wrapped[keySize+sha256.Size:]; len(signature) > 0 {
+		var err error
+		if sender, err = checkSender(key, signature, sum); err != nil {
+			return true, nil, nil, err
+		}
+	}
+	clear, err := bc.AesDecrypt(payload, wrapped[:keySize])
+	if err != nil {
+		return true, nil, nil, err
+	}
+	return true, clear, sender, nil
+}
+
+// checkSender - returns the sender key from the signature part of a wrapped key, if its tag checks out
+func checkSender(key bc.KeyPair, signature, sum []byte) (bc.PubKey, error) {
+	if len(signature) < 2 {
+		return nil, errors.New("Malformed multicast envelope")
+	}
+	n := int(binary.BigEndian.Uint16(signature))
+	if len(signature) < 2+n {
+		return nil, errors.New("Malformed multicast envelope")
+	}
+	sender := key.GetPubKey().Clone()
+	if err := sender.FromBytes(signature[2 : 2+n]); err != nil {
+		return nil, err
+	}
+	if !checkTag(key, sender, sum, signature[2+n:]) {
+		return nil, errors.New("Invalid sender signature")
+	}
+	return sender, nil
+}
+
+// ContactName - returns the name of the contact with the content key pubkey, or an empty string if there is none
+func ContactName(node api.Node, pubkey bc.PubKey) string {
+	contacts, err := node.GetContacts()
+	if err != nil {
+		return ""
+	}
+	b64 := pubkey.ToB64()
+	for _, c := range contacts {
+		if c.Pubkey == b64 {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+func digest(nonce, payload []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,107 @@
+package multicast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/bencrypt/rsa"
+)
+
+var keyTypes = map[string]func() bc.KeyPair{
+	"ecc": func() bc.KeyPair { return new(ecc.KeyPair) },
+	"rsa": func() bc.KeyPair { return new(rsa.KeyPair) },
+}
+
+func newKey(keyType func() bc.KeyPair) bc.KeyPair {
+	key := keyType()
+	key.GenerateKey()
+	return key
+}
+
+// signature - the signature part of a wrapped key, naming sender but tagged by signer
+func signature(t *testing.T, signer bc.KeyPair, sender, recipient bc.PubKey, sum []byte) []byte {
+	tg, err := tag(signer, recipient, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint16(len(sender.ToBytes())))
+	b.Write(sender.ToBytes())
+	b.Write(tg)
+	return b.Bytes()
+}
+
+func Test_Open_Signed_1(t *testing.T) {
+	clear := []byte("signed for bob and carol")
+	for name, keyType := range keyTypes {
+		alice, bob, carol := newKey(keyType), newKey(keyType), newKey(keyType)
+		envelope, err := Seal(alice, []bc.PubKey{bob.GetPubKey(), carol.GetPubKey()}, clear, true)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for _, recipient := range []bc.KeyPair{bob, carol} {
+			ok, opened, sender, err := Open(recipient, envelope)
+			if !ok || err != nil || !bytes.Equal(opened, clear) {
+				t.Fatal(name, "Envelope did not open", ok, err)
+			}
+			if sender == nil || sender.ToB64() != alice.GetPubKey().ToB64() {
+				t.Error(name, "Expected alice as the sender")
+			}
+		}
+		// only the recipients can open it
+		if ok, _, _, err := Open(alice, envelope); ok || err != nil {
+			t.Error(name, "Envelope opened for a key it was not sealed to", ok, err)
+		}
+		// the digest covers the payload
+		tampered := append([]byte{}, envelope...)
+		tampered[len(tampered)-1] ^= 0xFF
+		if ok, _, _, err := Open(bob, tampered); !ok || err == nil {
+			t.Error(name, "Tampered payload was accepted", ok, err)
+		}
+	}
+}
+
+func Test_checkSender_Forged_1(t *testing.T) {
+	sum := digest([]byte("nonce"), []byte("payload"))
+	for name, keyType := range keyTypes {
+		alice, bob, mallory := newKey(keyType), newKey(keyType), newKey(keyType)
+
+		if sender, err := checkSender(bob, signature(t, alice, alice.GetPubKey(), bob.GetPubKey(), sum), sum); err != nil || sender.ToB64() != alice.GetPubKey().ToB64() {
+			t.Fatal(name, "Valid signature was rejected", err)
+		}
+		// mallory claims to be alice
+		if _, err := checkSender(bob, signature(t, mallory, alice.GetPubKey(), bob.GetPubKey(), sum), sum); err == nil {
+			t.Error(name, "Forged sender was accepted")
+		}
+		// alice's tag for someone else, or for another digest
+		if _, err := checkSender(bob, signature(t, alice, alice.GetPubKey(), mallory.GetPubKey(), sum), sum); err == nil {
+			t.Error(name, "Tag for another recipient was accepted")
+		}
+		other := digest([]byte("nonce"), []byte("other payload"))
+		if _, err := checkSender(bob, signature(t, alice, alice.GetPubKey(), bob.GetPubKey(), other), sum); err == nil {
+			t.Error(name, "Tag for another digest was accepted")
+		}
+		// truncated and garbled signatures
+		valid := signature(t, alice, alice.GetPubKey(), bob.GetPubKey(), sum)
+		for _, bad := range [][]byte{valid[:1], valid[:len(valid)-1], append(append([]byte{}, valid...), 0)} {
+			if _, err := checkSender(bob, bad, sum); err == nil {
+				t.Error(name, "Malformed signature was accepted")
+			}
+		}
+	}
+}
+
+func Test_checkSender_KeyTypes_1(t *testing.T) {
+	sum := digest([]byte("nonce"), []byte("payload"))
+	alice, bob := newKey(keyTypes["ecc"]), newKey(keyTypes["rsa"])
+	// an RSA recipient can not check a Curve25519 tag, nor can it be tagged for
+	if checkTag(bob, alice.GetPubKey(), sum, make([]byte, 32)) {
+		t.Error("Tag from another key type was accepted")
+	}
+	if _, err := tag(alice, bob.GetPubKey(), sum); err == nil {
+		t.Error("Tagged for a recipient of another key type")
+	}
+}
@@ -0,0 +1,140 @@
+package multicast
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	gorsa "crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/bencrypt/rsa"
+	"golang.org/x/crypto/curve25519"
+)
+
+// sender tags: RSA keys sign the digest and the recipient's key with RSA-PSS.
+// Curve25519 keys can not sign, so they tag the digest with an HMAC keyed by the Diffie-Hellman secret
+// of the sender and recipient keys instead, which only the recipient can check.
+// Keys are told apart by bc.KeyPair.GetName, and public keys are read with bc.PubKey.ToBytes.
+
+var tagLabel = []byte("ratnet multicast sender tag")
+
+// tag - returns the sender tag of digest by key, for recipient
+func tag(key bc.KeyPair, recipient bc.PubKey, digest []byte) ([]byte, error) {
+	switch key.GetName() {
+	case rsa.NAME:
+		priv, err := rsaPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return gorsa.SignPSS(rand.Reader, priv, crypto.SHA256, rsaHash(recipient, digest), nil)
+	case ecc.NAME:
+		return eccTag(key, recipient.ToBytes(), digest)
+	}
+	return nil, errors.New("Signing is not supported with " + key.GetName())
+}
+
+// checkTag - returns true if t is the sender tag of digest by sender, for key
+func checkTag(key bc.KeyPair, sender bc.PubKey, digest, t []byte) bool {
+	switch key.GetName() {
+	case rsa.NAME:
+		pub, err := rsaPublicKey(sender)
+		return err == nil && gorsa.VerifyPSS(pub, crypto.SHA256, rsaHash(key.GetPubKey(), digest), t, nil) == nil
+	case ecc.NAME:
+		expected, err := eccTag(key, sender.ToBytes(), digest)
+		return err == nil && hmac.Equal(expected, t)
+	}
+	return false
+}
+
+func rsaHash(recipient bc.PubKey, digest []byte) []byte {
+	h := sha256.New()
+	h.Write(tagLabel)
+	h.Write(recipient.ToBytes())
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+// rsaPublicKey - parses the PEM encoded PKIX public key that ToBytes returns for RSA keys
+func rsaPublicKey(pubkey bc.PubKey) (*gorsa.PublicKey, error) {
+	p, _ := pem.Decode(pubkey.ToBytes())
+	if p == nil || p.Type != "PUBLIC KEY" {
+		return nil, errors.New("No Public Key Found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(p.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*gorsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public Key is not an RSA key")
+	}
+	return rsaPub, nil
+}
+
+// rsaPrivateKey - returns the private key of an RSA key pair.
+// bencrypt only hands private keys out through ToB64, so it is checked against GetPubKey before use.
+func rsaPrivateKey(key bc.KeyPair) (*gorsa.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(key.ToB64())
+	if err != nil {
+		return nil, err
+	}
+	p, _ := pem.Decode(b)
+	if p == nil {
+		return nil, errors.New("No Private Key Found")
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(p.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := rsaPublicKey(key.GetPubKey())
+	if err != nil {
+		return nil, err
+	}
+	if !priv.PublicKey.Equal(pub) {
+		return nil, errors.New("Private Key does not match Public Key")
+	}
+	return priv, nil
+}
+
+// eccPrivateKey - returns the private key of a Curve25519 key pair, which ToB64 appends to the public key.
+// It is checked against GetPubKey before use.
+func eccPrivateKey(key bc.KeyPair) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key.ToB64())
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 2*curve25519.ScalarSize {
+		return nil, errors.New("Invalid Curve25519 key")
+	}
+	priv := b[curve25519.ScalarSize:]
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub, key.GetPubKey().ToBytes()) {
+		return nil, errors.New("Private Key does not match Public Key")
+	}
+	return priv, nil
+}
+
+func eccTag(key bc.KeyPair, peer []byte, digest []byte) ([]byte, error) {
+	priv, err := eccPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := curve25519.X25519(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(tagLabel)
+	mac.Write(digest)
+	return mac.Sum(nil), nil
+}
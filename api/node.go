@@ -1,6 +1,8 @@
 package api
 
 import (
+	"io"
+
 	"github.com/awgh/bencrypt/bc"
 )
 
@@ -14,6 +16,8 @@ type Node interface {
 	SetPolicy(policies ...Policy)
 	Router() Router
 	SetRouter(router Router)
+	Outbox() Outbox
+	SetOutbox(outbox Outbox)
 	GetChannelPrivKey(name string) (string, error)
 	Handle(msg Msg) (bool, error)
 	Forward(msg Msg) error
@@ -21,12 +25,44 @@ type Node interface {
 
 	// Chunking
 	// AddStream - inform node of receipt of a stream header
-	AddStream(streamID uint32, totalChunks uint32, channelName string) error
+	AddStream(stream StreamHeader) error
 	// AddChunk - inform node of receipt of a chunk
 	AddChunk(streamID uint32, chunkNum uint32, data []byte) error
+	// RetainChunk - keep a copy of an outbound chunk, so it can be resent if the receiver NACKs it
+	RetainChunk(msg Msg) error
+	// ResendChunks - re-queue retained chunks of a stream, in response to a NACK
+	ResendChunks(streamID uint32, chunkNums []uint32) error
+	// OpenStream - start a chunked transfer to a contact or channel, chunked as it is written
+	OpenStream(dest string, channel bool) (io.WriteCloser, error)
+	// SetStreamHandler - hand incoming chunked streams to handler as io.Readers, instead of reassembling them to Out()
+	SetStreamHandler(handler StreamHandler)
+
+	// Receipts
+	// SendReceipted - send a direct message and ask the recipient for a delivery receipt,
+	//	a Delivered event with the returned MsgID is emitted when the receipt arrives
+	SendReceipted(msg Msg) (MsgID, error)
+	// ConfirmDelivery - records that the receipt for a message sent with SendReceipted arrived,
+	//	false if this node asked for no receipt with that MsgID, or already had it
+	ConfirmDelivery(id MsgID) bool
 
 	// FlushOutbox : Empties the outbox of messages older than maxAgeSeconds
 	FlushOutbox(maxAgeSeconds int64)
+	// OutboxTTL : seconds outbound messages are kept before the running node flushes them, negative if never
+	OutboxTTL() int64
+	// SetOutboxTTL : sets the OutboxTTL, zero restores the default
+	SetOutboxTTL(seconds int64)
+	// Quota : the limits on the whole outbox, the zero OutboxQuota if there are none
+	Quota() OutboxQuota
+	// SetQuota : sets the limits on the whole outbox, the zero OutboxQuota removes them
+	SetQuota(quota OutboxQuota)
+	// ChannelQuotas : the limits on the messages of each channel, "" is for the messages not on a channel
+	ChannelQuotas() map[string]OutboxQuota
+	// SetChannelQuota : sets the limits on the messages of one channel, the zero OutboxQuota removes them
+	SetChannelQuota(channel string, quota OutboxQuota)
+	// ChannelKeyOverlap : seconds the older keys of a channel keep working after AddChannel gives it a new one, negative if forever
+	ChannelKeyOverlap() int64
+	// SetChannelKeyOverlap : sets the ChannelKeyOverlap, zero restores the default
+	SetChannelKeyOverlap(seconds int64)
 
 	// RPC Entrypoints
 
@@ -69,7 +105,7 @@ type Node interface {
 	GetChannel(name string) (*Channel, error)
 	// GetChannels : Return list of channels known to this node (22)
 	GetChannels() ([]Channel, error)
-	// AddChannel : Add a channel to this node's database (23)
+	// AddChannel : Add a channel to this node's database, or give it a new key (23)
 	AddChannel(name string, privkey string) error
 	// DeleteChannel : Remove a channel from this node's database (24)
 	DeleteChannel(name string) error
@@ -99,8 +135,13 @@ type Node interface {
 	// SendChannel : Transmit a message to a channel (35) <deprecated>
 	SendChannel(channelName string, data []byte, pubkey ...bc.PubKey) error
 
-	// SendMsg : Transmit a message object (36)
-	SendMsg(msg Msg) error
+	// SendMsg : Transmit a message object, returns the MsgID its status is tracked by (36)
+	SendMsg(msg Msg) (MsgID, error)
+
+	// GetMsgStatus : Return what has become of a message sent with SendMsg (37)
+	GetMsgStatus(id MsgID) (*MsgStatus, error)
+	// GetMsgStatuses : Return the status of every message this node is tracking (38)
+	GetMsgStatuses() ([]MsgStatus, error)
 
 	//  End of Admin API Functions
 
@@ -134,12 +175,18 @@ type ChannelPriv struct {
 	Name    string
 	Pubkey  string
 	Privkey bc.KeyPair
+	// Version : goes up by one with each new key a channel is given, the newest key is used to send
+	Version int64
+	// Expires : UnixNano time after which this older key no longer decrypts, zero for the newest key
+	Expires int64
 }
 
 // ChannelPrivB64 : object that describes a channel, database version (including private key)
 type ChannelPrivB64 struct {
 	Name    string `db:"name"`
 	Privkey string `db:"privkey"`
+	Version int64  `db:"version"`
+	Expires int64  `db:"expires"`
 }
 
 // Profile : object that describes a profile
@@ -175,6 +222,8 @@ type Peer struct {
 type Bundle struct {
 	Data []byte
 	Time int64
+	// Ingress : where the bundle came from, set by whoever passes it into Dropoff, not sent over the wire
+	Ingress Ingress
 }
 
 // OutboxMsg : object that describes an outbox message
@@ -182,6 +231,9 @@ type OutboxMsg struct {
 	Channel   string `db:"channel"`
 	Msg       []byte `db:"msg"`
 	Timestamp int64  `db:"timestamp"`
+	Forwarded bool   `db:"forwarded"` // queued by Forward on behalf of another node
+	Priority  int8   `db:"priority"`  // higher priorities are picked up first
+	Ingress   string `db:"ingress"`   // base64 routing key of the peer a forwarded message came in from, if known
 }
 
 // ConfigValue - Name/Value pairs of configuration strings
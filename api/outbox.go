@@ -0,0 +1,70 @@
+package api
+
+// Outbox : defines an interface for the storage of outbound messages, any Node can use any Outbox
+type Outbox interface {
+	// Enqueue : stores outbound messages
+	Enqueue(msgs ...OutboxMsg) error
+	// MsgsSince : returns messages newer than lastTime, oldest first, and the timestamp of the last one returned.
+	//	Only messages on the given channels are returned, or all messages if none are given.
+	//	If maxBytes is positive, no more than maxBytes are returned,
+	//	except when the first message is bigger than that on its own, then it is returned alone.
+	MsgsSince(lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error)
+	// MsgsSinceExcept : same as MsgsSince, but leaves out the messages with an Ingress of except,
+	//	so they are not handed back to the peer they came from.  An empty except leaves out nothing.
+	//	The Ingress of a dropped off message is whatever the dropping peer claimed, see api.Ingress.
+	MsgsSinceExcept(except string, lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error)
+	// Flush : deletes messages older than maxAgeSeconds seconds
+	Flush(maxAgeSeconds int64) error
+	// Stats : returns the number and size of the stored messages
+	Stats() (OutboxStats, error)
+	// Entries : describes the stored messages without their contents, oldest first.
+	//	Only messages on the given channels are listed, or all messages if none are given.
+	Entries(channelNames ...string) ([]OutboxEntry, error)
+	// Remove : deletes the messages with the given timestamps
+	Remove(timestamps ...int64) error
+}
+
+// OutboxEntry : object that describes a stored message, without its contents
+type OutboxEntry struct {
+	Channel   string
+	Timestamp int64
+	Size      int64
+	Forwarded bool
+	Priority  int8
+}
+
+// OutboxStats : object that describes the contents of an Outbox
+type OutboxStats struct {
+	Messages int64
+	Bytes    int64
+	Oldest   int64 // timestamp of the oldest message, 0 if empty
+	Newest   int64 // timestamp of the newest message, 0 if empty
+}
+
+// EvictionPolicy : picks which messages are dropped first when an Outbox is over quota
+type EvictionPolicy int
+
+const (
+	// EvictOldest - drop the oldest messages first
+	EvictOldest EvictionPolicy = iota
+	// EvictLargest - drop the largest messages first
+	EvictLargest
+	// EvictForwarded - drop messages forwarded for other nodes before the ones this node sent, oldest first
+	EvictForwarded
+)
+
+// OutboxQuota : limits on the contents of an Outbox, zero means no limit
+type OutboxQuota struct {
+	MaxBytes    int64
+	MaxMessages int64
+	Eviction    EvictionPolicy
+}
+
+const (
+	// PriorityBulk - chunks and other traffic that can wait
+	PriorityBulk int8 = -1
+	// PriorityNormal - the default priority of messages
+	PriorityNormal int8 = 0
+	// PriorityUrgent - small messages that should not wait behind bulk traffic
+	PriorityUrgent int8 = 1
+)
@@ -0,0 +1,110 @@
+// Package receipt - end-to-end delivery receipts for direct messages, shared by the Nodes
+package receipt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+	"github.com/awgh/ratnet/api/events"
+)
+
+// the content of a message with the ReceiptFlag starts with one of these
+const (
+	// request: kind, MsgID, uint16 reply key length, reply key, then the payload
+	kindRequest = 0x01
+	// receipt: kind, MsgID
+	kindReceipt = 0x02
+)
+
+// Send - sends a direct message with a receipt request in front of its content,
+// the recipient answers to our content key with a receipt carrying the returned MsgID
+func Send(node api.Node, msg api.Msg) (api.MsgID, error) {
+	if msg.IsChan {
+		return msg.ID, errors.New("Delivery receipts are only for direct messages")
+	}
+	id := msg.ID
+	if id == (api.MsgID{}) {
+		var err error
+		if id, err = api.NewMsgID(); err != nil {
+			return id, err
+		}
+	}
+	cid, err := node.CID()
+	if err != nil {
+		return id, err
+	}
+	replyKey := cid.ToB64()
+
+	content := bytes.NewBuffer([]byte{kindRequest})
+	content.Write(id[:])                                              // MsgID
+	binary.Write(content, binary.LittleEndian, uint16(len(replyKey))) // ReplyKey length
+	content.WriteString(replyKey)                                     // ReplyKey
+	content.Write(msg.Content.Bytes())
+	msg.Content = content
+	msg.Receipt = true
+	msg.ID = id
+
+	// chunks do not carry the request, so the whole message has to fit in one
+	if uint32(msg.Content.Len()) > chunking.ChunkSize(node, msg) {
+		return id, errors.New("Message too big for a delivery receipt")
+	}
+	return node.SendMsg(msg)
+}
+
+// Handle - shared handler for Nodes that deals with messages with the ReceiptFlag.
+// Receipts for messages the node sent with SendReceipted emit a Delivered event, other receipts
+// are ignored, and both return false.  Requests are answered with a receipt,
+// then msg is returned with only its payload and true, to be handled like any other message.
+func Handle(node api.Node, msg api.Msg) (api.Msg, bool, error) {
+	var id api.MsgID
+	data := msg.Content.Bytes()
+	if len(data) < 1+len(id) {
+		return msg, false, errors.New("Malformed receipt")
+	}
+	kind := data[0]
+	copy(id[:], data[1:])
+	data = data[1+len(id):]
+
+	switch kind {
+	case kindReceipt:
+		if !node.ConfirmDelivery(id) { // forged, or a duplicate
+			events.Warning(node, "Ignored receipt for an unknown or delivered message: "+id.String())
+			return msg, false, nil
+		}
+		events.Emit(node, api.Info, api.Delivered, id)
+		return msg, false, nil
+	case kindRequest:
+		if len(data) < 2 {
+			return msg, false, errors.New("Malformed receipt request")
+		}
+		n := int(binary.LittleEndian.Uint16(data))
+		if len(data) < 2+n {
+			return msg, false, errors.New("Malformed receipt request")
+		}
+		if err := sendReceipt(node, id, string(data[2:2+n])); err != nil {
+			events.Warning(node, "Could not send delivery receipt: "+err.Error())
+		}
+		msg.Content = bytes.NewBuffer(data[2+n:])
+		return msg, true, nil
+	}
+	return msg, false, errors.New("Unknown receipt type")
+}
+
+// sendReceipt - answers a receipt request for the given MsgID to replyKey
+func sendReceipt(node api.Node, id api.MsgID, replyKey string) error {
+	cid, err := node.CID() // we need this for cloning
+	if err != nil {
+		return err
+	}
+	pubkey := cid.Clone()
+	if err := pubkey.FromB64(replyKey); err != nil {
+		return err
+	}
+	content := bytes.NewBuffer([]byte{kindReceipt})
+	content.Write(id[:]) // MsgID
+	_, err = node.SendMsg(api.Msg{Content: content, PubKey: pubkey, Receipt: true, Priority: api.PriorityUrgent})
+	return err
+}
@@ -0,0 +1,77 @@
+package receipt_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/receipt"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+// receiptFor - the content of a receipt for id, as the recipient sends it back
+func receiptFor(id api.MsgID) api.Msg {
+	return api.Msg{Content: bytes.NewBuffer(append([]byte{0x02}, id[:]...)), Receipt: true}
+}
+
+// delivered - the MsgIDs of the Delivered events emitted on node so far
+func delivered(node api.Node) []api.MsgID {
+	var ids []api.MsgID
+	for {
+		select {
+		case ev := <-node.Events():
+			if ev.Type == api.Delivered {
+				ids = append(ids, ev.Data[0].(api.MsgID))
+			}
+		default:
+			return ids
+		}
+	}
+}
+
+func Test_Handle_Forged_1(t *testing.T) {
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	cid, _ := node.CID()
+
+	// a receipt for a MsgID this node never sent
+	forged, err := api.NewMsgID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, deliver, err := receipt.Handle(node, receiptFor(forged)); deliver || err != nil {
+		t.Fatal("Unexpected result for a forged receipt", deliver, err)
+	}
+	// a receipt for a message sent without asking for one
+	plain, err := node.SendMsg(api.Msg{Content: bytes.NewBufferString("no receipt"), PubKey: cid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt.Handle(node, receiptFor(plain))
+	if ids := delivered(node); len(ids) != 0 {
+		t.Fatal("Receipts for messages that asked for none were delivered", ids)
+	}
+	if status, _ := node.GetMsgStatus(plain); status.State == api.MsgDelivered {
+		t.Error("Message that asked for no receipt was marked delivered")
+	}
+
+	// the real receipt is delivered once, a replay of it is ignored
+	id, err := node.SendReceipted(api.Msg{Content: bytes.NewBufferString("receipt please"), PubKey: cid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt.Handle(node, receiptFor(id))
+	receipt.Handle(node, receiptFor(id))
+	if ids := delivered(node); len(ids) != 1 || ids[0] != id {
+		t.Fatal("Expected one Delivered event for the receipted message, got", ids)
+	}
+}
+
+func Test_Handle_Malformed_1(t *testing.T) {
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	for _, content := range [][]byte{{}, {0x02, 1, 2}, {0x01}, {0x09, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		if _, deliver, err := receipt.Handle(node, api.Msg{Content: bytes.NewBuffer(content)}); deliver || err == nil {
+			t.Errorf("Malformed receipt %v was accepted", content)
+		}
+	}
+}
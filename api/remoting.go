@@ -26,15 +26,19 @@ const (
 	APITypePubKeyECC byte = 0x10
 	APITypePubKeyRSA byte = 0x11
 
-	APITypeContactArray byte = 0x20
-	APITypeChannelArray byte = 0x21
-	APITypeProfileArray byte = 0x22
-	APITypePeerArray    byte = 0x23
-
-	APITypeContact byte = 0x30
-	APITypeChannel byte = 0x31
-	APITypeProfile byte = 0x32
-	APITypePeer    byte = 0x33
+	APITypeContactArray   byte = 0x20
+	APITypeChannelArray   byte = 0x21
+	APITypeProfileArray   byte = 0x22
+	APITypePeerArray      byte = 0x23
+	APITypeMsgStatusArray byte = 0x24
+	APITypePatchArray     byte = 0x25
+
+	APITypeContact   byte = 0x30
+	APITypeChannel   byte = 0x31
+	APITypeProfile   byte = 0x32
+	APITypePeer      byte = 0x33
+	APITypeMsgStatus byte = 0x34
+	APITypePatch     byte = 0x35
 
 	APITypeBundle byte = 0x40
 )
@@ -298,6 +302,32 @@ func serialize(w io.Writer, v interface{}) {
 			}
 		}
 		writeTLV(w, APITypePeerArray, b.Bytes())
+	case *MsgStatus:
+		b := new(bytes.Buffer)
+		writeMsgStatus(b, v.(*MsgStatus))
+		writeTLV(w, APITypeMsgStatus, b.Bytes())
+	case []MsgStatus:
+		as := v.([]MsgStatus)
+		lenBuf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(lenBuf, uint64(len(as))) // number of elements in array
+		b := bytes.NewBuffer(lenBuf[:n])
+		for i := range as {
+			writeMsgStatus(b, &as[i])
+		}
+		writeTLV(w, APITypeMsgStatusArray, b.Bytes())
+	case *Patch:
+		b := new(bytes.Buffer)
+		writePatch(b, v.(*Patch))
+		writeTLV(w, APITypePatch, b.Bytes())
+	case []Patch:
+		ap := v.([]Patch)
+		lenBuf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(lenBuf, uint64(len(ap))) // number of elements in array
+		b := bytes.NewBuffer(lenBuf[:n])
+		for i := range ap {
+			writePatch(b, &ap[i])
+		}
+		writeTLV(w, APITypePatchArray, b.Bytes())
 	case Bundle:
 		bundle := v.(Bundle)
 		b := new(bytes.Buffer)
@@ -601,6 +631,48 @@ func deserialize(r bytesReader) (interface{}, error) {
 		}
 		return peers, nil
 
+	case APITypeMsgStatus:
+		return readMsgStatus(bytes.NewReader(v))
+
+	case APITypeMsgStatusArray:
+		var statuses []MsgStatus
+		l, n := binary.Uvarint(v)
+		if n == 0 {
+			return nil, ErrInputTooShort
+		} else if n < 0 {
+			return nil, ErrLenOverflow
+		}
+		b := bytes.NewReader(v[n:])
+		for i := uint64(0); i < l; i++ {
+			status, err := readMsgStatus(b)
+			if err != nil {
+				return nil, err
+			}
+			statuses = append(statuses, *status)
+		}
+		return statuses, nil
+
+	case APITypePatch:
+		return readPatch(bytes.NewReader(v))
+
+	case APITypePatchArray:
+		patches := []Patch{}
+		l, n := binary.Uvarint(v)
+		if n == 0 {
+			return nil, ErrInputTooShort
+		} else if n < 0 {
+			return nil, ErrLenOverflow
+		}
+		b := bytes.NewReader(v[n:])
+		for i := uint64(0); i < l; i++ {
+			patch, err := readPatch(b)
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, *patch)
+		}
+		return patches, nil
+
 	case APITypeBundle:
 		var bundle Bundle
 		b := bytes.NewBuffer(v)
@@ -619,6 +691,87 @@ func deserialize(r bytesReader) (interface{}, error) {
 	return nil, errors.New("Unknown Type")
 }
 
+// writeMsgStatus - writes the fields of a MsgStatus, without a type
+func writeMsgStatus(w io.Writer, status *MsgStatus) {
+	writeLV(w, status.ID[:])
+	binary.Write(w, binary.BigEndian, status.State)
+	binary.Write(w, binary.BigEndian, status.Queued)
+	binary.Write(w, binary.BigEndian, status.Updated)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(status.PickedUpBy))) // number of peers
+	w.Write(lenBuf[:n])
+	for _, peer := range status.PickedUpBy {
+		writeLV(w, []byte(peer))
+	}
+}
+
+// readMsgStatus - reads the fields of a MsgStatus written by writeMsgStatus
+func readMsgStatus(r bytesReader) (*MsgStatus, error) {
+	var status MsgStatus
+	va, err := readLV(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(va) != len(status.ID) {
+		return nil, errors.New("Invalid MsgID length")
+	}
+	copy(status.ID[:], va)
+	if err := binary.Read(r, binary.BigEndian, &status.State); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &status.Queued); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &status.Updated); err != nil {
+		return nil, err
+	}
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < l; i++ {
+		va, err := readLV(r)
+		if err != nil {
+			return nil, err
+		}
+		status.PickedUpBy = append(status.PickedUpBy, string(va))
+	}
+	return &status, nil
+}
+
+// writePatch - writes the fields of a Patch, without a type
+func writePatch(w io.Writer, patch *Patch) {
+	writeLV(w, []byte(patch.From))
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(patch.To))) // number of destinations
+	w.Write(lenBuf[:n])
+	for _, to := range patch.To {
+		writeLV(w, []byte(to))
+	}
+}
+
+// readPatch - reads the fields of a Patch written by writePatch
+func readPatch(r bytesReader) (*Patch, error) {
+	var patch Patch
+	va, err := readLV(r)
+	if err != nil {
+		return nil, err
+	}
+	patch.From = string(va)
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < l; i++ {
+		va, err := readLV(r)
+		if err != nil {
+			return nil, err
+		}
+		patch.To = append(patch.To, string(va))
+	}
+	return &patch, nil
+}
+
 func writeTLV(w io.Writer, typ byte, value []byte) {
 	binary.Write(w, binary.BigEndian, typ) // type
 	if typ != APITypeNil {
@@ -101,3 +101,59 @@ func Test_ResponseRoundTrip_2(t *testing.T) {
 		t.Fatal("Before and After Errors do not match")
 	}
 }
+
+func Test_ResponseRoundTrip_MsgStatus_1(t *testing.T) {
+	id, err := NewMsgID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []MsgStatus{
+		{ID: id, State: MsgPickedUp, Queued: 1, Updated: 2, PickedUpBy: []string{"peer1", "peer2"}},
+		{State: MsgQueued, Queued: 3, Updated: 3},
+	}
+	b := RemoteResponseToBytes(&RemoteResponse{Value: statuses})
+	reresp, err := RemoteResponseFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restatuses, ok := reresp.Value.([]MsgStatus)
+	if !ok || len(restatuses) != len(statuses) {
+		t.Fatalf("Expected %d statuses, got %+v", len(statuses), reresp.Value)
+	}
+	if restatuses[0].ID != id || restatuses[0].State != MsgPickedUp || restatuses[0].Updated != 2 ||
+		strings.Join(restatuses[0].PickedUpBy, ",") != "peer1,peer2" {
+		t.Errorf("Before and After statuses do not match: %+v", restatuses[0])
+	}
+	if restatuses[1].Queued != 3 || len(restatuses[1].PickedUpBy) != 0 {
+		t.Errorf("Before and After statuses do not match: %+v", restatuses[1])
+	}
+
+	b = RemoteResponseToBytes(&RemoteResponse{Value: &statuses[0]})
+	if reresp, err = RemoteResponseFromBytes(b); err != nil {
+		t.Fatal(err)
+	}
+	if status, ok := reresp.Value.(*MsgStatus); !ok || status.ID != id {
+		t.Errorf("Before and After status does not match: %+v", reresp.Value)
+	}
+}
+
+func Test_CallRoundTrip_Patches_1(t *testing.T) {
+	patches := []Patch{
+		{From: "in", To: []string{"out1", "out2"}},
+		{From: "", To: []string{"direct"}},
+	}
+	call := &RemoteCall{Action: SetPatches, Args: []interface{}{patches}}
+	recall, err := RemoteCallFromBytes(RemoteCallToBytes(call))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repatches, ok := recall.Args[0].([]Patch)
+	if !ok || len(repatches) != len(patches) {
+		t.Fatalf("Expected %d patches, got %+v", len(patches), recall.Args[0])
+	}
+	for i := range patches {
+		if repatches[i].From != patches[i].From || strings.Join(repatches[i].To, ",") != strings.Join(patches[i].To, ",") {
+			t.Errorf("Before and After patches do not match: %+v", repatches[i])
+		}
+	}
+}
@@ -2,16 +2,60 @@ package api
 
 // Router : defines an interface for a stateful Routing object
 type Router interface {
-	// Route : Determine what to do with the given message, and then have the node do it.
-	Route(node Node, msg []byte) error
-	// Patch : Add a mapping from an incoming channel to one or more destination channels
+	// Route : Determine what to do with the given message, that came in from ingress, and then have the node do it.
+	Route(node Node, msg []byte, ingress Ingress) error
+	// Patch : Add a mapping from an incoming channel to one or more destination channels,
+	// replacing any mapping from the same incoming channel
 	Patch(patch Patch)
+	// Unpatch : Remove the mapping from the given incoming channel
+	Unpatch(from string)
+	// SetPatches : Replace all of the mappings
+	SetPatches(patches []Patch)
 	// GetPatches : Returns an array with the mappings of incoming channels to destination channels
 	GetPatches() []Patch
 
 	JSON
 }
 
+// SeenEntry : a hash of a message nonce remembered for loop detection, and the UnixNano time it was first seen
+type SeenEntry struct {
+	Hash [32]byte
+	Time int64
+}
+
+// SeenStore : implemented by nodes that can keep a router's loop detection state across restarts
+type SeenStore interface {
+	// LoadSeen : returns the entries first seen at or after the given time, oldest first
+	LoadSeen(since int64) ([]SeenEntry, error)
+	// SaveSeen : stores entries
+	SaveSeen(entries ...SeenEntry) error
+	// ForgetSeen : deletes the entries first seen before the given time
+	ForgetSeen(before int64) error
+}
+
+// SeenPersister : implemented by routers that can keep their loop detection state in a node's SeenStore
+type SeenPersister interface {
+	// RestoreSeen : reloads loop detection state from the node, if it is a SeenStore, and keeps saving it there
+	RestoreSeen(node Node) error
+	// FlushSeen : saves loop detection state that has not been saved yet
+	FlushSeen() error
+}
+
+// PickupFilter : implemented by routers that choose which peers get which messages from the outbox
+type PickupFilter interface {
+	// FilterPickup : returns the msgs to hand to the peer with the given base64 routing key, Pickup calls this
+	FilterPickup(node Node, consumer string, msgs [][]byte) [][]byte
+}
+
+// SigningRouter : implemented by routers with a secret key of their own.
+// Nodes export and import it with their other secret keys, it is not part of the router's config.
+type SigningRouter interface {
+	// SigningKey : returns the secret key, base64
+	SigningKey() string
+	// SetSigningKey : sets the secret key from base64
+	SetSigningKey(b64 string) error
+}
+
 // Patch : defines a mapping from an incoming channel to one or more destination channels.
 type Patch struct {
 	From string
@@ -25,4 +69,14 @@ const (
 	ChunkedFlag = 0x02
 	// ChannelFlag : this message has a channel name prefix
 	ChannelFlag = 0x04
+	// NackFlag : this message is a request to retransmit missing chunks
+	NackFlag = 0x08
+	// FragmentFlag : this message is a piece of a message too big for the transport it was picked up with
+	FragmentFlag = 0x10
+	// TTLFlag : this message has a TTL header after its channel name prefix, see AppendTTLHeader
+	TTLFlag = 0x20
+	// ReceiptFlag : this message is a delivery receipt or asks for one, see package receipt
+	ReceiptFlag = 0x40
+	// MulticastFlag : this direct message is a multi-recipient envelope, see package multicast
+	MulticastFlag = 0x80
 )
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/awgh/bencrypt/bc"
+)
+
+// SendState : what has become of a message sent by this node
+type SendState uint8
+
+const (
+	// MsgQueued : in the outbox, no peer has picked it up yet
+	MsgQueued SendState = iota
+	// MsgPickedUp : in the outbox, and picked up by at least one peer
+	MsgPickedUp
+	// MsgExpired : flushed from the outbox for being older than the node's OutboxTTL
+	MsgExpired
+	// MsgDelivered : the recipient sent back a delivery receipt, see SendReceipted
+	MsgDelivered
+)
+
+// String : returns the name of the SendState
+func (s SendState) String() string {
+	switch s {
+	case MsgQueued:
+		return "queued"
+	case MsgPickedUp:
+		return "picked up"
+	case MsgExpired:
+		return "expired"
+	case MsgDelivered:
+		return "delivered"
+	}
+	return "unknown"
+}
+
+// MsgStatus : the status of a message sent with SendMsg, as tracked by the node that sent it
+type MsgStatus struct {
+	ID    MsgID
+	State SendState
+	// Queued : UnixNano time the message was queued
+	Queued int64
+	// Updated : UnixNano time of the last change to this status
+	Updated int64
+	// PickedUpBy : base64 routing keys of the peers that picked up the message, or any chunk of it
+	PickedUpBy []string
+	// Receipted : a delivery receipt was asked for, State becomes MsgDelivered when it arrives
+	Receipted bool
+}
+
+// NewMsgID : returns a new random MsgID
+func NewMsgID() (MsgID, error) {
+	var id MsgID
+	b, err := bc.GenerateRandomBytes(len(id))
+	if err != nil {
+		return id, err
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// ParseMsgID : parses a MsgID from the hex returned by its String method
+func ParseMsgID(s string) (MsgID, error) {
+	var id MsgID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, errors.New("Invalid MsgID length")
+	}
+	copy(id[:], b)
+	return id, nil
+}
@@ -1,5 +1,7 @@
 package api
 
+import "io"
+
 // Transport - Interface to implement in a RatNet-compatable pluggable transport module
 type Transport interface {
 	Listen(listen string, adminMode bool)
@@ -18,8 +20,17 @@ type StreamHeader struct {
 	StreamID    uint32 `db:"streamid"`
 	NumChunks   uint32 `db:"parts"`
 	ChannelName string `db:"channel"`
+	ReplyKey    string `db:"replykey"`  // content key of the sender of a direct stream, for NACKs
+	Length      int64  `db:"msglen"`    // length of the whole message
+	Digest      []byte `db:"digest"`    // SHA-256 of the whole message
+	FirstSeen   int64  `db:"firstseen"` // when the header or first chunk arrived, UnixNano
+	Buffered    int64  `db:"buffered"`  // bytes of chunk data received so far
+	Signed      bool   `db:"signed"`    // the header was signed with ReplyKey, so its Digest vouches for the whole message
 }
 
+// StreamHandler - receives incoming chunked streams as they arrive, see Node.SetStreamHandler
+type StreamHandler func(stream StreamHeader, r io.Reader)
+
 // Chunk header for each chunk
 type Chunk struct {
 	StreamID uint32 `db:"streamid"`
@@ -5,7 +5,6 @@ go 1.15
 require (
 	github.com/AlexsJones/cli v0.0.0-20200618222640-740e329af210
 	github.com/awgh/bencrypt v0.0.0-20190918184257-b65cb460b2c8
-	github.com/awgh/debouncer v0.0.0-20200721022636-91ed01fa9bc9
 	github.com/chzyer/logex v1.1.10 // indirect
 	github.com/chzyer/test v0.0.0-20180213035817-a1ea475d72b1 // indirect
 	github.com/fatih/color v1.10.0
@@ -16,7 +15,8 @@ require (
 	github.com/tjfoc/gmsm v1.4.0 // indirect
 	github.com/upper/db/v4 v4.1.0
 	github.com/xtaci/kcp-go/v5 v5.6.1
-	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/net v0.0.0-20201224014010-6772e930b67b // indirect
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9 // indirect
 	golang.org/x/sys v0.0.0-20210113181707-4bcb84eeeb78 // indirect
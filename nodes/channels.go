@@ -0,0 +1,90 @@
+package nodes
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+)
+
+// DefaultChannelKeyOverlap - seconds the older keys of a channel keep working after it is given a new one,
+// on a node that has not been given a ChannelKeyOverlap
+var DefaultChannelKeyOverlap int64 = 24 * 60 * 60
+
+// AddChannelKey : returns keys, the keys of one channel newest first, with key added as the newest version.
+// The keys that were in use before are kept for overlap more seconds, or forever if overlap is negative,
+// and keys that have expired are left out.  Adding the newest key again changes nothing.
+func AddChannelKey(keys []api.ChannelPriv, key api.ChannelPriv, overlap int64) []api.ChannelPriv {
+	b64 := key.Privkey.ToB64()
+	if len(keys) > 0 && keys[0].Privkey.ToB64() == b64 {
+		return keys
+	}
+	expires := int64(math.MaxInt64)
+	if overlap >= 0 {
+		expires = time.Now().Add(time.Duration(overlap) * time.Second).UnixNano()
+	}
+	key.Version = 1
+	if len(keys) > 0 {
+		key.Version = keys[0].Version + 1
+	}
+	key.Expires = 0
+	rotated := []api.ChannelPriv{key}
+	for _, k := range ActiveChannelKeys(keys) {
+		if k.Privkey.ToB64() == b64 { // an older key made the newest again
+			continue
+		}
+		if k.Expires == 0 {
+			k.Expires = expires
+		}
+		rotated = append(rotated, k)
+	}
+	return rotated
+}
+
+// ActiveChannelKeys : returns the keys that have not expired, in the same order
+func ActiveChannelKeys(keys []api.ChannelPriv) []api.ChannelPriv {
+	now := time.Now().UnixNano()
+	active := make([]api.ChannelPriv, 0, len(keys))
+	for _, k := range keys {
+		if k.Expires == 0 || k.Expires > now {
+			active = append(active, k)
+		}
+	}
+	return active
+}
+
+// GroupChannelKeys : returns the keys of several channels by channel name, newest first
+func GroupChannelKeys(keys []api.ChannelPriv) map[string][]api.ChannelPriv {
+	channels := make(map[string][]api.ChannelPriv)
+	for _, k := range keys {
+		channels[k.Name] = append(channels[k.Name], k)
+	}
+	for _, v := range channels {
+		sort.SliceStable(v, func(i, j int) bool { return v[i].Version > v[j].Version })
+	}
+	return channels
+}
+
+// DecodeChannelKeys : returns the channel keys in channels, decoded as keys of the same type as keyType
+func DecodeChannelKeys(keyType bc.KeyPair, channels []api.ChannelPrivB64) ([]api.ChannelPriv, error) {
+	keys := make([]api.ChannelPriv, 0, len(channels))
+	for _, c := range channels {
+		prv := keyType.Clone()
+		if err := prv.FromB64(c.Privkey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, api.ChannelPriv{Name: c.Name, Pubkey: prv.GetPubKey().ToB64(), Privkey: prv, Version: c.Version, Expires: c.Expires})
+	}
+	return keys, nil
+}
+
+// EncodeChannelKeys : returns the channel keys for storage or export
+func EncodeChannelKeys(keys []api.ChannelPriv) []api.ChannelPrivB64 {
+	channels := make([]api.ChannelPrivB64, 0, len(keys))
+	for _, k := range keys {
+		channels = append(channels, api.ChannelPrivB64{Name: k.Name, Privkey: k.Privkey.ToB64(), Version: k.Version, Expires: k.Expires})
+	}
+	return channels
+}
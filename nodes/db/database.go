@@ -1,12 +1,13 @@
 package db
 
 import (
-	"errors"
 	"fmt"
 	"time"
 
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/nodes"
+	dboutbox "github.com/awgh/ratnet/outbox/db"
 
 	"github.com/upper/db/v4"
 )
@@ -72,7 +73,7 @@ func (node *Node) dbDeleteContact(name string) {
 }
 
 func (node *Node) dbGetChannelPrivKey(name string) (string, error) {
-	res := node.db.SQL().SelectFrom("channels").Where("name = ?", name)
+	res := node.db.SQL().SelectFrom("channels").Where("name = ?", name).OrderBy("-version")
 	var channel api.ChannelPrivB64
 	if err := res.One(&channel); err != nil {
 		return "", err
@@ -81,22 +82,22 @@ func (node *Node) dbGetChannelPrivKey(name string) (string, error) {
 }
 
 func (node *Node) dbGetChannels() ([]api.Channel, error) {
-	res := node.db.SQL().SelectFrom("channels")
-	var channels []api.ChannelPrivB64
-	if err := res.All(&channels); err != nil {
+	channels, err := node.dbGetChannelsPriv()
+	if err != nil {
 		return nil, err
 	}
+	newest := nodes.GroupChannelKeys(channels)
 	var retval []api.Channel
 	for _, v := range channels {
-		prv := node.contentKey.Clone()
-		if err := prv.FromB64(v.Privkey); err != nil {
-			return nil, err
+		if keys, ok := newest[v.Name]; ok { // one per channel
+			retval = append(retval, api.Channel{Name: v.Name, Pubkey: keys[0].Pubkey})
+			delete(newest, v.Name)
 		}
-		retval = append(retval, api.Channel{Name: v.Name, Pubkey: prv.GetPubKey().ToB64()})
 	}
 	return retval, nil
 }
 
+// dbGetChannelsPriv - returns every key of every channel
 func (node *Node) dbGetChannelsPriv() ([]api.ChannelPriv, error) {
 	col := node.db.Collection("channels")
 	res := col.Find()
@@ -104,40 +105,53 @@ func (node *Node) dbGetChannelsPriv() ([]api.ChannelPriv, error) {
 	if err := res.All(&channels); err != nil {
 		return nil, err
 	}
-	var retval []api.ChannelPriv
-	for _, v := range channels {
-		prv := node.contentKey.Clone()
-		if err := prv.FromB64(v.Privkey); err != nil {
-			return nil, err
-		}
-		retval = append(retval, api.ChannelPriv{Name: v.Name, Pubkey: prv.GetPubKey().ToB64(), Privkey: prv})
-	}
-	return retval, nil
+	return nodes.DecodeChannelKeys(node.contentKey, channels)
 }
 
+// dbAddChannel - gives a channel a new key, see nodes.AddChannelKey
 func (node *Node) dbAddChannel(name, privkey string) error {
+	prv := node.contentKey.Clone()
+	if err := prv.FromB64(privkey); err != nil {
+		return err
+	}
 	return node.db.Tx(func(tx db.Session) error {
-		col := tx.Collection("channels")
-		res := col.Find("name = ?", name)
-		cnt, err := res.Count()
-		if err != nil {
+		var channels []api.ChannelPrivB64
+		if err := tx.SQL().SelectFrom("channels").Where("name = ?", name).OrderBy("-version").All(&channels); err != nil {
 			return err
 		}
-		if cnt > 0 {
-			_ = res.Delete()
-		}
-		prv := node.contentKey.Clone()
-		if err := prv.FromB64(privkey); err != nil {
+		keys, err := nodes.DecodeChannelKeys(node.contentKey, channels)
+		if err != nil {
 			return err
 		}
-		channel := api.ChannelPrivB64{Name: name, Privkey: prv.ToB64()}
-		_, err = col.Insert(&channel)
-		if err != nil {
+		keys = nodes.AddChannelKey(keys, api.ChannelPriv{Name: name, Pubkey: prv.GetPubKey().ToB64(), Privkey: prv}, node.ChannelKeyOverlap())
+		return node.dbPutChannelKeys(tx, name, keys)
+	})
+}
+
+// dbSetChannelKeys - replaces the keys of a channel
+func (node *Node) dbSetChannelKeys(name string, keys []api.ChannelPriv) error {
+	return node.db.Tx(func(tx db.Session) error {
+		return node.dbPutChannelKeys(tx, name, keys)
+	})
+}
+
+func (node *Node) dbPutChannelKeys(tx db.Session, name string, keys []api.ChannelPriv) error {
+	col := tx.Collection("channels")
+	res := col.Find("name = ?", name)
+	cnt, err := res.Count()
+	if err != nil {
+		return err
+	}
+	if cnt > 0 {
+		_ = res.Delete()
+	}
+	for _, channel := range nodes.EncodeChannelKeys(keys) {
+		if _, err := col.Insert(&channel); err != nil {
 			events.Error(node, err.Error())
 			return err
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 func (node *Node) dbDeleteChannel(name string) {
@@ -312,151 +326,47 @@ func (node *Node) dbDeletePeer(name string) {
 	_ = res.Delete()
 }
 
-func (node *Node) dbOutboxEnqueue(channelName string, msg []byte, ts int64, checkExists bool) error {
-	col := node.db.Collection("outbox")
-	doInsert := !checkExists
-	var outboxmsg api.OutboxMsg
-
-	if checkExists {
-		// save message in my outbox, if not already present
-		res := col.Find(db.Cond{"channel": channelName}).And(db.Cond{"msg": msg})
-		if err := res.One(&outboxmsg); err != nil {
-			return err
-		}
-		count, err := res.Count()
-		if err != nil {
-			return err
-		}
-		if count == 0 {
-			// we don't have this yet, so add it
-			doInsert = true
-		}
-	}
-	if doInsert {
-		outboxmsg.Channel = channelName
-		outboxmsg.Msg = msg
-		outboxmsg.Timestamp = ts
-		_, err := col.Insert(&outboxmsg)
-		return err
-	}
-	return nil
-}
-
-func (node *Node) outboxBulkInsert(channelName string, timestamp int64, msgs [][]byte) error {
-	return node.db.Tx(func(tx db.Session) error {
-		col := tx.Collection("outbox")
-		// todo: convert this to BatchInserter?
-		for i, v := range msgs {
-			var outboxmsg api.OutboxMsg
-			outboxmsg.Channel = channelName
-			outboxmsg.Msg = v
-			outboxmsg.Timestamp = timestamp + int64(i) // increment timestamp by one each message to simplify queueing
-			_, err := col.Insert(outboxmsg)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-}
-
-func (node *Node) dbGetMessages(lastTime, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
-	lastTimeReturned := lastTime
-	var args []interface{}
-	var msgs [][]byte
-	var bytesRead int64
-
-	// Build the query
-	wildcard := false
-	if len(channelNames) < 1 {
-		wildcard = true // if no channels are given, get everything
-	}
-	sqlq := "SELECT msg, timestamp FROM outbox"
-	if lastTime != 0 {
-		sqlq += " WHERE (? < timestamp)"
-		args = append(args, lastTime)
-	}
-	if !wildcard && len(channelNames) > 0 {
-		if lastTime != 0 {
-			sqlq += " AND"
-		} else {
-			sqlq += " WHERE"
-		}
-		sqlq = sqlq + " channel IN( ?"
-		args = append(args, channelNames[0])
-		for i := 1; i < len(channelNames); i++ {
-			sqlq = sqlq + ",?"
-			args = append(args, channelNames[i])
-		}
-		sqlq = sqlq + " )"
-	}
-	sqlq = sqlq + " ORDER BY timestamp ASC;"
-	res, err := node.db.SQL().Query(sqlq, args...)
-
-	if res == nil || err != nil {
-		return nil, lastTimeReturned, err
-	}
-	n := 0
-	for res.Next() {
-		n++
-		var msg []byte
-		var ts int64
-		res.Scan(&msg, &ts)
-		if bytesRead+int64(len(msg)) > maxBytes { // no room for next msg
-			events.Debug(node, "skipping messages after %d results\n", n)
-			if n == 0 {
-				return nil, lastTimeReturned, errors.New("Result too big to be fetched on this transport! Flush and rechunk")
-			}
-			break
-		} else {
-			if ts > lastTimeReturned {
-				lastTimeReturned = ts
-			} else {
-				events.Error(node, "Timestamps not increasing - prev: %d  cur: %d\n", lastTimeReturned, ts)
-			}
-			msgs = append(msgs, msg)
-			bytesRead += int64(len(msg))
-		}
-	}
-	return msgs, lastTimeReturned, nil
-}
-
 func (node *Node) dbClearStream(streamID uint32) error {
 	col := node.db.Collection("chunks")
 	res := col.Find(db.Cond{"streamid": streamID})
 	_ = res.Delete()
 	col = node.db.Collection("streams")
 	res = col.Find(db.Cond{"streamid": streamID})
+	node.nackTimer.Forget(streamID)
+	node.readers.Close(streamID)
 	return res.Delete()
 }
 
 // AddStream - implemented from Node API
-func (node *Node) AddStream(streamID uint32, totalChunks uint32, channelName string) error {
+func (node *Node) AddStream(stream api.StreamHeader) error {
 	node.trigggerMutex.Lock()
 	defer node.trigggerMutex.Unlock()
 	col := node.db.Collection("streams")
-	res := col.Find(db.Cond{"streamid": streamID})
+	res := col.Find(db.Cond{"streamid": stream.StreamID})
 	count, err := res.Count()
 	if err != nil {
 		return err
 	}
-	var stream api.StreamHeader
 	if count == 0 {
 		// insert new stream
-		stream.StreamID = streamID
-		stream.NumChunks = totalChunks
-		stream.ChannelName = channelName
-		_, err = col.Insert(stream)
-		return err
+		stream.FirstSeen = time.Now().UnixNano()
+		stream.Buffered = 0
+		if _, err = col.Insert(stream); err != nil {
+			return err
+		}
+		node.debouncer.Trigger()
+		return nil
 	}
-	err = res.One(&stream)
+	var old api.StreamHeader
+	err = res.One(&old)
 	if err != nil {
 		return err
 	}
-	events.Warning(node, "Over-writing stream header: %x\n", streamID)
-	stream.StreamID = streamID
-	stream.NumChunks = totalChunks
-	stream.ChannelName = channelName
+	if old.NumChunks != 0 { // otherwise this is the placeholder made by AddChunk
+		events.Warning(node, "Over-writing stream header: %x\n", stream.StreamID)
+	}
+	stream.FirstSeen = old.FirstSeen
+	stream.Buffered = old.Buffered
 	node.debouncer.Trigger()
 	return res.Update(stream)
 }
@@ -465,9 +375,27 @@ func (node *Node) AddStream(streamID uint32, totalChunks uint32, channelName str
 func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error {
 	node.trigggerMutex.Lock()
 	defer node.trigggerMutex.Unlock()
+	streams := node.db.Collection("streams")
+	sres := streams.Find(db.Cond{"streamid": streamID})
+	count, err := sres.Count()
+	if err != nil {
+		return err
+	}
+	var stream api.StreamHeader
+	if count == 0 {
+		// header hasn't arrived yet, insert a placeholder so the chunk can still expire
+		stream.StreamID = streamID
+		stream.FirstSeen = time.Now().UnixNano()
+		if _, err = streams.Insert(stream); err != nil {
+			return err
+		}
+	} else if err = sres.One(&stream); err != nil {
+		return err
+	}
+
 	col := node.db.Collection("chunks")
 	res := col.Find(db.Cond{"streamid": streamID}).And(db.Cond{"chunknum": chunkNum})
-	count, err := res.Count()
+	count, err = res.Count()
 	if err != nil {
 		return err
 	}
@@ -477,19 +405,26 @@ func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error
 		chunk.StreamID = streamID
 		chunk.ChunkNum = chunkNum
 		chunk.Data = data
-		_, err = col.Insert(chunk)
-		return err
-	}
-	err = res.One(&chunk)
-	if err != nil {
-		return err
+		if _, err = col.Insert(chunk); err != nil {
+			return err
+		}
+	} else {
+		err = res.One(&chunk)
+		if err != nil {
+			return err
+		}
+		events.Warning(node, "Over-writing chunk: %x:%x\n", streamID, chunkNum)
+		stream.Buffered -= int64(len(chunk.Data))
+		chunk.StreamID = streamID
+		chunk.ChunkNum = chunkNum
+		chunk.Data = data
+		if err = res.Update(chunk); err != nil {
+			return err
+		}
 	}
-	events.Warning(node, "Over-writing chunk: %x:%x\n", streamID, chunkNum)
-	chunk.StreamID = streamID
-	chunk.ChunkNum = chunkNum
-	chunk.Data = data
+	stream.Buffered += int64(len(data))
 	node.debouncer.Trigger()
-	return res.Update(chunk)
+	return sres.Update(stream)
 }
 
 func (node *Node) dbGetStreams() ([]api.StreamHeader, error) {
@@ -518,13 +453,86 @@ func (node *Node) dbGetChunks(streamID uint32) ([]api.Chunk, error) {
 	return chunks, nil
 }
 
+func (node *Node) dbGetChunk(streamID uint32, chunkNum uint32) ([]byte, bool, error) {
+	col := node.db.Collection("chunks")
+	res := col.Find(db.Cond{"streamid": streamID}).And(db.Cond{"chunknum": chunkNum})
+	var chunk api.Chunk
+	if err := res.One(&chunk); err == db.ErrNoMoreRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return chunk.Data, true, nil
+}
+
+func (node *Node) dbRemoveChunk(streamID uint32, chunkNum uint32) error {
+	col := node.db.Collection("chunks")
+	res := col.Find(db.Cond{"streamid": streamID}).And(db.Cond{"chunknum": chunkNum})
+	var chunk api.Chunk
+	if err := res.One(&chunk); err == db.ErrNoMoreRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := res.Delete(); err != nil {
+		return err
+	}
+	sres := node.db.Collection("streams").Find(db.Cond{"streamid": streamID})
+	var stream api.StreamHeader
+	if err := sres.One(&stream); err != nil {
+		return err
+	}
+	stream.Buffered -= int64(len(chunk.Data))
+	return sres.Update(stream)
+}
+
+// seenRow - a row of the seen table, which holds the router's loop detection entries
+type seenRow struct {
+	Hash      []byte `db:"hash"`
+	FirstSeen int64  `db:"firstseen"`
+}
+
+// LoadSeen : returns the router's loop detection entries first seen at or after since, oldest first
+func (node *Node) LoadSeen(since int64) ([]api.SeenEntry, error) {
+	col := node.db.Collection("seen")
+	res := col.Find("firstseen >= ?", since).OrderBy("firstseen")
+	var rows []seenRow
+	if err := res.All(&rows); err != nil {
+		return nil, err
+	}
+	entries := make([]api.SeenEntry, 0, len(rows))
+	for _, row := range rows {
+		entry := api.SeenEntry{Time: row.FirstSeen}
+		copy(entry.Hash[:], row.Hash)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SaveSeen : stores the router's loop detection entries
+func (node *Node) SaveSeen(entries ...api.SeenEntry) error {
+	col := node.db.Collection("seen")
+	for _, entry := range entries {
+		if _, err := col.Insert(seenRow{Hash: entry.Hash[:], FirstSeen: entry.Time}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForgetSeen : deletes the router's loop detection entries first seen before the given time
+func (node *Node) ForgetSeen(before int64) error {
+	col := node.db.Collection("seen")
+	return col.Find("firstseen < ?", before).Delete()
+}
+
 // FlushOutbox : Deletes outbound messages older than maxAgeSeconds seconds
 func (node *Node) FlushOutbox(maxAgeSeconds int64) {
-	ts := time.Now().UnixNano()
-	ts = ts - (maxAgeSeconds * 1000000000)
-	col := node.db.Collection("outbox")
-	res := col.Find("timestamp < ?", ts)
-	_ = res.Delete()
+	if err := node.outbox.Flush(maxAgeSeconds); err != nil {
+		events.Error(node, "FlushOutbox failed: "+err.Error())
+		return
+	}
+	node.tracker.Expire(maxAgeSeconds)
 }
 
 type connectionURL struct {
@@ -543,6 +551,14 @@ func (node *Node) BootstrapDB(dbAdapter, dbConnectionString string) db.Session {
 	if err != nil {
 		events.Critical(node, err.Error())
 	}
+	if node.outbox == nil {
+		inner, err := dboutbox.New(node.db, dbAdapter)
+		if err != nil {
+			events.Critical(node, err.Error())
+		} else {
+			node.SetOutbox(inner)
+		}
+	}
 
 	strName := getBackendType(dbAdapter, "string")
 	blobName := getBackendType(dbAdapter, "blob")
@@ -566,10 +582,15 @@ func (node *Node) BootstrapDB(dbAdapter, dbConnectionString string) db.Session {
 	_, err = node.db.SQL().Exec(fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS channels ( 			
 			name	%s	NOT NULL,
-			privkey	%s	NOT NULL
+			privkey	%s	NOT NULL,
+			version	%s	NOT NULL,
+			expires	%s	NOT NULL
 		);
-	`, strName, strName))
+	`, strName, strName, int64Name, int64Name))
 	checkErr(err)
+	// tables from before key rotation hold one key per channel, the first version of it
+	checkErr(node.addColumn("channels", "version", int64Name, int64(1)))
+	checkErr(node.addColumn("channels", "expires", int64Name, int64(0)))
 
 	_, err = node.db.SQL().Exec(fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS config ( 
@@ -579,20 +600,6 @@ func (node *Node) BootstrapDB(dbAdapter, dbConnectionString string) db.Session {
 	`, strName, strName))
 	checkErr(err)
 
-	_, err = node.db.SQL().Exec(fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS outbox (
-			channel		%s, 
-			msg			%s	NOT NULL,
-			timestamp	%s	NOT NULL
-		);
-	`, strName, blobName, int64Name))
-	checkErr(err)
-
-	_, err = node.db.SQL().Exec(`
-			CREATE INDEX IF NOT EXISTS outboxID ON outbox (timestamp);
-	`)
-	checkErr(err)
-
 	_, err = node.db.SQL().Exec(fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS peers (
 			name		%s		NOT NULL,  
@@ -626,9 +633,29 @@ func (node *Node) BootstrapDB(dbAdapter, dbConnectionString string) db.Session {
 	CREATE TABLE IF NOT EXISTS streams (		
 		streamid		%s	NOT NULL,
 		parts			%s	NOT NULL,
-		channel			%s	NOT NULL
+		channel			%s	NOT NULL,
+		replykey		%s	NOT NULL,
+		msglen			%s	NOT NULL,
+		digest			%s,
+		firstseen		%s	NOT NULL,
+		buffered		%s	NOT NULL,
+		signed			bool	NOT NULL
 	);
-	`, int64Name, int64Name, strName))
+	`, int64Name, int64Name, strName, strName, int64Name, blobName, int64Name, int64Name))
+	checkErr(err)
+	checkErr(node.addColumn("streams", "replykey", strName, ""))
+	checkErr(node.addColumn("streams", "msglen", int64Name, int64(0)))
+	checkErr(node.addColumn("streams", "digest", blobName, nil))
+	checkErr(node.addColumn("streams", "firstseen", int64Name, time.Now().UnixNano())) // expire them from now on
+	checkErr(node.addColumn("streams", "buffered", int64Name, int64(0)))
+	checkErr(node.addColumn("streams", "signed", "bool", false))
+
+	_, err = node.db.SQL().Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS seen (
+		hash		%s	NOT NULL,
+		firstseen	%s	NOT NULL
+	);
+	`, blobName, int64Name))
 	checkErr(err)
 
 	// Content Key Setup
@@ -674,6 +701,34 @@ func (node *Node) BootstrapDB(dbAdapter, dbConnectionString string) db.Session {
 	return node.db
 }
 
+// addColumn - adds a column to a table made by an older version, without constraints, since that table
+// may have rows already.  Those rows are set to value, if it is not nil
+func (node *Node) addColumn(table, column, colType string, value interface{}) error {
+	rows, err := node.db.SQL().Query("SELECT * FROM " + table + " LIMIT 1")
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, col := range columns {
+		if col == column {
+			return nil // already there
+		}
+	}
+	events.Info(node, "Adding column "+column+" to table "+table)
+	if _, err := node.db.SQL().Exec("ALTER TABLE " + table + " ADD " + column + " " + colType); err != nil {
+		return err
+	}
+	if value == nil {
+		return nil
+	}
+	_, err = node.db.SQL().Exec("UPDATE "+table+" SET "+column+" = ?", value)
+	return err
+}
+
 func getBackendType(dbAdapter, dbType string) string {
 	switch dbAdapter {
 	case "postgresql":
@@ -734,3 +789,15 @@ func getBackendType(dbAdapter, dbType string) string {
 
 	panic(fmt.Sprintf("invalid data type %s", dbType))
 }
+
+// streamStore - where the stream reassembly pass finds this node's incoming streams
+func (node *Node) streamStore() nodes.StreamStore {
+	return nodes.StreamStore{
+		Streams:     node.dbGetStreams,
+		ChunkCount:  node.dbGetChunkCount,
+		Chunks:      node.dbGetChunks,
+		ReadChunk:   node.dbGetChunk,
+		RemoveChunk: node.dbRemoveChunk,
+		ClearStream: node.dbClearStream,
+	}
+}
@@ -7,12 +7,14 @@ package db
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/bencrypt/ecc"
-	"github.com/awgh/debouncer"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
 	"github.com/awgh/ratnet/nodes"
+	"github.com/awgh/ratnet/outbox"
 	"github.com/awgh/ratnet/router"
 	"github.com/upper/db/v4"
 )
@@ -22,20 +24,32 @@ var OutBufferSize = 128
 
 // Node : defines an instance of the API with a ql-DB backed Node
 type Node struct {
+	outboxTTL         int64 // accessed atomically, kept first for 64-bit alignment
+	channelKeyOverlap int64 // accessed atomically, kept first for 64-bit alignment
+	outboxExpiry      int64 // accessed atomically, kept first for 64-bit alignment
+
 	contentKey  bc.KeyPair
 	routingKey  bc.KeyPair
-	channelKeys map[string]bc.KeyPair
+	channelKeys map[string][]api.ChannelPriv // newest key first
 
 	policies []api.Policy
 	router   api.Router
+	outbox   api.Outbox
+	quota    *outbox.Quota // wraps outbox, so every message is within the quotas
 
 	db db.Session
 
 	mutex         *sync.Mutex
 	trigggerMutex sync.Mutex
-	debouncer     *debouncer.Debouncer
+	debouncer     *nodes.Debouncer
+	retainer      *chunking.Retainer
+	fragmenter    *chunking.Fragmenter
+	tracker       *nodes.Tracker
+	nackTimer     *chunking.NackTimer
+	readers       *chunking.Readers
 
 	isRunning uint32
+	stop      chan struct{} // closed by Stop, ends the goroutines of the last Start
 
 	// external data members
 	in     chan api.Msg
@@ -50,7 +64,7 @@ func New(contentKey, routingKey bc.KeyPair) *Node {
 	node.mutex = &sync.Mutex{}
 
 	// init channel key map
-	node.channelKeys = make(map[string]bc.KeyPair)
+	node.channelKeys = make(map[string][]api.ChannelPriv)
 
 	// set crypto modes
 	if contentKey == nil {
@@ -68,6 +82,17 @@ func New(contentKey, routingKey bc.KeyPair) *Node {
 	node.contentKey = contentKey
 	node.routingKey = routingKey
 
+	// init chunk retransmission and stream reading state
+	node.retainer = chunking.NewRetainer()
+	node.fragmenter = chunking.NewFragmenter()
+	node.tracker = nodes.NewTracker()
+	node.nackTimer = chunking.NewNackTimer()
+	node.readers = chunking.NewReaders(func() {
+		node.trigggerMutex.Lock()
+		node.debouncer.Trigger()
+		node.trigggerMutex.Unlock()
+	})
+
 	// setup chans
 	node.in = make(chan api.Msg)
 	node.out = make(chan api.Msg, OutBufferSize)
@@ -75,6 +100,7 @@ func New(contentKey, routingKey bc.KeyPair) *Node {
 
 	// setup default router
 	node.router = router.NewDefaultRouter()
+	node.quota = outbox.NewQuota(node, nil)
 
 	return node
 }
@@ -112,6 +138,77 @@ func (node *Node) SetRouter(router api.Router) {
 	node.router = router
 }
 
+// Outbox : get the Outbox object for this Node
+func (node *Node) Outbox() api.Outbox {
+	return node.outbox
+}
+
+// SetOutbox : set the Outbox object for this Node, replacing the default one.
+// It is wrapped in the node's quotas, which are kept.
+func (node *Node) SetOutbox(outbox api.Outbox) {
+	node.quota.SetOutbox(outbox)
+	node.outbox = node.quota
+}
+
+// Quota : the limits on the whole outbox, the zero OutboxQuota if there are none
+func (node *Node) Quota() api.OutboxQuota {
+	return node.quota.Quota()
+}
+
+// SetQuota : sets the limits on the whole outbox, the zero OutboxQuota removes them
+func (node *Node) SetQuota(quota api.OutboxQuota) {
+	node.quota.SetQuota(quota)
+}
+
+// ChannelQuotas : the limits on the messages of each channel, "" is for the messages not on a channel
+func (node *Node) ChannelQuotas() map[string]api.OutboxQuota {
+	return node.quota.ChannelQuotas()
+}
+
+// SetChannelQuota : sets the limits on the messages of one channel, the zero OutboxQuota removes them
+func (node *Node) SetChannelQuota(channel string, quota api.OutboxQuota) {
+	node.quota.SetChannelQuota(channel, quota)
+}
+
+// OutboxTTL : seconds outbound messages are kept before the running node flushes them, negative if never
+func (node *Node) OutboxTTL() int64 {
+	if ttl := atomic.LoadInt64(&node.outboxTTL); ttl != 0 {
+		return ttl
+	}
+	return nodes.DefaultOutboxTTL
+}
+
+// SetOutboxTTL : sets the OutboxTTL, zero restores the default
+func (node *Node) SetOutboxTTL(seconds int64) {
+	atomic.StoreInt64(&node.outboxTTL, seconds)
+}
+
+// OutboxExpiryInterval : how often the running node flushes outbound messages older than its OutboxTTL
+func (node *Node) OutboxExpiryInterval() time.Duration {
+	if interval := atomic.LoadInt64(&node.outboxExpiry); interval != 0 {
+		return time.Duration(interval)
+	}
+	return nodes.DefaultOutboxExpiryInterval
+}
+
+// SetOutboxExpiryInterval : sets the OutboxExpiryInterval, zero restores the default.  It takes effect at the next Start.
+func (node *Node) SetOutboxExpiryInterval(interval time.Duration) {
+	atomic.StoreInt64(&node.outboxExpiry, int64(interval))
+}
+
+// ChannelKeyOverlap : seconds the older keys of a channel keep working after AddChannel gives it a new one, negative if forever
+func (node *Node) ChannelKeyOverlap() int64 {
+	if overlap := atomic.LoadInt64(&node.channelKeyOverlap); overlap != 0 {
+		return overlap
+	}
+	return nodes.DefaultChannelKeyOverlap
+}
+
+// SetChannelKeyOverlap : sets the ChannelKeyOverlap, zero restores the default
+func (node *Node) SetChannelKeyOverlap(seconds int64) {
+	atomic.StoreInt64(&node.channelKeyOverlap, seconds)
+}
+
 // Channels
 
 // In : Returns the In channel of this node
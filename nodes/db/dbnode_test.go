@@ -2,23 +2,43 @@ package db
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/awgh/bencrypt/ecc"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/router"
 
 	_ "github.com/upper/db/v4/adapter/ql"
 )
 
 var node *Node
 
+// dbtmp - directory of the database shared by the tests, removed by TestMain
+var dbtmp string
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if node != nil {
+		node.Stop()
+	}
+	os.RemoveAll(dbtmp)
+	os.Exit(code)
+}
+
 func Test_init(t *testing.T) {
 	node = New(new(ecc.KeyPair), new(ecc.KeyPair))
-	os.RemoveAll("dbtmp")
-	os.Mkdir("dbtmp", os.FileMode(int(0755)))
-	node.BootstrapDB("ql", "file://dbtmp/ratnet_test.ql")
+	var err error
+	if dbtmp, err = ioutil.TempDir("", "dbtmp"); err != nil {
+		t.Fatal(err)
+	}
+	node.BootstrapDB("ql", "file://"+filepath.Join(dbtmp, "ratnet_test.ql"))
 	node.FlushOutbox(0)
 	if err := node.routingKey.FromB64(pubprivkeyb64Ecc); err != nil {
 		log.Fatal(err)
@@ -80,10 +100,155 @@ func Test_apicall_Channels_1(t *testing.T) {
 	t.Log(message)
 }
 
+func Test_streams_Verify_1(t *testing.T) {
+	digest := sha256.Sum256([]byte("hello, world"))
+	header := api.StreamHeader{NumChunks: 2, Length: 12, Digest: digest[:]}
+
+	// good stream is delivered
+	header.StreamID = 0x1001
+	if err := node.AddStream(header); err != nil {
+		t.Fatal(err)
+	}
+	node.AddChunk(0x1001, 0, []byte("hello, "))
+	node.AddChunk(0x1001, 1, []byte("world"))
+	select {
+	case msg := <-node.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Errorf("Wrong message delivered: %s", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Verified stream not delivered")
+	}
+
+	// tampered stream is dropped and reported
+	header.StreamID = 0x1002
+	if err := node.AddStream(header); err != nil {
+		t.Fatal(err)
+	}
+	node.AddChunk(0x1002, 0, []byte("hello, "))
+	node.AddChunk(0x1002, 1, []byte("WORLD"))
+	timeout := time.After(2 * time.Second)
+	for corrupted := false; !corrupted; {
+		select {
+		case msg := <-node.Out():
+			t.Fatalf("Corrupted stream delivered: %s", msg.Content.String())
+		case ev := <-node.Events():
+			corrupted = ev.Type == api.StreamCorrupted
+		case <-timeout:
+			t.Fatal("Corrupted stream not reported")
+		}
+	}
+}
+
 func Test_stop(t *testing.T) {
 	node.Stop()
 }
 
+func Test_streams_Resume_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_resume.ql")
+	newNode := func() *Node {
+		n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+		n.BootstrapDB("ql", "file://"+dbFile)
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	n1 := newNode()
+	if err := n1.AddStream(api.StreamHeader{StreamID: 0x1234, NumChunks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n1.AddChunk(0x1234, 0, []byte("hello, ")); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+	if err := n1.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a fresh node on the same database picks up where the first one left off
+	n2 := newNode()
+	defer n2.Stop()
+	if err := n2.AddChunk(0x1234, 1, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-n2.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Fatalf("reassembled wrong content: %q", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream was not reassembled after restart")
+	}
+}
+
+// legacyDB - makes a database with tables as an older version made them
+func legacyDB(t *testing.T, dbFile string, statements ...string) {
+	c, err := sql.Open("ql", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, q := range statements {
+		tx, err := c.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_schema_Upgrade_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_upgrade.ql")
+	chnKey := new(ecc.KeyPair)
+	chnKey.GenerateKey()
+	legacyDB(t, dbFile,
+		"CREATE TABLE streams (streamid int64 NOT NULL, parts int64 NOT NULL, channel string NOT NULL);",
+		"CREATE TABLE chunks (streamid int64 NOT NULL, chunknum int64 NOT NULL, data blob NOT NULL);",
+		"CREATE TABLE channels (name string NOT NULL, privkey string NOT NULL);",
+		"INSERT INTO streams VALUES(4660, 2, \"\");",
+		"INSERT INTO chunks VALUES(4660, 0, blob(\"hello, \"));",
+		"INSERT INTO channels VALUES(\"news\", \""+chnKey.ToB64()+"\");",
+	)
+
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	n.BootstrapDB("ql", "file://"+dbFile)
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if err := n.AddChunk(0x1234, 1, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-n.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Fatalf("reassembled wrong content: %q", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream from the old database was not reassembled")
+	}
+
+	// the channel key from the old database is the first version, and rotates from there
+	chn, err := n.GetChannel("news")
+	if err != nil || chn == nil || chn.Pubkey != chnKey.GetPubKey().ToB64() {
+		t.Fatalf("channel from the old database not found: %+v %v", chn, err)
+	}
+	newKey := new(ecc.KeyPair)
+	newKey.GenerateKey()
+	if err := n.AddChannel("news", newKey.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	if chn, err := n.GetChannel("news"); err != nil || chn.Pubkey != newKey.GetPubKey().ToB64() {
+		t.Errorf("channel key did not rotate: %+v %v", chn, err)
+	}
+}
+
 // Test Messages
 var testMessage1 = `'In THAT direction,' the Cat said, waving its right paw round, 'lives a Hatter: and in THAT direction,' waving the other paw, 'lives a March Hare. Visit either you like: they're both mad.'
 'But I don't want to go among mad people,' Alice remarked.
@@ -111,6 +276,56 @@ var pubkeyb64 = "LS0tLS1CRUdJTiBQVUJMSUMgS0VZLS0tLS0KTUlJQ0lqQU5CZ2txaGtpRzl3MEJ
 	"RUFBUT09Ci0tLS0tRU5EIFBVQkxJQyBLRVktLS0tLQo="
 
 // ECC TEST KEYS
+func Test_seen_Persist_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_seen.ql")
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	newRelay := func() (*Node, *router.DefaultRouter) {
+		n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+		n.BootstrapDB("ql", "file://"+dbFile)
+		r := router.NewDefaultRouter()
+		r.PersistSeen = true
+		n.SetRouter(r)
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return n, r
+	}
+
+	n1, r1 := newRelay()
+	if _, err := n1.SendMsg(api.Msg{Name: "seen", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString(testMessage1)}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _, err := n1.Outbox().MsgsSince(0, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	if err := r1.Route(n1, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+	if err := n1.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh relay on the same database still remembers the message
+	n2, r2 := newRelay()
+	defer n2.Stop()
+	if err := r2.Route(n2, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r2.SeenStats(); stats.Seen != 1 {
+		t.Errorf("Expected the message to be filtered out after a restart, got %+v", stats)
+	}
+
+	if err := n2.ForgetSeen(time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := n2.LoadSeen(0); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries left, got %d %v", len(entries), err)
+	}
+}
+
 var (
 	pubprivkeyb64Ecc = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq1+dln3M3IaOmg+YfTIbBpk+jIbZZZiT+4CoeFzaJGEWmg=="
 	pubkeyb64Ecc     = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq18="
@@ -35,7 +35,7 @@ func (node *Node) Dropoff(bundle api.Bundle) error {
 		if len((*msgs)[i]) < 16 { // aes.BlockSize == 16
 			continue // todo: remove padding before here?
 		}
-		err = node.router.Route(node, (*msgs)[i])
+		err = node.router.Route(node, (*msgs)[i], bundle.Ingress)
 		if err != nil {
 			events.Warning(node, "error in dropoff: "+err.Error())
 			continue // we don't want to return routing errors back out the remote public interface
@@ -49,15 +49,32 @@ func (node *Node) Dropoff(bundle api.Bundle) error {
 func (node *Node) Pickup(rpub bc.PubKey, lastTime int64, maxBytes int64, channelNames ...string) (api.Bundle, error) {
 	events.Debug(node, "Pickup called")
 	var retval api.Bundle
+	consumer := rpub.ToB64()
 
-	msgs, lastTimeReturned, err := node.dbGetMessages(lastTime, maxBytes, channelNames...)
-	if err != nil {
-		return retval, err
+	// finish handing over anything that had to be fragmented for this consumer first
+	msgs, lastFragment := node.fragmenter.Pending(consumer, lastTime, maxBytes)
+	retval.Time = lastFragment
+	if len(msgs) == 0 {
+		var err error
+		// split horizon, don't hand the consumer back what it gave us
+		msgs, retval.Time, err = node.outbox.MsgsSinceExcept(consumer, lastTime, maxBytes, channelNames...)
+		if err != nil {
+			return retval, err
+		}
+		if filter, ok := node.router.(api.PickupFilter); ok {
+			msgs = filter.FilterPickup(node, consumer, msgs)
+		}
+		node.tracker.PickedUp(consumer, msgs)
+		if maxBytes > 0 && len(msgs) == 1 && int64(len(msgs[0])) > maxBytes {
+			if err := node.fragmenter.Split(consumer, msgs[0], maxBytes, lastTime, retval.Time); err != nil {
+				return retval, err
+			}
+			msgs, retval.Time = node.fragmenter.Pending(consumer, lastTime, maxBytes)
+		}
 	}
 
 	// Return things
 
-	retval.Time = lastTimeReturned
 	if len(msgs) > 0 {
 		buf := api.BytesBytesToBytes(&msgs)
 		cipher, err := node.routingKey.EncryptMessage(*buf, rpub)
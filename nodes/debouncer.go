@@ -0,0 +1,31 @@
+package nodes
+
+import (
+	"sync"
+	"time"
+)
+
+// Debouncer : calls a callback once, a while after the last of several Triggers.
+// Unlike github.com/awgh/debouncer, Trigger may be called from any goroutine at any time,
+// including while the callback is being run.
+type Debouncer struct {
+	mutex    sync.Mutex
+	duration time.Duration
+	callback func()
+	timer    *time.Timer
+}
+
+// NewDebouncer : returns a Debouncer that calls callback duration after the last Trigger
+func NewDebouncer(duration time.Duration, callback func()) *Debouncer {
+	return &Debouncer{duration: duration, callback: callback}
+}
+
+// Trigger : (re)starts the wait before the callback is called
+func (d *Debouncer) Trigger() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.timer != nil {
+		d.timer.Stop() // if it already fired, the callback runs and this Trigger schedules another
+	}
+	d.timer = time.AfterFunc(d.duration, d.callback)
+}
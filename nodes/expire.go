@@ -0,0 +1,31 @@
+package nodes
+
+import (
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// DefaultOutboxTTL - seconds outbound messages are kept by a node that has not been given an OutboxTTL
+var DefaultOutboxTTL int64 = 300
+
+// DefaultOutboxExpiryInterval - how often a running node deletes outbound messages older than its OutboxTTL,
+// unless it has been given an OutboxExpiryInterval
+var DefaultOutboxExpiryInterval = time.Minute
+
+// ExpireOutbox : flushes messages older than the node's OutboxTTL from its outbox
+// every interval, until stop is closed.  Nodes run this from Start, with the channel their Stop closes.
+func ExpireOutbox(node api.Node, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if ttl := node.OutboxTTL(); ttl > 0 {
+			node.FlushOutbox(ttl)
+		}
+	}
+}
@@ -3,36 +3,38 @@ package fs
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/awgh/bencrypt/bc"
-	"github.com/awgh/debouncer"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
 	"github.com/awgh/ratnet/api/events"
 	"github.com/awgh/ratnet/nodes"
+	"github.com/awgh/ratnet/outbox"
+	fsoutbox "github.com/awgh/ratnet/outbox/fs"
 	"github.com/awgh/ratnet/router"
 )
 
 // OutBufferSize - size of the buffer in messages for the Out() channel
 var OutBufferSize = 128
 
-type outboxMsg struct {
-	channel   string
-	msg       []byte
-	timeStamp int64
-}
-
 // Node : defines an instance of the API with a ql-DB backed Node
 type Node struct {
+	outboxTTL         int64 // accessed atomically, kept first for 64-bit alignment
+	channelKeyOverlap int64 // accessed atomically, kept first for 64-bit alignment
+	outboxExpiry      int64 // accessed atomically, kept first for 64-bit alignment
+
 	contentKey bc.KeyPair
 	routingKey bc.KeyPair
 
 	policies  []api.Policy
 	router    api.Router
+	outbox    api.Outbox
+	quota     *outbox.Quota // wraps outbox, so every message is within the quotas
 	isRunning uint32
+	stop      chan struct{} // closed by Stop, ends the goroutines of the last Start
 
 	// external data members
 	in     chan api.Msg
@@ -40,7 +42,7 @@ type Node struct {
 	events chan api.Event
 
 	// db -> ram replacements
-	channels map[string]*api.ChannelPriv
+	channels map[string][]api.ChannelPriv // newest key first
 	config   map[string]string
 	contacts map[string]*api.Contact
 	peers    map[string]*api.Peer
@@ -52,7 +54,13 @@ type Node struct {
 
 	mutex         sync.RWMutex
 	trigggerMutex sync.Mutex
-	debouncer     *debouncer.Debouncer
+	seenMutex     sync.Mutex
+	debouncer     *nodes.Debouncer
+	retainer      *chunking.Retainer
+	fragmenter    *chunking.Fragmenter
+	tracker       *nodes.Tracker
+	nackTimer     *chunking.NackTimer
+	readers       *chunking.Readers
 }
 
 // New : creates a new instance of API
@@ -61,7 +69,7 @@ func New(contentKey, routingKey bc.KeyPair, basePath string) *Node {
 	node := new(Node)
 
 	// init assorted other
-	node.channels = make(map[string]*api.ChannelPriv)
+	node.channels = make(map[string][]api.ChannelPriv)
 	node.config = make(map[string]string)
 	node.contacts = make(map[string]*api.Contact)
 	node.peers = make(map[string]*api.Peer)
@@ -73,6 +81,17 @@ func New(contentKey, routingKey bc.KeyPair, basePath string) *Node {
 	node.contentKey = contentKey
 	node.routingKey = routingKey
 
+	// init chunk retransmission and stream reading state
+	node.retainer = chunking.NewRetainer()
+	node.fragmenter = chunking.NewFragmenter()
+	node.tracker = nodes.NewTracker()
+	node.nackTimer = chunking.NewNackTimer()
+	node.readers = chunking.NewReaders(func() {
+		node.trigggerMutex.Lock()
+		node.debouncer.Trigger()
+		node.trigggerMutex.Unlock()
+	})
+
 	// setup chans
 	node.in = make(chan api.Msg)
 	node.out = make(chan api.Msg, OutBufferSize)
@@ -80,9 +99,11 @@ func New(contentKey, routingKey bc.KeyPair, basePath string) *Node {
 
 	// setup default router
 	node.router = router.NewDefaultRouter()
+	node.quota = outbox.NewQuota(node, nil)
 
 	node.basePath = basePath
 	os.Mkdir(basePath, 0700)
+	node.SetOutbox(fsoutbox.New(basePath))
 
 	return node
 }
@@ -91,10 +112,6 @@ func hex32(n uint32) string {
 	return fmt.Sprintf("%08x", n)
 }
 
-func hex64(n int64) string {
-	return fmt.Sprintf("%016x", n)
-}
-
 // IsRunning - returns true if this node is running
 func (node *Node) IsRunning() bool {
 	return atomic.LoadUint32(&node.isRunning) == 1
@@ -132,24 +149,84 @@ func (node *Node) SetRouter(router api.Router) {
 	node.router = router
 }
 
+// Outbox : get the Outbox object for this Node
+func (node *Node) Outbox() api.Outbox {
+	return node.outbox
+}
+
+// SetOutbox : set the Outbox object for this Node, replacing the default one.
+// It is wrapped in the node's quotas, which are kept.
+func (node *Node) SetOutbox(outbox api.Outbox) {
+	node.quota.SetOutbox(outbox)
+	node.outbox = node.quota
+}
+
+// Quota : the limits on the whole outbox, the zero OutboxQuota if there are none
+func (node *Node) Quota() api.OutboxQuota {
+	return node.quota.Quota()
+}
+
+// SetQuota : sets the limits on the whole outbox, the zero OutboxQuota removes them
+func (node *Node) SetQuota(quota api.OutboxQuota) {
+	node.quota.SetQuota(quota)
+}
+
+// ChannelQuotas : the limits on the messages of each channel, "" is for the messages not on a channel
+func (node *Node) ChannelQuotas() map[string]api.OutboxQuota {
+	return node.quota.ChannelQuotas()
+}
+
+// SetChannelQuota : sets the limits on the messages of one channel, the zero OutboxQuota removes them
+func (node *Node) SetChannelQuota(channel string, quota api.OutboxQuota) {
+	node.quota.SetChannelQuota(channel, quota)
+}
+
+// OutboxTTL : seconds outbound messages are kept before the running node flushes them, negative if never
+func (node *Node) OutboxTTL() int64 {
+	if ttl := atomic.LoadInt64(&node.outboxTTL); ttl != 0 {
+		return ttl
+	}
+	return nodes.DefaultOutboxTTL
+}
+
+// SetOutboxTTL : sets the OutboxTTL, zero restores the default
+func (node *Node) SetOutboxTTL(seconds int64) {
+	atomic.StoreInt64(&node.outboxTTL, seconds)
+}
+
+// OutboxExpiryInterval : how often the running node flushes outbound messages older than its OutboxTTL
+func (node *Node) OutboxExpiryInterval() time.Duration {
+	if interval := atomic.LoadInt64(&node.outboxExpiry); interval != 0 {
+		return time.Duration(interval)
+	}
+	return nodes.DefaultOutboxExpiryInterval
+}
+
+// SetOutboxExpiryInterval : sets the OutboxExpiryInterval, zero restores the default.  It takes effect at the next Start.
+func (node *Node) SetOutboxExpiryInterval(interval time.Duration) {
+	atomic.StoreInt64(&node.outboxExpiry, int64(interval))
+}
+
+// ChannelKeyOverlap : seconds the older keys of a channel keep working after AddChannel gives it a new one, negative if forever
+func (node *Node) ChannelKeyOverlap() int64 {
+	if overlap := atomic.LoadInt64(&node.channelKeyOverlap); overlap != 0 {
+		return overlap
+	}
+	return nodes.DefaultChannelKeyOverlap
+}
+
+// SetChannelKeyOverlap : sets the ChannelKeyOverlap, zero restores the default
+func (node *Node) SetChannelKeyOverlap(seconds int64) {
+	atomic.StoreInt64(&node.channelKeyOverlap, seconds)
+}
+
 // FlushOutbox : Deletes outbound messages older than maxAgeSeconds seconds
 func (node *Node) FlushOutbox(maxAgeSeconds int64) {
-	now := time.Now()
-	_ = filepath.Walk(node.basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			events.Warning(node, "FlushOutbox failure accessing a path:", path, err.Error())
-			return err
-		}
-		if !info.IsDir() {
-			if diff := now.Sub(info.ModTime()); diff > time.Duration(maxAgeSeconds)*time.Second {
-				events.Debug(node, "Deleting file:", filepath.Join(node.basePath, info.Name()), diff)
-				if err = os.Remove(path); err != nil {
-					events.Error(node, "error deleting file: "+err.Error())
-				}
-			}
-		}
-		return nil
-	})
+	if err := node.outbox.Flush(maxAgeSeconds); err != nil {
+		events.Error(node, "FlushOutbox failed: "+err.Error())
+		return
+	}
+	node.tracker.Expire(maxAgeSeconds)
 }
 
 // Channels
@@ -5,9 +5,11 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/awgh/bencrypt/ecc"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/router"
 )
 
 var node *Node
@@ -73,6 +75,87 @@ func Test_stop(t *testing.T) {
 	node.Stop()
 }
 
+func Test_streams_Resume_1(t *testing.T) {
+	os.RemoveAll("tmp_resume")
+	defer os.RemoveAll("tmp_resume")
+
+	n1 := New(new(ecc.KeyPair), new(ecc.KeyPair), "tmp_resume")
+	if err := n1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n1.AddStream(api.StreamHeader{StreamID: 0x1234, NumChunks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n1.AddChunk(0x1234, 0, []byte("hello, ")); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+
+	// a fresh node on the same basePath picks up where the first one left off
+	n2 := New(new(ecc.KeyPair), new(ecc.KeyPair), "tmp_resume")
+	if err := n2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer n2.Stop()
+	if err := n2.AddChunk(0x1234, 1, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-n2.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Fatalf("reassembled wrong content: %q", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream was not reassembled after restart")
+	}
+}
+
+func Test_seen_Persist_1(t *testing.T) {
+	dir := t.TempDir()
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	newRelay := func() (*Node, *router.DefaultRouter) {
+		n := New(new(ecc.KeyPair), new(ecc.KeyPair), dir)
+		r := router.NewDefaultRouter()
+		r.PersistSeen = true
+		n.SetRouter(r)
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return n, r
+	}
+
+	n1, r1 := newRelay()
+	if _, err := n1.SendMsg(api.Msg{Name: "seen", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString(testMessage1)}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _, err := n1.Outbox().MsgsSince(0, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	if err := r1.Route(n1, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+
+	// a fresh relay on the same basePath still remembers the message
+	n2, r2 := newRelay()
+	defer n2.Stop()
+	if err := r2.Route(n2, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r2.SeenStats(); stats.Seen != 1 {
+		t.Errorf("Expected the message to be filtered out after a restart, got %+v", stats)
+	}
+
+	if err := n2.ForgetSeen(time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := n2.LoadSeen(0); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries left, got %d %v", len(entries), err)
+	}
+}
+
 // Test Messages
 
 var testMessage1 = `'In THAT direction,' the Cat said, waving its right paw round, 'lives a Hatter: and in THAT direction,' waving the other paw, 'lives a March Hare. Visit either you like: they're both mad.'
@@ -1,76 +1,49 @@
 package fs
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
 	"time"
 
+	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/chunking"
 	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/api/multicast"
+	"github.com/awgh/ratnet/api/receipt"
+	"github.com/awgh/ratnet/nodes"
 )
 
-// GetChannelPrivKey : Return the private key of a given channel
+// GetChannelPrivKey : Return the newest private key of a given channel
 func (node *Node) GetChannelPrivKey(name string) (string, error) {
 	c, ok := node.channels[name]
 	if !ok {
 		return "", errors.New("Channel not found")
 	}
-	return c.Privkey.ToB64(), nil
+	return c[0].Privkey.ToB64(), nil
+}
+
+// setChannelKeys - replaces the keys of a channel, newest first
+func (node *Node) setChannelKeys(name string, keys []api.ChannelPriv) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.channels[name] = keys
+	return nil
 }
 
 // Forward - Add an already-encrypted message to the outbound message queue (forward it along)
 func (node *Node) Forward(msg api.Msg) error {
-	flags := uint8(0)
-	if msg.IsChan {
-		flags |= api.ChannelFlag
-	}
-	if msg.Chunked {
-		flags |= api.ChunkedFlag
-	}
-	if msg.StreamHeader {
-		flags |= api.StreamHeaderFlag
-	}
-	rxsum := []byte{flags} // prepend flags byte
-	m := new(outboxMsg)
-	path := node.basePath
-	if msg.IsChan {
-		// prepend a uint16 of channel name length, little-endian
-		t := uint16(len(msg.Name))
-		rxsum = append(rxsum, byte(t>>8), byte(t&0xFF))
-		rxsum = append(rxsum, []byte(msg.Name)...)
-		m.channel = msg.Name
-		// create channel dir if not exist
-		path = filepath.Join(path, msg.Name)
-		os.Mkdir(path, os.FileMode(int(0700)))
-	}
-	message := append(rxsum, msg.Content.Bytes()...)
-	/*
-		for _, mail := range node.outbox {
-			if mail.channel == channelName && bytes.Equal(mail.msg, message) {
-				return nil // already have a copy... //todo: do we really need this check?
-			}
-		}
-	*/
-	now := time.Now().UnixNano()
-	f, err := os.Create(filepath.Join(path, hex64(now)))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	w.Write(message)
-	w.Flush()
-
-	return nil
+	m := nodes.NewOutboxMsg(msg, msg.Content.Bytes())
+	m.Forwarded = true
+	m.Ingress = msg.Ingress.Peer
+	return node.outbox.Enqueue(m)
 }
 
 // Handle - Decrypt and handle an encrypted message
-// 			returns TagOK, which is true if the message is intended for a key we have
+//
+//	returns TagOK, which is true if the message is intended for a key we have
 func (node *Node) Handle(msg api.Msg) (bool, error) {
 	var clear []byte
 	var err error
@@ -78,15 +51,30 @@ func (node *Node) Handle(msg api.Msg) (bool, error) {
 	var clearMsg api.Msg // msg to out channel
 
 	if msg.IsChan {
-		v, ok := node.channels[msg.Name]
-		if !ok || v.Privkey == nil {
+		keys, ok := node.channels[msg.Name]
+		if !ok {
 			return tagOK, errors.New("Cannot Handle message for Unknown Channel")
 		}
-		clearMsg = api.Msg{Name: msg.Name, IsChan: true, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader}
-		tagOK, clear, err = v.Privkey.DecryptMessage(msg.Content.Bytes())
+		clearMsg = api.Msg{Name: msg.Name, IsChan: true, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader, Ingress: msg.Ingress}
+		for _, v := range nodes.ActiveChannelKeys(keys) { // newest first, older keys while they overlap
+			if tagOK, clear, err = v.Privkey.DecryptMessage(msg.Content.Bytes()); tagOK {
+				break
+			}
+		}
 	} else {
-		clearMsg = api.Msg{Name: "[content]", IsChan: false, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader}
-		tagOK, clear, err = node.contentKey.DecryptMessage(msg.Content.Bytes())
+		clearMsg = api.Msg{Name: "[content]", IsChan: false, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader, Ingress: msg.Ingress}
+		if msg.Multicast {
+			var sender bc.PubKey
+			tagOK, clear, sender, err = multicast.Open(node.contentKey, msg.Content.Bytes())
+			if sender != nil { // signed, and the signature checked out
+				clearMsg.PubKey, clearMsg.Signed = sender, true
+				if name := multicast.ContactName(node, sender); name != "" {
+					clearMsg.Name = name
+				}
+			}
+		} else {
+			tagOK, clear, err = node.contentKey.DecryptMessage(msg.Content.Bytes())
+		}
 	}
 	// DecryptMessage will return !tagOK if the quick-check fails, which is common
 	if !tagOK || err != nil {
@@ -95,6 +83,17 @@ func (node *Node) Handle(msg api.Msg) (bool, error) {
 
 	clearMsg.Content = bytes.NewBuffer(clear)
 
+	if msg.Nack {
+		return true, chunking.HandleNack(node, clearMsg)
+	}
+
+	if msg.Receipt {
+		var deliver bool
+		if clearMsg, deliver, err = receipt.Handle(node, clearMsg); !deliver || err != nil {
+			return true, err
+		}
+	}
+
 	if msg.Chunked {
 		err = chunking.HandleChunked(node, clearMsg)
 		if err != nil {
@@ -116,14 +115,20 @@ func (node *Node) Handle(msg api.Msg) (bool, error) {
 }
 
 // AddStream - adds a partial message header to internal storage
-func (node *Node) AddStream(streamID uint32, totalChunks uint32, channelName string) error {
+func (node *Node) AddStream(stream api.StreamHeader) error {
 	node.trigggerMutex.Lock()
 	defer node.trigggerMutex.Unlock()
-	stream := new(api.StreamHeader)
-	stream.StreamID = streamID
-	stream.NumChunks = totalChunks
-	stream.ChannelName = channelName
-	node.streams[streamID] = stream
+	if old, ok := node.streams[stream.StreamID]; ok { // keep the age and size of the placeholder made by AddChunk
+		stream.FirstSeen = old.FirstSeen
+		stream.Buffered = old.Buffered
+	} else {
+		stream.FirstSeen = time.Now().UnixNano()
+		stream.Buffered = 0
+	}
+	if err := node.saveStream(&stream); err != nil {
+		return err
+	}
+	node.streams[stream.StreamID] = &stream
 	node.debouncer.Trigger()
 	return nil
 }
@@ -136,10 +141,59 @@ func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error
 	chunk.StreamID = streamID
 	chunk.ChunkNum = chunkNum
 	chunk.Data = data
+	stream, ok := node.streams[streamID]
+	if !ok { // header hasn't arrived yet, keep a placeholder so the chunk can still expire
+		stream = &api.StreamHeader{StreamID: streamID, FirstSeen: time.Now().UnixNano()}
+		if err := node.saveStream(stream); err != nil {
+			return err
+		}
+		node.streams[streamID] = stream
+	}
+	if err := node.saveChunk(chunk); err != nil {
+		return err
+	}
 	if node.chunks[streamID] == nil {
 		node.chunks[streamID] = make(map[uint32]*api.Chunk)
 	}
+	if old, ok := node.chunks[streamID][chunkNum]; ok {
+		stream.Buffered -= int64(len(old.Data))
+	}
+	stream.Buffered += int64(len(data))
 	node.chunks[streamID][chunkNum] = chunk
 	node.debouncer.Trigger()
 	return nil
 }
+
+// RetainChunk - keeps a copy of an outbound chunk for retransmission
+func (node *Node) RetainChunk(msg api.Msg) error {
+	return node.retainer.Retain(msg)
+}
+
+// ResendChunks - re-queues retained chunks of a stream to the outbox
+func (node *Node) ResendChunks(streamID uint32, chunkNums []uint32) error {
+	return node.retainer.Resend(node, streamID, chunkNums)
+}
+
+// OpenStream - starts a chunked transfer to a contact or channel, chunked as it is written
+func (node *Node) OpenStream(dest string, channel bool) (io.WriteCloser, error) {
+	return chunking.OpenStream(node, dest, channel)
+}
+
+// SendReceipted - send a direct message and ask the recipient for a delivery receipt
+func (node *Node) SendReceipted(msg api.Msg) (api.MsgID, error) {
+	id, err := receipt.Send(node, msg)
+	if err == nil {
+		node.tracker.Receipted(id)
+	}
+	return id, err
+}
+
+// ConfirmDelivery - records that the receipt for a message sent with SendReceipted arrived
+func (node *Node) ConfirmDelivery(id api.MsgID) bool {
+	return node.tracker.Delivered(id)
+}
+
+// SetStreamHandler - hands incoming chunked streams to handler instead of reassembling them to Out()
+func (node *Node) SetStreamHandler(handler api.StreamHandler) {
+	node.readers.SetHandler(handler)
+}
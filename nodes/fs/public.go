@@ -2,11 +2,6 @@ package fs
 
 import (
 	"errors"
-	"io"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"strconv"
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/ratnet/api"
@@ -39,7 +34,7 @@ func (node *Node) Dropoff(bundle api.Bundle) error {
 		if len((*msgs)[i]) < 16 { // aes.BlockSize == 16
 			continue // todo: remove padding before here?
 		}
-		err = node.router.Route(node, (*msgs)[i])
+		err = node.router.Route(node, (*msgs)[i], bundle.Ingress)
 		if err != nil {
 			events.Error(node, "error in dropoff: "+err.Error())
 			continue // we don't want to return routing errors back out the remote public interface
@@ -54,49 +49,28 @@ func (node *Node) Dropoff(bundle api.Bundle) error {
 func (node *Node) Pickup(rpub bc.PubKey, lastTime int64, maxBytes int64, channelNames ...string) (api.Bundle, error) {
 	events.Debug(node, "Pickup called")
 	var retval api.Bundle
-	var msgs [][]byte
-	retval.Time = lastTime
-	var bytesRead int64
+	consumer := rpub.ToB64()
 
-	err := filepath.Walk(node.basePath, func(path string, info os.FileInfo, err error) error {
+	// finish handing over anything that had to be fragmented for this consumer first
+	msgs, lastFragment := node.fragmenter.Pending(consumer, lastTime, maxBytes)
+	retval.Time = lastFragment
+	if len(msgs) == 0 {
+		var err error
+		// split horizon, don't hand the consumer back what it gave us
+		msgs, retval.Time, err = node.outbox.MsgsSinceExcept(consumer, lastTime, maxBytes, channelNames...)
 		if err != nil {
-			events.Error(node, "Pickup failure accessing a path:", path, err)
-			return err
+			return retval, err
 		}
-
-		if !info.IsDir() {
-
-			fileName := filepath.Base(path)
-			fileTime, err := strconv.ParseInt(fileName, 16, 64)
-			if err != nil {
-				return err
-			}
-
-			b, err := ioutil.ReadFile(path) // filepath.Join(node.basePath, path))
-			if err != nil {
-				events.Error(node, "prevent panic by handling failure reading a file:", path, err)
-				return err
-			}
-
-			proposedSize := int64(len(b)) + bytesRead
-
-			if maxBytes > 0 && proposedSize > maxBytes { // we're over the set byte limit for this transport
-				if bytesRead == 0 { // first message too big, this is definitely a code problem
-					events.Critical(node, "Result too big to be fetched on this transport! Flush and rechunk")
-				}
-				return io.EOF
-			}
-
-			if fileTime > retval.Time {
-				msgs = append(msgs, b)
-				bytesRead += int64(len(b))
-				retval.Time = fileTime
+		if filter, ok := node.router.(api.PickupFilter); ok {
+			msgs = filter.FilterPickup(node, consumer, msgs)
+		}
+		node.tracker.PickedUp(consumer, msgs)
+		if maxBytes > 0 && len(msgs) == 1 && int64(len(msgs[0])) > maxBytes {
+			if err := node.fragmenter.Split(consumer, msgs[0], maxBytes, lastTime, retval.Time); err != nil {
+				return retval, err
 			}
+			msgs, retval.Time = node.fragmenter.Pending(consumer, lastTime, maxBytes)
 		}
-		return nil
-	})
-	if err != nil && err != io.EOF {
-		return retval, err
 	}
 
 	// transmit
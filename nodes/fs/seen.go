@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// seenFile - file under basePath holding the router's loop detection entries,
+// each a nonce hash then the big-endian UnixNano time it was first seen, oldest first
+const seenFile = ".seen"
+
+const seenRecordSize = 32 + 8
+
+func (node *Node) readSeen() ([]api.SeenEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(node.basePath, seenFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []api.SeenEntry
+	for ; len(data) >= seenRecordSize; data = data[seenRecordSize:] { // a torn last record is dropped
+		var entry api.SeenEntry
+		copy(entry.Hash[:], data)
+		entry.Time = int64(binary.BigEndian.Uint64(data[32:]))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func appendSeen(b []byte, entries []api.SeenEntry) []byte {
+	for _, entry := range entries {
+		b = append(b, entry.Hash[:]...)
+		b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(entry.Time))
+	}
+	return b
+}
+
+// LoadSeen : returns the router's loop detection entries first seen at or after since, oldest first
+func (node *Node) LoadSeen(since int64) ([]api.SeenEntry, error) {
+	node.seenMutex.Lock()
+	defer node.seenMutex.Unlock()
+	entries, err := node.readSeen()
+	if err != nil {
+		return nil, err
+	}
+	var recent []api.SeenEntry
+	for _, entry := range entries {
+		if entry.Time >= since {
+			recent = append(recent, entry)
+		}
+	}
+	return recent, nil
+}
+
+// SaveSeen : stores the router's loop detection entries
+func (node *Node) SaveSeen(entries ...api.SeenEntry) error {
+	node.seenMutex.Lock()
+	defer node.seenMutex.Unlock()
+	f, err := os.OpenFile(filepath.Join(node.basePath, seenFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// drop a record torn by a crash, so the new ones line up
+	if info, err := f.Stat(); err == nil && info.Size()%seenRecordSize != 0 {
+		if err := f.Truncate(info.Size() - info.Size()%seenRecordSize); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Write(appendSeen(nil, entries)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ForgetSeen : deletes the router's loop detection entries first seen before the given time
+func (node *Node) ForgetSeen(before int64) error {
+	node.seenMutex.Lock()
+	defer node.seenMutex.Unlock()
+	entries, err := node.readSeen()
+	if err != nil || len(entries) == 0 || entries[0].Time >= before {
+		return err
+	}
+	var recent []api.SeenEntry
+	for _, entry := range entries {
+		if entry.Time >= before {
+			recent = append(recent, entry)
+		}
+	}
+	return writeFileAtomic(filepath.Join(node.basePath, seenFile), appendSeen(nil, recent))
+}
@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/nodes"
+)
+
+// streamsDir - subdirectory of basePath that holds partially received chunked streams,
+// skipped by Pickup and FlushOutbox
+const streamsDir = ".streams"
+
+// streamHeaderFile - name of the file holding the stream header inside a stream's directory
+const streamHeaderFile = "header"
+
+func (node *Node) streamPath(streamID uint32) string {
+	return filepath.Join(node.basePath, streamsDir, hex32(streamID))
+}
+
+// writeFileAtomic - writes to a temporary file and renames it into place,
+// so a crash never leaves a partially written file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveStream - persists a stream header under basePath
+func (node *Node) saveStream(stream *api.StreamHeader) error {
+	dir := node.streamPath(stream.StreamID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(stream); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, streamHeaderFile), b.Bytes())
+}
+
+// saveChunk - persists a chunk under basePath
+func (node *Node) saveChunk(chunk *api.Chunk) error {
+	dir := node.streamPath(chunk.StreamID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, hex32(chunk.ChunkNum)), chunk.Data)
+}
+
+// clearStream - removes a stream and its chunks from memory and disk
+func (node *Node) clearStream(streamID uint32) error {
+	delete(node.streams, streamID)
+	delete(node.chunks, streamID)
+	node.nackTimer.Forget(streamID)
+	node.readers.Close(streamID)
+	return os.RemoveAll(node.streamPath(streamID))
+}
+
+// getStreams - returns the headers of the streams being received
+func (node *Node) getStreams() ([]api.StreamHeader, error) {
+	streams := make([]api.StreamHeader, 0, len(node.streams))
+	for _, stream := range node.streams {
+		streams = append(streams, *stream)
+	}
+	return streams, nil
+}
+
+// getChunkCount - returns how many chunks of a stream are stored
+func (node *Node) getChunkCount(streamID uint32) (uint64, error) {
+	return uint64(len(node.chunks[streamID])), nil
+}
+
+// getChunks - returns the stored chunks of a stream, ordered by chunk number
+func (node *Node) getChunks(streamID uint32) ([]api.Chunk, error) {
+	chunks := make([]api.Chunk, 0, len(node.chunks[streamID]))
+	for _, chunk := range node.chunks[streamID] {
+		chunks = append(chunks, *chunk)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ChunkNum < chunks[j].ChunkNum })
+	return chunks, nil
+}
+
+// streamStore - where the stream reassembly pass finds this node's incoming streams
+func (node *Node) streamStore() nodes.StreamStore {
+	return nodes.StreamStore{
+		Streams:     node.getStreams,
+		ChunkCount:  node.getChunkCount,
+		Chunks:      node.getChunks,
+		ReadChunk:   node.readChunk,
+		RemoveChunk: node.removeChunk,
+		ClearStream: node.clearStream,
+	}
+}
+
+// readChunk - returns the data of a stored chunk, if we have it
+func (node *Node) readChunk(streamID uint32, chunkNum uint32) ([]byte, bool, error) {
+	chunk, ok := node.chunks[streamID][chunkNum]
+	if !ok {
+		return nil, false, nil
+	}
+	return chunk.Data, true, nil
+}
+
+// removeChunk - deletes a stored chunk that has been handed to a stream reader, from memory and disk
+func (node *Node) removeChunk(streamID uint32, chunkNum uint32) error {
+	chunk, ok := node.chunks[streamID][chunkNum]
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(node.streamPath(streamID), hex32(chunkNum))); err != nil {
+		return err
+	}
+	node.streams[streamID].Buffered -= int64(len(chunk.Data))
+	delete(node.chunks[streamID], chunkNum)
+	return nil
+}
+
+// loadStreams - reads partially received streams left on disk by a previous run
+func (node *Node) loadStreams() error {
+	dirs, err := ioutil.ReadDir(filepath.Join(node.basePath, streamsDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(d.Name(), 16, 32)
+		if err != nil {
+			events.Warning(node, "skipping unknown stream directory:", d.Name())
+			continue
+		}
+		streamID := uint32(id)
+		dir := filepath.Join(node.basePath, streamsDir, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			path := filepath.Join(dir, f.Name())
+			if strings.HasSuffix(f.Name(), ".tmp") { // interrupted write, never renamed into place
+				os.Remove(path)
+				continue
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if f.Name() == streamHeaderFile {
+				stream := new(api.StreamHeader)
+				if err := gob.NewDecoder(bytes.NewReader(b)).Decode(stream); err != nil {
+					events.Warning(node, "skipping corrupt stream header:", path, err.Error())
+					continue
+				}
+				node.streams[streamID] = stream
+				continue
+			}
+			n, err := strconv.ParseUint(f.Name(), 16, 32)
+			if err != nil {
+				events.Warning(node, "skipping unknown chunk file:", path)
+				continue
+			}
+			if node.chunks[streamID] == nil {
+				node.chunks[streamID] = make(map[uint32]*api.Chunk)
+			}
+			node.chunks[streamID][uint32(n)] = &api.Chunk{StreamID: streamID, ChunkNum: uint32(n), Data: b}
+		}
+		stream, ok := node.streams[streamID]
+		if !ok {
+			if len(node.chunks[streamID]) == 0 {
+				continue
+			}
+			// chunks without a header, keep a placeholder so they can still expire
+			stream = &api.StreamHeader{StreamID: streamID, FirstSeen: d.ModTime().UnixNano()}
+			node.streams[streamID] = stream
+		}
+		stream.Buffered = 0 // recount, the saved header is not rewritten for every chunk
+		for _, chunk := range node.chunks[streamID] {
+			stream.Buffered += int64(len(chunk.Data))
+		}
+	}
+	return nil
+}
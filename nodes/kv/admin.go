@@ -0,0 +1,464 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/api/multicast"
+	"github.com/awgh/ratnet/nodes"
+)
+
+// CID : Return content key
+func (node *Node) CID() (bc.PubKey, error) {
+	return node.contentKey.GetPubKey(), nil
+}
+
+// GetContact : Return a Contact by name
+func (node *Node) GetContact(name string) (*api.Contact, error) {
+	pubs, err := node.kvGetContactPubKey(name)
+	if err != nil {
+		return nil, err
+	} else if pubs == "" {
+		return nil, errors.New("Contact not found")
+	}
+	contact := new(api.Contact)
+	contact.Name = name
+	contact.Pubkey = pubs
+	return contact, nil
+}
+
+// GetContacts : Return a list of Contacts
+func (node *Node) GetContacts() ([]api.Contact, error) {
+	return node.kvGetContacts()
+}
+
+// AddContact : Add or Update a contact key to this node's database
+func (node *Node) AddContact(name string, key string) error {
+	if !node.contentKey.ValidatePubKey(key) {
+		return errors.New("Invalid Public Key in AddContact")
+	}
+	return node.kvPut(contactsBucket, name, key)
+}
+
+// DeleteContact : Remove a contact from this node's database
+func (node *Node) DeleteContact(name string) error {
+	return node.kvDelete(contactsBucket, name)
+}
+
+// GetChannel : Return a channel by name
+func (node *Node) GetChannel(name string) (*api.Channel, error) {
+	privkey, err := node.kvGetChannelPrivKey(name)
+	if err != nil {
+		return nil, err
+	} else if privkey == "" {
+		return nil, errors.New("Channel not found")
+	}
+	prv := node.contentKey.Clone()
+	if err := prv.FromB64(privkey); err != nil {
+		return nil, err
+	}
+	channel := new(api.Channel)
+	channel.Name = name
+	channel.Pubkey = prv.GetPubKey().ToB64()
+	return channel, nil
+}
+
+// GetChannels : Return list of channels known to this node
+func (node *Node) GetChannels() ([]api.Channel, error) {
+	channels, err := node.kvGetChannelsPriv()
+	if err != nil {
+		return nil, err
+	}
+	var retval []api.Channel
+	for _, v := range channels {
+		if v.Expires == 0 { // the newest key
+			retval = append(retval, api.Channel{Name: v.Name, Pubkey: v.Pubkey})
+		}
+	}
+	return retval, nil
+}
+
+// AddChannel : Add a channel to this node's database, or give it a new key,
+// the older keys keep working for ChannelKeyOverlap seconds
+func (node *Node) AddChannel(name string, privkey string) error {
+	prv := node.contentKey.Clone()
+	if err := prv.FromB64(privkey); err != nil {
+		return err
+	}
+	if err := node.kvAddChannel(name, prv); err != nil {
+		return err
+	}
+	node.refreshChannels()
+	return nil
+}
+
+// DeleteChannel : Remove a channel from this node's database
+func (node *Node) DeleteChannel(name string) error {
+	if err := node.kvDeleteChannel(name); err != nil {
+		return err
+	}
+	node.mutex.Lock()
+	delete(node.channelKeys, name)
+	node.mutex.Unlock()
+	return nil
+}
+
+// GetProfile : Retrieve a profiles
+func (node *Node) GetProfile(name string) (*api.Profile, error) {
+	profile, err := node.kvGetProfilePriv(name)
+	if err != nil {
+		return nil, err
+	} else if profile == nil {
+		return nil, errors.New("Profile not found")
+	}
+	prv := node.contentKey.Clone()
+	if err := prv.FromB64(profile.Privkey); err != nil {
+		return nil, err
+	}
+	return &api.Profile{Name: profile.Name, Enabled: profile.Enabled, Pubkey: prv.GetPubKey().ToB64()}, nil
+}
+
+// GetProfiles : Retrieve the list of profiles for this node
+func (node *Node) GetProfiles() ([]api.Profile, error) {
+	profiles, err := node.kvGetProfilesPriv()
+	if err != nil {
+		return nil, err
+	}
+	var retval []api.Profile
+	for _, v := range profiles {
+		prv := node.contentKey.Clone()
+		if err := prv.FromB64(v.Privkey); err != nil {
+			return nil, err
+		}
+		retval = append(retval, api.Profile{Name: v.Name, Enabled: v.Enabled, Pubkey: prv.GetPubKey().ToB64()})
+	}
+	return retval, nil
+}
+
+// AddProfile : Add or Update a profile to this node's database
+func (node *Node) AddProfile(name string, enabled bool) error {
+	return node.kvAddProfile(name, enabled)
+}
+
+// DeleteProfile : Remove a profile from this node's database
+func (node *Node) DeleteProfile(name string) error {
+	return node.kvDelete(profilesBucket, name)
+}
+
+// LoadProfile : Load a profile key from the database as the content key
+func (node *Node) LoadProfile(name string) (bc.PubKey, error) {
+	profileKey, err := node.privProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	node.contentKey = profileKey
+	return profileKey.GetPubKey(), nil
+}
+
+// privProfile : Internal call to load secret key only for decryption operation
+func (node *Node) privProfile(name string) (bc.KeyPair, error) {
+	profile, err := node.kvGetProfilePriv(name)
+	if err != nil {
+		return nil, err
+	} else if profile == nil {
+		return nil, errors.New("No matching profile key found")
+	}
+	profileKey := node.contentKey.Clone()
+	if err := profileKey.FromB64(profile.Privkey); err != nil {
+		events.Error(node, err)
+		return nil, err
+	}
+	events.Debug(node, "Profile Loaded: "+profileKey.GetPubKey().ToB64())
+	return profileKey, nil
+}
+
+// GetPeer : Retrieve a peer by name
+func (node *Node) GetPeer(name string) (*api.Peer, error) {
+	return node.kvGetPeer(name)
+}
+
+// GetPeers : Retrieve a list of peers in this node's database
+func (node *Node) GetPeers(group ...string) ([]api.Peer, error) {
+	// if we don't have a specified group, it's ""
+	groupName := strings.Join(group, " ")
+	return node.kvGetPeers(groupName)
+}
+
+// AddPeer : Add or Update a peer configuration
+func (node *Node) AddPeer(name string, enabled bool, uri string, group ...string) error {
+	// if we don't have a specified group, it's ""
+	groupName := strings.Join(group, " ")
+	return node.kvAddPeer(name, enabled, uri, groupName)
+}
+
+// DeletePeer : Remove a peer from this node's database
+func (node *Node) DeletePeer(name string) error {
+	return node.kvDelete(peersBucket, name)
+}
+
+// Send : Transmit a message to a single key
+func (node *Node) Send(contactName string, data []byte, pubkey ...bc.PubKey) error {
+	var destkey bc.PubKey
+	if pubkey != nil && len(pubkey) > 0 && pubkey[0] != nil { // third argument is optional pubkey override
+		destkey = pubkey[0]
+	} else {
+		s, err := node.kvGetContactPubKey(contactName)
+		if err != nil {
+			return err
+		} else if s == "" {
+			return errors.New("Unknown Contact")
+		}
+		destkey = node.contentKey.GetPubKey().Clone()
+		if err := destkey.FromB64(s); err != nil {
+			return err
+		}
+	}
+	_, err := node.SendMsg(api.Msg{Name: contactName, Content: bytes.NewBuffer(data), IsChan: false, PubKey: destkey, Chunked: false})
+	return err
+}
+
+// SendChannel : Transmit a message to a channel
+func (node *Node) SendChannel(channelName string, data []byte, pubkey ...bc.PubKey) error {
+	var destkey bc.PubKey
+
+	if pubkey != nil && len(pubkey) > 0 && pubkey[0] != nil { // third argument is optional PubKey override
+		destkey = pubkey[0]
+	} else {
+		keys, ok := node.channelKey(channelName)
+		if !ok {
+			return errors.New("No public key for Channel")
+		}
+		destkey = keys[0].Privkey.GetPubKey() // the newest key
+	}
+
+	if destkey == nil {
+		events.Critical(node, "nil DestKey in SendChannel")
+	}
+	_, err := node.SendMsg(api.Msg{Name: channelName, Content: bytes.NewBuffer(data), IsChan: true, PubKey: destkey, Chunked: false})
+	return err
+}
+
+// SendMsg : Transmits a message, returns the MsgID its status is tracked by
+func (node *Node) SendMsg(msg api.Msg) (api.MsgID, error) {
+	if msg.ID == (api.MsgID{}) {
+		var err error
+		if msg.ID, err = api.NewMsgID(); err != nil {
+			return msg.ID, err
+		}
+	}
+	if msg.Signed { // signatures travel in an envelope for the one recipient
+		if msg.IsChan {
+			return msg.ID, errors.New("Only direct messages can be signed")
+		}
+		if len(msg.Recipients) == 0 {
+			msg.Recipients = []bc.PubKey{msg.PubKey}
+		}
+	}
+	// determine if we need to chunk
+	chunkSize := chunking.ChunkSize(node, msg)                          // what fits the smallest transport once encrypted
+	if msg.Content.Len() > 0 && uint32(msg.Content.Len()) > chunkSize { // we need to chunk
+		if msg.Chunked { // we're already chunked, freak out!
+			return msg.ID, errors.New("Chunked message needs to be chunked, bailing out")
+		}
+		return msg.ID, chunking.SendChunked(node, chunkSize, msg)
+	}
+
+	var data []byte
+	var err error
+	if len(msg.Recipients) > 0 { // one envelope for all of them
+		if msg.IsChan {
+			return msg.ID, errors.New("Multiple recipients are only for direct messages")
+		}
+		msg.Multicast = true
+		data, err = multicast.Seal(node.contentKey, msg.Recipients, msg.Content.Bytes(), msg.Signed)
+	} else {
+		data, err = node.contentKey.EncryptMessage(msg.Content.Bytes(), msg.PubKey)
+	}
+	if err != nil {
+		return msg.ID, err
+	}
+
+	m := nodes.NewOutboxMsg(msg, data)
+	if err := node.outbox.Enqueue(m); err != nil {
+		return msg.ID, err
+	}
+	node.tracker.Queued(msg.ID, m.Msg)
+	return msg.ID, nil
+}
+
+// GetMsgStatus : Returns what has become of a message sent with SendMsg
+func (node *Node) GetMsgStatus(id api.MsgID) (*api.MsgStatus, error) {
+	return node.tracker.Status(id)
+}
+
+// GetMsgStatuses : Returns the status of every message this node is tracking
+func (node *Node) GetMsgStatuses() ([]api.MsgStatus, error) {
+	return node.tracker.Statuses(), nil
+}
+
+// SendBulk : Transmit messages to a single key
+func (node *Node) SendBulk(contactName string, data [][]byte, pubkey ...bc.PubKey) error {
+	var destkey bc.PubKey
+
+	if pubkey != nil && len(pubkey) > 0 && pubkey[0] != nil { // third argument is optional pubkey override
+		destkey = pubkey[0]
+	} else {
+		s, err := node.kvGetContactPubKey(contactName)
+		if err != nil {
+			return err
+		}
+		if s == "" {
+			return errors.New("Unknown Contact")
+		}
+		destkey = node.contentKey.GetPubKey().Clone()
+		if err := destkey.FromB64(s); err != nil {
+			return err
+		}
+	}
+
+	return node.sendBulk("", destkey, data)
+}
+
+// SendChannelBulk : Transmit messages to a channel
+func (node *Node) SendChannelBulk(channelName string, data [][]byte, pubkey ...bc.PubKey) error {
+	var destkey bc.PubKey
+
+	if pubkey != nil && len(pubkey) > 0 && pubkey[0] != nil { // third argument is optional PubKey override
+		destkey = pubkey[0]
+	} else {
+		keys, ok := node.channelKey(channelName)
+		if !ok {
+			return errors.New("No public key for Channel")
+		}
+		destkey = keys[0].Privkey.GetPubKey() // the newest key
+	}
+
+	if destkey == nil {
+		events.Critical(node, "nil DestKey in SendChannel")
+	}
+
+	return node.sendBulk(channelName, destkey, data)
+}
+
+func (node *Node) sendBulk(channelName string, destkey bc.PubKey, msg [][]byte) error {
+	isChan := (channelName != "")
+	flags := uint8(0)
+	if isChan {
+		flags |= api.ChannelFlag
+	}
+	rxsum := []byte{flags} // prepend flags byte
+	if isChan {
+		// prepend a uint16 of channel name length, little-endian
+		t := uint16(len(channelName))
+		rxsum = append(rxsum, byte(t>>8), byte(t&0xFF))
+		rxsum = append(rxsum, []byte(channelName)...)
+	}
+
+	// todo: is this passing msg by reference or not???
+	ts := time.Now().UnixNano()
+	data := make([]api.OutboxMsg, len(msg))
+	for i := range msg {
+		ct, err := node.contentKey.EncryptMessage(msg[i], destkey)
+		if err != nil {
+			return err
+		}
+		data[i].Channel = channelName
+		data[i].Msg = append(rxsum, ct...)
+		data[i].Timestamp = ts + int64(i) // increment timestamp by one each message to simplify queueing
+	}
+	return node.outbox.Enqueue(data...)
+}
+
+// Start : starts the Connection Policy threads
+func (node *Node) Start() error {
+	// do not start again if the node is already running
+	if node.IsRunning() {
+		return nil
+	}
+	node.setIsRunning(true)
+	node.stop = make(chan struct{})
+
+	// reload the router's loop detection state, for routers that keep it in the node
+	if r, ok := node.router.(api.SeenPersister); ok {
+		if err := r.RestoreSeen(node); err != nil {
+			events.Error(node, "Could not restore seen messages: "+err.Error())
+		}
+	}
+
+	// start the policies
+	if node.policies != nil {
+		for i := 0; i < len(node.policies); i++ {
+			if err := node.policies[i].RunPolicy(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// input loop
+	go func() {
+		for {
+			// check if we should stop running
+			if !node.IsRunning() {
+				break
+			}
+			// read message off the input channel
+			message, more := <-node.In()
+			if !more {
+				break
+			}
+			if _, err := node.SendMsg(message); err != nil {
+				events.Error(node, err.Error())
+			}
+		}
+	}()
+
+	node.trigggerMutex.Lock()
+	node.debouncer = nodes.NewDebouncer(10*time.Millisecond, func() {
+		node.trigggerMutex.Lock()
+		defer node.trigggerMutex.Unlock()
+		// check if we should stop running
+		if !node.IsRunning() {
+			return
+		}
+		nodes.ProcessStreams(node, node.streamStore(), node.readers, node.nackTimer)
+	})
+	node.debouncer.Trigger() // resume streams that were persisted before a restart
+	node.trigggerMutex.Unlock()
+
+	// wake up periodically, so stalled streams get NACKed or expired
+	go nodes.WakeStreams(func() {
+		node.trigggerMutex.Lock()
+		node.debouncer.Trigger()
+		node.trigggerMutex.Unlock()
+	}, node.nackTimer, node.stop)
+
+	// expire old outbound messages, whether or not a policy flushes the outbox
+	go nodes.ExpireOutbox(node, node.OutboxExpiryInterval(), node.stop)
+
+	return nil
+}
+
+// Stop : sets the isRunning flag to false, indicating that all go routines should end
+func (node *Node) Stop() {
+	for _, policy := range node.policies {
+		policy.Stop()
+	}
+	node.trigggerMutex.Lock() // wait for a stream pass that is already running
+	node.setIsRunning(false)
+	node.trigggerMutex.Unlock()
+	if node.stop != nil {
+		close(node.stop)
+		node.stop = nil
+	}
+	if r, ok := node.router.(api.SeenPersister); ok {
+		if err := r.FlushSeen(); err != nil {
+			events.Error(node, "Could not save seen messages: "+err.Error())
+		}
+	}
+}
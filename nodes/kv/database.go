@@ -0,0 +1,565 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/nodes"
+	kvoutbox "github.com/awgh/ratnet/outbox/kv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// THIS SHOULD BE THE ONLY FILE THAT INCLUDES bbolt !!!
+// ... other than the database var definition in kvnode.go and tests
+
+// buckets, the outbox bucket belongs to the outbox package
+var (
+	channelsBucket    = []byte("channels")    // name -> b64 private key, the newest one
+	channelKeysBucket = []byte("channelkeys") // name -> gob []api.ChannelPrivB64, every key newest first
+	configBucket      = []byte("config")      // name -> value
+	contactsBucket    = []byte("contacts")    // name -> b64 public key
+	peersBucket       = []byte("peers")       // name -> gob api.Peer
+	profilesBucket    = []byte("profiles")    // name -> gob api.ProfilePrivB64
+	streamsBucket     = []byte("streams")     // stream id -> gob api.StreamHeader
+	chunksBucket      = []byte("chunks")      // stream id -> bucket of chunk number -> data
+	seenBucket        = []byte("seen")        // nonce hash -> big-endian UnixNano time first seen
+)
+
+//
+// Generic Database Functions
+//
+
+func idKey(id uint32) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, id)
+	return k
+}
+
+func putGob(b *bolt.Bucket, key []byte, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return b.Put(key, buf.Bytes())
+}
+
+func getGob(b *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (node *Node) kvGet(bucket []byte, name string) (string, error) {
+	var value string
+	err := node.db.View(func(tx *bolt.Tx) error {
+		value = string(tx.Bucket(bucket).Get([]byte(name)))
+		return nil
+	})
+	return value, err
+}
+
+func (node *Node) kvPut(bucket []byte, name, value string) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(name), []byte(value))
+	})
+}
+
+func (node *Node) kvDelete(bucket []byte, name string) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(name))
+	})
+}
+
+//
+// End Generic Database Functions
+//
+
+//
+// Specific Database Functions
+//
+
+func (node *Node) kvGetContactPubKey(name string) (string, error) {
+	return node.kvGet(contactsBucket, name)
+}
+
+func (node *Node) kvGetContacts() ([]api.Contact, error) {
+	var contacts []api.Contact
+	err := node.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(contactsBucket).ForEach(func(k, v []byte) error {
+			contacts = append(contacts, api.Contact{Name: string(k), Pubkey: string(v)})
+			return nil
+		})
+	})
+	return contacts, err
+}
+
+func (node *Node) kvGetChannelPrivKey(name string) (string, error) {
+	return node.kvGet(channelsBucket, name)
+}
+
+// kvGetChannelsPriv - returns every key of every channel
+func (node *Node) kvGetChannelsPriv() ([]api.ChannelPriv, error) {
+	var channels []api.ChannelPrivB64
+	err := node.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(channelsBucket).ForEach(func(k, v []byte) error {
+			keys, err := getChannelKeys(tx, string(k))
+			channels = append(channels, keys...)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes.DecodeChannelKeys(node.contentKey, channels)
+}
+
+// getChannelKeys - returns every key of a channel newest first, channels stored before
+// they could have more than one key only have the one in channelsBucket
+func getChannelKeys(tx *bolt.Tx, name string) ([]api.ChannelPrivB64, error) {
+	var keys []api.ChannelPrivB64
+	found, err := getGob(tx.Bucket(channelKeysBucket), []byte(name), &keys)
+	if err != nil || found {
+		return keys, err
+	}
+	if privkey := tx.Bucket(channelsBucket).Get([]byte(name)); privkey != nil {
+		keys = append(keys, api.ChannelPrivB64{Name: name, Privkey: string(privkey)})
+	}
+	return keys, nil
+}
+
+// putChannelKeys - replaces the keys of a channel, newest first
+func putChannelKeys(tx *bolt.Tx, name string, keys []api.ChannelPrivB64) error {
+	if len(keys) == 0 {
+		return errors.New("Channel has no keys")
+	}
+	if err := tx.Bucket(channelsBucket).Put([]byte(name), []byte(keys[0].Privkey)); err != nil {
+		return err
+	}
+	return putGob(tx.Bucket(channelKeysBucket), []byte(name), keys)
+}
+
+// kvAddChannel - gives a channel a new key, see nodes.AddChannelKey
+func (node *Node) kvAddChannel(name string, key bc.KeyPair) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		channels, err := getChannelKeys(tx, name)
+		if err != nil {
+			return err
+		}
+		keys, err := nodes.DecodeChannelKeys(node.contentKey, channels)
+		if err != nil {
+			return err
+		}
+		keys = nodes.AddChannelKey(keys, api.ChannelPriv{Name: name, Pubkey: key.GetPubKey().ToB64(), Privkey: key}, node.ChannelKeyOverlap())
+		return putChannelKeys(tx, name, nodes.EncodeChannelKeys(keys))
+	})
+}
+
+func (node *Node) kvSetChannelKeys(name string, keys []api.ChannelPriv) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		return putChannelKeys(tx, name, nodes.EncodeChannelKeys(keys))
+	})
+}
+
+func (node *Node) kvDeleteChannel(name string) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(channelKeysBucket).Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket(channelsBucket).Delete([]byte(name))
+	})
+}
+
+func (node *Node) kvGetProfilePriv(name string) (*api.ProfilePrivB64, error) {
+	var profile api.ProfilePrivB64
+	var found bool
+	err := node.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getGob(tx.Bucket(profilesBucket), []byte(name), &profile)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (node *Node) kvGetProfilesPriv() ([]api.ProfilePrivB64, error) {
+	var profiles []api.ProfilePrivB64
+	err := node.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(profilesBucket).ForEach(func(k, v []byte) error {
+			var profile api.ProfilePrivB64
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&profile); err != nil {
+				return err
+			}
+			profiles = append(profiles, profile)
+			return nil
+		})
+	})
+	return profiles, err
+}
+
+func (node *Node) kvAddProfilePriv(name string, enabled bool, b64key string) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		return putGob(tx.Bucket(profilesBucket), []byte(name), api.ProfilePrivB64{Name: name, Enabled: enabled, Privkey: b64key})
+	})
+}
+
+func (node *Node) kvAddProfile(name string, enabled bool) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(profilesBucket)
+		var profile api.ProfilePrivB64
+		found, err := getGob(b, []byte(name), &profile)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// generate new profile keypair
+			profileKey := node.contentKey.Clone()
+			profileKey.GenerateKey()
+			profile.Privkey = profileKey.ToB64()
+		}
+		profile.Name = name
+		profile.Enabled = enabled
+		return putGob(b, []byte(name), profile)
+	})
+}
+
+func (node *Node) kvGetPeer(name string) (*api.Peer, error) {
+	var peer api.Peer
+	var found bool
+	err := node.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getGob(tx.Bucket(peersBucket), []byte(name), &peer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, errors.New("Peer not found")
+	}
+	return &peer, nil
+}
+
+func (node *Node) kvGetPeers(group string) ([]api.Peer, error) {
+	var peers []api.Peer
+	err := node.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+			var peer api.Peer
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&peer); err != nil {
+				return err
+			}
+			if peer.Group == group {
+				peers = append(peers, peer)
+			}
+			return nil
+		})
+	})
+	return peers, err
+}
+
+func (node *Node) kvAddPeer(name string, enabled bool, uri string, group string) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		return putGob(tx.Bucket(peersBucket), []byte(name), api.Peer{Name: name, Enabled: enabled, URI: uri, Group: group})
+	})
+}
+
+func (node *Node) kvClearStream(streamID uint32) error {
+	node.nackTimer.Forget(streamID)
+	node.readers.Close(streamID)
+	return node.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(chunksBucket).DeleteBucket(idKey(streamID)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket(streamsBucket).Delete(idKey(streamID))
+	})
+}
+
+// AddStream - implemented from Node API
+func (node *Node) AddStream(stream api.StreamHeader) error {
+	node.trigggerMutex.Lock()
+	defer node.trigggerMutex.Unlock()
+	err := node.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(streamsBucket)
+		var old api.StreamHeader
+		found, err := getGob(b, idKey(stream.StreamID), &old)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// insert new stream
+			stream.FirstSeen = time.Now().UnixNano()
+			stream.Buffered = 0
+		} else {
+			if old.NumChunks != 0 { // otherwise this is the placeholder made by AddChunk
+				events.Warning(node, "Over-writing stream header: %x\n", stream.StreamID)
+			}
+			stream.FirstSeen = old.FirstSeen
+			stream.Buffered = old.Buffered
+		}
+		return putGob(b, idKey(stream.StreamID), stream)
+	})
+	if err != nil {
+		return err
+	}
+	node.debouncer.Trigger()
+	return nil
+}
+
+// AddChunk - implemented from Node API
+func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error {
+	node.trigggerMutex.Lock()
+	defer node.trigggerMutex.Unlock()
+	err := node.db.Update(func(tx *bolt.Tx) error {
+		streams := tx.Bucket(streamsBucket)
+		var stream api.StreamHeader
+		found, err := getGob(streams, idKey(streamID), &stream)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// header hasn't arrived yet, insert a placeholder so the chunk can still expire
+			stream.StreamID = streamID
+			stream.FirstSeen = time.Now().UnixNano()
+		}
+		chunks, err := tx.Bucket(chunksBucket).CreateBucketIfNotExists(idKey(streamID))
+		if err != nil {
+			return err
+		}
+		if old := chunks.Get(idKey(chunkNum)); old != nil {
+			events.Warning(node, "Over-writing chunk: %x:%x\n", streamID, chunkNum)
+			stream.Buffered -= int64(len(old))
+		}
+		if err := chunks.Put(idKey(chunkNum), data); err != nil {
+			return err
+		}
+		stream.Buffered += int64(len(data))
+		return putGob(streams, idKey(streamID), stream)
+	})
+	if err != nil {
+		return err
+	}
+	node.debouncer.Trigger()
+	return nil
+}
+
+func (node *Node) kvGetStreams() ([]api.StreamHeader, error) {
+	var streams []api.StreamHeader
+	err := node.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(streamsBucket).ForEach(func(k, v []byte) error {
+			var stream api.StreamHeader
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&stream); err != nil {
+				return err
+			}
+			streams = append(streams, stream)
+			return nil
+		})
+	})
+	return streams, err
+}
+
+func (node *Node) kvGetChunkCount(streamID uint32) (uint64, error) {
+	var count uint64
+	err := node.db.View(func(tx *bolt.Tx) error {
+		if chunks := tx.Bucket(chunksBucket).Bucket(idKey(streamID)); chunks != nil {
+			count = uint64(chunks.Stats().KeyN)
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (node *Node) kvGetChunks(streamID uint32) ([]api.Chunk, error) {
+	var chunks []api.Chunk
+	err := node.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(chunksBucket).Bucket(idKey(streamID))
+		if b == nil {
+			return nil
+		}
+		// keys are big-endian, so these come out in chunk order
+		return b.ForEach(func(k, v []byte) error {
+			chunks = append(chunks, api.Chunk{StreamID: streamID, ChunkNum: binary.BigEndian.Uint32(k), Data: append([]byte(nil), v...)})
+			return nil
+		})
+	})
+	return chunks, err
+}
+
+func (node *Node) kvGetChunk(streamID uint32, chunkNum uint32) ([]byte, bool, error) {
+	var data []byte
+	err := node.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(chunksBucket).Bucket(idKey(streamID)); b != nil {
+			if v := b.Get(idKey(chunkNum)); v != nil {
+				data = append([]byte(nil), v...)
+			}
+		}
+		return nil
+	})
+	return data, data != nil, err
+}
+
+func (node *Node) kvRemoveChunk(streamID uint32, chunkNum uint32) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(chunksBucket).Bucket(idKey(streamID))
+		if b == nil {
+			return nil
+		}
+		v := b.Get(idKey(chunkNum))
+		if v == nil {
+			return nil
+		}
+		size := int64(len(v))
+		if err := b.Delete(idKey(chunkNum)); err != nil {
+			return err
+		}
+		streams := tx.Bucket(streamsBucket)
+		var stream api.StreamHeader
+		if _, err := getGob(streams, idKey(streamID), &stream); err != nil {
+			return err
+		}
+		stream.Buffered -= size
+		return putGob(streams, idKey(streamID), stream)
+	})
+}
+
+// LoadSeen : returns the router's loop detection entries first seen at or after since, oldest first
+func (node *Node) LoadSeen(since int64) ([]api.SeenEntry, error) {
+	var entries []api.SeenEntry
+	err := node.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(seenBucket).ForEach(func(k, v []byte) error {
+			if len(k) != 32 || len(v) != 8 {
+				return nil // not one of ours
+			}
+			entry := api.SeenEntry{Time: int64(binary.BigEndian.Uint64(v))}
+			if entry.Time >= since {
+				copy(entry.Hash[:], k)
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time < entries[j].Time })
+	return entries, err
+}
+
+// SaveSeen : stores the router's loop detection entries
+func (node *Node) SaveSeen(entries ...api.SeenEntry) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		for _, entry := range entries {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(entry.Time))
+			if err := b.Put(entry.Hash[:], v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForgetSeen : deletes the router's loop detection entries first seen before the given time
+func (node *Node) ForgetSeen(before int64) error {
+	return node.db.Update(func(tx *bolt.Tx) error {
+		var old [][]byte
+		b := tx.Bucket(seenBucket)
+		if err := b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) < before {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FlushOutbox : Deletes outbound messages older than maxAgeSeconds seconds
+func (node *Node) FlushOutbox(maxAgeSeconds int64) {
+	if err := node.outbox.Flush(maxAgeSeconds); err != nil {
+		events.Error(node, "FlushOutbox failed: "+err.Error())
+		return
+	}
+	node.tracker.Expire(maxAgeSeconds)
+}
+
+// keySetup - loads a key from the config bucket, or saves the current one if there is none yet
+func (node *Node) keySetup(name string, key bc.KeyPair) {
+	value, err := node.kvGet(configBucket, name)
+	if err == nil && value == "" {
+		err = node.kvPut(configBucket, name, key.ToB64())
+	} else if err == nil {
+		err = key.FromB64(value)
+	}
+	if err != nil {
+		events.Critical(node, err)
+	}
+}
+
+// BootstrapDB - Initialize or open a database file
+func (node *Node) BootstrapDB(dbFile string) *bolt.DB {
+	if node.db != nil {
+		return node.db
+	}
+	var err error
+	node.db, err = bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		events.Critical(node, errors.New("DB Error Opening: "+dbFile+" => "+err.Error()))
+	}
+	if node.outbox == nil {
+		inner, err := kvoutbox.New(node.db)
+		if err != nil {
+			events.Critical(node, err.Error())
+		} else {
+			node.SetOutbox(inner)
+		}
+	}
+
+	// One-time Initialization
+	err = node.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{channelsBucket, channelKeysBucket, configBucket, contactsBucket, peersBucket, profilesBucket, streamsBucket, chunksBucket, seenBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		events.Critical(node, err.Error())
+	}
+
+	// Content Key Setup
+	node.keySetup("contentkey", node.contentKey)
+
+	// Routing Key Setup
+	node.keySetup("routingkey", node.routingKey)
+
+	node.refreshChannels()
+	return node.db
+}
+
+// streamStore - where the stream reassembly pass finds this node's incoming streams
+func (node *Node) streamStore() nodes.StreamStore {
+	return nodes.StreamStore{
+		Streams:     node.kvGetStreams,
+		ChunkCount:  node.kvGetChunkCount,
+		Chunks:      node.kvGetChunks,
+		ReadChunk:   node.kvGetChunk,
+		RemoveChunk: node.kvRemoveChunk,
+		ClearStream: node.kvClearStream,
+	}
+}
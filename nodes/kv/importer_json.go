@@ -0,0 +1,172 @@
+// +build !no_json
+
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+
+	"github.com/awgh/bencrypt"
+	"github.com/awgh/ratnet"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes"
+)
+
+// Import : Load a node configuration from a JSON config
+func (node *Node) Import(jsonConfig []byte) error {
+	restartNode := false
+	if node.IsRunning() {
+		node.Stop()
+		restartNode = true
+	}
+	var nj api.ImportedNode
+	if err := json.Unmarshal(jsonConfig, &nj); err != nil {
+		return err
+	}
+	// setup content and routing keys
+	if len(nj.ContentKey) > 0 {
+		v, ok := bencrypt.KeypairTypes[nj.ContentType]
+		if !ok {
+			return errors.New("Unknown Content Keypair Type in Import")
+		}
+		node.contentKey = v()
+		if err := node.contentKey.FromB64(nj.ContentKey); err != nil {
+			return err
+		}
+	}
+	if len(nj.RoutingKey) > 0 {
+		v, ok := bencrypt.KeypairTypes[nj.RoutingType]
+		if !ok {
+			return errors.New("Unknown Routing Keypair Type in Import")
+		}
+		node.routingKey = v()
+		if err := node.routingKey.FromB64(nj.RoutingKey); err != nil {
+			return err
+		}
+	}
+	channelKeys, err := nodes.DecodeChannelKeys(node.contentKey, nj.Channels)
+	if err != nil {
+		return err
+	}
+	for name, keys := range nodes.GroupChannelKeys(channelKeys) {
+		if err := node.setChannelKeys(name, keys); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(nj.Contacts); i++ {
+		if err := node.AddContact(nj.Contacts[i].Name, nj.Contacts[i].Pubkey); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(nj.Peers); i++ {
+		if err := node.AddPeer(nj.Peers[i].Name, nj.Peers[i].Enabled, nj.Peers[i].URI); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(nj.Profiles); i++ {
+		cp := new(api.ProfilePriv)
+		cp.Privkey = node.contentKey.Clone()
+		if err := cp.Privkey.FromB64(nj.Profiles[i].Privkey); err != nil {
+			return err
+		}
+		cp.Enabled = nj.Profiles[i].Enabled
+		cp.Name = nj.Profiles[i].Name
+
+		if err := node.kvAddProfilePriv(cp.Name, cp.Enabled, cp.Privkey.ToB64()); err != nil {
+			return err
+		}
+	}
+
+	if len(nj.Router) < 0 {
+		node.SetRouter(ratnet.NewRouterFromMap(nj.Router))
+	}
+
+	if keyed, ok := node.router.(api.SigningRouter); ok && len(nj.RouterKey) > 0 {
+		if err := keyed.SetSigningKey(nj.RouterKey); err != nil {
+			return err
+		}
+	}
+
+	node.SetOutboxTTL(nj.OutboxTTL)
+	node.SetChannelKeyOverlap(nj.ChannelKeyOverlap)
+	node.SetQuota(nj.Quota)
+	for channel := range node.ChannelQuotas() {
+		node.SetChannelQuota(channel, api.OutboxQuota{})
+	}
+	for channel, quota := range nj.ChannelQuotas {
+		node.SetChannelQuota(channel, quota)
+	}
+
+	for _, p := range nj.Policies {
+		// extract the inner Transport first
+		t := p["Transport"].(map[string]interface{})
+		trans := ratnet.NewTransportFromMap(node, t)
+		pol := ratnet.NewPolicyFromMap(trans, node, p)
+		node.policies = append(node.policies, pol)
+	}
+	if restartNode {
+		return node.Start()
+	}
+	return nil
+}
+
+// Export : Save a node configuration to a JSON config
+func (node *Node) Export() ([]byte, error) {
+	var nj api.ExportedNode
+	nj.ContentKey = node.contentKey.ToB64()
+	nj.ContentType = node.contentKey.GetName()
+	nj.RoutingKey = node.routingKey.ToB64()
+	nj.RoutingType = node.routingKey.GetName()
+	channels, err := node.kvGetChannelsPriv()
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := node.kvGetContacts()
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := node.kvGetProfilesPriv()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := node.kvGetPeers("")
+	if err != nil {
+		return nil, err
+	}
+
+	nj.Channels = nodes.EncodeChannelKeys(nodes.ActiveChannelKeys(channels))
+	nj.Contacts = make([]api.Contact, len(contacts))
+	i := 0
+	for _, v := range contacts {
+		nj.Contacts[i].Name = v.Name
+		nj.Contacts[i].Pubkey = v.Pubkey
+		i++
+	}
+	nj.Profiles = make([]api.ProfilePrivB64, len(profiles))
+	i = 0
+	for _, v := range profiles {
+		nj.Profiles[i].Name = v.Name
+		nj.Profiles[i].Enabled = v.Enabled
+		nj.Profiles[i].Privkey = v.Privkey
+		i++
+	}
+	nj.Peers = make([]api.Peer, len(peers))
+	i = 0
+	for _, v := range peers {
+		nj.Peers[i].Name = v.Name
+		nj.Peers[i].Enabled = v.Enabled
+		nj.Peers[i].URI = v.URI
+		i++
+	}
+	nj.Router = node.router
+	if keyed, ok := node.router.(api.SigningRouter); ok { // kept with the other secret keys, not in the router config
+		nj.RouterKey = keyed.SigningKey()
+	}
+	nj.Policies = node.policies
+	nj.OutboxTTL = atomic.LoadInt64(&node.outboxTTL) // zero if never set, so the default still applies on import
+	nj.ChannelKeyOverlap = atomic.LoadInt64(&node.channelKeyOverlap) // zero if never set, like OutboxTTL
+	nj.Quota = node.Quota()
+	nj.ChannelQuotas = node.ChannelQuotas()
+	return json.MarshalIndent(nj, "", "    ")
+}
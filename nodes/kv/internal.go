@@ -0,0 +1,172 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/api/multicast"
+	"github.com/awgh/ratnet/api/receipt"
+	"github.com/awgh/ratnet/nodes"
+)
+
+// GetChannelPrivKey : Return the private key of a given channel
+func (node *Node) GetChannelPrivKey(name string) (string, error) {
+	return node.kvGetChannelPrivKey(name)
+}
+
+// Forward - Add an already-encrypted message to the outbound message queue (forward it along)
+func (node *Node) Forward(msg api.Msg) error {
+	m := nodes.NewOutboxMsg(msg, msg.Content.Bytes())
+	m.Forwarded = true
+	m.Ingress = msg.Ingress.Peer
+	return node.outbox.Enqueue(m)
+}
+
+// Handle - Decrypt and handle an encrypted message
+func (node *Node) Handle(msg api.Msg) (bool, error) {
+	var clear []byte
+	var err error
+	var tagOK bool
+	var clearMsg api.Msg // msg to out channel
+
+	if msg.IsChan {
+		keys, ok := node.channelKey(msg.Name)
+		if !ok {
+			return false, errors.New("Cannot Handle message for Unknown Channel")
+		}
+		clearMsg = api.Msg{Name: msg.Name, IsChan: true, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader, Ingress: msg.Ingress}
+		for _, v := range nodes.ActiveChannelKeys(keys) { // newest first, older keys while they overlap
+			if tagOK, clear, err = v.Privkey.DecryptMessage(msg.Content.Bytes()); tagOK {
+				break
+			}
+		}
+	} else if len(msg.Name) > 0 {
+		clearMsg = api.Msg{Name: msg.Name, IsChan: false, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader, Ingress: msg.Ingress}
+		var key bc.KeyPair
+		key, err = node.privProfile(msg.Name)
+		if err != nil {
+			return false, err
+		}
+		tagOK, clear, err = key.DecryptMessage(msg.Content.Bytes())
+	} else {
+		clearMsg = api.Msg{Name: "[content]", IsChan: false, Chunked: msg.Chunked, StreamHeader: msg.StreamHeader, Ingress: msg.Ingress}
+		if msg.Multicast {
+			var sender bc.PubKey
+			tagOK, clear, sender, err = multicast.Open(node.contentKey, msg.Content.Bytes())
+			if sender != nil { // signed, and the signature checked out
+				clearMsg.PubKey, clearMsg.Signed = sender, true
+				if name := multicast.ContactName(node, sender); name != "" {
+					clearMsg.Name = name
+				}
+			}
+		} else {
+			tagOK, clear, err = node.contentKey.DecryptMessage(msg.Content.Bytes())
+		}
+	}
+	// DecryptMessage will return !tagOK if the quick-check fails, which is common
+	if !tagOK || err != nil {
+		return tagOK, err
+	}
+	clearMsg.Content = bytes.NewBuffer(clear)
+
+	if msg.Nack {
+		return true, chunking.HandleNack(node, clearMsg)
+	}
+
+	if msg.Receipt {
+		var deliver bool
+		if clearMsg, deliver, err = receipt.Handle(node, clearMsg); !deliver || err != nil {
+			return true, err
+		}
+	}
+
+	if msg.Chunked {
+		err = chunking.HandleChunked(node, clearMsg)
+		if err != nil {
+			return false, err
+		}
+		node.trigggerMutex.Lock()
+		defer node.trigggerMutex.Unlock()
+		node.debouncer.Trigger()
+		return true, err
+	}
+
+	select {
+	case node.Out() <- clearMsg:
+		events.Debug(node, "Sent message "+fmt.Sprint(msg.Content.Bytes()))
+	default:
+		events.Debug(node, "No message sent")
+	}
+	return tagOK, nil
+}
+
+func (node *Node) refreshChannels() { // todo: this could be selective or somehow less heavy
+	// refresh the channelKeys map
+	channels, err := node.kvGetChannelsPriv()
+	if err != nil {
+		events.Error(node, "refreshChannels failed: "+err.Error())
+		return
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for name, keys := range nodes.GroupChannelKeys(channels) {
+		node.channelKeys[name] = keys
+	}
+}
+
+// channelKey - returns the cached keys of a channel, newest first
+func (node *Node) channelKey(name string) ([]api.ChannelPriv, bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	keys, ok := node.channelKeys[name]
+	return keys, ok
+}
+
+// setChannelKeys - replaces the keys of a channel, newest first
+func (node *Node) setChannelKeys(name string, keys []api.ChannelPriv) error {
+	if err := node.kvSetChannelKeys(name, keys); err != nil {
+		return err
+	}
+	node.refreshChannels()
+	return nil
+}
+
+// RetainChunk - keeps a copy of an outbound chunk for retransmission
+func (node *Node) RetainChunk(msg api.Msg) error {
+	return node.retainer.Retain(msg)
+}
+
+// ResendChunks - re-queues retained chunks of a stream to the outbox
+func (node *Node) ResendChunks(streamID uint32, chunkNums []uint32) error {
+	return node.retainer.Resend(node, streamID, chunkNums)
+}
+
+// OpenStream - starts a chunked transfer to a contact or channel, chunked as it is written
+func (node *Node) OpenStream(dest string, channel bool) (io.WriteCloser, error) {
+	return chunking.OpenStream(node, dest, channel)
+}
+
+// SendReceipted - send a direct message and ask the recipient for a delivery receipt
+func (node *Node) SendReceipted(msg api.Msg) (api.MsgID, error) {
+	id, err := receipt.Send(node, msg)
+	if err == nil {
+		node.tracker.Receipted(id)
+	}
+	return id, err
+}
+
+// ConfirmDelivery - records that the receipt for a message sent with SendReceipted arrived
+func (node *Node) ConfirmDelivery(id api.MsgID) bool {
+	return node.tracker.Delivered(id)
+}
+
+// SetStreamHandler - hands incoming chunked streams to handler instead of reassembling them to Out()
+func (node *Node) SetStreamHandler(handler api.StreamHandler) {
+	node.readers.SetHandler(handler)
+}
@@ -0,0 +1,511 @@
+package kv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/bencrypt/rsa"
+	"github.com/awgh/ratnet/api"
+	ramoutbox "github.com/awgh/ratnet/outbox/ram"
+	"github.com/awgh/ratnet/policy/server"
+	"github.com/awgh/ratnet/router"
+	"github.com/awgh/ratnet/transports/https"
+	"github.com/awgh/ratnet/transports/tls"
+	"github.com/awgh/ratnet/transports/udp"
+)
+
+var node *Node
+
+// kvtmp - directory of the database shared by the tests, removed by TestMain
+var kvtmp string
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if node != nil {
+		node.Stop()
+	}
+	os.RemoveAll(kvtmp)
+	os.Exit(code)
+}
+
+func Test_init(t *testing.T) {
+	node = New(new(ecc.KeyPair), new(ecc.KeyPair))
+	var err error
+	if kvtmp, err = ioutil.TempDir("", "kvtmp"); err != nil {
+		t.Fatal(err)
+	}
+	node.BootstrapDB(filepath.Join(kvtmp, "ratnet_test.db"))
+	node.FlushOutbox(0)
+	if err := node.routingKey.FromB64(pubprivkeyb64Ecc); err != nil {
+		log.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func Test_apicall_ID_1(t *testing.T) {
+	result, err := node.ID()
+	if err != nil {
+		t.Error(err.Error())
+	}
+	t.Log("API ID RESULT: ", result)
+}
+
+func Test_apicall_AddContact_1(t *testing.T) {
+	p1 := pubkeyb64Ecc
+	if err := node.AddContact("destname1", p1); err != nil {
+		t.Error(err.Error())
+	}
+	contact, err := node.GetContact("destname1")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	t.Logf("API AddContact RESULT: %+v\n", contact)
+	if contact == nil {
+		t.Fail()
+	}
+}
+
+func Test_apicall_Send_1(t *testing.T) {
+	err := node.Send("destname1", []byte(pubkeyb64))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	t.Log("API Send RESULT: OK")
+}
+
+func Test_apicall_Pickup_1(t *testing.T) {
+	rpk, err := node.ID()
+	if err != nil {
+		t.Error(err.Error())
+	}
+	_, err = node.Pickup(rpk, 0, 0)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	t.Log("API Pickup RESULT: OK")
+}
+
+func Test_apicall_Channels_1(t *testing.T) {
+	message := api.Msg{Name: "destname1", IsChan: false}
+	message.Content = bytes.NewBufferString(testMessage1)
+	node.In() <- message
+
+	t.Log("API Channel TX: ")
+	t.Log(message)
+}
+
+func Test_streams_Verify_1(t *testing.T) {
+	digest := sha256.Sum256([]byte("hello, world"))
+	header := api.StreamHeader{NumChunks: 2, Length: 12, Digest: digest[:]}
+
+	// good stream is delivered
+	header.StreamID = 0x1001
+	if err := node.AddStream(header); err != nil {
+		t.Fatal(err)
+	}
+	node.AddChunk(0x1001, 0, []byte("hello, "))
+	node.AddChunk(0x1001, 1, []byte("world"))
+	select {
+	case msg := <-node.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Errorf("Wrong message delivered: %s", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Verified stream not delivered")
+	}
+
+	// tampered stream is dropped and reported
+	header.StreamID = 0x1002
+	if err := node.AddStream(header); err != nil {
+		t.Fatal(err)
+	}
+	node.AddChunk(0x1002, 0, []byte("hello, "))
+	node.AddChunk(0x1002, 1, []byte("WORLD"))
+	timeout := time.After(2 * time.Second)
+	for corrupted := false; !corrupted; {
+		select {
+		case msg := <-node.Out():
+			t.Fatalf("Corrupted stream delivered: %s", msg.Content.String())
+		case ev := <-node.Events():
+			corrupted = ev.Type == api.StreamCorrupted
+		case <-timeout:
+			t.Fatal("Corrupted stream not reported")
+		}
+	}
+}
+
+func Test_stop(t *testing.T) {
+	node.Stop()
+}
+
+// newTestNode - a node backed by its own database file, removed when the test ends
+func newTestNode(t *testing.T, contentKey, routingKey bc.KeyPair) *Node {
+	n := New(contentKey, routingKey)
+	n.BootstrapDB(filepath.Join(t.TempDir(), "ratnet_test.db"))
+	return n
+}
+
+// outboxMsgs - everything queued in a node's outbox, oldest first
+func outboxMsgs(t *testing.T, n *Node) [][]byte {
+	msgs, _, err := n.Outbox().MsgsSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func Test_persist_Reopen_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_test.db")
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	n.BootstrapDB(dbFile)
+	cid, _ := n.CID()
+	if err := n.AddContact("self", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Send("self", []byte(testMessage1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys, contacts and the outbox all come back from the file
+	n = New(new(ecc.KeyPair), new(ecc.KeyPair))
+	n.BootstrapDB(dbFile)
+	reopened, _ := n.CID()
+	if !bytes.Equal(cid.ToBytes(), reopened.ToBytes()) {
+		t.Error("Content key not restored")
+	}
+	if _, err := n.GetContact("self"); err != nil {
+		t.Error(err)
+	}
+	if msgs := outboxMsgs(t, n); len(msgs) != 1 {
+		t.Errorf("Expected 1 queued message after reopening, got %d", len(msgs))
+	}
+}
+
+func Test_nack_Retransmit_1(t *testing.T) {
+	sender := newTestNode(t, new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := newTestNode(t, new(ecc.KeyPair), new(ecc.KeyPair))
+	sender.nackTimer.SetInterval(50 * time.Millisecond)
+	receiver.nackTimer.SetInterval(50 * time.Millisecond)
+	if err := sender.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+
+	// big enough for three chunks
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+	cid, _ := receiver.CID()
+	if _, err := sender.SendMsg(api.Msg{Content: bytes.NewBuffer(payload), PubKey: cid}); err != nil {
+		t.Fatal(err)
+	}
+
+	// deliver everything except the second chunk
+	chunks := 0
+	queued := outboxMsgs(t, sender)
+	sent := len(queued)
+	for _, m := range queued {
+		if m[0]&api.ChunkedFlag != 0 && m[0]&api.StreamHeaderFlag == 0 {
+			chunks++
+			if chunks == 2 {
+				continue
+			}
+		}
+		if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// wait for the receiver to NACK the missing chunk back to the sender
+	var nack []byte
+	for i := 0; i < 100 && nack == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		for _, m := range outboxMsgs(t, receiver) {
+			if m[0]&api.NackFlag != 0 {
+				nack = m
+			}
+		}
+	}
+	if nack == nil {
+		t.Fatal("Receiver never sent a NACK")
+	}
+	if err := sender.router.Route(sender, nack, api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	queued = outboxMsgs(t, sender)
+	if len(queued) != sent+1 {
+		t.Fatalf("Expected 1 resent chunk, got %d", len(queued)-sent)
+	}
+	if err := receiver.router.Route(receiver, queued[sent], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-receiver.Out():
+		if !bytes.Equal(msg.Content.Bytes(), payload) {
+			t.Error("Reassembled message does not match")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Stream not reassembled after retransmission")
+	}
+}
+
+func Test_streams_Handler_1(t *testing.T) {
+	sender := newTestNode(t, new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := newTestNode(t, new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := sender.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	receiver.SetStreamHandler(func(stream api.StreamHeader, r io.Reader) {
+		data, err := ioutil.ReadAll(r)
+		results <- result{data, err}
+	})
+
+	cid, _ := receiver.CID()
+	if err := sender.AddContact("receiver", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	w, err := sender.OpenStream("receiver", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// big enough for several chunks, written in odd sizes
+	payload := bytes.Repeat([]byte(testMessage1), 1+(300*1024)/len(testMessage1))
+	for p := payload; len(p) > 0; {
+		n := 7777
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range outboxMsgs(t, sender) {
+		if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if !bytes.Equal(res.data, payload) {
+			t.Error("Streamed message does not match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Stream handler did not finish reading")
+	}
+}
+
+func Test_chunking_Overhead_1(t *testing.T) {
+	cert, key, err := bc.GenerateSSLCertBytes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+
+	for _, contentKey := range []bc.KeyPair{new(ecc.KeyPair), new(rsa.KeyPair)} {
+		n := newTestNode(t, contentKey, new(ecc.KeyPair))
+		cid, _ := n.CID()
+		if err := n.AddContact("self", cid.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.AddChannel("a-channel-with-a-rather-long-name", n.contentKey.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		transports := []api.Transport{udp.New(n), tls.New(cert, key, n, true), https.New(cert, key, n, true)}
+		for _, transport := range transports {
+			// every transport's own limit, and one small enough to chunk on
+			for _, limit := range []int64{transport.ByteLimit(), 4096} {
+				transport.SetByteLimit(limit)
+				n.SetPolicy(server.New(transport, "", false))
+				n.SetOutbox(ramoutbox.New())
+				if err := n.Send("self", payload); err != nil {
+					t.Fatal(err)
+				}
+				if err := n.SendChannel("a-channel-with-a-rather-long-name", payload); err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range outboxMsgs(t, n) {
+					if int64(len(m)) > limit {
+						t.Errorf("%s: %d byte message over %s limit of %d", contentKey.GetName(), len(m), transport.Name(), limit)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_chunking_Fragment_1(t *testing.T) {
+	sender := newTestNode(t, new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := newTestNode(t, new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+
+	// a constrained transport next to a fast one
+	small := udp.New(sender)
+	small.SetByteLimit(4096)
+	cert, key, err := bc.GenerateSSLCertBytes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.SetPolicy(server.New(small, "", false), server.New(tls.New(cert, key, sender, true), "", false))
+
+	cid, _ := receiver.CID()
+	if err := sender.AddContact("receiver", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+	if err := sender.Send("receiver", payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range outboxMsgs(t, sender) {
+		if m[0]&api.StreamHeaderFlag == 0 && len(m) <= 4096 {
+			t.Fatalf("Chunk of %d bytes sized for the small transport", len(m))
+		}
+	}
+
+	// pick everything up over the small transport, fragments and all
+	rpub := receiver.routingKey.GetPubKey()
+	var lastTime int64
+	for i := 0; i < 1000; i++ {
+		bundle, err := sender.Pickup(rpub, lastTime, small.ByteLimit())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bundle.Data == nil {
+			break
+		}
+		lastTime = bundle.Time
+		if err := receiver.Dropoff(bundle); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case msg := <-receiver.Out():
+		if !bytes.Equal(msg.Content.Bytes(), payload) {
+			t.Error("Reassembled message does not match")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Fragmented message not reassembled")
+	}
+}
+
+// Test Messages
+
+var testMessage1 = `'In THAT direction,' the Cat said, waving its right paw round, 'lives a Hatter: and in THAT direction,' waving the other paw, 'lives a March Hare. Visit either you like: they're both mad.'
+'But I don't want to go among mad people,' Alice remarked.
+'Oh, you can't help that,' said the Cat: 'we're all mad here. I'm mad. You're mad.'
+'How do you know I'm mad?' said Alice.
+'You must be,' said the Cat, 'or you wouldn't have come here.'`
+
+// RSA TEST KEYS
+var pubkeyb64 = "LS0tLS1CRUdJTiBQVUJMSUMgS0VZLS0tLS0KTUlJQ0lqQU5CZ2txaGtpRzl3MEJB" +
+	"UUVGQUFPQ0FnOEFNSUlDQ2dLQ0FnRUFzSFpRNndSTS9WNXI2REdDcjJpbwpVczEw" +
+	"T1JheUlQWkVtNFJ3YXFKU2Y4S2RuYVdhOHNQZFFJbnJwZjBsOWIyZHFPSFdrNDVw" +
+	"YkhxUlJleWhPQzhJCk9tbWRmSXdxYm14cXpuUXhDWHRsZWsrd3dyQTdLWGRyVWty" +
+	"NGVJSGJkbzFnNlRGQkd3ZVJtR2tsR2t5Wm5MNVgKV2tNWUZnQ2JuN3MxOTFFcm9u" +
+	"L3l4ajBXdUtEM3dwZ1pvTjdxeW1UMWRSTEVROGJnSUU0WUQ3UDdRYnBjRjMrRApp" +
+	"YnVFUW53R1FxM1lYQnlCa0ZCOTdzVDNjUjVqM2Z2ZlJwd1UweXowYTdxRXp0Nm5F" +
+	"NVJXcmtoNGJDUTZPNHg4CjNZdjZqSGtPampNdFNUVlRsNE8zNW51QWFYRXB1NEo5" +
+	"S0E2VXpXdzN0eDF6UHNFNkdhaTd3S0kxWmpEOENicHkKU1M3emdrSmR4WWgzRmFn" +
+	"Q3dIN2U4emVDRW5YbWdIR01FaUJPZWFoN1MrejE3WlRhSHFzZW1sMjBRR1NEN0F4" +
+	"egpMVjlLWHl0NjNmVno4UGE5enAwOW4zUS8yakpYRlFvNzYyQ0dKbGVuT1dOejlL" +
+	"ZFVub1MxOE5ZSUdDMi9oOTRECjdWbktDbzVKRVJyRy9Xa3Z6a3hvSnMzTGZESUw1" +
+	"VkhFUlI5T3FsVnBWM3oxQ3JHYzV6WitTTXluQ1VsYVdTWHQKMUZzUjNqdFplcXc4" +
+	"dmZZZUxXYkRMei8zQUJQME1wbG9tMWxVWUFQWUs5UCtXTEt5OVBYaVlGV2ZJdmJX" +
+	"YkV0ZwpjZkl3VXBtYWozLzlETkVwOHBWSThSWFJTa3IxQXVaa0tYMTA1Y0R6amdU" +
+	"bjd1Uk1mUFJEeVZwcGw1aWxhN2QvCnA3SnE3eHk5MGxnMnpVWFUwVXVDWGhrQ0F3" +
+	"RUFBUT09Ci0tLS0tRU5EIFBVQkxJQyBLRVktLS0tLQo="
+
+// ECC TEST KEYS
+func Test_seen_Persist_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_seen.db")
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	newRelay := func() (*Node, *router.DefaultRouter) {
+		n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+		n.BootstrapDB(dbFile)
+		r := router.NewDefaultRouter()
+		r.PersistSeen = true
+		n.SetRouter(r)
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return n, r
+	}
+
+	n1, r1 := newRelay()
+	if _, err := n1.SendMsg(api.Msg{Name: "seen", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString(testMessage1)}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _, err := n1.Outbox().MsgsSince(0, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	if err := r1.Route(n1, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+	if err := n1.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh relay on the same database still remembers the message
+	n2, r2 := newRelay()
+	defer n2.Stop()
+	if err := r2.Route(n2, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r2.SeenStats(); stats.Seen != 1 {
+		t.Errorf("Expected the message to be filtered out after a restart, got %+v", stats)
+	}
+
+	if err := n2.ForgetSeen(time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := n2.LoadSeen(0); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries left, got %d %v", len(entries), err)
+	}
+}
+
+var (
+	pubprivkeyb64Ecc = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq1+dln3M3IaOmg+YfTIbBpk+jIbZZZiT+4CoeFzaJGEWmg=="
+	pubkeyb64Ecc     = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq18="
+)
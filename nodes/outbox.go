@@ -0,0 +1,51 @@
+package nodes
+
+import (
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// NewOutboxMsg : frames an encrypted message for the outbox, prepending the flags byte,
+// the channel name and the TTL header that the router parses on the far side
+func NewOutboxMsg(msg api.Msg, data []byte) api.OutboxMsg {
+	flags := uint8(0)
+	if msg.IsChan {
+		flags |= api.ChannelFlag
+	}
+	if msg.Chunked {
+		flags |= api.ChunkedFlag
+	}
+	if msg.StreamHeader {
+		flags |= api.StreamHeaderFlag
+	}
+	if msg.Nack {
+		flags |= api.NackFlag
+	}
+	if msg.Receipt {
+		flags |= api.ReceiptFlag
+	}
+	if msg.Multicast {
+		flags |= api.MulticastFlag
+	}
+	if msg.HasTTL() {
+		flags |= api.TTLFlag
+	}
+	rxsum := []byte{flags} // prepend flags byte
+
+	var m api.OutboxMsg
+	if msg.IsChan {
+		// prepend a uint16 of channel name length, big-endian
+		t := uint16(len(msg.Name))
+		rxsum = append(rxsum, byte(t>>8), byte(t&0xFF))
+		rxsum = append(rxsum, []byte(msg.Name)...)
+		m.Channel = msg.Name
+	}
+	if msg.HasTTL() {
+		rxsum = api.AppendTTLHeader(rxsum, msg)
+	}
+	m.Msg = append(rxsum, data...)
+	m.Timestamp = time.Now().UnixNano()
+	m.Priority = msg.Priority
+	return m
+}
@@ -3,15 +3,15 @@ package qldb
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"strings"
 	"time"
 
 	"github.com/awgh/bencrypt/bc"
-	"github.com/awgh/debouncer"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/chunking"
 	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/api/multicast"
+	"github.com/awgh/ratnet/nodes"
 )
 
 // CID : Return content key
@@ -70,7 +70,8 @@ func (node *Node) GetChannels() ([]api.Channel, error) {
 	return node.qlGetChannels()
 }
 
-// AddChannel : Add a channel to this node's database
+// AddChannel : Add a channel to this node's database, or give it a new key,
+// the older keys keep working for ChannelKeyOverlap seconds
 func (node *Node) AddChannel(name string, privkey string) error {
 	if err := node.qlAddChannel(name, privkey); err != nil {
 		return err
@@ -162,7 +163,8 @@ func (node *Node) Send(contactName string, data []byte, pubkey ...bc.PubKey) err
 			return err
 		}
 	}
-	return node.SendMsg(api.Msg{Name: contactName, Content: bytes.NewBuffer(data), IsChan: false, PubKey: destkey, Chunked: false})
+	_, err := node.SendMsg(api.Msg{Name: contactName, Content: bytes.NewBuffer(data), IsChan: false, PubKey: destkey, Chunked: false})
+	return err
 }
 
 // SendChannel : Transmit a message to a channel
@@ -172,58 +174,75 @@ func (node *Node) SendChannel(channelName string, data []byte, pubkey ...bc.PubK
 	if pubkey != nil && len(pubkey) > 0 && pubkey[0] != nil { // third argument is optional PubKey override
 		destkey = pubkey[0]
 	} else {
-		key, ok := node.channelKeys[channelName]
+		keys, ok := node.channelKeys[channelName]
 		if !ok {
 			return errors.New("No public key for Channel")
 		}
-		destkey = key.GetPubKey()
+		destkey = keys[0].Privkey.GetPubKey() // the newest key
 	}
 
 	if destkey == nil {
 		events.Critical(node, "nil DestKey in SendChannel")
 	}
-	return node.SendMsg(api.Msg{Name: channelName, Content: bytes.NewBuffer(data), IsChan: true, PubKey: destkey, Chunked: false})
+	_, err := node.SendMsg(api.Msg{Name: channelName, Content: bytes.NewBuffer(data), IsChan: true, PubKey: destkey, Chunked: false})
+	return err
 }
 
-// SendMsg : Transmits a message
-func (node *Node) SendMsg(msg api.Msg) error {
+// SendMsg : Transmits a message, returns the MsgID its status is tracked by
+func (node *Node) SendMsg(msg api.Msg) (api.MsgID, error) {
+	if msg.ID == (api.MsgID{}) {
+		var err error
+		if msg.ID, err = api.NewMsgID(); err != nil {
+			return msg.ID, err
+		}
+	}
+	if msg.Signed { // signatures travel in an envelope for the one recipient
+		if msg.IsChan {
+			return msg.ID, errors.New("Only direct messages can be signed")
+		}
+		if len(msg.Recipients) == 0 {
+			msg.Recipients = []bc.PubKey{msg.PubKey}
+		}
+	}
 	// determine if we need to chunk
-	chunkSize := chunking.ChunkSize(node)                               // finds the minimum transport byte limit
+	chunkSize := chunking.ChunkSize(node, msg)                          // what fits the smallest transport once encrypted
 	if msg.Content.Len() > 0 && uint32(msg.Content.Len()) > chunkSize { // we need to chunk
 		if msg.Chunked { // we're already chunked, freak out!
-			return errors.New("Chunked message needs to be chunked, bailing out")
+			return msg.ID, errors.New("Chunked message needs to be chunked, bailing out")
 		}
-		return chunking.SendChunked(node, chunkSize, msg)
+		return msg.ID, chunking.SendChunked(node, chunkSize, msg)
+	}
+	var data []byte
+	var err error
+	if len(msg.Recipients) > 0 { // one envelope for all of them
+		if msg.IsChan {
+			return msg.ID, errors.New("Multiple recipients are only for direct messages")
+		}
+		msg.Multicast = true
+		data, err = multicast.Seal(node.contentKey, msg.Recipients, msg.Content.Bytes(), msg.Signed)
+	} else {
+		data, err = node.contentKey.EncryptMessage(msg.Content.Bytes(), msg.PubKey)
 	}
-	data, err := node.contentKey.EncryptMessage(msg.Content.Bytes(), msg.PubKey)
 	if err != nil {
-		return err
+		return msg.ID, err
 	}
 
-	flags := uint8(0)
-	if msg.IsChan {
-		flags |= api.ChannelFlag
-	}
-	if msg.Chunked {
-		flags |= api.ChunkedFlag
-	}
-	if msg.StreamHeader {
-		flags |= api.StreamHeaderFlag
+	m := nodes.NewOutboxMsg(msg, data)
+	if err := node.outbox.Enqueue(m); err != nil {
+		return msg.ID, err
 	}
-	rxsum := []byte{flags} // prepend flags byte
+	node.tracker.Queued(msg.ID, m.Msg)
+	return msg.ID, nil
+}
 
-	if msg.IsChan {
-		// prepend a uint16 of channel name length, little-endian
-		t := uint16(len(msg.Name))
-		rxsum = append(rxsum, byte(t>>8), byte(t&0xFF))
-		rxsum = append(rxsum, []byte(msg.Name)...)
-	}
-	data = append(rxsum, data...)
-	ts := time.Now().UnixNano()
-	if msg.IsChan {
-		return node.qlOutboxEnqueue(msg.Name, data, ts, false)
-	}
-	return node.qlOutboxEnqueue("", data, ts, false)
+// GetMsgStatus : Returns what has become of a message sent with SendMsg
+func (node *Node) GetMsgStatus(id api.MsgID) (*api.MsgStatus, error) {
+	return node.tracker.Status(id)
+}
+
+// GetMsgStatuses : Returns the status of every message this node is tracking
+func (node *Node) GetMsgStatuses() ([]api.MsgStatus, error) {
+	return node.tracker.Statuses(), nil
 }
 
 // SendBulk : Transmit messages to a single key
@@ -256,11 +275,11 @@ func (node *Node) SendChannelBulk(channelName string, data [][]byte, pubkey ...b
 	if pubkey != nil && len(pubkey) > 0 && pubkey[0] != nil { // third argument is optional PubKey override
 		destkey = pubkey[0]
 	} else {
-		key, ok := node.channelKeys[channelName]
+		keys, ok := node.channelKeys[channelName]
 		if !ok {
 			return errors.New("No public key for Channel")
 		}
-		destkey = key.GetPubKey()
+		destkey = keys[0].Privkey.GetPubKey() // the newest key
 	}
 
 	if destkey == nil {
@@ -285,18 +304,18 @@ func (node *Node) sendBulk(channelName string, destkey bc.PubKey, msg [][]byte)
 	}
 
 	// todo: is this passing msg by reference or not???
-	data := make([][]byte, len(msg))
+	ts := time.Now().UnixNano()
+	data := make([]api.OutboxMsg, len(msg))
 	for i := range msg {
-		var err error
-		data[i], err = node.contentKey.EncryptMessage(msg[i], destkey)
+		ct, err := node.contentKey.EncryptMessage(msg[i], destkey)
 		if err != nil {
 			return err
 		}
-		data[i] = append(rxsum, data[i]...)
+		data[i].Channel = channelName
+		data[i].Msg = append(rxsum, ct...)
+		data[i].Timestamp = ts + int64(i) // increment timestamp by one each message to simplify queueing
 	}
-	ts := time.Now().UnixNano()
-	node.outboxBulkInsert(channelName, ts, data)
-	return nil
+	return node.outbox.Enqueue(data...)
 }
 
 // Start : starts the Connection Policy threads
@@ -306,6 +325,14 @@ func (node *Node) Start() error {
 		return nil
 	}
 	node.setIsRunning(true)
+	node.stop = make(chan struct{})
+
+	// reload the router's loop detection state, for routers that keep it in the node
+	if r, ok := node.router.(api.SeenPersister); ok {
+		if err := r.RestoreSeen(node); err != nil {
+			events.Error(node, "Could not restore seen messages: "+err.Error())
+		}
+	}
 
 	// start the policies
 	if node.policies != nil {
@@ -329,59 +356,34 @@ func (node *Node) Start() error {
 			if !more {
 				break
 			}
-			if err := node.SendMsg(message); err != nil {
+			if _, err := node.SendMsg(message); err != nil {
 				events.Error(node, err.Error())
 			}
 		}
 	}()
 
 	node.trigggerMutex.Lock()
-	defer node.trigggerMutex.Unlock()
-	node.debouncer = debouncer.New(10*time.Millisecond, func() {
+	node.debouncer = nodes.NewDebouncer(10*time.Millisecond, func() {
 		node.trigggerMutex.Lock()
 		defer node.trigggerMutex.Unlock()
 		// check if we should stop running
 		if !node.IsRunning() {
 			return
 		}
-		// get all streams
-		streams, err := node.qlGetStreams()
-		if err != nil {
-			events.Critical(node, err.Error())
-		}
-		// for each stream, count chunks for that header
-		for _, stream := range streams {
-			count, err := node.qlGetChunkCount(stream.StreamID)
-			if err != nil {
-				events.Critical(node, err.Error())
-			}
-			// if chunks == total chunks, re-assemble Msg and call Handle
-			if count == uint64(stream.NumChunks) {
-				chunks, err := node.qlGetChunks(stream.StreamID)
-				if err != nil {
-					events.Critical(node, err.Error())
-				}
-				buf := bytes.NewBuffer([]byte{})
-				for _, chunk := range chunks {
-					buf.Write(chunk.Data)
-				}
-				var msg api.Msg
-				if len(stream.ChannelName) > 0 {
-					msg.IsChan = true
-					msg.Name = stream.ChannelName
-				}
-				msg.Content = buf
-
-				select {
-				case node.Out() <- msg:
-					events.Debug(node, "Sent message "+fmt.Sprint(msg.Content.Bytes()))
-					node.qlClearStream(stream.StreamID)
-				default:
-					events.Debug(node, "No message sent")
-				}
-			}
-		}
+		nodes.ProcessStreams(node, node.streamStore(), node.readers, node.nackTimer)
 	})
+	node.debouncer.Trigger() // resume streams that were persisted before a restart
+	node.trigggerMutex.Unlock()
+
+	// wake up periodically, so stalled streams get NACKed or expired
+	go nodes.WakeStreams(func() {
+		node.trigggerMutex.Lock()
+		node.debouncer.Trigger()
+		node.trigggerMutex.Unlock()
+	}, node.nackTimer, node.stop)
+
+	// expire old outbound messages, whether or not a policy flushes the outbox
+	go nodes.ExpireOutbox(node, node.OutboxExpiryInterval(), node.stop)
 
 	return nil
 }
@@ -391,5 +393,16 @@ func (node *Node) Stop() {
 	for _, policy := range node.policies {
 		policy.Stop()
 	}
+	node.trigggerMutex.Lock() // wait for a stream pass that is already running
 	node.setIsRunning(false)
+	node.trigggerMutex.Unlock()
+	if node.stop != nil {
+		close(node.stop)
+		node.stop = nil
+	}
+	if r, ok := node.router.(api.SeenPersister); ok {
+		if err := r.FlushSeen(); err != nil {
+			events.Error(node, "Could not save seen messages: "+err.Error())
+		}
+	}
 }
@@ -3,12 +3,12 @@ package qldb
 import (
 	"database/sql"
 	"errors"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/nodes"
+	qloutbox "github.com/awgh/ratnet/outbox/qldb"
 )
 
 // THIS SHOULD BE THE ONLY FILE THAT INCLUDES database/sql !!!
@@ -42,6 +42,34 @@ func (node *Node) transactExec(sql string, params ...interface{}) {
 	}
 }
 
+// addColumn - adds a column to a table made by an older version, which can not have been constrained,
+// so the rows already there are set to value instead, if it is not nil
+func (node *Node) addColumn(table, column, colType string, value interface{}) {
+	c := node.db()
+	r, err := c.Query("SELECT * FROM " + table + " LIMIT 1;")
+	if err != nil {
+		events.Critical(node, err)
+	}
+	columns, err := r.Columns()
+	for r.Next() { // ql still reads the row behind our back, until it is drained
+	}
+	r.Close()
+	closeDB(c)
+	if err != nil {
+		events.Critical(node, err)
+	}
+	for _, col := range columns {
+		if col == column {
+			return // already there
+		}
+	}
+	events.Info(node, "Adding column "+column+" to table "+table)
+	node.transactExec("ALTER TABLE " + table + " ADD " + column + " " + colType + ";")
+	if value != nil {
+		node.transactExec("UPDATE "+table+" SET "+column+" = $1;", value)
+	}
+}
+
 //
 // End Generic Database Functions
 //
@@ -121,11 +149,12 @@ func (node *Node) qlDeleteContact(name string) {
 func (node *Node) qlGetChannelPrivKey(name string) (string, error) {
 	c := node.db()
 	defer closeDB(c)
-	sqlq := "SELECT privkey FROM channels WHERE name==$1;"
+	sqlq := "SELECT privkey,version FROM channels WHERE name==$1 ORDER BY version DESC;"
 	events.Info(node, sqlq, name)
 	r := c.QueryRow(sqlq, name)
 	var privkey string
-	if err := r.Scan(&privkey); err == sql.ErrNoRows {
+	var version int64
+	if err := r.Scan(&privkey, &version); err == sql.ErrNoRows {
 		return "", nil
 	} else if err != nil {
 		events.Error(node, err)
@@ -135,80 +164,116 @@ func (node *Node) qlGetChannelPrivKey(name string) (string, error) {
 }
 
 func (node *Node) qlGetChannels() ([]api.Channel, error) {
-	c := node.db()
-	defer closeDB(c)
-	sqlq := "SELECT name,privkey FROM channels;"
-	events.Info(node, sqlq)
-	r, err := c.Query(sqlq)
-	if r == nil || err != nil {
+	channels, err := node.qlGetChannelsPriv()
+	if err != nil {
 		return nil, err
 	}
-	// defer r.Close()
-	var channels []api.Channel
-	for r.Next() {
-		var n, p string
-		if err := r.Scan(&n, &p); err != nil {
-			return nil, err
-		}
-		prv := node.contentKey.Clone()
-		if err := prv.FromB64(p); err != nil {
-			return nil, err
+	newest := nodes.GroupChannelKeys(channels)
+	var retval []api.Channel
+	for _, v := range channels {
+		if keys, ok := newest[v.Name]; ok { // one per channel
+			retval = append(retval, api.Channel{Name: v.Name, Pubkey: keys[0].Pubkey})
+			delete(newest, v.Name)
 		}
-		channels = append(channels,
-			api.Channel{Name: n, Pubkey: prv.GetPubKey().ToB64()})
 	}
-	return channels, nil
+	return retval, nil
 }
 
+// qlGetChannelsPriv - returns every key of every channel
 func (node *Node) qlGetChannelsPriv() ([]api.ChannelPriv, error) {
 	c := node.db()
 	defer closeDB(c)
-	sqlq := "SELECT name,privkey FROM channels;"
+	sqlq := "SELECT name,privkey,version,expires FROM channels;"
 	events.Info(node, sqlq)
 	r, err := c.Query(sqlq)
 	if r == nil || err != nil {
 		return nil, err
 	}
 	defer r.Close()
-	var channels []api.ChannelPriv
+	channels, err := scanChannelKeys(r)
+	if err != nil {
+		return nil, err
+	}
+	return nodes.DecodeChannelKeys(node.contentKey, channels)
+}
+
+func scanChannelKeys(r *sql.Rows) ([]api.ChannelPrivB64, error) {
+	var channels []api.ChannelPrivB64
 	for r.Next() {
-		var n, p string
-		if err := r.Scan(&n, &p); err != nil {
+		var ch api.ChannelPrivB64
+		if err := r.Scan(&ch.Name, &ch.Privkey, &ch.Version, &ch.Expires); err != nil {
 			return nil, err
 		}
-		prv := node.contentKey.Clone()
-		if err := prv.FromB64(p); err != nil {
-			return nil, err
-		}
-		channels = append(channels,
-			api.ChannelPriv{
-				Name: n, Privkey: prv,
-				Pubkey: prv.GetPubKey().ToB64(),
-			})
+		channels = append(channels, ch)
 	}
-	return channels, nil
+	return channels, r.Err()
 }
 
+// qlAddChannel - gives a channel a new key, see nodes.AddChannelKey
 func (node *Node) qlAddChannel(name, privkey string) error {
+	prv := node.contentKey.Clone()
+	if err := prv.FromB64(privkey); err != nil {
+		return err
+	}
 	c := node.db()
 	defer closeDB(c)
-	// todo: sanity check key via bencrypt
 	tx, err := c.Begin()
 	if err != nil {
 		return err
 	}
-	sqlq := "DELETE FROM channels WHERE name==$1;"
+	sqlq := "SELECT name,privkey,version,expires FROM channels WHERE name==$1 ORDER BY version DESC;"
 	events.Info(node, sqlq, name)
-	_, _ = tx.Exec(sqlq, name)
+	r, err := tx.Query(sqlq, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	channels, err := scanChannelKeys(r)
+	r.Close()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	keys, err := nodes.DecodeChannelKeys(node.contentKey, channels)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	keys = nodes.AddChannelKey(keys, api.ChannelPriv{Name: name, Pubkey: prv.GetPubKey().ToB64(), Privkey: prv}, node.ChannelKeyOverlap())
+	if err := node.qlPutChannelKeys(tx, name, keys); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
-	sqlq = "INSERT INTO channels VALUES( $1, $2 );"
-	events.Info(node, sqlq, name, privkey)
-	if _, err := tx.Exec(sqlq, name, privkey); err != nil {
+// qlSetChannelKeys - replaces the keys of a channel
+func (node *Node) qlSetChannelKeys(name string, keys []api.ChannelPriv) error {
+	c := node.db()
+	defer closeDB(c)
+	tx, err := c.Begin()
+	if err != nil {
 		return err
 	}
-	if err := tx.Commit(); err != nil {
+	if err := node.qlPutChannelKeys(tx, name, keys); err != nil {
+		tx.Rollback()
 		return err
 	}
+	return tx.Commit()
+}
+
+func (node *Node) qlPutChannelKeys(tx *sql.Tx, name string, keys []api.ChannelPriv) error {
+	sqlq := "DELETE FROM channels WHERE name==$1;"
+	events.Info(node, sqlq, name)
+	_, _ = tx.Exec(sqlq, name)
+
+	sqlq = "INSERT INTO channels VALUES( $1, $2, $3, $4 );"
+	for _, ch := range nodes.EncodeChannelKeys(keys) {
+		events.Info(node, sqlq, name, ch.Version)
+		if _, err := tx.Exec(sqlq, name, ch.Privkey, ch.Version, ch.Expires); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -429,159 +494,24 @@ func (node *Node) qlDeletePeer(name string) {
 	node.transactExec("DELETE FROM peers WHERE name==$1;", name)
 }
 
-func (node *Node) qlOutboxEnqueue(channelName string, msg []byte, ts int64, checkExists bool) error {
-	doInsert := !checkExists
-
-	if checkExists {
-		c := node.db()
-		defer closeDB(c)
-		// save message in my outbox, if not already present
-		sqlq := "SELECT channel FROM outbox WHERE channel==$1 AND msg==$2;"
-		events.Info(node, sqlq, channelName, msg)
-		r1 := c.QueryRow(sqlq, channelName, msg)
-		var rc string
-		err := r1.Scan(&rc)
-		if err == sql.ErrNoRows {
-			// we don't have this yet, so add it
-			doInsert = true
-		} else if err != nil {
-			return err
-		}
-	}
-	if doInsert {
-		node.transactExec("INSERT INTO outbox(channel,msg,timestamp) VALUES($1,$2,$3);",
-			channelName, msg, ts)
-	}
-	return nil
-}
-
-func (node *Node) outboxBulkInsert(channelName string, timestamp int64, msgs [][]byte) {
-	c := node.db()
-	defer closeDB(c)
-	tx, err := c.Begin()
-	if err != nil {
-		events.Critical(node, err.Error())
-	}
-	args := make([]interface{}, 1+(2*len(msgs)))
-	args[0] = channelName
-	// args[1] = timestamp
-	idx := 2                                                    // starting 1-based index for 2nd arg
-	sql := "INSERT INTO outbox(channel, msg, timestamp) VALUES" //($1,$2, $3);
-	for i, v := range msgs {
-		// sql += "($1,$" + strconv.Itoa(i+3) + ", $2)"
-		sql += "($1,$" + strconv.Itoa(idx) + ", $" + strconv.Itoa(idx+1) + ")"
-		if i != len(msgs) {
-			sql += ", "
-		} else {
-			sql += ";"
-		}
-		args[idx-1] = v // convert to 0-based index here
-		args[idx] = timestamp
-		timestamp++ // increment timestamp by one each message to simplify queueing
-		idx += 2
-	}
-	events.Info(node, sql, args)
-	_, err = tx.Exec(sql, args...)
-	if err != nil {
-		events.Critical(node, err.Error())
-	}
-	err = tx.Commit()
-	if err != nil {
-		events.Critical(node, err.Error())
-	}
-}
-
-func (node *Node) qlGetMessages(lastTime, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
-	c := node.db()
-	defer closeDB(c)
-	lastTimeReturned := lastTime
-
-	// Build the query
-
-	wildcard := false
-	if len(channelNames) < 1 {
-		wildcard = true // if no channels are given, get everything
-	} else {
-		for _, cname := range channelNames {
-			for _, char := range cname {
-				if !strings.Contains("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0987654321", string(char)) {
-					return nil, lastTimeReturned, errors.New("Invalid character in channel name")
-				}
-			}
-		}
-	}
-	sqlq := "SELECT msg, timestamp FROM outbox"
-	if lastTime != 0 {
-		sqlq += " WHERE (int64(" + strconv.FormatInt(lastTime, 10) +
-			") < timestamp)"
-	}
-	if !wildcard && len(channelNames) > 0 { // QL is broken?  couldn't make it work with prepared stmts
-		if lastTime != 0 {
-			sqlq += " AND"
-		} else {
-			sqlq += " WHERE"
-		}
-		sqlq = sqlq + " channel IN( \"" + channelNames[0] + "\""
-		for i := 1; i < len(channelNames); i++ {
-			sqlq = sqlq + ",\"" + channelNames[i] + "\""
-		}
-		sqlq = sqlq + " )"
-	}
-	sqlq = sqlq + " ORDER BY timestamp ASC;"
-
-	var msgs [][]byte
-	var bytesRead int64
-
-	r, err := c.Query(sqlq)
-	if r == nil || err != nil {
-		return nil, lastTimeReturned, err
-	}
-	defer r.Close()
-
-	n := 0
-	for r.Next() {
-		n++
-		var msg []byte
-		var ts int64
-		r.Scan(&msg, &ts)
-		if bytesRead+int64(len(msg)) > maxBytes { // no room for next msg
-			events.Debug(node, "skipping messages after # results:", n)
-			if n == 0 {
-				return nil, lastTimeReturned, errors.New("Result too big to be fetched on this transport! Flush and rechunk")
-			}
-			break
-		} else {
-			if ts > lastTimeReturned {
-				lastTimeReturned = ts
-			} else {
-				events.Warning(node, "Timestamps not increasing - prev/cur:", lastTimeReturned, ts)
-			}
-			msgs = append(msgs, msg)
-			bytesRead += int64(len(msg))
-		}
-	}
-
-	return msgs, lastTimeReturned, nil
-}
-
 // AddStream - implemented from Node API
-func (node *Node) AddStream(streamID uint32, totalChunks uint32, channelName string) error {
+func (node *Node) AddStream(stream api.StreamHeader) error {
 	node.trigggerMutex.Lock()
 	defer node.trigggerMutex.Unlock()
 	c := node.db()
 	defer closeDB(c)
 	sqlq := "SELECT streamid FROM streams WHERE streamid==$1;"
-	events.Info(node, sqlq, streamID)
-	r := c.QueryRow(sqlq, streamID)
+	events.Info(node, sqlq, stream.StreamID)
+	r := c.QueryRow(sqlq, stream.StreamID)
 	var n int64
 	if err := r.Scan(&n); err == sql.ErrNoRows {
 		events.Debug(node, "New Stream Header")
-		node.transactExec("INSERT INTO streams (streamid,parts,channel) VALUES( $1, $2, $3 );",
-			streamID, totalChunks, channelName)
+		node.transactExec("INSERT INTO streams (streamid,parts,channel,replykey,msglen,digest,firstseen,buffered,signed) VALUES( $1, $2, $3, $4, $5, $6, $7, 0, $8 );",
+			stream.StreamID, stream.NumChunks, stream.ChannelName, stream.ReplyKey, stream.Length, stream.Digest, time.Now().UnixNano(), stream.Signed)
 	} else if err == nil {
-		events.Debug(node, "Update Server")
-		node.transactExec("UPDATE streams SET parts=$1,channel=$2 WHERE streamid==$4;",
-			totalChunks, channelName, streamID)
+		events.Debug(node, "Update Stream Header")
+		node.transactExec("UPDATE streams SET parts=$1,channel=$2,replykey=$3,msglen=$4,digest=$5,signed=$6 WHERE streamid==$7;",
+			stream.NumChunks, stream.ChannelName, stream.ReplyKey, stream.Length, stream.Digest, stream.Signed, stream.StreamID)
 	} else {
 		return err
 	}
@@ -595,11 +525,21 @@ func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error
 	defer node.trigggerMutex.Unlock()
 	c := node.db()
 	defer closeDB(c)
-	sqlq := "SELECT chunknum FROM chunks WHERE streamid==$1 AND chunknum==$2;"
+	sqlq := "SELECT streamid FROM streams WHERE streamid==$1;"
+	events.Info(node, sqlq, streamID)
+	var n int64
+	if err := c.QueryRow(sqlq, streamID).Scan(&n); err == sql.ErrNoRows {
+		// header hasn't arrived yet, insert a placeholder so the chunk can still expire
+		node.transactExec("INSERT INTO streams (streamid,parts,channel,replykey,msglen,firstseen,buffered,signed) VALUES( $1, 0, \"\", \"\", 0, $2, 0, false );",
+			streamID, time.Now().UnixNano())
+	} else if err != nil {
+		return err
+	}
+	sqlq = "SELECT data FROM chunks WHERE streamid==$1 AND chunknum==$2;"
 	events.Info(node, sqlq, streamID, chunkNum)
 	r := c.QueryRow(sqlq, streamID, chunkNum)
-	var n int64
-	if err := r.Scan(&n); err == sql.ErrNoRows {
+	var old []byte
+	if err := r.Scan(&old); err == sql.ErrNoRows {
 		events.Debug(node, "New Chunk")
 		node.transactExec("INSERT INTO chunks (streamid,chunknum,data) VALUES( $1, $2, $3 );",
 			streamID, chunkNum, data)
@@ -610,6 +550,8 @@ func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error
 	} else {
 		return err
 	}
+	node.transactExec("UPDATE streams SET buffered=buffered+$1 WHERE streamid==$2;",
+		int64(len(data)-len(old)), streamID)
 	node.debouncer.Trigger()
 	return nil
 }
@@ -617,13 +559,15 @@ func (node *Node) AddChunk(streamID uint32, chunkNum uint32, data []byte) error
 func (node *Node) qlClearStream(streamID uint32) error {
 	node.transactExec("DELETE FROM chunks WHERE streamid == $1;", streamID)
 	node.transactExec("DELETE FROM streams WHERE streamid == $1;", streamID)
+	node.nackTimer.Forget(streamID)
+	node.readers.Close(streamID)
 	return nil
 }
 
 func (node *Node) qlGetStreams() ([]api.StreamHeader, error) {
 	c := node.db()
 	defer closeDB(c)
-	sqlq := "SELECT streamid,parts,channel FROM streams;"
+	sqlq := "SELECT streamid,parts,channel,replykey,msglen,digest,firstseen,buffered,signed FROM streams;"
 	events.Info(node, sqlq)
 	r, err := c.Query(sqlq)
 	if r == nil || err != nil {
@@ -633,7 +577,7 @@ func (node *Node) qlGetStreams() ([]api.StreamHeader, error) {
 	var streams []api.StreamHeader
 	for r.Next() {
 		var s api.StreamHeader
-		if err := r.Scan(&s.StreamID, &s.NumChunks, &s.ChannelName); err != nil {
+		if err := r.Scan(&s.StreamID, &s.NumChunks, &s.ChannelName, &s.ReplyKey, &s.Length, &s.Digest, &s.FirstSeen, &s.Buffered, &s.Signed); err != nil {
 			return nil, err
 		}
 		streams = append(streams, s)
@@ -676,13 +620,87 @@ func (node *Node) qlGetChunks(streamID uint32) ([]api.Chunk, error) {
 	return chunks, nil
 }
 
+func (node *Node) qlGetChunk(streamID uint32, chunkNum uint32) ([]byte, bool, error) {
+	c := node.db()
+	defer closeDB(c)
+	sqlq := "SELECT data FROM chunks WHERE streamid==$1 AND chunknum==$2;"
+	events.Info(node, sqlq, streamID, chunkNum)
+	var data []byte
+	if err := c.QueryRow(sqlq, streamID, chunkNum).Scan(&data); err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (node *Node) qlRemoveChunk(streamID uint32, chunkNum uint32) error {
+	data, ok, err := node.qlGetChunk(streamID, chunkNum)
+	if err != nil || !ok {
+		return err
+	}
+	node.transactExec("DELETE FROM chunks WHERE streamid==$1 AND chunknum==$2;", streamID, chunkNum)
+	node.transactExec("UPDATE streams SET buffered=buffered-$1 WHERE streamid==$2;", int64(len(data)), streamID)
+	return nil
+}
+
+// LoadSeen : returns the router's loop detection entries first seen at or after since, oldest first
+func (node *Node) LoadSeen(since int64) ([]api.SeenEntry, error) {
+	c := node.db()
+	defer closeDB(c)
+	sqlq := "SELECT hash,firstseen FROM seen WHERE firstseen>=$1 ORDER BY firstseen ASC;"
+	events.Info(node, sqlq, since)
+	r, err := c.Query(sqlq, since)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var entries []api.SeenEntry
+	for r.Next() {
+		var hash []byte
+		var entry api.SeenEntry
+		if err := r.Scan(&hash, &entry.Time); err != nil {
+			return nil, err
+		}
+		copy(entry.Hash[:], hash)
+		entries = append(entries, entry)
+	}
+	return entries, r.Err()
+}
+
+// SaveSeen : stores the router's loop detection entries
+func (node *Node) SaveSeen(entries ...api.SeenEntry) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	c := node.db()
+	defer closeDB(c)
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := tx.Exec("INSERT INTO seen (hash,firstseen) VALUES( $1, $2 );", entry.Hash[:], entry.Time); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ForgetSeen : deletes the router's loop detection entries first seen before the given time
+func (node *Node) ForgetSeen(before int64) error {
+	node.transactExec("DELETE FROM seen WHERE firstseen<$1;", before)
+	return nil
+}
+
 // FlushOutbox : Deletes outbound messages older than maxAgeSeconds seconds
 func (node *Node) FlushOutbox(maxAgeSeconds int64) {
-	ts := time.Now().UnixNano()
-	ts = ts - (maxAgeSeconds * 1000000000)
-	sql := "DELETE FROM outbox WHERE timestamp < ($1);"
+	if err := node.outbox.Flush(maxAgeSeconds); err != nil {
+		events.Error(node, "FlushOutbox failed: "+err.Error())
+		return
+	}
+	node.tracker.Expire(maxAgeSeconds)
 	events.Info(node, "Flushed Database (seconds): ", maxAgeSeconds)
-	node.transactExec(sql, ts)
 }
 
 // BootstrapDB - Initialize or open a database file
@@ -699,6 +717,14 @@ func (node *Node) BootstrapDB(database string) func() *sql.DB {
 		}
 		return c
 	}
+	if node.outbox == nil {
+		inner, err := qloutbox.New(node.db, node.mutex)
+		if err != nil {
+			events.Critical(node, err.Error())
+		} else {
+			node.SetOutbox(inner)
+		}
+	}
 
 	// One-time Initialization
 	node.transactExec(`
@@ -712,9 +738,14 @@ func (node *Node) BootstrapDB(database string) func() *sql.DB {
 	node.transactExec(`
 		CREATE TABLE IF NOT EXISTS channels ( 			
 			name	string	NOT NULL,
-			privkey	string	NOT NULL
+			privkey	string	NOT NULL,
+			version	int64	NOT NULL,
+			expires	int64	NOT NULL
 		);
 	`)
+	// tables from before key rotation hold one key per channel, the first version of it
+	node.addColumn("channels", "version", "int64", int64(1))
+	node.addColumn("channels", "expires", "int64", int64(0))
 
 	node.transactExec(`
 		CREATE TABLE IF NOT EXISTS config ( 
@@ -723,20 +754,6 @@ func (node *Node) BootstrapDB(database string) func() *sql.DB {
 		);
 	`)
 
-	/*  timestamp field must stay int64 and not time type,
-	due to a unknown bug only on android/arm in cznic/ql via sql driver
-	*/
-	node.transactExec(`
-		CREATE TABLE IF NOT EXISTS outbox (
-			channel		string	DEFAULT "",
-			msg			blob	NOT NULL,
-			timestamp	int64	NOT NULL
-		);
-	`)
-	node.transactExec(`
-			CREATE INDEX IF NOT EXISTS outboxID ON outbox (timestamp);
-	`)
-
 	node.transactExec(`
 		CREATE TABLE IF NOT EXISTS peers (
 			name	string	NOT NULL,  
@@ -767,7 +784,26 @@ func (node *Node) BootstrapDB(database string) func() *sql.DB {
 	CREATE TABLE IF NOT EXISTS streams (		
 		streamid		int64	NOT NULL,
 		parts			int64	NOT NULL,
-		channel			string	NOT NULL
+		channel			string	NOT NULL,
+		replykey		string	NOT NULL,
+		msglen			int64	NOT NULL,
+		digest			blob,
+		firstseen		int64	NOT NULL,
+		buffered		int64	NOT NULL,
+		signed			bool	NOT NULL
+	);
+	`)
+	node.addColumn("streams", "replykey", "string", "")
+	node.addColumn("streams", "msglen", "int64", int64(0))
+	node.addColumn("streams", "digest", "blob", nil)
+	node.addColumn("streams", "firstseen", "int64", time.Now().UnixNano()) // expire them from now on
+	node.addColumn("streams", "buffered", "int64", int64(0))
+	node.addColumn("streams", "signed", "bool", false)
+
+	node.transactExec(`
+	CREATE TABLE IF NOT EXISTS seen (
+		hash		blob	NOT NULL,
+		firstseen	int64	NOT NULL
 	);
 	`)
 
@@ -808,3 +844,15 @@ func (node *Node) BootstrapDB(database string) func() *sql.DB {
 	node.refreshChannels()
 	return node.db
 }
+
+// streamStore - where the stream reassembly pass finds this node's incoming streams
+func (node *Node) streamStore() nodes.StreamStore {
+	return nodes.StreamStore{
+		Streams:     node.qlGetStreams,
+		ChunkCount:  node.qlGetChunkCount,
+		Chunks:      node.qlGetChunks,
+		ReadChunk:   node.qlGetChunk,
+		RemoveChunk: node.qlRemoveChunk,
+		ClearStream: node.qlClearStream,
+	}
+}
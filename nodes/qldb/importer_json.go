@@ -5,10 +5,12 @@ package qldb
 import (
 	"encoding/json"
 	"errors"
+	"sync/atomic"
 
 	"github.com/awgh/bencrypt"
 	"github.com/awgh/ratnet"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes"
 )
 
 // Import : Load a node configuration from a JSON config
@@ -43,8 +45,12 @@ func (node *Node) Import(jsonConfig []byte) error {
 			return err
 		}
 	}
-	for i := 0; i < len(nj.Channels); i++ {
-		if err := node.AddChannel(nj.Channels[i].Name, nj.Channels[i].Privkey); err != nil {
+	channelKeys, err := nodes.DecodeChannelKeys(node.contentKey, nj.Channels)
+	if err != nil {
+		return err
+	}
+	for name, keys := range nodes.GroupChannelKeys(channelKeys) {
+		if err := node.setChannelKeys(name, keys); err != nil {
 			return err
 		}
 	}
@@ -74,6 +80,22 @@ func (node *Node) Import(jsonConfig []byte) error {
 		node.SetRouter(ratnet.NewRouterFromMap(nj.Router))
 	}
 
+	if keyed, ok := node.router.(api.SigningRouter); ok && len(nj.RouterKey) > 0 {
+		if err := keyed.SetSigningKey(nj.RouterKey); err != nil {
+			return err
+		}
+	}
+
+	node.SetOutboxTTL(nj.OutboxTTL)
+	node.SetChannelKeyOverlap(nj.ChannelKeyOverlap)
+	node.SetQuota(nj.Quota)
+	for channel := range node.ChannelQuotas() {
+		node.SetChannelQuota(channel, api.OutboxQuota{})
+	}
+	for channel, quota := range nj.ChannelQuotas {
+		node.SetChannelQuota(channel, quota)
+	}
+
 	for _, p := range nj.Policies {
 		// extract the inner Transport first
 		t := p["Transport"].(map[string]interface{})
@@ -111,15 +133,9 @@ func (node *Node) Export() ([]byte, error) {
 		return nil, err
 	}
 
-	nj.Channels = make([]api.ChannelPrivB64, len(channels))
-	i := 0
-	for _, v := range channels {
-		nj.Channels[i].Name = v.Name
-		nj.Channels[i].Privkey = v.Privkey.ToB64()
-		i++
-	}
+	nj.Channels = nodes.EncodeChannelKeys(nodes.ActiveChannelKeys(channels))
 	nj.Contacts = make([]api.Contact, len(contacts))
-	i = 0
+	i := 0
 	for _, v := range contacts {
 		nj.Contacts[i].Name = v.Name
 		nj.Contacts[i].Pubkey = v.Pubkey
@@ -142,6 +158,13 @@ func (node *Node) Export() ([]byte, error) {
 		i++
 	}
 	nj.Router = node.router
+	if keyed, ok := node.router.(api.SigningRouter); ok { // kept with the other secret keys, not in the router config
+		nj.RouterKey = keyed.SigningKey()
+	}
 	nj.Policies = node.policies
+	nj.OutboxTTL = atomic.LoadInt64(&node.outboxTTL) // zero if never set, so the default still applies on import
+	nj.ChannelKeyOverlap = atomic.LoadInt64(&node.channelKeyOverlap) // zero if never set, like OutboxTTL
+	nj.Quota = node.Quota()
+	nj.ChannelQuotas = node.ChannelQuotas()
 	return json.MarshalIndent(nj, "", "    ")
 }
@@ -2,12 +2,16 @@ package qldb
 
 import (
 	"bytes"
+	"database/sql"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/awgh/bencrypt/ecc"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/router"
 
 	_ "modernc.org/ql/driver"
 )
@@ -80,10 +84,144 @@ func Test_apicall_Channels_1(t *testing.T) {
 	t.Log(message)
 }
 
+func Test_streams_Expire_1(t *testing.T) {
+	node.nackTimer.SetLimits(0, 16)
+	defer node.nackTimer.SetLimits(0, 0)
+
+	// a chunk with no header, bigger than the limit
+	if err := node.AddChunk(0xbeef, 0, bytes.Repeat([]byte{0x55}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(2 * time.Second)
+	for abandoned := false; !abandoned; {
+		select {
+		case ev := <-node.Events():
+			if ev.Type == api.StreamAbandoned {
+				stream := ev.Data[0].(api.StreamHeader)
+				if stream.StreamID != 0xbeef || stream.Buffered != 32 {
+					t.Errorf("Wrong stream abandoned: %+v", stream)
+				}
+				abandoned = true
+			}
+		case <-timeout:
+			t.Fatal("Stream was not abandoned")
+		}
+	}
+	streams, err := node.qlGetStreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 0 {
+		t.Errorf("Expected no streams left, got %+v", streams)
+	}
+}
+
 func Test_stop(t *testing.T) {
 	node.Stop()
 }
 
+func Test_streams_Resume_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_resume.ql")
+	newNode := func() *Node {
+		n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+		n.BootstrapDB(dbFile)
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	n1 := newNode()
+	if err := n1.AddStream(api.StreamHeader{StreamID: 0x1234, NumChunks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n1.AddChunk(0x1234, 0, []byte("hello, ")); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+	// a fresh node on the same database picks up where the first one left off
+	n2 := newNode()
+	defer n2.Stop()
+	if err := n2.AddChunk(0x1234, 1, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-n2.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Fatalf("reassembled wrong content: %q", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream was not reassembled after restart")
+	}
+}
+
+// legacyDB - makes a database with tables as an older version made them
+func legacyDB(t *testing.T, dbFile string, statements ...string) {
+	c, err := sql.Open("ql", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, q := range statements {
+		tx, err := c.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_schema_Upgrade_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_upgrade.ql")
+	chnKey := new(ecc.KeyPair)
+	chnKey.GenerateKey()
+	legacyDB(t, dbFile,
+		"CREATE TABLE streams (streamid int64 NOT NULL, parts int64 NOT NULL, channel string NOT NULL);",
+		"CREATE TABLE chunks (streamid int64 NOT NULL, chunknum int64 NOT NULL, data blob NOT NULL);",
+		"CREATE TABLE channels (name string NOT NULL, privkey string NOT NULL);",
+		"INSERT INTO streams VALUES(4660, 2, \"\");",
+		"INSERT INTO chunks VALUES(4660, 0, blob(\"hello, \"));",
+		"INSERT INTO channels VALUES(\"news\", \""+chnKey.ToB64()+"\");",
+	)
+
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	n.BootstrapDB(dbFile)
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if err := n.AddChunk(0x1234, 1, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-n.Out():
+		if msg.Content.String() != "hello, world" {
+			t.Fatalf("reassembled wrong content: %q", msg.Content.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream from the old database was not reassembled")
+	}
+
+	// the channel key from the old database is the first version, and rotates from there
+	chn, err := n.GetChannel("news")
+	if err != nil || chn == nil || chn.Pubkey != chnKey.GetPubKey().ToB64() {
+		t.Fatalf("channel from the old database not found: %+v %v", chn, err)
+	}
+	newKey := new(ecc.KeyPair)
+	newKey.GenerateKey()
+	if err := n.AddChannel("news", newKey.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	if chn, err := n.GetChannel("news"); err != nil || chn.Pubkey != newKey.GetPubKey().ToB64() {
+		t.Errorf("channel key did not rotate: %+v %v", chn, err)
+	}
+}
+
 // Test Messages
 var testMessage1 = `'In THAT direction,' the Cat said, waving its right paw round, 'lives a Hatter: and in THAT direction,' waving the other paw, 'lives a March Hare. Visit either you like: they're both mad.'
 'But I don't want to go among mad people,' Alice remarked.
@@ -111,6 +249,53 @@ var pubkeyb64 = "LS0tLS1CRUdJTiBQVUJMSUMgS0VZLS0tLS0KTUlJQ0lqQU5CZ2txaGtpRzl3MEJ
 	"RUFBUT09Ci0tLS0tRU5EIFBVQkxJQyBLRVktLS0tLQo="
 
 // ECC TEST KEYS
+func Test_seen_Persist_1(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "ratnet_seen.ql")
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	newRelay := func() (*Node, *router.DefaultRouter) {
+		n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+		n.BootstrapDB(dbFile)
+		r := router.NewDefaultRouter()
+		r.PersistSeen = true
+		n.SetRouter(r)
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return n, r
+	}
+
+	n1, r1 := newRelay()
+	if _, err := n1.SendMsg(api.Msg{Name: "seen", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString(testMessage1)}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _, err := n1.Outbox().MsgsSince(0, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	if err := r1.Route(n1, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	n1.Stop()
+
+	// a fresh relay on the same database still remembers the message
+	n2, r2 := newRelay()
+	defer n2.Stop()
+	if err := r2.Route(n2, msgs[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r2.SeenStats(); stats.Seen != 1 {
+		t.Errorf("Expected the message to be filtered out after a restart, got %+v", stats)
+	}
+
+	if err := n2.ForgetSeen(time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := n2.LoadSeen(0); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries left, got %d %v", len(entries), err)
+	}
+}
+
 var (
 	pubprivkeyb64Ecc = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq1+dln3M3IaOmg+YfTIbBpk+jIbZZZiT+4CoeFzaJGEWmg=="
 	pubkeyb64Ecc     = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq18="
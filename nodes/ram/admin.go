@@ -3,15 +3,15 @@ package ram
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/bencrypt/ecc"
-	"github.com/awgh/debouncer"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/chunking"
 	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/api/multicast"
+	"github.com/awgh/ratnet/nodes"
 )
 
 // CID : Return content key
@@ -74,13 +74,13 @@ func (node *Node) DeleteContact(name string) error {
 func (node *Node) GetChannel(name string) (*api.Channel, error) {
 	node.mutex.RLock()
 	defer node.mutex.RUnlock()
-	channel, ok := node.channels[name]
+	keys, ok := node.channels[name]
 	if !ok {
 		return nil, errors.New("Channel not found")
 	}
 	c := new(api.Channel)
 	c.Name = name
-	c.Pubkey = channel.Pubkey
+	c.Pubkey = keys[0].Pubkey
 	return c, nil
 }
 
@@ -91,13 +91,14 @@ func (node *Node) GetChannels() ([]api.Channel, error) {
 	var channels []api.Channel
 	for _, v := range node.channels {
 		channels = append(channels, api.Channel{
-			Name: v.Name, Pubkey: v.Pubkey,
+			Name: v[0].Name, Pubkey: v[0].Pubkey,
 		})
 	}
 	return channels, nil
 }
 
-// AddChannel : Add a channel to this node's database
+// AddChannel : Add a channel to this node's database, or give it a new key,
+// the older keys keep working for ChannelKeyOverlap seconds
 func (node *Node) AddChannel(name string, privkey string) error {
 	node.mutex.Lock()
 	defer node.mutex.Unlock()
@@ -105,11 +106,8 @@ func (node *Node) AddChannel(name string, privkey string) error {
 	if err := pk.FromB64(privkey); err != nil {
 		return errors.New("Invalid channel key")
 	}
-	c := new(api.ChannelPriv)
-	c.Name = name
-	c.Pubkey = pk.GetPubKey().ToB64()
-	c.Privkey = pk
-	node.channels[name] = c
+	c := api.ChannelPriv{Name: name, Pubkey: pk.GetPubKey().ToB64(), Privkey: pk}
+	node.channels[name] = nodes.AddChannelKey(node.channels[name], c, node.ChannelKeyOverlap())
 	return nil
 }
 
@@ -279,7 +277,8 @@ func (node *Node) Send(contactName string, data []byte, pubkey ...bc.PubKey) err
 		node.mutex.RUnlock()
 	}
 
-	return node.SendMsg(api.Msg{Name: contactName, Content: bytes.NewBuffer(data), IsChan: false, PubKey: destkey, Chunked: false})
+	_, err := node.SendMsg(api.Msg{Name: contactName, Content: bytes.NewBuffer(data), IsChan: false, PubKey: destkey, Chunked: false})
+	return err
 }
 
 // SendChannelBulk : Transmit messages to a channel
@@ -305,59 +304,69 @@ func (node *Node) SendChannel(channelName string, data []byte, pubkey ...bc.PubK
 		if !ok {
 			return errors.New("No public key for Channel")
 		}
-		destkey = c.Privkey.GetPubKey()
+		destkey = c[0].Privkey.GetPubKey() // the newest key
 	}
 
-	return node.SendMsg(api.Msg{Name: channelName, Content: bytes.NewBuffer(data), IsChan: true, PubKey: destkey, Chunked: false})
+	_, err := node.SendMsg(api.Msg{Name: channelName, Content: bytes.NewBuffer(data), IsChan: true, PubKey: destkey, Chunked: false})
+	return err
 }
 
-// SendMsg : Transmits a message
-func (node *Node) SendMsg(msg api.Msg) error {
+// SendMsg : Transmits a message, returns the MsgID its status is tracked by
+func (node *Node) SendMsg(msg api.Msg) (api.MsgID, error) {
+	if msg.ID == (api.MsgID{}) {
+		var err error
+		if msg.ID, err = api.NewMsgID(); err != nil {
+			return msg.ID, err
+		}
+	}
+	if msg.Signed { // signatures travel in an envelope for the one recipient
+		if msg.IsChan {
+			return msg.ID, errors.New("Only direct messages can be signed")
+		}
+		if len(msg.Recipients) == 0 {
+			msg.Recipients = []bc.PubKey{msg.PubKey}
+		}
+	}
 	// determine if we need to chunk
-	chunkSize := chunking.ChunkSize(node)                               // finds the minimum transport byte limit
+	chunkSize := chunking.ChunkSize(node, msg)                          // what fits the smallest transport once encrypted
 	if msg.Content.Len() > 0 && uint32(msg.Content.Len()) > chunkSize { // we need to chunk
 		if msg.Chunked { // we're already chunked, freak out!
-			return errors.New("Chunked message needs to be chunked, bailing out")
+			return msg.ID, errors.New("Chunked message needs to be chunked, bailing out")
 		}
-		return chunking.SendChunked(node, chunkSize, msg)
+		return msg.ID, chunking.SendChunked(node, chunkSize, msg)
 	}
 
-	data, err := node.contentKey.EncryptMessage(msg.Content.Bytes(), msg.PubKey)
+	var data []byte
+	var err error
+	if len(msg.Recipients) > 0 { // one envelope for all of them
+		if msg.IsChan {
+			return msg.ID, errors.New("Multiple recipients are only for direct messages")
+		}
+		msg.Multicast = true
+		data, err = multicast.Seal(node.contentKey, msg.Recipients, msg.Content.Bytes(), msg.Signed)
+	} else {
+		data, err = node.contentKey.EncryptMessage(msg.Content.Bytes(), msg.PubKey)
+	}
 	if err != nil {
-		return err
+		return msg.ID, err
 	}
 
-	flags := uint8(0)
-	if msg.IsChan {
-		flags |= api.ChannelFlag
-	}
-	if msg.Chunked {
-		flags |= api.ChunkedFlag
-	}
-	if msg.StreamHeader {
-		flags |= api.StreamHeaderFlag
+	m := nodes.NewOutboxMsg(msg, data)
+	if err := node.outbox.Enqueue(m); err != nil {
+		return msg.ID, err
 	}
-	rxsum := []byte{flags} // prepend flags byte
+	node.tracker.Queued(msg.ID, m.Msg)
+	return msg.ID, nil
+}
 
-	if msg.IsChan {
-		// prepend a uint16 of channel name length, little-endian
-		t := uint16(len(msg.Name))
-		rxsum = append(rxsum, byte(t>>8), byte(t&0xFF))
-		rxsum = append(rxsum, []byte(msg.Name)...)
-	}
-	data = append(rxsum, data...)
-	ts := time.Now().UnixNano()
+// GetMsgStatus : Returns what has become of a message sent with SendMsg
+func (node *Node) GetMsgStatus(id api.MsgID) (*api.MsgStatus, error) {
+	return node.tracker.Status(id)
+}
 
-	m := new(outboxMsg)
-	if msg.IsChan {
-		m.channel = msg.Name
-	}
-	m.timeStamp = ts
-	m.msg = data
-	node.mutex.Lock()
-	node.outbox.Append(m)
-	node.mutex.Unlock()
-	return nil
+// GetMsgStatuses : Returns the status of every message this node is tracking
+func (node *Node) GetMsgStatuses() ([]api.MsgStatus, error) {
+	return node.tracker.Statuses(), nil
 }
 
 // Start : starts the Connection Policy threads
@@ -377,6 +386,13 @@ func (node *Node) Start() error {
 		node.routingKey.GenerateKey()
 	}
 
+	// reload the router's loop detection state, for routers that keep it in the node
+	if r, ok := node.router.(api.SeenPersister); ok {
+		if err := r.RestoreSeen(node); err != nil {
+			events.Error(node, "Could not restore seen messages: "+err.Error())
+		}
+	}
+
 	// start the policies
 	if node.policies != nil {
 		for i := 0; i < len(node.policies); i++ {
@@ -387,6 +403,7 @@ func (node *Node) Start() error {
 	}
 
 	node.setIsRunning(true)
+	node.stop = make(chan struct{})
 
 	// input loop
 	go func() {
@@ -399,60 +416,34 @@ func (node *Node) Start() error {
 			// read message off the input channel
 			message := <-node.In()
 			events.Debug(node, "Message accepted on input channel")
-			if err := node.SendMsg(message); err != nil {
+			if _, err := node.SendMsg(message); err != nil {
 				events.Error(node, err.Error())
 			}
 		}
 	}()
 
 	node.trigggerMutex.Lock()
-	defer node.trigggerMutex.Unlock()
-	node.debouncer = debouncer.New(10*time.Millisecond, func() {
+	node.debouncer = nodes.NewDebouncer(10*time.Millisecond, func() {
 		node.trigggerMutex.Lock()
 		defer node.trigggerMutex.Unlock()
-
 		// check if we should stop running
 		if !node.IsRunning() {
 			return
 		}
-		// for each stream, count chunks for that header
-		for _, stream := range node.streams {
-			count := 0
-			if stream != nil {
-				v, ok := node.chunks[stream.StreamID]
-				if ok && v != nil {
-					count = len(v)
-				}
-				// if chunks == total chunks, re-assemble Msg and call Handle
-				if uint32(count) == uint32(stream.NumChunks) {
-					buf := bytes.NewBuffer([]byte{})
-					for i := uint32(0); i < stream.NumChunks; i++ {
-						chunk, ok := node.chunks[stream.StreamID][i]
-						if !ok {
-							events.Critical(node, "Chunk count miscalculated - code broken")
-						}
-						buf.Write(chunk.Data)
-					}
-
-					var msg api.Msg
-					if len(stream.ChannelName) > 0 {
-						msg.IsChan = true
-						msg.Name = stream.ChannelName
-					}
-					msg.Content = buf
-
-					select {
-					case node.Out() <- msg:
-						events.Debug(node, "Sent message "+fmt.Sprint(msg.Content.Bytes()))
-						node.streams[stream.StreamID] = nil
-						node.chunks[stream.StreamID] = make(map[uint32]*api.Chunk)
-					default:
-						events.Debug(node, "No message sent")
-					}
-				}
-			}
-		}
+		nodes.ProcessStreams(node, node.streamStore(), node.readers, node.nackTimer)
 	})
+	node.debouncer.Trigger() // reassemble anything that completed while we were stopped
+	node.trigggerMutex.Unlock()
+
+	// wake up periodically, so stalled streams get NACKed or expired
+	go nodes.WakeStreams(func() {
+		node.trigggerMutex.Lock()
+		node.debouncer.Trigger()
+		node.trigggerMutex.Unlock()
+	}, node.nackTimer, node.stop)
+
+	// expire old outbound messages, whether or not a policy flushes the outbox
+	go nodes.ExpireOutbox(node, node.OutboxExpiryInterval(), node.stop)
 
 	return nil
 }
@@ -462,5 +453,16 @@ func (node *Node) Stop() {
 	for _, policy := range node.policies {
 		policy.Stop()
 	}
+	node.trigggerMutex.Lock() // wait for a stream pass that is already running
 	node.setIsRunning(false)
+	node.trigggerMutex.Unlock()
+	if node.stop != nil {
+		close(node.stop)
+		node.stop = nil
+	}
+	if r, ok := node.router.(api.SeenPersister); ok {
+		if err := r.FlushSeen(); err != nil {
+			events.Error(node, "Could not save seen messages: "+err.Error())
+		}
+	}
 }
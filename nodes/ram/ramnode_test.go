@@ -2,12 +2,25 @@ package ram
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/bencrypt/rsa"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+	"github.com/awgh/ratnet/nodes"
+	ramoutbox "github.com/awgh/ratnet/outbox/ram"
+	"github.com/awgh/ratnet/policy/server"
+	"github.com/awgh/ratnet/transports/https"
+	"github.com/awgh/ratnet/transports/tls"
+	"github.com/awgh/ratnet/transports/udp"
 )
 
 var node *Node
@@ -80,8 +93,472 @@ func Test_stop(t *testing.T) {
 	node.Stop()
 }
 
+// outboxMsgs - everything queued in a node's outbox, oldest first
+func outboxMsgs(t *testing.T, n *Node) [][]byte {
+	msgs, _, err := n.Outbox().MsgsSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func Test_nack_Retransmit_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	sender.nackTimer.SetInterval(50 * time.Millisecond)
+	receiver.nackTimer.SetInterval(50 * time.Millisecond)
+	if err := sender.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+
+	// big enough for three chunks
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+	cid, _ := receiver.CID()
+	if _, err := sender.SendMsg(api.Msg{Content: bytes.NewBuffer(payload), PubKey: cid}); err != nil {
+		t.Fatal(err)
+	}
+
+	// deliver everything except the second chunk
+	chunks := 0
+	queued := outboxMsgs(t, sender)
+	sent := len(queued)
+	for _, m := range queued {
+		if m[0]&api.ChunkedFlag != 0 && m[0]&api.StreamHeaderFlag == 0 {
+			chunks++
+			if chunks == 2 {
+				continue
+			}
+		}
+		if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// wait for the receiver to NACK the missing chunk back to the sender
+	var nack []byte
+	for i := 0; i < 100 && nack == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		for _, m := range outboxMsgs(t, receiver) {
+			if m[0]&api.NackFlag != 0 {
+				nack = m
+			}
+		}
+	}
+	if nack == nil {
+		t.Fatal("Receiver never sent a NACK")
+	}
+	if err := sender.router.Route(sender, nack, api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	queued = outboxMsgs(t, sender)
+	if len(queued) != sent+1 {
+		t.Fatalf("Expected 1 resent chunk, got %d", len(queued)-sent)
+	}
+	if err := receiver.router.Route(receiver, queued[sent], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-receiver.Out():
+		if !bytes.Equal(msg.Content.Bytes(), payload) {
+			t.Error("Reassembled message does not match")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Stream not reassembled after retransmission")
+	}
+}
+
+func Test_streams_Handler_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := sender.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	receiver.SetStreamHandler(func(stream api.StreamHeader, r io.Reader) {
+		data, err := ioutil.ReadAll(r)
+		results <- result{data, err}
+	})
+
+	cid, _ := receiver.CID()
+	if err := sender.AddContact("receiver", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	w, err := sender.OpenStream("receiver", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// big enough for several chunks, written in odd sizes
+	payload := bytes.Repeat([]byte(testMessage1), 1+(300*1024)/len(testMessage1))
+	for p := payload; len(p) > 0; {
+		n := 7777
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range outboxMsgs(t, sender) {
+		if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if !bytes.Equal(res.data, payload) {
+			t.Error("Streamed message does not match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Stream handler did not finish reading")
+	}
+}
+
+func Test_streams_Expire_1(t *testing.T) {
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	old := time.Now().Add(-2 * chunking.DefaultStreamMaxAge).UnixNano()
+	stalled := api.StreamHeader{StreamID: 1, NumChunks: 10, FirstSeen: old}
+	arriving := api.StreamHeader{StreamID: 2, NumChunks: 10, FirstSeen: old}
+
+	// both were first seen long ago, but only one is still receiving chunks
+	n.nackTimer.Due(arriving.StreamID, 3)
+
+	expired := n.nackTimer.Expired([]api.StreamHeader{stalled, arriving})
+	if len(expired) != 1 || expired[0].StreamID != stalled.StreamID {
+		t.Fatalf("Expected only the stalled stream to expire, got %+v", expired)
+	}
+}
+
+func Test_chunking_Overhead_1(t *testing.T) {
+	cert, key, err := bc.GenerateSSLCertBytes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+
+	for _, contentKey := range []bc.KeyPair{new(ecc.KeyPair), new(rsa.KeyPair)} {
+		n := New(contentKey, new(ecc.KeyPair))
+		cid, _ := n.CID()
+		if err := n.AddContact("self", cid.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.AddChannel("a-channel-with-a-rather-long-name", n.contentKey.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		transports := []api.Transport{udp.New(n), tls.New(cert, key, n, true), https.New(cert, key, n, true)}
+		for _, transport := range transports {
+			// every transport's own limit, and one small enough to chunk on
+			for _, limit := range []int64{transport.ByteLimit(), 4096} {
+				transport.SetByteLimit(limit)
+				n.SetPolicy(server.New(transport, "", false))
+				n.SetOutbox(ramoutbox.New())
+				if err := n.Send("self", payload); err != nil {
+					t.Fatal(err)
+				}
+				if err := n.SendChannel("a-channel-with-a-rather-long-name", payload); err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range outboxMsgs(t, n) {
+					if int64(len(m)) > limit {
+						t.Errorf("%s: %d byte message over %s limit of %d", contentKey.GetName(), len(m), transport.Name(), limit)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_chunking_Fragment_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+
+	// a constrained transport next to a fast one
+	small := udp.New(sender)
+	small.SetByteLimit(4096)
+	cert, key, err := bc.GenerateSSLCertBytes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.SetPolicy(server.New(small, "", false), server.New(tls.New(cert, key, sender, true), "", false))
+
+	cid, _ := receiver.CID()
+	if err := sender.AddContact("receiver", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+	if err := sender.Send("receiver", payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range outboxMsgs(t, sender) {
+		if m[0]&api.StreamHeaderFlag == 0 && len(m) <= 4096 {
+			t.Fatalf("Chunk of %d bytes sized for the small transport", len(m))
+		}
+	}
+
+	// pick everything up over the small transport, fragments and all
+	rpub := receiver.routingKey.GetPubKey()
+	var lastTime int64
+	for i := 0; i < 1000; i++ {
+		bundle, err := sender.Pickup(rpub, lastTime, small.ByteLimit())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bundle.Data == nil {
+			break
+		}
+		lastTime = bundle.Time
+		if err := receiver.Dropoff(bundle); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case msg := <-receiver.Out():
+		if !bytes.Equal(msg.Content.Bytes(), payload) {
+			t.Error("Reassembled message does not match")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Fragmented message not reassembled")
+	}
+}
+
+func Test_ingress_Out_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	cid, _ := receiver.CID()
+	if err := sender.AddContact("receiver", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	rpub := receiver.routingKey.GetPubKey()
+	spub := sender.routingKey.GetPubKey()
+
+	// handed to Dropoff by a policy
+	if err := sender.Send("receiver", []byte(testMessage1)); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := sender.Pickup(rpub, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress := api.Ingress{Peer: spub.ToB64(), URI: "localhost:20001", Transport: "udp"}
+	bundle.Ingress = ingress
+	if err := receiver.Dropoff(bundle); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-receiver.Out():
+		if msg.Ingress != ingress {
+			t.Errorf("Expected ingress %+v, got %+v", ingress, msg.Ingress)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message not received")
+	}
+
+	// dropped off over RPC by the peer itself
+	if err := sender.Send("receiver", []byte("hello again")); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err = sender.Pickup(rpub, bundle.Time, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.PublicRPC(nil, api.RemoteCall{Action: api.Dropoff, Args: []interface{}{bundle, spub}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-receiver.Out():
+		if msg.Ingress.Peer != spub.ToB64() || msg.Ingress.URI != "" {
+			t.Errorf("Expected ingress from the claimed peer, got %+v", msg.Ingress)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message not received")
+	}
+}
+
+func Test_ingress_SplitHorizon_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	relay := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	other := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	chn := new(ecc.KeyPair)
+	chn.GenerateKey()
+	if err := sender.AddChannel("splithorizon", chn.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendChannel("splithorizon", []byte(testMessage1)); err != nil {
+		t.Fatal(err)
+	}
+	spub := sender.routingKey.GetPubKey()
+	bundle, err := sender.Pickup(relay.routingKey.GetPubKey(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.Ingress = api.Ingress{Peer: spub.ToB64()}
+	if err := relay.Dropoff(bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	back, err := relay.Pickup(spub, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Data != nil {
+		t.Error("Relay handed the message back to the peer it came from")
+	}
+	onward, err := relay.Pickup(other.routingKey.GetPubKey(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onward.Data == nil {
+		t.Error("Relay did not forward the message to another peer")
+	}
+}
+
 // Test Messages
 
+func Test_outbox_Expire_1(t *testing.T) {
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	n.SetOutboxTTL(60)
+	n.SetOutboxExpiryInterval(10 * time.Millisecond)
+	old := api.OutboxMsg{Msg: []byte("old"), Timestamp: time.Now().Add(-time.Hour).UnixNano()}
+	fresh := api.OutboxMsg{Msg: []byte("fresh"), Timestamp: time.Now().UnixNano()}
+	if err := n.Outbox().Enqueue(old, fresh); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	for timeout := time.Now().Add(2 * time.Second); len(outboxMsgs(t, n)) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(timeout) {
+			t.Fatal("Old message was not expired")
+		}
+	}
+	if msgs := outboxMsgs(t, n); string(msgs[0]) != "fresh" {
+		t.Errorf("Wrong message expired, kept %s", msgs[0])
+	}
+}
+
+func Test_outbox_TTL_Export_1(t *testing.T) {
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if n.OutboxTTL() != nodes.DefaultOutboxTTL {
+		t.Errorf("Expected the default OutboxTTL, got %d", n.OutboxTTL())
+	}
+	// an unset TTL is not exported as the current default
+	j, err := n.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported api.ImportedNode
+	if err := json.Unmarshal(j, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.OutboxTTL != 0 {
+		t.Errorf("Expected an unset OutboxTTL to be exported as 0, got %d", exported.OutboxTTL)
+	}
+	n.SetOutboxTTL(-1)
+	if j, err = n.Export(); err != nil {
+		t.Fatal(err)
+	}
+	imported := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := imported.Import(j); err != nil {
+		t.Fatal(err)
+	}
+	if imported.OutboxTTL() != -1 {
+		t.Errorf("Expected OutboxTTL -1 after Import, got %d", imported.OutboxTTL())
+	}
+}
+
+func Test_outbox_Quota_1(t *testing.T) {
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	cid, _ := receiver.CID()
+	if err := n.AddContact("receiver", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	// set over RPC, as an admin would
+	if _, err := n.AdminRPC(nil, api.RemoteCall{Action: api.SetQuota,
+		Args: []interface{}{int64(0), int64(3), int64(api.EvictForwarded)}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := n.Send("receiver", []byte(testMessage1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		relayed := api.Msg{Content: bytes.NewBufferString("relayed"), Ingress: api.Ingress{Peer: "peer"}}
+		if err := n.Forward(relayed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := n.Outbox().Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected the quota to keep 3 messages, kept %d", len(entries))
+	}
+	forwarded := 0
+	for _, entry := range entries {
+		if entry.Forwarded {
+			forwarded++
+		}
+	}
+	if forwarded != 1 {
+		t.Errorf("Expected a forwarded message to be evicted first, %d are left", forwarded)
+	}
+	select {
+	case ev := <-n.Events():
+		if ev.Type != api.OutboxEvicted || !ev.Data[0].(api.OutboxEntry).Forwarded {
+			t.Errorf("Expected an OutboxEvicted event for a forwarded message, got %+v", ev)
+		}
+	default:
+		t.Error("No OutboxEvicted event")
+	}
+
+	// quotas survive Export and Import, and a replaced outbox
+	n.SetChannelQuota("busy", api.OutboxQuota{MaxBytes: 1024})
+	j, err := n.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := imported.Import(j); err != nil {
+		t.Fatal(err)
+	}
+	imported.SetOutbox(ramoutbox.New())
+	if imported.Quota() != n.Quota() || imported.ChannelQuotas()["busy"].MaxBytes != 1024 {
+		t.Errorf("Quotas were not imported, got %+v and %+v", imported.Quota(), imported.ChannelQuotas())
+	}
+}
+
 var testMessage1 = `'In THAT direction,' the Cat said, waving its right paw round, 'lives a Hatter: and in THAT direction,' waving the other paw, 'lives a March Hare. Visit either you like: they're both mad.'
 'But I don't want to go among mad people,' Alice remarked.
 'Oh, you can't help that,' said the Cat: 'we're all mad here. I'm mad. You're mad.'
@@ -112,3 +589,377 @@ var (
 	pubprivkeyb64Ecc = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq1+dln3M3IaOmg+YfTIbBpk+jIbZZZiT+4CoeFzaJGEWmg=="
 	pubkeyb64Ecc     = "Tcksa18txiwMEocq7NXdeMwz6PPBD+nxCjb/WCtxq18="
 )
+
+func Test_receipts_Delivered_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+
+	cid, _ := receiver.CID()
+	id, err := sender.SendReceipted(api.Msg{Content: bytes.NewBufferString(testMessage1), PubKey: cid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range outboxMsgs(t, sender) {
+		if m[0]&api.ReceiptFlag == 0 {
+			t.Error("Receipt request sent without the ReceiptFlag")
+		}
+		if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case msg := <-receiver.Out():
+		if msg.Content.String() != testMessage1 {
+			t.Errorf("Expected the payload without the receipt request, got %q", msg.Content.String())
+		}
+	default:
+		t.Fatal("Receipted message was not delivered")
+	}
+
+	receipts := outboxMsgs(t, receiver)
+	if len(receipts) != 1 {
+		t.Fatalf("Expected the receiver to send one receipt, got %d", len(receipts))
+	}
+	if err := sender.router.Route(sender, receipts[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.Out()) != 0 {
+		t.Error("Receipt was delivered as a message")
+	}
+	delivered := false
+	for !delivered {
+		select {
+		case ev := <-sender.Events():
+			if ev.Type != api.Delivered {
+				continue
+			}
+			if ev.Data[0].(api.MsgID) != id {
+				t.Errorf("Expected a receipt for %s, got %s", id, ev.Data[0].(api.MsgID))
+			}
+			delivered = true
+		default:
+			t.Fatal("No Delivered event for the receipt")
+		}
+	}
+	status, err := sender.GetMsgStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != api.MsgDelivered || !status.Receipted {
+		t.Errorf("Expected the receipted message to be delivered, got %s", status.State)
+	}
+}
+
+func Test_status_Tracking_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	peer := new(ecc.KeyPair)
+	peer.GenerateKey()
+
+	cid, _ := sender.CID()
+	id, err := sender.SendMsg(api.Msg{Content: bytes.NewBufferString(testMessage1), PubKey: cid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := sender.GetMsgStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != api.MsgQueued {
+		t.Errorf("Expected a new message to be queued, got %s", status.State)
+	}
+
+	if _, err := sender.Pickup(peer.GetPubKey(), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	v, err := sender.AdminRPC(nil, api.RemoteCall{Action: api.GetMsgStatus, Args: []interface{}{id.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = v.(*api.MsgStatus)
+	if status.State != api.MsgPickedUp || len(status.PickedUpBy) != 1 || status.PickedUpBy[0] != peer.GetPubKey().ToB64() {
+		t.Errorf("Expected the message to be picked up by the peer, got %s by %v", status.State, status.PickedUpBy)
+	}
+
+	sender.FlushOutbox(0)
+	statuses, err := sender.GetMsgStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].ID != id || statuses[0].State != api.MsgExpired {
+		t.Errorf("Expected the flushed message to be expired, got %+v", statuses)
+	}
+}
+
+func Test_status_Bounded_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	sender.tracker.SetLimits(0, 10)
+	sender.SetOutboxTTL(-1) // never flushed, so only the limit keeps the tracker small
+	cid, _ := sender.CID()
+	if err := sender.AddContact("self", cid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if _, err := sender.SendMsg(api.Msg{Content: bytes.NewBufferString(testMessage1), PubKey: cid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses, err := sender.GetMsgStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) > 10 {
+		t.Errorf("Expected at most %d statuses, got %d", 10, len(statuses))
+	}
+
+	// a stream is one message, however many chunks it takes
+	sender.FlushOutbox(0)
+	w, err := chunking.OpenStream(sender, "self", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err = sender.GetMsgStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := w.(interface{ ID() api.MsgID }).ID()
+	queued := 0
+	for _, status := range statuses {
+		if status.State == api.MsgQueued {
+			queued++
+			if status.ID != id {
+				t.Errorf("Stream chunk tracked as %s, not the stream's %s", status.ID, id)
+			}
+		}
+	}
+	if queued != 1 {
+		t.Errorf("Expected the stream to be tracked as one message, got %d", queued)
+	}
+}
+
+func Test_multicast_Recipients_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	var receivers []*Node
+	for _, name := range []string{"alice", "bob", "carol"} {
+		receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+		cid, _ := receiver.CID()
+		if err := sender.AddContact(name, cid.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		receivers = append(receivers, receiver)
+	}
+	bystander := New(new(ecc.KeyPair), new(ecc.KeyPair))
+
+	v, err := sender.AdminRPC(nil, api.RemoteCall{Action: api.SendMulti, Args: []interface{}{[]byte(testMessage1), "alice", "bob", "carol"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := v.(string); !ok || len(id) != 32 {
+		t.Errorf("Expected a MsgID, got %v", v)
+	}
+	msgs := outboxMsgs(t, sender)
+	if len(msgs) != 1 || msgs[0][0]&api.MulticastFlag == 0 {
+		t.Fatalf("Expected one multicast message in the outbox, got %d", len(msgs))
+	}
+
+	for i, receiver := range append(receivers, bystander) {
+		rpub := receiver.routingKey.GetPubKey()
+		bundle, err := sender.Pickup(rpub, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := receiver.Dropoff(bundle); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-receiver.Out():
+			if receiver == bystander {
+				t.Error("Message received by a node that is not a recipient")
+			} else if msg.Content.String() != testMessage1 {
+				t.Errorf("Recipient %d received the wrong content", i)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if receiver != bystander {
+				t.Errorf("Message not received by recipient %d", i)
+			}
+		}
+	}
+
+	if _, err := sender.SendMsg(api.Msg{Name: "chan", IsChan: true, Content: bytes.NewBufferString(testMessage1), Recipients: []bc.PubKey{bystander.contentKey.GetPubKey()}}); err == nil {
+		t.Error("Channel message with multiple recipients was sent")
+	}
+}
+
+func Test_channels_Rotation_1(t *testing.T) {
+	n := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	n.SetChannelKeyOverlap(1)
+	oldKey, newKey := new(ecc.KeyPair), new(ecc.KeyPair)
+	oldKey.GenerateKey()
+	newKey.GenerateKey()
+	if err := n.AddChannel("chan", oldKey.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddChannel("chan", newKey.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := n.GetChannel("chan"); err != nil || c.Pubkey != newKey.GetPubKey().ToB64() {
+		t.Fatal("GetChannel did not return the newest key")
+	}
+	if err := n.SendChannel("chan", []byte(testMessage1)); err != nil {
+		t.Fatal(err)
+	}
+	msgs := outboxMsgs(t, n)
+	n.FlushOutbox(0)
+
+	// what the newest key sent, and what a node that still has the old key sends
+	sent := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if _, err := sent.SendMsg(api.Msg{Name: "chan", IsChan: true, PubKey: oldKey.GetPubKey(), Content: bytes.NewBufferString(testMessage1)}); err != nil {
+		t.Fatal(err)
+	}
+	msgs = append(msgs, outboxMsgs(t, sent)...)
+	for i, m := range msgs {
+		if err := n.router.Route(n, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-n.Out():
+			if msg.Content.String() != testMessage1 {
+				t.Errorf("Message %d decrypted to the wrong content", i)
+			}
+		default:
+			t.Errorf("Message %d was not received during the overlap", i)
+		}
+	}
+
+	j, err := n.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := imported.Import(j); err != nil {
+		t.Fatal(err)
+	}
+	if imported.ChannelKeyOverlap() != 1 {
+		t.Errorf("Expected ChannelKeyOverlap 1 after Import, got %d", imported.ChannelKeyOverlap())
+	}
+	keys := imported.channels["chan"]
+	if len(keys) != 2 || keys[0].Version != 2 || keys[0].Expires != 0 || keys[1].Version != 1 || keys[1].Expires == 0 {
+		t.Errorf("Channel keys were not restored, got %+v", keys)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	sent.FlushOutbox(0)
+	if _, err := sent.SendMsg(api.Msg{Name: "chan", IsChan: true, PubKey: oldKey.GetPubKey(), Content: bytes.NewBufferString(testMessage1)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range outboxMsgs(t, sent) {
+		n.router.Route(n, m, api.Ingress{})
+	}
+	if len(n.Out()) != 0 {
+		t.Error("Message for an expired key was received")
+	}
+}
+
+func Test_signed_Sender_1(t *testing.T) {
+	for _, keyType := range []func() bc.KeyPair{func() bc.KeyPair { return new(ecc.KeyPair) }, func() bc.KeyPair { return new(rsa.KeyPair) }} {
+		sender := New(keyType(), keyType())
+		receiver := New(keyType(), keyType())
+		scid, _ := sender.CID()
+		rcid, _ := receiver.CID()
+		if err := sender.AddContact("bob", rcid.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+
+		received := func() api.Msg {
+			for _, m := range outboxMsgs(t, sender) {
+				if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sender.FlushOutbox(0)
+			select {
+			case msg := <-receiver.Out():
+				if msg.Content.String() != testMessage1 {
+					t.Error("Received the wrong content")
+				}
+				return msg
+			default:
+				t.Fatal("Message was not received")
+			}
+			return api.Msg{}
+		}
+
+		// signed by a stranger, then by a contact
+		if _, err := sender.AdminRPC(nil, api.RemoteCall{Action: api.SendSigned, Args: []interface{}{"bob", []byte(testMessage1)}}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := received(); !msg.Signed || msg.Name != "[content]" || msg.PubKey.ToB64() != scid.ToB64() {
+			t.Errorf("Expected a signed message from an unknown sender, got %s %v", msg.Name, msg.Signed)
+		}
+		if err := receiver.AddContact("alice", scid.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sender.SendMsg(api.Msg{Content: bytes.NewBufferString(testMessage1), PubKey: rcid, Signed: true}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := received(); !msg.Signed || msg.Name != "alice" {
+			t.Errorf("Expected a signed message from alice, got %s %v", msg.Name, msg.Signed)
+		}
+		if err := sender.Send("bob", []byte(testMessage1)); err != nil {
+			t.Fatal(err)
+		}
+		if msg := received(); msg.Signed || msg.Name != "[content]" {
+			t.Errorf("Expected an unsigned message, got %s %v", msg.Name, msg.Signed)
+		}
+	}
+}
+
+func Test_signed_Chunked_1(t *testing.T) {
+	sender := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	receiver := New(new(ecc.KeyPair), new(ecc.KeyPair))
+	if err := sender.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+	scid, _ := sender.CID()
+	rcid, _ := receiver.CID()
+	if err := receiver.AddContact("alice", scid.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+
+	// big enough for three chunks, only the stream header is signed
+	payload := bytes.Repeat([]byte(testMessage1), 1+(150*1024)/len(testMessage1))
+	for _, signed := range []bool{true, false} {
+		if _, err := sender.SendMsg(api.Msg{Content: bytes.NewBuffer(payload), PubKey: rcid, Signed: signed}); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range outboxMsgs(t, sender) {
+			if err := receiver.router.Route(receiver, m, api.Ingress{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sender.FlushOutbox(0)
+		select {
+		case msg := <-receiver.Out():
+			if !bytes.Equal(msg.Content.Bytes(), payload) {
+				t.Error("Reassembled message does not match")
+			}
+			if signed && (!msg.Signed || msg.Name != "alice" || msg.PubKey.ToB64() != scid.ToB64()) {
+				t.Errorf("Expected a signed message from alice, got %s %v", msg.Name, msg.Signed)
+			} else if !signed && msg.Signed {
+				t.Error("Unsigned stream was reassembled as signed")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Stream not reassembled")
+		}
+	}
+}
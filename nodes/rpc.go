@@ -7,6 +7,7 @@ import (
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/multicast"
 )
 
 // PublicRPC : Entrypoint for RPC functions that are exposed to the public/Internet
@@ -56,6 +57,19 @@ func PublicRPC(transport api.Transport, node api.Node, call api.RemoteCall) (int
 		if !ok {
 			return nil, errors.New("Invalid argument")
 		}
+		if transport != nil {
+			bundle.Ingress.Transport = transport.Name()
+		}
+		// the routing key of the peer, as claimed by the peer.  Nothing checks it, the bundle is encrypted
+		// to us rather than signed by the caller, so a false claim gets through.  All it can do is keep the
+		// messages of this bundle from being handed to the peer it names, and steer Rules on Peer.
+		if len(call.Args) > 1 {
+			rpk, ok := call.Args[1].(bc.PubKey)
+			if !ok {
+				return nil, errors.New("Invalid argument 2")
+			}
+			bundle.Ingress.Peer = rpk.ToB64()
+		}
 		return nil, node.Dropoff(bundle)
 
 	default:
@@ -345,7 +359,157 @@ func AdminRPC(transport api.Transport, node api.Node, call api.RemoteCall) (inte
 		}
 		return nil, node.SendChannel(channelName, msg)
 
+	case api.SendMulti:
+		if len(call.Args) < 2 {
+			return nil, errors.New("Invalid argument count")
+		}
+		msg, ok := call.Args[0].([]byte)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		var contactNames []string
+		for _, v := range call.Args[1:] {
+			vs, ok := v.(string)
+			if !ok {
+				return nil, errors.New("Invalid argument")
+			}
+			contactNames = append(contactNames, vs)
+		}
+		id, err := multicast.Send(node, contactNames, msg)
+		if err != nil {
+			return nil, err
+		}
+		return id.String(), nil
+
+	case api.SendSigned:
+		if len(call.Args) < 2 {
+			return nil, errors.New("Invalid argument count")
+		}
+		contactName, ok := call.Args[0].(string)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		msg, ok := call.Args[1].([]byte)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		id, err := multicast.SendSigned(node, contactName, msg)
+		if err != nil {
+			return nil, err
+		}
+		return id.String(), nil
+
+	case api.GetMsgStatus:
+		if len(call.Args) < 1 {
+			return nil, errors.New("Invalid argument count")
+		}
+		msgID, ok := call.Args[0].(string)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		id, err := api.ParseMsgID(msgID)
+		if err != nil {
+			return nil, err
+		}
+		return node.GetMsgStatus(id)
+
+	case api.GetMsgStatuses:
+		if statuses, err := node.GetMsgStatuses(); err != nil {
+			return nil, err
+		} else {
+			return statuses, nil
+		}
+
+	case api.GetPatches:
+		return node.Router().GetPatches(), nil
+
+	case api.AddPatch:
+		if len(call.Args) < 1 {
+			return nil, errors.New("Invalid argument count")
+		}
+		var patch api.Patch
+		for i, v := range call.Args {
+			vs, ok := v.(string)
+			if !ok {
+				return nil, errors.New("Invalid argument")
+			}
+			if i == 0 {
+				patch.From = vs
+			} else {
+				patch.To = append(patch.To, vs)
+			}
+		}
+		node.Router().Patch(patch)
+		return nil, nil
+
+	case api.Unpatch:
+		if len(call.Args) < 1 {
+			return nil, errors.New("Invalid argument count")
+		}
+		from, ok := call.Args[0].(string)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		node.Router().Unpatch(from)
+		return nil, nil
+
+	case api.SetPatches:
+		if len(call.Args) < 1 {
+			return nil, errors.New("Invalid argument count")
+		}
+		patches, ok := call.Args[0].([]api.Patch)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		node.Router().SetPatches(patches)
+		return nil, nil
+
+	case api.SetQuota:
+		quota, err := quotaArgs(call.Args)
+		if err != nil {
+			return nil, err
+		}
+		node.SetQuota(quota)
+		return nil, nil
+
+	case api.SetChannelQuota:
+		if len(call.Args) < 1 {
+			return nil, errors.New("Invalid argument count")
+		}
+		channelName, ok := call.Args[0].(string)
+		if !ok {
+			return nil, errors.New("Invalid argument")
+		}
+		quota, err := quotaArgs(call.Args[1:])
+		if err != nil {
+			return nil, err
+		}
+		node.SetChannelQuota(channelName, quota)
+		return nil, nil
+
 	default:
 		return node.PublicRPC(transport, call)
 	}
 }
+
+// quotaArgs - reads an OutboxQuota from the int64 arguments MaxBytes, MaxMessages and Eviction
+func quotaArgs(args []interface{}) (api.OutboxQuota, error) {
+	var quota api.OutboxQuota
+	if len(args) < 3 {
+		return quota, errors.New("Invalid argument count")
+	}
+	maxBytes, ok := args[0].(int64)
+	if !ok {
+		return quota, errors.New("Invalid argument")
+	}
+	maxMessages, ok := args[1].(int64)
+	if !ok {
+		return quota, errors.New("Invalid argument")
+	}
+	eviction, ok := args[2].(int64)
+	if !ok {
+		return quota, errors.New("Invalid argument")
+	}
+	quota.MaxBytes, quota.MaxMessages, quota.Eviction = maxBytes, maxMessages, api.EvictionPolicy(eviction)
+	return quota, nil
+}
@@ -0,0 +1,150 @@
+package nodes
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+	"github.com/awgh/ratnet/api/events"
+	"github.com/awgh/ratnet/api/multicast"
+)
+
+// StreamStore : how a node keeps the headers and chunks of incoming streams until they are reassembled
+type StreamStore struct {
+	Streams     func() ([]api.StreamHeader, error)
+	ChunkCount  func(streamID uint32) (uint64, error)
+	Chunks      func(streamID uint32) ([]api.Chunk, error) // ordered by chunk number
+	ReadChunk   func(streamID, chunkNum uint32) ([]byte, bool, error)
+	RemoveChunk func(streamID, chunkNum uint32) error
+	ClearStream func(streamID uint32) error
+}
+
+// ProcessStreams : one pass over a node's incoming streams, run by its debouncer with the node's stream lock held.
+// Complete streams are verified and sent to Out(), streams being read by a stream handler are fed to it,
+// stalled streams are NACKed and streams that are too old or too big are abandoned.
+func ProcessStreams(node api.Node, store StreamStore, readers *chunking.Readers, nackTimer *chunking.NackTimer) {
+	clear := func(streamID uint32) {
+		if err := store.ClearStream(streamID); err != nil {
+			events.Error(node, "error deleting stream: "+err.Error())
+		}
+	}
+	streams, err := store.Streams()
+	if err != nil {
+		events.Critical(node, err.Error())
+	}
+	// for each stream, count chunks for that header
+	for _, stream := range streams {
+		// streams being read by a stream handler are handed over chunk by chunk instead
+		reading, done, err := readers.Feed(node, stream, store.ReadChunk, store.RemoveChunk)
+		if err != nil {
+			clear(stream.StreamID)
+			chunking.Corrupted(node, stream, err)
+			continue
+		} else if done {
+			clear(stream.StreamID)
+			continue
+		}
+		count, err := store.ChunkCount(stream.StreamID)
+		if err != nil {
+			events.Critical(node, err.Error())
+		}
+		next := readers.Next(stream.StreamID)
+		// if chunks == total chunks, re-assemble Msg and call Handle
+		if !reading && stream.NumChunks > 0 && count == uint64(stream.NumChunks) {
+			chunks, err := store.Chunks(stream.StreamID)
+			if err != nil {
+				events.Critical(node, err.Error())
+			}
+			buf := bytes.NewBuffer([]byte{})
+			for i, chunk := range chunks {
+				if chunk.ChunkNum != uint32(i) {
+					events.Critical(node, "Chunk count miscalculated - code broken")
+				}
+				buf.Write(chunk.Data)
+			}
+			if err := chunking.Verify(stream, buf.Bytes()); err != nil {
+				clear(stream.StreamID)
+				chunking.Corrupted(node, stream, err)
+				continue
+			}
+
+			var msg api.Msg
+			if len(stream.ChannelName) > 0 {
+				msg.IsChan = true
+				msg.Name = stream.ChannelName
+			}
+			msg.Content = buf
+			if stream.Signed { // the signed header vouched for the digest that was just verified
+				if err := signedBy(node, &msg, stream.ReplyKey); err != nil {
+					clear(stream.StreamID)
+					chunking.Corrupted(node, stream, err)
+					continue
+				}
+			}
+
+			select {
+			case node.Out() <- msg:
+				events.Debug(node, "Sent message "+fmt.Sprint(msg.Content.Bytes()))
+				clear(stream.StreamID)
+			default:
+				events.Debug(node, "No message sent")
+			}
+		} else if nackTimer.Due(stream.StreamID, int(count)+int(next)) {
+			chunks, err := store.Chunks(stream.StreamID)
+			if err != nil {
+				events.Critical(node, err.Error())
+			}
+			received := make([]uint32, 0, len(chunks))
+			for _, chunk := range chunks {
+				received = append(received, chunk.ChunkNum)
+			}
+			// nothing is missing until the final header arrives, or while a slow reader catches up
+			if missing := chunking.MissingChunks(next, stream.NumChunks, received); len(missing) > 0 {
+				if err := chunking.SendNack(node, stream, missing); err != nil {
+					events.Warning(node, "Could not NACK stream: "+err.Error())
+				}
+				nackTimer.Nacked(stream.StreamID)
+			}
+		}
+	}
+	// discard incomplete streams that are too old or too big to keep around
+	if streams, err = store.Streams(); err != nil {
+		events.Critical(node, err.Error())
+	}
+	for _, stream := range nackTimer.Expired(streams) {
+		clear(stream.StreamID)
+		chunking.Abandoned(node, stream)
+	}
+}
+
+// signedBy : marks a reassembled msg as signed by the content key b64, like a signed message that was not chunked
+func signedBy(node api.Node, msg *api.Msg, b64 string) error {
+	cid, err := node.CID() // we need this for cloning
+	if err != nil {
+		return err
+	}
+	sender := cid.Clone()
+	if err := sender.FromB64(b64); err != nil {
+		return err
+	}
+	msg.PubKey, msg.Signed = sender, true
+	if name := multicast.ContactName(node, sender); name != "" {
+		msg.Name = name
+	}
+	return nil
+}
+
+// WakeStreams : calls trigger every NACK interval until stop is closed,
+// so streams that stopped receiving chunks still get NACKed or expired
+func WakeStreams(trigger func(), nackTimer *chunking.NackTimer, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(nackTimer.Interval()):
+		}
+		trigger()
+	}
+}
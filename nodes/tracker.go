@@ -0,0 +1,211 @@
+package nodes
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// DefaultTrackerMaxAge - statuses that have not changed for this long are forgotten, even if the OutboxTTL never expires them,
+// unless the Tracker has been given another limit
+var DefaultTrackerMaxAge = 24 * time.Hour
+
+// DefaultTrackerMaxEntries - limit on the number of statuses a Tracker keeps, the oldest are forgotten first,
+// unless the Tracker has been given another limit
+var DefaultTrackerMaxEntries = 10000
+
+// Tracker : keeps the MsgStatus of the messages a node sends, from SendMsg until
+// a while after they expire.  Outbound messages are matched to their MsgID by the
+// hash of what was put in the outbox, chunked messages are all tracked by one MsgID.
+type Tracker struct {
+	mutex      sync.Mutex
+	maxAge     time.Duration
+	maxEntries int
+	statuses   map[api.MsgID]*api.MsgStatus
+	queued     map[[sha256.Size]byte]api.MsgID // outbox messages to the MsgID they were sent as
+	pruned     int64                           // when statuses older than maxAge were last forgotten, UnixNano
+}
+
+// NewTracker : returns an empty Tracker
+func NewTracker() *Tracker {
+	t := new(Tracker)
+	t.maxAge = DefaultTrackerMaxAge
+	t.maxEntries = DefaultTrackerMaxEntries
+	t.statuses = make(map[api.MsgID]*api.MsgStatus)
+	t.queued = make(map[[sha256.Size]byte]api.MsgID)
+	return t
+}
+
+// SetLimits : sets how long unchanged statuses are kept and how many statuses are kept at most,
+// zero restores the default
+func (t *Tracker) SetLimits(maxAge time.Duration, maxEntries int) {
+	if maxAge <= 0 {
+		maxAge = DefaultTrackerMaxAge
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultTrackerMaxEntries
+	}
+	t.mutex.Lock()
+	t.maxAge, t.maxEntries = maxAge, maxEntries
+	t.mutex.Unlock()
+}
+
+// Queued : records that msg was put in the outbox for the message with the given MsgID
+func (t *Tracker) Queued(id api.MsgID, msg []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now().UnixNano()
+	status, ok := t.statuses[id]
+	if !ok {
+		t.prune(now)
+		status = &api.MsgStatus{ID: id, State: api.MsgQueued, Queued: now}
+		t.statuses[id] = status
+	}
+	status.Updated = now
+	t.queued[sha256.Sum256(msg)] = id
+}
+
+// prune - forgets statuses that have not changed for maxAge, at most once a minute,
+// and the oldest statuses while there is no room for another, call with mutex held
+func (t *Tracker) prune(now int64) {
+	if now-t.pruned > int64(time.Minute) {
+		t.pruned = now
+		cutoff := now - int64(t.maxAge)
+		for id, status := range t.statuses {
+			if status.Updated < cutoff {
+				delete(t.statuses, id)
+			}
+		}
+		t.forget()
+	}
+	if len(t.statuses) < t.maxEntries {
+		return
+	}
+	// make some room at once, rather than sorting for every new message
+	oldest := make([]*api.MsgStatus, 0, len(t.statuses))
+	for _, status := range t.statuses {
+		oldest = append(oldest, status)
+	}
+	sort.Slice(oldest, func(i, j int) bool { return oldest[i].Queued < oldest[j].Queued })
+	for _, status := range oldest[:len(oldest)-t.maxEntries*9/10] {
+		delete(t.statuses, status.ID)
+	}
+	t.forget()
+}
+
+// forget - drops the outbox hashes of messages that are no longer tracked or have expired, call with mutex held
+func (t *Tracker) forget() {
+	for hash, id := range t.queued {
+		if status, ok := t.statuses[id]; !ok || status.State == api.MsgExpired {
+			delete(t.queued, hash)
+		}
+	}
+}
+
+// Receipted : records that a delivery receipt was asked for the message with the given MsgID
+func (t *Tracker) Receipted(id api.MsgID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if status, ok := t.statuses[id]; ok {
+		status.Receipted = true
+		status.Updated = time.Now().UnixNano()
+	}
+}
+
+// Delivered : records that the delivery receipt for the message with the given MsgID arrived,
+// false if no receipt was asked for that MsgID or it already arrived
+func (t *Tracker) Delivered(id api.MsgID) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	status, ok := t.statuses[id]
+	if !ok || !status.Receipted || status.State == api.MsgDelivered {
+		return false
+	}
+	status.State = api.MsgDelivered
+	status.Updated = time.Now().UnixNano()
+	return true
+}
+
+// PickedUp : records that the peer with the given routing key picked up msgs from the outbox
+func (t *Tracker) PickedUp(peer string, msgs [][]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.queued) == 0 { // nothing of ours in the outbox, only forwarded messages
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, msg := range msgs {
+		id, ok := t.queued[sha256.Sum256(msg)]
+		if !ok {
+			continue
+		}
+		status := t.statuses[id]
+		if status.State == api.MsgQueued {
+			status.State = api.MsgPickedUp
+			status.Updated = now
+		}
+		if !contains(status.PickedUpBy, peer) {
+			status.PickedUpBy = append(status.PickedUpBy, peer)
+			status.Updated = now
+		}
+	}
+}
+
+// Expire : marks messages older than maxAgeSeconds as expired, as FlushOutbox drops them,
+// and forgets messages that expired or were delivered more than maxAgeSeconds ago
+func (t *Tracker) Expire(maxAgeSeconds int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now().UnixNano()
+	cutoff := now - maxAgeSeconds*int64(time.Second)
+	for id, status := range t.statuses {
+		done := status.State == api.MsgExpired || status.State == api.MsgDelivered
+		if done && status.Updated < cutoff {
+			delete(t.statuses, id)
+		} else if !done && status.Queued < cutoff {
+			status.State = api.MsgExpired
+			status.Updated = now
+		}
+	}
+	t.forget()
+}
+
+// Status : returns a copy of the status of the message with the given MsgID
+func (t *Tracker) Status(id api.MsgID) (*api.MsgStatus, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	status, ok := t.statuses[id]
+	if !ok {
+		return nil, errors.New("Message not found")
+	}
+	s := *status
+	s.PickedUpBy = append([]string(nil), status.PickedUpBy...)
+	return &s, nil
+}
+
+// Statuses : returns copies of the statuses of every tracked message, oldest first
+func (t *Tracker) Statuses() []api.MsgStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	statuses := make([]api.MsgStatus, 0, len(t.statuses))
+	for _, status := range t.statuses {
+		s := *status
+		s.PickedUpBy = append([]string(nil), status.PickedUpBy...)
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Queued < statuses[j].Queued })
+	return statuses
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
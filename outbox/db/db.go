@@ -0,0 +1,301 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox"
+
+	"github.com/upper/db/v4"
+)
+
+// Outbox : upper db implementation of api.Outbox, messages are kept in the outbox table
+type Outbox struct {
+	db      db.Session
+	pickups outbox.PickupLog // what each consumer was handed ahead of its lastTime
+}
+
+// New : creates a new Outbox in the given database session, creating the outbox table if needed.
+// dbAdapter is the upper db adapter name the session was opened with.
+func New(sess db.Session, dbAdapter string) (*Outbox, error) {
+	o := new(Outbox)
+	o.db = sess
+
+	_, err := o.db.SQL().Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS outbox (
+			channel		%s,
+			msg			%s	NOT NULL,
+			timestamp	%s	NOT NULL,
+			forwarded	bool,
+			priority	%s	DEFAULT 0,
+			ingress		%s
+		);
+	`, getBackendType(dbAdapter, "string"), getBackendType(dbAdapter, "blob"), getBackendType(dbAdapter, "int64"),
+		getBackendType(dbAdapter, "int64"), getBackendType(dbAdapter, "string")))
+	if err != nil {
+		return nil, err
+	}
+	// outbox tables made by older versions lack the later columns
+	for _, c := range []struct {
+		name, colType string
+		value         interface{}
+	}{
+		{"forwarded", "bool", false},
+		{"priority", getBackendType(dbAdapter, "int64"), int64(0)},
+		{"ingress", getBackendType(dbAdapter, "string"), ""},
+	} {
+		if err := o.addColumn(c.name, c.colType, c.value); err != nil {
+			return nil, err
+		}
+	}
+	_, err = o.db.SQL().Exec(`
+			CREATE INDEX IF NOT EXISTS outboxID ON outbox (timestamp);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// addColumn - adds a column to the outbox table if it is missing, set to value in the existing rows
+func (o *Outbox) addColumn(column, colType string, value interface{}) error {
+	rows, err := o.db.SQL().Query("SELECT * FROM outbox LIMIT 1")
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, col := range columns {
+		if col == column {
+			return nil // already there
+		}
+	}
+	if _, err := o.db.SQL().Exec("ALTER TABLE outbox ADD " + column + " " + colType); err != nil {
+		return err
+	}
+	_, err = o.db.SQL().Exec("UPDATE outbox SET "+column+" = ?", value)
+	return err
+}
+
+// Enqueue : stores outbound messages
+func (o *Outbox) Enqueue(msgs ...api.OutboxMsg) error {
+	return o.db.Tx(func(tx db.Session) error {
+		col := tx.Collection("outbox")
+		// todo: convert this to BatchInserter?
+		for _, msg := range msgs {
+			if _, err := col.Insert(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MsgsSince : Get messages after the given timestamp, highest priority first
+func (o *Outbox) MsgsSince(lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	return o.MsgsSinceExcept("", lastTime, maxBytes, channelNames...)
+}
+
+// MsgsSinceExcept : Get messages after the given timestamp that did not come in from except, highest priority first
+func (o *Outbox) MsgsSinceExcept(except string, lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	var args []interface{}
+	var entries []api.OutboxEntry
+
+	// Build the query
+	where := " WHERE (? < timestamp)"
+	args = append(args, lastTime)
+	if len(channelNames) > 0 { // if no channels are given, get everything
+		where = where + " AND channel IN( ?"
+		args = append(args, channelNames[0])
+		for i := 1; i < len(channelNames); i++ {
+			where = where + ",?"
+			args = append(args, channelNames[i])
+		}
+		where = where + " )"
+	}
+	if except != "" {
+		where = where + " AND (ingress IS NULL OR ingress != ?)"
+		args = append(args, except)
+	}
+	// pick from the sizes and priorities first, so only the picked messages are kept
+	res, err := o.db.SQL().Query("SELECT msg, timestamp, priority FROM outbox"+where+" ORDER BY timestamp ASC;", args...)
+	if res == nil || err != nil {
+		return nil, lastTime, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var entry api.OutboxEntry
+		var msg []byte
+		if err := res.Scan(&msg, &entry.Timestamp, &entry.Priority); err != nil {
+			return nil, lastTime, err
+		}
+		entry.Size = int64(len(msg))
+		entries = append(entries, entry)
+	}
+	picked, lastTimeReturned := o.pickups.Order(except, entries, lastTime, maxBytes)
+	if len(picked) == 0 {
+		return nil, lastTimeReturned, nil
+	}
+
+	// then fetch the picked messages
+	where = where + " AND timestamp IN( ?"
+	args = append(args, entries[picked[0]].Timestamp)
+	for _, i := range picked[1:] {
+		where = where + ",?"
+		args = append(args, entries[i].Timestamp)
+	}
+	where = where + " )"
+	res2, err := o.db.SQL().Query("SELECT msg, timestamp FROM outbox"+where+";", args...)
+	if res2 == nil || err != nil {
+		return nil, lastTime, err
+	}
+	defer res2.Close()
+	byTime := make(map[int64][]byte, len(picked))
+	for res2.Next() {
+		var msg []byte
+		var ts int64
+		if err := res2.Scan(&msg, &ts); err != nil {
+			return nil, lastTime, err
+		}
+		byTime[ts] = msg
+	}
+	msgs := make([][]byte, 0, len(picked))
+	for _, i := range picked {
+		if msg, ok := byTime[entries[i].Timestamp]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, lastTimeReturned, nil
+}
+
+// Flush : Deletes outbound messages older than maxAgeSeconds seconds
+func (o *Outbox) Flush(maxAgeSeconds int64) error {
+	ts := time.Now().UnixNano()
+	ts = ts - (maxAgeSeconds * 1000000000)
+	col := o.db.Collection("outbox")
+	res := col.Find("timestamp < ?", ts)
+	return res.Delete()
+}
+
+// Stats : returns the number and size of the stored messages
+func (o *Outbox) Stats() (api.OutboxStats, error) {
+	var stats api.OutboxStats
+	res, err := o.db.SQL().Query("SELECT msg, timestamp FROM outbox ORDER BY timestamp ASC;")
+	if res == nil || err != nil {
+		return stats, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var msg []byte
+		var ts int64
+		if err := res.Scan(&msg, &ts); err != nil {
+			return stats, err
+		}
+		if stats.Messages == 0 {
+			stats.Oldest = ts
+		}
+		stats.Newest = ts
+		stats.Messages++
+		stats.Bytes += int64(len(msg))
+	}
+	return stats, nil
+}
+
+// Entries : describes the stored messages without their contents, oldest first
+func (o *Outbox) Entries(channelNames ...string) ([]api.OutboxEntry, error) {
+	var args []interface{}
+	var entries []api.OutboxEntry
+
+	// Build the query
+	sqlq := "SELECT channel, msg, timestamp, forwarded, priority FROM outbox"
+	if len(channelNames) > 0 { // if no channels are given, get everything
+		sqlq = sqlq + " WHERE channel IN( ?"
+		args = append(args, channelNames[0])
+		for i := 1; i < len(channelNames); i++ {
+			sqlq = sqlq + ",?"
+			args = append(args, channelNames[i])
+		}
+		sqlq = sqlq + " )"
+	}
+	sqlq = sqlq + " ORDER BY timestamp ASC;"
+	res, err := o.db.SQL().Query(sqlq, args...)
+	if res == nil || err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var entry api.OutboxEntry
+		var msg []byte
+		if err := res.Scan(&entry.Channel, &msg, &entry.Timestamp, &entry.Forwarded, &entry.Priority); err != nil {
+			return nil, err
+		}
+		entry.Size = int64(len(msg))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Remove : deletes the messages with the given timestamps
+func (o *Outbox) Remove(timestamps ...int64) error {
+	return o.db.Tx(func(tx db.Session) error {
+		col := tx.Collection("outbox")
+		for _, ts := range timestamps {
+			if err := col.Find("timestamp = ?", ts).Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getBackendType(dbAdapter, dbType string) string {
+	switch dbAdapter {
+	case "postgresql":
+		switch dbType {
+		case "blob":
+			return "bytea"
+		case "int64":
+			return "bigint"
+		default:
+			return "text"
+		}
+	case "mysql":
+		switch dbType {
+		case "int64":
+			return "bigint"
+		case "string":
+			return "text"
+		}
+	case "sqllite":
+		switch dbType {
+		case "int64":
+			return "integer"
+		case "string":
+			return "text"
+		}
+	case "mssql":
+		switch dbType {
+		case "blob":
+			return "varbinary"
+		case "int64":
+			return "bigint"
+		default:
+			return "varchar"
+		}
+	case "mongodb":
+		switch dbType {
+		case "blob":
+			return "binData"
+		case "int64":
+			return "long"
+		}
+	case "ql":
+	default:
+		panic(fmt.Sprintf("invalid database backend %s", dbAdapter))
+	}
+	return dbType
+}
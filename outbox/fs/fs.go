@@ -0,0 +1,297 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox"
+)
+
+// Outbox : filesystem implementation of api.Outbox,
+// each message is a file named by its hex timestamp, channel messages are in a directory named by the channel.
+// Forwarded messages have forwardedSuffix appended to their file name, messages with an Ingress have
+// ingressSuffix and a hash of the Ingress after that, and messages with a priority other than normal
+// have prioritySuffix and the priority in decimal appended last.
+// Directories starting with a dot are left alone, so the base path can be shared with other node state.
+type Outbox struct {
+	mux      sync.Mutex
+	basePath string
+	pickups  outbox.PickupLog // what each consumer was handed ahead of its lastTime
+}
+
+const (
+	// forwardedSuffix - marks the files of messages queued by Forward
+	forwardedSuffix = ".fwd"
+	// prioritySuffix - marks the files of messages with a priority other than normal
+	prioritySuffix = ".p"
+	// ingressSuffix - marks the files of messages with an Ingress, routing keys don't fit in file names so it is hashed
+	ingressSuffix = ".i"
+)
+
+type outboxFile struct {
+	path      string
+	channel   string
+	timestamp int64
+	size      int64
+	forwarded bool
+	priority  int8
+	ingress   string // ingressTag of the Ingress
+}
+
+// New : creates a new Outbox that keeps its messages under basePath
+func New(basePath string) *Outbox {
+	o := new(Outbox)
+	o.basePath = basePath
+	os.MkdirAll(basePath, 0700)
+	return o
+}
+
+func hex64(n int64) string {
+	return fmt.Sprintf("%016x", n)
+}
+
+// ingressTag - short hash of an Ingress for file names
+func ingressTag(ingress string) string {
+	h := sha256.Sum256([]byte(ingress))
+	return hex.EncodeToString(h[:8])
+}
+
+// Enqueue : stores outbound messages
+func (o *Outbox) Enqueue(msgs ...api.OutboxMsg) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, msg := range msgs {
+		path := o.basePath
+		if msg.Channel != "" {
+			// create channel dir if not exist
+			path = filepath.Join(path, msg.Channel)
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+		}
+		name := hex64(msg.Timestamp)
+		if msg.Forwarded {
+			name += forwardedSuffix
+		}
+		if msg.Ingress != "" {
+			name += ingressSuffix + ingressTag(msg.Ingress)
+		}
+		if msg.Priority != api.PriorityNormal {
+			name += prioritySuffix + strconv.Itoa(int(msg.Priority))
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, name), msg.Msg, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseName - reads the timestamp, forwarded flag, ingress tag and priority from a message file name
+func parseName(name string) (outboxFile, bool) {
+	var file outboxFile
+	if i := strings.Index(name, prioritySuffix); i >= 0 {
+		p, err := strconv.ParseInt(name[i+len(prioritySuffix):], 10, 8)
+		if err != nil {
+			return file, false
+		}
+		file.priority = int8(p)
+		name = name[:i]
+	}
+	if i := strings.Index(name, ingressSuffix); i >= 0 {
+		file.ingress = name[i+len(ingressSuffix):]
+		name = name[:i]
+	}
+	if strings.HasSuffix(name, forwardedSuffix) {
+		file.forwarded = true
+		name = strings.TrimSuffix(name, forwardedSuffix)
+	}
+	ts, err := strconv.ParseInt(name, 16, 64)
+	if err != nil {
+		return file, false
+	}
+	file.timestamp = ts
+	return file, true
+}
+
+// list - returns every message file, oldest first, call with mux held
+func (o *Outbox) list() ([]outboxFile, error) {
+	var files []outboxFile
+	read := func(dir, channel string) error {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				continue
+			}
+			file, ok := parseName(info.Name())
+			if !ok {
+				continue // not one of ours
+			}
+			file.path = filepath.Join(dir, info.Name())
+			file.channel = channel
+			file.size = info.Size()
+			files = append(files, file)
+		}
+		return nil
+	}
+	if err := read(o.basePath, ""); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(o.basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			if err := read(filepath.Join(o.basePath, info.Name()), info.Name()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].timestamp < files[j].timestamp })
+	return files, nil
+}
+
+// MsgsSince : Get messages after the given timestamp, highest priority first
+func (o *Outbox) MsgsSince(lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	return o.MsgsSinceExcept("", lastTime, maxBytes, channelNames...)
+}
+
+// MsgsSinceExcept : Get messages after the given timestamp that did not come in from except, highest priority first
+func (o *Outbox) MsgsSinceExcept(except string, lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	var entries []api.OutboxEntry
+	var candidates []outboxFile
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	files, err := o.list()
+	if err != nil {
+		return nil, lastTime, err
+	}
+	exceptTag := ""
+	if except != "" {
+		exceptTag = ingressTag(except)
+	}
+	for _, file := range files {
+		if file.timestamp <= lastTime || (exceptTag != "" && file.ingress == exceptTag) {
+			continue
+		}
+		pickupMsg := len(channelNames) == 0
+		for _, channelName := range channelNames {
+			if channelName == file.channel {
+				pickupMsg = true
+			}
+		}
+		if !pickupMsg {
+			continue
+		}
+		entries = append(entries, api.OutboxEntry{Timestamp: file.timestamp, Size: file.size, Priority: file.priority})
+		candidates = append(candidates, file)
+	}
+	picked, lastTimeReturned := o.pickups.Order(except, entries, lastTime, maxBytes)
+	msgs := make([][]byte, 0, len(picked))
+	for _, i := range picked {
+		b, err := ioutil.ReadFile(candidates[i].path)
+		if err != nil {
+			return nil, lastTime, err
+		}
+		msgs = append(msgs, b)
+	}
+	return msgs, lastTimeReturned, nil
+}
+
+// Flush : Deletes outbound messages older than maxAgeSeconds seconds
+func (o *Outbox) Flush(maxAgeSeconds int64) error {
+	c := time.Now().UnixNano() - (maxAgeSeconds * 1000000000)
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	files, err := o.list()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.timestamp < c {
+			if err := os.Remove(file.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stats : returns the number and size of the stored messages
+func (o *Outbox) Stats() (api.OutboxStats, error) {
+	var stats api.OutboxStats
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	files, err := o.list()
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range files {
+		stats.Messages++
+		stats.Bytes += file.size
+	}
+	if len(files) > 0 {
+		stats.Oldest = files[0].timestamp
+		stats.Newest = files[len(files)-1].timestamp
+	}
+	return stats, nil
+}
+
+// Entries : describes the stored messages without their contents, oldest first
+func (o *Outbox) Entries(channelNames ...string) ([]api.OutboxEntry, error) {
+	var entries []api.OutboxEntry
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	files, err := o.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		pickupMsg := len(channelNames) == 0
+		for _, channelName := range channelNames {
+			if channelName == file.channel {
+				pickupMsg = true
+			}
+		}
+		if pickupMsg {
+			entries = append(entries, api.OutboxEntry{Channel: file.channel, Timestamp: file.timestamp, Size: file.size,
+				Forwarded: file.forwarded, Priority: file.priority})
+		}
+	}
+	return entries, nil
+}
+
+// Remove : deletes the messages with the given timestamps
+func (o *Outbox) Remove(timestamps ...int64) error {
+	remove := make(map[int64]bool, len(timestamps))
+	for _, ts := range timestamps {
+		remove[ts] = true
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	files, err := o.list()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if remove[file.timestamp] {
+			if err := os.Remove(file.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
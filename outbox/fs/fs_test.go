@@ -0,0 +1,18 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox/outboxtest"
+)
+
+func Test_outbox_Conformance(t *testing.T) {
+	outboxtest.Run(t, func(t *testing.T) api.Outbox {
+		dir := t.TempDir()
+		os.Mkdir(filepath.Join(dir, ".streams"), 0700) // other node state is left alone
+		return New(dir)
+	})
+}
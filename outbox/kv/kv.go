@@ -0,0 +1,250 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucketName - name of the bucket that holds the outbox
+var bucketName = []byte("outbox")
+
+// Outbox : bbolt implementation of api.Outbox,
+// messages are keyed by timestamp and a sequence number so a cursor walks them oldest first
+type Outbox struct {
+	db      *bolt.DB
+	pickups outbox.PickupLog // what each consumer was handed ahead of its lastTime
+}
+
+// New : creates a new Outbox in the given database, creating the outbox bucket if needed
+func New(db *bolt.DB) (*Outbox, error) {
+	o := new(Outbox)
+	o.db = db
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// timeKey - big-endian timestamp with the sign bit flipped, so keys sort in time order
+func timeKey(ts int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(ts)^(1<<63))
+	return k
+}
+
+func keyTime(k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(k[:8]) ^ (1 << 63))
+}
+
+const (
+	// flagForwarded - set in the value flags for messages queued by Forward
+	flagForwarded = 0x01
+	// flagIngress - set in the value flags for messages with an Ingress
+	flagIngress = 0x02
+)
+
+// value layout: flags byte, priority byte, uint16 channel name length, channel name,
+// uint16 ingress length and ingress if flagIngress is set, message
+func encodeValue(msg api.OutboxMsg) []byte {
+	n := 4 + len(msg.Channel)
+	if msg.Ingress != "" {
+		n += 2 + len(msg.Ingress)
+	}
+	v := make([]byte, n+len(msg.Msg))
+	if msg.Forwarded {
+		v[0] |= flagForwarded
+	}
+	v[1] = byte(msg.Priority)
+	binary.BigEndian.PutUint16(v[2:], uint16(len(msg.Channel)))
+	copy(v[4:], msg.Channel)
+	if msg.Ingress != "" {
+		v[0] |= flagIngress
+		binary.BigEndian.PutUint16(v[4+len(msg.Channel):], uint16(len(msg.Ingress)))
+		copy(v[6+len(msg.Channel):], msg.Ingress)
+	}
+	copy(v[n:], msg.Msg)
+	return v
+}
+
+func decodeValue(v []byte) (api.OutboxMsg, error) {
+	var msg api.OutboxMsg
+	if len(v) < 4 {
+		return msg, errors.New("Outbox value too short")
+	}
+	n := int(binary.BigEndian.Uint16(v[2:]))
+	if len(v) < 4+n {
+		return msg, errors.New("Outbox value too short for channel name")
+	}
+	flags := v[0]
+	msg.Forwarded = flags&flagForwarded != 0
+	msg.Priority = int8(v[1])
+	msg.Channel = string(v[4 : 4+n])
+	v = v[4+n:]
+	if flags&flagIngress != 0 {
+		if len(v) < 2 || len(v) < 2+int(binary.BigEndian.Uint16(v)) {
+			return msg, errors.New("Outbox value too short for ingress")
+		}
+		n = int(binary.BigEndian.Uint16(v))
+		msg.Ingress = string(v[2 : 2+n])
+		v = v[2+n:]
+	}
+	msg.Msg = v
+	return msg, nil
+}
+
+// Enqueue : stores outbound messages, all of them or none
+func (o *Outbox) Enqueue(msgs ...api.OutboxMsg) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, msg := range msgs {
+			// the sequence number keeps messages with the same timestamp apart
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			k := append(timeKey(msg.Timestamp), make([]byte, 8)...)
+			binary.BigEndian.PutUint64(k[8:], seq)
+			if err := b.Put(k, encodeValue(msg)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hasChannel - true if channel is one of channelNames, or no channelNames are given
+func hasChannel(channelNames []string, channel string) bool {
+	if len(channelNames) == 0 {
+		return true
+	}
+	for _, channelName := range channelNames {
+		if channelName == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// MsgsSince : Get messages after the given timestamp, highest priority first
+func (o *Outbox) MsgsSince(lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	return o.MsgsSinceExcept("", lastTime, maxBytes, channelNames...)
+}
+
+// MsgsSinceExcept : Get messages after the given timestamp that did not come in from except, highest priority first
+func (o *Outbox) MsgsSinceExcept(except string, lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	var msgs [][]byte
+	lastTimeReturned := lastTime
+	err := o.db.View(func(tx *bolt.Tx) error {
+		var entries []api.OutboxEntry
+		var candidates [][]byte
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.Seek(timeKey(lastTime + 1)); k != nil; k, v = c.Next() {
+			m, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+			if !hasChannel(channelNames, m.Channel) || (except != "" && m.Ingress == except) {
+				continue
+			}
+			entries = append(entries, api.OutboxEntry{Timestamp: keyTime(k), Size: int64(len(m.Msg)), Priority: m.Priority})
+			candidates = append(candidates, m.Msg)
+		}
+		var picked []int
+		picked, lastTimeReturned = o.pickups.Order(except, entries, lastTime, maxBytes)
+		for _, i := range picked {
+			// values are only valid inside the transaction so copy them out
+			msgs = append(msgs, append([]byte(nil), candidates[i]...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, lastTime, err
+	}
+	return msgs, lastTimeReturned, nil
+}
+
+// Flush : Deletes outbound messages older than maxAgeSeconds seconds
+func (o *Outbox) Flush(maxAgeSeconds int64) error {
+	ts := time.Now().UnixNano() - (maxAgeSeconds * 1000000000)
+	return o.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, _ := c.First(); k != nil && keyTime(k) < ts; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Stats : returns the number and size of the stored messages
+func (o *Outbox) Stats() (api.OutboxStats, error) {
+	var stats api.OutboxStats
+	err := o.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+			if stats.Messages == 0 {
+				stats.Oldest = keyTime(k)
+			}
+			stats.Newest = keyTime(k)
+			stats.Messages++
+			stats.Bytes += int64(len(m.Msg))
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Entries : describes the stored messages without their contents, oldest first
+func (o *Outbox) Entries(channelNames ...string) ([]api.OutboxEntry, error) {
+	var entries []api.OutboxEntry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m, err := decodeValue(v)
+			if err != nil {
+				return err
+			}
+			if !hasChannel(channelNames, m.Channel) {
+				continue
+			}
+			entries = append(entries, api.OutboxEntry{Channel: m.Channel, Timestamp: keyTime(k),
+				Size: int64(len(m.Msg)), Forwarded: m.Forwarded, Priority: m.Priority})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Remove : deletes the messages with the given timestamps
+func (o *Outbox) Remove(timestamps ...int64) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for _, ts := range timestamps {
+			// every message with this timestamp, whatever its sequence number
+			for k, _ := c.Seek(timeKey(ts)); k != nil && keyTime(k) == ts; k, _ = c.Seek(timeKey(ts)) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
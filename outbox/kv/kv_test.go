@@ -0,0 +1,26 @@
+package kv
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox/outboxtest"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func Test_outbox_Conformance(t *testing.T) {
+	outboxtest.Run(t, func(t *testing.T) api.Outbox {
+		db, err := bolt.Open(filepath.Join(t.TempDir(), "outbox.db"), 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		o, err := New(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	})
+}
@@ -0,0 +1,296 @@
+// Package outboxtest - conformance tests that every api.Outbox implementation should pass
+package outboxtest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// Run - runs the conformance suite, newOutbox must return a new, empty Outbox each time it is called
+func Run(t *testing.T, newOutbox func(t *testing.T) api.Outbox) {
+	base := time.Now().UnixNano()
+	msg := func(channel string, ts int64, size int) api.OutboxMsg {
+		return api.OutboxMsg{Channel: channel, Msg: bytes.Repeat([]byte{byte(ts)}, size), Timestamp: base + ts}
+	}
+	since := func(t *testing.T, o api.Outbox, lastTime, maxBytes int64, channelNames ...string) ([][]byte, int64) {
+		msgs, ts, err := o.MsgsSince(lastTime, maxBytes, channelNames...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs, ts
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		o := newOutbox(t)
+		msgs, ts := since(t, o, 0, 0)
+		if len(msgs) != 0 || ts != 0 {
+			t.Errorf("Empty outbox returned %d messages, time %d", len(msgs), ts)
+		}
+		stats, err := o.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != (api.OutboxStats{}) {
+			t.Errorf("Empty outbox stats: %+v", stats)
+		}
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		o := newOutbox(t)
+		if err := o.Enqueue(msg("", 3, 10), msg("", 1, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Enqueue(msg("", 2, 10)); err != nil {
+			t.Fatal(err)
+		}
+		msgs, ts := since(t, o, 0, 0)
+		if len(msgs) != 3 || ts != base+3 {
+			t.Fatalf("Expected 3 messages up to %d, got %d up to %d", base+3, len(msgs), ts)
+		}
+		for i, m := range msgs {
+			if m[0] != byte(i+1) {
+				t.Errorf("Message %d out of order", i)
+			}
+		}
+		if msgs, ts = since(t, o, base+2, 0); len(msgs) != 1 || ts != base+3 {
+			t.Errorf("Expected 1 message after %d, got %d", base+2, len(msgs))
+		}
+		if msgs, ts = since(t, o, base+3, 0); len(msgs) != 0 || ts != base+3 {
+			t.Errorf("Expected no messages after the last one, got %d, time %d", len(msgs), ts)
+		}
+	})
+
+	t.Run("Channels", func(t *testing.T) {
+		o := newOutbox(t)
+		if err := o.Enqueue(msg("", 1, 10), msg("chana", 2, 10), msg("chanb", 3, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if msgs, _ := since(t, o, 0, 0); len(msgs) != 3 {
+			t.Errorf("Expected all 3 messages with no channels given, got %d", len(msgs))
+		}
+		if msgs, ts := since(t, o, 0, 0, "chana"); len(msgs) != 1 || msgs[0][0] != 2 || ts != base+2 {
+			t.Errorf("Expected only the chana message, got %d", len(msgs))
+		}
+		if msgs, _ := since(t, o, 0, 0, "chana", "chanb"); len(msgs) != 2 {
+			t.Errorf("Expected both channel messages, got %d", len(msgs))
+		}
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		o := newOutbox(t)
+		if err := o.Enqueue(msg("", 1, 10), msg("", 2, 10), msg("", 3, 10), msg("", 4, 100), msg("", 5, 10)); err != nil {
+			t.Fatal(err)
+		}
+		msgs, ts := since(t, o, 0, 25)
+		if len(msgs) != 2 || ts != base+2 {
+			t.Fatalf("Expected 2 messages in 25 bytes, got %d", len(msgs))
+		}
+		if msgs, ts = since(t, o, ts, 25); len(msgs) != 1 || ts != base+3 {
+			t.Fatalf("Expected the 3rd message alone, got %d", len(msgs))
+		}
+		// too big on its own, so it comes back alone
+		if msgs, ts = since(t, o, ts, 25); len(msgs) != 1 || len(msgs[0]) != 100 || ts != base+4 {
+			t.Fatalf("Expected the oversized message alone, got %d", len(msgs))
+		}
+		if msgs, ts = since(t, o, ts, 25); len(msgs) != 1 || ts != base+5 {
+			t.Fatalf("Expected the last message, got %d", len(msgs))
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		o := newOutbox(t)
+		old := api.OutboxMsg{Msg: []byte("old"), Timestamp: base - int64(time.Hour)}
+		if err := o.Enqueue(old, msg("", 1, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Flush(60); err != nil {
+			t.Fatal(err)
+		}
+		if msgs, _ := since(t, o, 0, 0); len(msgs) != 1 || msgs[0][0] != 1 {
+			t.Errorf("Expected only the new message after Flush, got %d", len(msgs))
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		o := newOutbox(t)
+		if err := o.Enqueue(msg("", 2, 20), msg("chana", 1, 10), msg("", 3, 30)); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := o.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := api.OutboxStats{Messages: 3, Bytes: 60, Oldest: base + 1, Newest: base + 3}
+		if stats != expected {
+			t.Errorf("Expected stats %+v, got %+v", expected, stats)
+		}
+	})
+
+	t.Run("Entries", func(t *testing.T) {
+		o := newOutbox(t)
+		fwd := msg("chanb", 2, 20)
+		fwd.Forwarded = true
+		if err := o.Enqueue(msg("chana", 3, 30), fwd, msg("", 1, 10)); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := o.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []api.OutboxEntry{
+			{Channel: "", Timestamp: base + 1, Size: 10},
+			{Channel: "chanb", Timestamp: base + 2, Size: 20, Forwarded: true},
+			{Channel: "chana", Timestamp: base + 3, Size: 30},
+		}
+		if len(entries) != len(expected) {
+			t.Fatalf("Expected %d entries, got %d", len(expected), len(entries))
+		}
+		for i := range expected {
+			if entries[i] != expected[i] {
+				t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entries[i])
+			}
+		}
+		if entries, err = o.Entries("chana"); err != nil {
+			t.Fatal(err)
+		} else if len(entries) != 1 || entries[0] != expected[2] {
+			t.Errorf("Expected only the chana entry, got %+v", entries)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		o := newOutbox(t)
+		if err := o.Enqueue(msg("", 1, 10), msg("", 2, 10), msg("", 3, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Remove(base+1, base+3, base+4); err != nil {
+			t.Fatal(err)
+		}
+		if msgs, _ := since(t, o, 0, 0); len(msgs) != 1 || msgs[0][0] != 2 {
+			t.Errorf("Expected only the 2nd message after Remove, got %d", len(msgs))
+		}
+	})
+
+	t.Run("Priority", func(t *testing.T) {
+		o := newOutbox(t)
+		prio := func(ts int64, priority int8) api.OutboxMsg {
+			m := msg("", ts, 10)
+			m.Priority = priority
+			return m
+		}
+		if err := o.Enqueue(prio(1, api.PriorityBulk), prio(2, api.PriorityNormal), prio(3, api.PriorityBulk), prio(4, api.PriorityUrgent)); err != nil {
+			t.Fatal(err)
+		}
+		order := func(msgs [][]byte) []byte {
+			var b []byte
+			for _, m := range msgs {
+				b = append(b, m[0])
+			}
+			return b
+		}
+		if msgs, ts := since(t, o, 0, 0); !bytes.Equal(order(msgs), []byte{4, 2, 1, 3}) || ts != base+4 {
+			t.Errorf("Expected all messages highest priority first, got %v up to %d", order(msgs), ts-base)
+		}
+		// the oldest message always goes, then the urgent one, and the cursor stops before the first one left behind
+		expected := []struct {
+			order []byte
+			ts    int64
+		}{{[]byte{4, 1}, 1}, {[]byte{4, 2}, 2}, {[]byte{4, 3}, 4}, {nil, 4}}
+		ts := int64(0)
+		for i, e := range expected {
+			var msgs [][]byte
+			msgs, ts = since(t, o, ts, 25)
+			if !bytes.Equal(order(msgs), e.order) || ts != base+e.ts {
+				t.Errorf("Pickup %d: expected %v up to %d, got %v up to %d", i, e.order, e.ts, order(msgs), ts-base)
+			}
+		}
+		entries, err := o.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 4 || entries[0].Priority != api.PriorityBulk || entries[3].Priority != api.PriorityUrgent {
+			t.Errorf("Priorities were not stored: %+v", entries)
+		}
+	})
+
+	t.Run("Resend", func(t *testing.T) {
+		o := newOutbox(t)
+		prio := func(ts int64, priority int8) api.OutboxMsg {
+			m := msg("", ts, 10)
+			m.Priority = priority
+			return m
+		}
+		if err := o.Enqueue(prio(1, api.PriorityBulk), prio(2, api.PriorityNormal), prio(3, api.PriorityBulk), prio(4, api.PriorityUrgent)); err != nil {
+			t.Fatal(err)
+		}
+		// a consumer gets the urgent message once, unless it comes back without having received it
+		expected := []struct {
+			lastTime int64
+			order    []byte
+			ts       int64
+		}{{0, []byte{4, 1}, 1}, {0, []byte{4, 1}, 1}, {1, []byte{2, 3}, 4}, {4, nil, 4}}
+		for i, e := range expected {
+			lastTime := int64(0)
+			if e.lastTime > 0 {
+				lastTime = base + e.lastTime
+			}
+			msgs, ts, err := o.MsgsSinceExcept("BASE64+/key=C", lastTime, 25)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b []byte
+			for _, m := range msgs {
+				b = append(b, m[0])
+			}
+			if !bytes.Equal(b, e.order) || ts != base+e.ts {
+				t.Errorf("Pickup %d: expected %v up to %d, got %v up to %d", i, e.order, e.ts, b, ts-base)
+			}
+		}
+	})
+
+	t.Run("Except", func(t *testing.T) {
+		o := newOutbox(t)
+		from := func(channel string, ts int64, ingress string) api.OutboxMsg {
+			m := msg(channel, ts, 10)
+			m.Forwarded = ingress != ""
+			m.Ingress = ingress
+			return m
+		}
+		peerA, peerB := "BASE64+/key=A", "BASE64+/key=B"
+		if err := o.Enqueue(from("", 1, peerA), from("chana", 2, peerB), from("", 3, ""), from("chana", 4, peerA)); err != nil {
+			t.Fatal(err)
+		}
+		except := func(except string, channelNames ...string) []byte {
+			msgs, _, err := o.MsgsSinceExcept(except, 0, 0, channelNames...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b []byte
+			for _, m := range msgs {
+				if len(m) != 10 {
+					t.Errorf("Message %d came back with %d bytes", m[0], len(m))
+				}
+				b = append(b, m[0])
+			}
+			return b
+		}
+		if got := except(""); !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+			t.Errorf("Expected every message with no except, got %v", got)
+		}
+		if got := except(peerA); !bytes.Equal(got, []byte{2, 3}) {
+			t.Errorf("Expected the messages not from peer A, got %v", got)
+		}
+		if got := except(peerB, "chana"); !bytes.Equal(got, []byte{4}) {
+			t.Errorf("Expected the chana message not from peer B, got %v", got)
+		}
+		if msgs, ts, err := o.MsgsSinceExcept(peerA, base+2, 0); err != nil || len(msgs) != 1 || ts != base+3 {
+			t.Errorf("Expected one message up to %d, got %d up to %d", base+3, len(msgs), ts)
+		}
+		entries, err := o.Entries()
+		if err != nil || len(entries) != 4 || !entries[0].Forwarded {
+			t.Errorf("Messages with an ingress were not stored: %+v", entries)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// PickupOrder : picks the messages that go in a bundle of at most maxBytes, or no limit if maxBytes is not positive,
+// from entries, the messages newer than lastTime, oldest first.
+// Returns the indexes of the picked entries, highest priority first and oldest first within a priority,
+// and the new lastTime: the timestamp of the newest entry that was picked along with every entry older than it.
+// Entries picked ahead of lastTime are picked again next time, use a PickupLog to leave them out.
+// The oldest entry is always picked, so lastTime moves on even when newer, higher priority entries fill every bundle,
+// and an oldest entry bigger than maxBytes on its own is picked alone.
+func PickupOrder(entries []api.OutboxEntry, lastTime, maxBytes int64) ([]int, int64) {
+	return pickupOrder(entries, lastTime, maxBytes, nil)
+}
+
+// pickupOrder - PickupOrder, treating the entries with a timestamp in skip as already sent
+func pickupOrder(entries []api.OutboxEntry, lastTime, maxBytes int64, skip map[int64]int64) ([]int, int64) {
+	sent := make([]bool, len(entries))
+	var order []int
+	for i, e := range entries {
+		if _, ok := skip[e.Timestamp]; ok {
+			sent[i] = true
+		} else {
+			order = append(order, i)
+		}
+	}
+	var picked []int
+	if len(order) > 0 {
+		first := order[0]
+		order = order[1:]
+		sort.SliceStable(order, func(i, j int) bool { return entries[order[i]].Priority > entries[order[j]].Priority })
+
+		picked = []int{first}
+		size := entries[first].Size
+		for _, i := range order {
+			if maxBytes > 0 && size+entries[i].Size > maxBytes { // no room for next msg
+				break
+			}
+			picked = append(picked, i)
+			size += entries[i].Size
+		}
+	}
+
+	for _, i := range picked {
+		sent[i] = true
+	}
+	for i := 0; i < len(entries) && sent[i]; i++ {
+		lastTime = entries[i].Timestamp
+	}
+	sort.SliceStable(picked, func(i, j int) bool { return entries[picked[i]].Priority > entries[picked[j]].Priority })
+	return picked, lastTime
+}
+
+// DefaultPickupLogMaxAge - how long a PickupLog remembers a consumer that has stopped picking up, unless its MaxAge is set
+var DefaultPickupLogMaxAge = 10 * time.Minute
+
+// PickupLog : remembers which entries each consumer was handed ahead of its lastTime,
+// so urgent messages are not sent again in every bundle while a backlog of older ones drains.
+// The zero value is ready to use.
+type PickupLog struct {
+	// MaxAge : how long a consumer that has stopped picking up is remembered, zero for DefaultPickupLogMaxAge
+	MaxAge time.Duration
+
+	mtx       sync.Mutex
+	consumers map[string]*pickupState
+}
+
+type pickupState struct {
+	ahead   map[int64]int64 // timestamp of an entry handed out ahead of lastTime -> the lastTime returned with it
+	touched time.Time
+}
+
+// Order : PickupOrder for consumer, leaving out the entries it was already handed ahead of lastTime.
+// A consumer that comes back with an older lastTime than it was given did not get the bundle,
+// so the entries that went out with it are picked again.  An empty consumer is not tracked.
+func (l *PickupLog) Order(consumer string, entries []api.OutboxEntry, lastTime, maxBytes int64) ([]int, int64) {
+	if consumer == "" {
+		return PickupOrder(entries, lastTime, maxBytes)
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	maxAge := l.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultPickupLogMaxAge
+	}
+	if l.consumers == nil {
+		l.consumers = make(map[string]*pickupState)
+	}
+	for c, s := range l.consumers {
+		if now.Sub(s.touched) > maxAge {
+			delete(l.consumers, c)
+		}
+	}
+	s, ok := l.consumers[consumer]
+	if !ok {
+		s = &pickupState{ahead: make(map[int64]int64)}
+		l.consumers[consumer] = s
+	}
+	s.touched = now
+	for ts, returned := range s.ahead {
+		if ts <= lastTime || lastTime < returned { // behind the consumer now, or the bundle was lost
+			delete(s.ahead, ts)
+		}
+	}
+
+	picked, newLastTime := pickupOrder(entries, lastTime, maxBytes, s.ahead)
+	for _, i := range picked {
+		if ts := entries[i].Timestamp; ts > newLastTime {
+			s.ahead[ts] = newLastTime
+		}
+	}
+	return picked, newLastTime
+}
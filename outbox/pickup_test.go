@@ -0,0 +1,34 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+func Test_PickupLog_MaxAge_1(t *testing.T) {
+	entries := []api.OutboxEntry{
+		{Timestamp: 1, Size: 10},
+		{Timestamp: 2, Size: 10},
+		{Timestamp: 3, Size: 10, Priority: api.PriorityUrgent},
+	}
+	log := PickupLog{MaxAge: time.Millisecond}
+
+	// the urgent entry goes out ahead of lastTime with the oldest one
+	picked, lastTime := log.Order("consumer", entries, 0, 20)
+	if len(picked) != 2 || picked[0] != 2 || lastTime != 1 {
+		t.Fatal("Unexpected first pickup", picked, lastTime)
+	}
+	// entries are always the ones newer than lastTime
+	if picked, _ := log.Order("consumer", entries[1:], lastTime, 20); len(picked) != 1 || picked[0] != 0 {
+		t.Fatal("Urgent entry was handed out again", picked)
+	}
+
+	// a consumer that has been away longer than MaxAge is forgotten, and gets everything again
+	time.Sleep(2 * time.Millisecond)
+	log.Order("other", entries, 0, 20)
+	if picked, _ := log.Order("consumer", entries[1:], lastTime, 20); len(picked) != 2 {
+		t.Fatal("Expected the forgotten consumer to get the urgent entry again", picked)
+	}
+}
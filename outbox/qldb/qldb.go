@@ -0,0 +1,300 @@
+package qldb
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox"
+)
+
+// Outbox : ql implementation of api.Outbox, messages are kept in the outbox table
+type Outbox struct {
+	db      func() *sql.DB
+	mutex   sync.Locker
+	pickups outbox.PickupLog // what each consumer was handed ahead of its lastTime
+}
+
+// New : creates a new Outbox in the database opened by db, creating the outbox table if needed.
+// Writes are serialized with mutex, which should be shared with anything else writing to the same database.
+func New(db func() *sql.DB, mutex sync.Locker) (*Outbox, error) {
+	o := new(Outbox)
+	o.db = db
+	o.mutex = mutex
+
+	/*  timestamp field must stay int64 and not time type,
+	due to a unknown bug only on android/arm in cznic/ql via sql driver
+	*/
+	err := o.transactExec(`
+		CREATE TABLE IF NOT EXISTS outbox (
+			channel		string	DEFAULT "",
+			msg			blob	NOT NULL,
+			timestamp	int64	NOT NULL,
+			forwarded	bool	DEFAULT false,
+			priority	int64	DEFAULT 0,
+			ingress		string	DEFAULT ""
+		);`)
+	if err != nil {
+		return nil, err
+	}
+	// outbox tables made by older versions lack the later columns
+	for _, c := range []struct {
+		name, colType string
+		value         interface{}
+	}{
+		{"forwarded", "bool", false},
+		{"priority", "int64", int64(0)},
+		{"ingress", "string", ""},
+	} {
+		if err := o.addColumn(c.name, c.colType, c.value); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.transactExec(`
+			CREATE INDEX IF NOT EXISTS outboxID ON outbox (timestamp);
+	`); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// addColumn - adds a column to the outbox table if it is missing, set to value in the existing rows.
+// ql will not add a constrained column to a table with data in it, so the default is left out.
+func (o *Outbox) addColumn(column, colType string, value interface{}) error {
+	c := o.db()
+	r, err := c.Query("SELECT * FROM outbox LIMIT 1;")
+	if err != nil {
+		c.Close()
+		return err
+	}
+	columns, err := r.Columns()
+	for r.Next() { // ql still reads the row behind our back, until it is drained
+	}
+	r.Close()
+	c.Close()
+	if err != nil {
+		return err
+	}
+	for _, col := range columns {
+		if col == column {
+			return nil // already there
+		}
+	}
+	if err := o.transactExec("ALTER TABLE outbox ADD " + column + " " + colType + ";"); err != nil {
+		return err
+	}
+	return o.transactExec("UPDATE outbox SET "+column+" = $1;", value)
+}
+
+func (o *Outbox) transactExec(query string, params ...interface{}) error {
+	return o.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(query, params...)
+		return err
+	})
+}
+
+// transact - runs fn in a transaction, rolled back if fn fails
+func (o *Outbox) transact(fn func(tx *sql.Tx) error) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	c := o.db()
+	defer c.Close()
+
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Enqueue : stores outbound messages
+func (o *Outbox) Enqueue(msgs ...api.OutboxMsg) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 6*len(msgs))
+	query := "INSERT INTO outbox(channel, msg, timestamp, forwarded, priority, ingress) VALUES"
+	for i, msg := range msgs {
+		idx := 1 + (6 * i)
+		if i > 0 {
+			query += ", "
+		}
+		query += "($" + strconv.Itoa(idx) + ", $" + strconv.Itoa(idx+1) + ", $" + strconv.Itoa(idx+2) +
+			", $" + strconv.Itoa(idx+3) + ", $" + strconv.Itoa(idx+4) + ", $" + strconv.Itoa(idx+5) + ")"
+		args = append(args, msg.Channel, msg.Msg, msg.Timestamp, msg.Forwarded, int64(msg.Priority), msg.Ingress)
+	}
+	return o.transactExec(query+";", args...)
+}
+
+// channelList - quotes channel names for an IN clause, QL is broken?  couldn't make it work with prepared stmts
+func channelList(channelNames []string) (string, error) {
+	for _, cname := range channelNames {
+		for _, char := range cname {
+			if !strings.Contains("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0987654321", string(char)) {
+				return "", errors.New("Invalid character in channel name")
+			}
+		}
+	}
+	if len(channelNames) == 0 {
+		return "", nil
+	}
+	return "\"" + strings.Join(channelNames, "\",\"") + "\"", nil
+}
+
+// MsgsSince : Get messages after the given timestamp, highest priority first
+func (o *Outbox) MsgsSince(lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	return o.MsgsSinceExcept("", lastTime, maxBytes, channelNames...)
+}
+
+// MsgsSinceExcept : Get messages after the given timestamp that did not come in from except, highest priority first
+func (o *Outbox) MsgsSinceExcept(except string, lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	c := o.db()
+	defer c.Close()
+
+	// Build the query
+	channels, err := channelList(channelNames)
+	if err != nil {
+		return nil, lastTime, err
+	}
+	where := " WHERE (int64(" + strconv.FormatInt(lastTime, 10) + ") < timestamp)"
+	if channels != "" {
+		where = where + " AND channel IN( " + channels + " )"
+	}
+	if except != "" { // QL string literals are Go string literals
+		where = where + " AND ingress != " + strconv.Quote(except)
+	}
+
+	// pick from the sizes and priorities first, then fetch only the picked messages
+	r, err := c.Query("SELECT timestamp, len(string(msg)), priority FROM outbox" + where + " ORDER BY timestamp ASC;")
+	if r == nil || err != nil {
+		return nil, lastTime, err
+	}
+	defer r.Close()
+	var entries []api.OutboxEntry
+	for r.Next() {
+		var entry api.OutboxEntry
+		var priority int64
+		if err := r.Scan(&entry.Timestamp, &entry.Size, &priority); err != nil {
+			return nil, lastTime, err
+		}
+		entry.Priority = int8(priority)
+		entries = append(entries, entry)
+	}
+	picked, lastTimeReturned := o.pickups.Order(except, entries, lastTime, maxBytes)
+	if len(picked) == 0 {
+		return nil, lastTimeReturned, nil
+	}
+
+	timestamps := make([]string, 0, len(picked))
+	for _, i := range picked {
+		timestamps = append(timestamps, "int64("+strconv.FormatInt(entries[i].Timestamp, 10)+")")
+	}
+	r2, err := c.Query("SELECT msg, timestamp FROM outbox" + where + " AND timestamp IN( " + strings.Join(timestamps, ",") + " );")
+	if r2 == nil || err != nil {
+		return nil, lastTime, err
+	}
+	defer r2.Close()
+	byTime := make(map[int64][]byte, len(picked))
+	for r2.Next() {
+		var msg []byte
+		var ts int64
+		if err := r2.Scan(&msg, &ts); err != nil {
+			return nil, lastTime, err
+		}
+		byTime[ts] = msg
+	}
+	msgs := make([][]byte, 0, len(picked))
+	for _, i := range picked {
+		if msg, ok := byTime[entries[i].Timestamp]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, lastTimeReturned, nil
+}
+
+// Flush : Deletes outbound messages older than maxAgeSeconds seconds
+func (o *Outbox) Flush(maxAgeSeconds int64) error {
+	ts := time.Now().UnixNano()
+	ts = ts - (maxAgeSeconds * 1000000000)
+	return o.transactExec("DELETE FROM outbox WHERE timestamp < ($1);", ts)
+}
+
+// Stats : returns the number and size of the stored messages
+func (o *Outbox) Stats() (api.OutboxStats, error) {
+	var stats api.OutboxStats
+	c := o.db()
+	defer c.Close()
+	r, err := c.Query("SELECT msg, timestamp FROM outbox ORDER BY timestamp ASC;")
+	if r == nil || err != nil {
+		return stats, err
+	}
+	defer r.Close()
+	for r.Next() {
+		var msg []byte
+		var ts int64
+		if err := r.Scan(&msg, &ts); err != nil {
+			return stats, err
+		}
+		if stats.Messages == 0 {
+			stats.Oldest = ts
+		}
+		stats.Newest = ts
+		stats.Messages++
+		stats.Bytes += int64(len(msg))
+	}
+	return stats, nil
+}
+
+// Entries : describes the stored messages without their contents, oldest first
+func (o *Outbox) Entries(channelNames ...string) ([]api.OutboxEntry, error) {
+	channels, err := channelList(channelNames)
+	if err != nil {
+		return nil, err
+	}
+	sqlq := "SELECT channel, msg, timestamp, forwarded, priority FROM outbox"
+	if channels != "" {
+		sqlq = sqlq + " WHERE channel IN( " + channels + " )"
+	}
+	sqlq = sqlq + " ORDER BY timestamp ASC;"
+
+	c := o.db()
+	defer c.Close()
+	r, err := c.Query(sqlq)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var entries []api.OutboxEntry
+	for r.Next() {
+		var entry api.OutboxEntry
+		var msg []byte
+		var priority int64
+		if err := r.Scan(&entry.Channel, &msg, &entry.Timestamp, &entry.Forwarded, &priority); err != nil {
+			return nil, err
+		}
+		entry.Size = int64(len(msg))
+		entry.Priority = int8(priority)
+		entries = append(entries, entry)
+	}
+	return entries, r.Err()
+}
+
+// Remove : deletes the messages with the given timestamps
+func (o *Outbox) Remove(timestamps ...int64) error {
+	return o.transact(func(tx *sql.Tx) error {
+		for _, ts := range timestamps {
+			if _, err := tx.Exec("DELETE FROM outbox WHERE timestamp == $1;", ts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,97 @@
+package qldb
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox/outboxtest"
+
+	_ "modernc.org/ql/driver"
+)
+
+func Test_outbox_Conformance(t *testing.T) {
+	outboxtest.Run(t, func(t *testing.T) api.Outbox {
+		file := filepath.Join(t.TempDir(), "outbox.ql")
+		o, err := New(func() *sql.DB {
+			c, err := sql.Open("ql", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}, new(sync.Mutex))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	})
+}
+
+// legacyOutbox - makes an outbox table as older versions made it, with one message in it
+func legacyOutbox(t *testing.T, file string) {
+	c, err := sql.Open("ql", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, q := range []string{
+		`CREATE TABLE outbox (channel string DEFAULT "", msg blob NOT NULL, timestamp int64 NOT NULL);`,
+		`CREATE INDEX outboxID ON outbox (timestamp);`,
+		`INSERT INTO outbox VALUES("", blob("old"), 1);`,
+	} {
+		tx, err := c.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(q); err != nil {
+			t.Fatal(q, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkUpgraded - the message from before the upgrade is still there, and new ones can be stored next to it
+func checkUpgraded(t *testing.T, o api.Outbox) {
+	if err := o.Enqueue(api.OutboxMsg{Msg: []byte("new"), Timestamp: 2, Forwarded: true, Priority: 1, Ingress: "peer"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := o.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Timestamp == 1 && (e.Forwarded || e.Priority != 0) {
+			t.Errorf("Old message not backfilled: %+v", e)
+		}
+	}
+	msgs, _, err := o.MsgsSinceExcept("peer", 0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || string(msgs[0]) != "old" {
+		t.Errorf("Expected only the old message, got %q", msgs)
+	}
+}
+
+func Test_outbox_Upgrade_1(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "outbox.ql")
+	legacyOutbox(t, file)
+	o, err := New(func() *sql.DB {
+		c, err := sql.Open("ql", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}, new(sync.Mutex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUpgraded(t, o)
+}
@@ -0,0 +1,145 @@
+// Package outbox - helpers that work with any api.Outbox, the implementations are in its subpackages
+package outbox
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+)
+
+// Quota : wraps an api.Outbox to keep it within a node quota and per-channel quotas.
+// After every Enqueue, messages are dropped by the quota's EvictionPolicy until it is met again,
+// and an OutboxEvicted event is emitted on the node for each one.
+// Every node wraps its outbox in one, set its quotas with node.SetQuota and node.SetChannelQuota.
+type Quota struct {
+	api.Outbox
+
+	node          api.Node
+	mutex         sync.Mutex
+	quota         api.OutboxQuota
+	channelQuotas map[string]api.OutboxQuota
+}
+
+// NewQuota : wraps inner with no quotas set, node receives the eviction events
+func NewQuota(node api.Node, inner api.Outbox) *Quota {
+	q := new(Quota)
+	q.Outbox = inner
+	q.node = node
+	q.channelQuotas = make(map[string]api.OutboxQuota)
+	return q
+}
+
+// SetOutbox : replaces the wrapped outbox, keeping the quotas
+func (q *Quota) SetOutbox(inner api.Outbox) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.Outbox = inner
+}
+
+// Quota : returns the quota for the whole outbox
+func (q *Quota) Quota() api.OutboxQuota {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.quota
+}
+
+// SetQuota : sets the quota for the whole outbox, the zero OutboxQuota removes it
+func (q *Quota) SetQuota(quota api.OutboxQuota) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.quota = quota
+}
+
+// ChannelQuotas : returns a copy of the per-channel quotas
+func (q *Quota) ChannelQuotas() map[string]api.OutboxQuota {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	quotas := make(map[string]api.OutboxQuota, len(q.channelQuotas))
+	for channel, quota := range q.channelQuotas {
+		quotas[channel] = quota
+	}
+	return quotas
+}
+
+// SetChannelQuota : sets the quota for the messages on one channel, the zero OutboxQuota removes it.
+// The empty channel name is the quota for messages that are not on a channel.
+func (q *Quota) SetChannelQuota(channel string, quota api.OutboxQuota) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if quota == (api.OutboxQuota{}) {
+		delete(q.channelQuotas, channel)
+	} else {
+		q.channelQuotas[channel] = quota
+	}
+}
+
+// Enqueue : stores outbound messages, then evicts messages until every quota is met.
+// The new messages can be evicted too, if the policy picks them.
+func (q *Quota) Enqueue(msgs ...api.OutboxMsg) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.Outbox.Enqueue(msgs...); err != nil {
+		return err
+	}
+	// channel quotas first, so a busy channel pays for itself before the node quota touches the others
+	touched := make(map[string]bool)
+	for _, msg := range msgs {
+		if _, ok := q.channelQuotas[msg.Channel]; ok && !touched[msg.Channel] {
+			touched[msg.Channel] = true
+			if err := q.enforce(q.channelQuotas[msg.Channel], msg.Channel); err != nil {
+				return err
+			}
+		}
+	}
+	return q.enforce(q.quota)
+}
+
+// enforce - drops messages on the given channels, or all messages, until quota is met, call with mutex held
+func (q *Quota) enforce(quota api.OutboxQuota, channelNames ...string) error {
+	if quota.MaxBytes <= 0 && quota.MaxMessages <= 0 {
+		return nil
+	}
+	entries, err := q.Outbox.Entries(channelNames...)
+	if err != nil {
+		return err
+	}
+	count := int64(len(entries))
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	var dropped []api.OutboxEntry
+	var timestamps []int64
+	for _, entry := range evictionOrder(entries, quota.Eviction) {
+		if (quota.MaxBytes <= 0 || size <= quota.MaxBytes) && (quota.MaxMessages <= 0 || count <= quota.MaxMessages) {
+			break
+		}
+		dropped = append(dropped, entry)
+		timestamps = append(timestamps, entry.Timestamp)
+		count--
+		size -= entry.Size
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	if err := q.Outbox.Remove(timestamps...); err != nil {
+		return err
+	}
+	for _, entry := range dropped {
+		events.Emit(q.node, api.Warning, api.OutboxEvicted, entry)
+	}
+	return nil
+}
+
+// evictionOrder - sorts entries, which are oldest first, into the order policy drops them in
+func evictionOrder(entries []api.OutboxEntry, policy api.EvictionPolicy) []api.OutboxEntry {
+	switch policy {
+	case api.EvictLargest:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Size > entries[j].Size })
+	case api.EvictForwarded:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Forwarded && !entries[j].Forwarded })
+	}
+	return entries
+}
@@ -0,0 +1,123 @@
+package outbox_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+	"github.com/awgh/ratnet/outbox"
+	ramoutbox "github.com/awgh/ratnet/outbox/ram"
+)
+
+func newQuota(t *testing.T) (*outbox.Quota, *ram.Node) {
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	return outbox.NewQuota(node, ramoutbox.New()), node
+}
+
+// evicted - drains the node's events and returns the timestamps of the evicted messages, relative to base
+func evicted(node *ram.Node, base int64) []int64 {
+	var timestamps []int64
+	for {
+		select {
+		case ev := <-node.Events():
+			if ev.Type == api.OutboxEvicted {
+				timestamps = append(timestamps, ev.Data[0].(api.OutboxEntry).Timestamp-base)
+			}
+		default:
+			return timestamps
+		}
+	}
+}
+
+func sameTimes(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_quota_Policies(t *testing.T) {
+	base := time.Now().UnixNano()
+	msg := func(channel string, ts int64, size int, forwarded bool) api.OutboxMsg {
+		return api.OutboxMsg{Channel: channel, Msg: bytes.Repeat([]byte{byte(ts)}, size), Timestamp: base + ts, Forwarded: forwarded}
+	}
+	queued := []api.OutboxMsg{msg("", 1, 10, false), msg("", 2, 30, true), msg("", 3, 20, false), msg("", 4, 10, true)}
+
+	tests := []struct {
+		name     string
+		quota    api.OutboxQuota
+		expected []int64
+	}{
+		{"NoQuota", api.OutboxQuota{}, nil},
+		{"OldestMessages", api.OutboxQuota{MaxMessages: 2}, []int64{1, 2}},
+		{"OldestBytes", api.OutboxQuota{MaxBytes: 45}, []int64{1, 2}},
+		{"Largest", api.OutboxQuota{MaxBytes: 45, Eviction: api.EvictLargest}, []int64{2}},
+		{"Forwarded", api.OutboxQuota{MaxMessages: 3, Eviction: api.EvictForwarded}, []int64{2}},
+		{"ForwardedThenOldest", api.OutboxQuota{MaxMessages: 1, Eviction: api.EvictForwarded}, []int64{2, 4, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, node := newQuota(t)
+			q.SetQuota(test.quota)
+			if err := q.Enqueue(queued...); err != nil {
+				t.Fatal(err)
+			}
+			if times := evicted(node, base); !sameTimes(times, test.expected) {
+				t.Errorf("Expected %v to be evicted, got %v", test.expected, times)
+			}
+			stats, err := q.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Messages != int64(len(queued)-len(test.expected)) {
+				t.Errorf("Expected %d messages left, got %d", len(queued)-len(test.expected), stats.Messages)
+			}
+		})
+	}
+}
+
+func Test_quota_Channels(t *testing.T) {
+	base := time.Now().UnixNano()
+	msg := func(channel string, ts int64) api.OutboxMsg {
+		return api.OutboxMsg{Channel: channel, Msg: []byte{byte(ts)}, Timestamp: base + ts}
+	}
+	q, node := newQuota(t)
+	q.SetChannelQuota("busy", api.OutboxQuota{MaxMessages: 1})
+	q.SetQuota(api.OutboxQuota{MaxMessages: 3})
+
+	if err := q.Enqueue(msg("", 1), msg("busy", 2), msg("busy", 3)); err != nil {
+		t.Fatal(err)
+	}
+	if times := evicted(node, base); !sameTimes(times, []int64{2}) {
+		t.Errorf("Expected only the oldest busy message to be evicted, got %v", times)
+	}
+	// the node quota applies across channels
+	if err := q.Enqueue(msg("quiet", 4), msg("quiet", 5)); err != nil {
+		t.Fatal(err)
+	}
+	if times := evicted(node, base); !sameTimes(times, []int64{1}) {
+		t.Errorf("Expected the oldest message to be evicted for the node quota, got %v", times)
+	}
+	if msgs, _, err := q.MsgsSince(0, 0, "busy"); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 1 || msgs[0][0] != 3 {
+		t.Errorf("Expected the newest busy message to be kept, got %d", len(msgs))
+	}
+
+	// removing the quota stops eviction
+	q.SetChannelQuota("busy", api.OutboxQuota{})
+	if err := q.Enqueue(msg("busy", 6)); err != nil {
+		t.Fatal(err)
+	}
+	if times := evicted(node, base); !sameTimes(times, []int64{3}) {
+		t.Errorf("Expected only the node quota to evict, got %v", times)
+	}
+}
@@ -0,0 +1,142 @@
+package ram
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox"
+)
+
+// Outbox : in-memory implementation of api.Outbox
+type Outbox struct {
+	mux     sync.Mutex
+	outbox  []api.OutboxMsg
+	pickups outbox.PickupLog // what each consumer was handed ahead of its lastTime
+}
+
+// New : creates a new, empty Outbox
+func New() *Outbox {
+	return new(Outbox)
+}
+
+// Enqueue : stores outbound messages
+func (o *Outbox) Enqueue(msgs ...api.OutboxMsg) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, msg := range msgs {
+		// keep the queue in timestamp order, messages usually arrive in order already
+		i := sort.Search(len(o.outbox), func(i int) bool { return o.outbox[i].Timestamp > msg.Timestamp })
+		o.outbox = append(o.outbox, msg)
+		if i < len(o.outbox)-1 {
+			copy(o.outbox[i+1:], o.outbox[i:])
+			o.outbox[i] = msg
+		}
+	}
+	return nil
+}
+
+// MsgsSince : Get messages after the given timestamp, highest priority first
+func (o *Outbox) MsgsSince(lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	return o.MsgsSinceExcept("", lastTime, maxBytes, channelNames...)
+}
+
+// MsgsSinceExcept : Get messages after the given timestamp that did not come in from except, highest priority first
+func (o *Outbox) MsgsSinceExcept(except string, lastTime int64, maxBytes int64, channelNames ...string) ([][]byte, int64, error) {
+	var entries []api.OutboxEntry
+	var candidates [][]byte
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, mail := range o.outbox {
+		if lastTime >= mail.Timestamp || (except != "" && mail.Ingress == except) {
+			continue
+		}
+		pickupMsg := len(channelNames) == 0
+		for _, channelName := range channelNames {
+			if channelName == mail.Channel {
+				pickupMsg = true
+			}
+		}
+		if !pickupMsg {
+			continue
+		}
+		entries = append(entries, api.OutboxEntry{Timestamp: mail.Timestamp, Size: int64(len(mail.Msg)), Priority: mail.Priority})
+		candidates = append(candidates, mail.Msg)
+	}
+	picked, retvalTime := o.pickups.Order(except, entries, lastTime, maxBytes)
+	msgs := make([][]byte, 0, len(picked))
+	for _, i := range picked {
+		msgs = append(msgs, candidates[i])
+	}
+	return msgs, retvalTime, nil
+}
+
+// Flush : Deletes outbound messages older than maxAgeSeconds seconds
+func (o *Outbox) Flush(maxAgeSeconds int64) error {
+	c := (time.Now().UnixNano()) - (maxAgeSeconds * 1000000000)
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	kept := o.outbox[:0]
+	for _, mail := range o.outbox {
+		if mail.Timestamp >= c {
+			kept = append(kept, mail)
+		}
+	}
+	o.outbox = kept
+	return nil
+}
+
+// Stats : returns the number and size of the stored messages
+func (o *Outbox) Stats() (api.OutboxStats, error) {
+	var stats api.OutboxStats
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, mail := range o.outbox {
+		stats.Messages++
+		stats.Bytes += int64(len(mail.Msg))
+	}
+	if len(o.outbox) > 0 {
+		stats.Oldest = o.outbox[0].Timestamp
+		stats.Newest = o.outbox[len(o.outbox)-1].Timestamp
+	}
+	return stats, nil
+}
+
+// Entries : describes the stored messages without their contents, oldest first
+func (o *Outbox) Entries(channelNames ...string) ([]api.OutboxEntry, error) {
+	var entries []api.OutboxEntry
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for _, mail := range o.outbox {
+		pickupMsg := len(channelNames) == 0
+		for _, channelName := range channelNames {
+			if channelName == mail.Channel {
+				pickupMsg = true
+			}
+		}
+		if pickupMsg {
+			entries = append(entries, api.OutboxEntry{Channel: mail.Channel, Timestamp: mail.Timestamp, Size: int64(len(mail.Msg)),
+				Forwarded: mail.Forwarded, Priority: mail.Priority})
+		}
+	}
+	return entries, nil
+}
+
+// Remove : deletes the messages with the given timestamps
+func (o *Outbox) Remove(timestamps ...int64) error {
+	remove := make(map[int64]bool, len(timestamps))
+	for _, ts := range timestamps {
+		remove[ts] = true
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	kept := o.outbox[:0]
+	for _, mail := range o.outbox {
+		if !remove[mail.Timestamp] {
+			kept = append(kept, mail)
+		}
+	}
+	o.outbox = kept
+	return nil
+}
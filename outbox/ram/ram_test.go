@@ -0,0 +1,12 @@
+package ram
+
+import (
+	"testing"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/outbox/outboxtest"
+)
+
+func Test_outbox_Conformance(t *testing.T) {
+	outboxtest.Run(t, func(t *testing.T) api.Outbox { return New() })
+}
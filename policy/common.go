@@ -82,7 +82,7 @@ func (pt *PeerTable) PollServer(transport api.Transport, node api.Node, host str
 	}
 	// Dropoff Remote
 	if len(toRemote.Data) > 0 {
-		if _, err := transport.RPC(host, api.Dropoff, toRemote); err != nil {
+		if _, err := transport.RPC(host, api.Dropoff, toRemote, pubsrv); err != nil {
 			events.Error(node, "remote dropoff error: "+err.Error())
 			return false, err
 		}
@@ -94,6 +94,7 @@ func (pt *PeerTable) PollServer(transport api.Transport, node api.Node, host str
 	}
 	// Dropoff Local
 	if toLocalRaw != nil && len(toLocal.Data) > 0 {
+		toLocal.Ingress = api.Ingress{Peer: peer.RoutingPub.ToB64(), URI: host, Transport: transport.Name()}
 		if err := node.Dropoff(toLocal); err != nil {
 			return false, err
 		}
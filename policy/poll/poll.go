@@ -100,7 +100,6 @@ func (p *Poll) RunPolicy() error {
 
 		fails := make(map[string]int)
 		b := make([]byte, 1)
-		counter := 0
 		for {
 			// check if we should still be running
 			if !p.IsRunning() {
@@ -154,10 +153,6 @@ func (p *Poll) RunPolicy() error {
 					events.Warning(p.node, "pollServer error: All Peers have been disabled or hit retry limits")
 				}
 			}
-			if counter%500 == 0 {
-				p.node.FlushOutbox(300) // seconds to cache
-			}
-			counter++
 		}
 	}()
 
@@ -16,6 +16,7 @@ import (
 	"github.com/awgh/ratnet/api/events/defaultlogger"
 	"github.com/awgh/ratnet/nodes/db"
 	"github.com/awgh/ratnet/nodes/fs"
+	"github.com/awgh/ratnet/nodes/kv"
 	"github.com/awgh/ratnet/nodes/qldb"
 	"github.com/awgh/ratnet/nodes/ram"
 	"github.com/awgh/ratnet/transports/https"
@@ -48,6 +49,7 @@ const (
 	QL           = "QL"
 	FS           = "FS"
 	DB           = "DB"
+	KV           = "KV"
 )
 
 var (
@@ -57,7 +59,7 @@ var (
 
 func init() {
 	TransportTypes = []TransportType{UDP, TLS, HTTPS}
-	NodeTypes = []NodeType{RAM, FS, QL} //, DB}
+	NodeTypes = []NodeType{RAM, FS, QL, KV} //, DB}
 }
 
 // Get preferred outbound ip of this machine
@@ -103,6 +105,17 @@ func initNode(n int, nodeType NodeType, transportType TransportType, p2pMode boo
 		s.BootstrapDB("ql", dbfile)
 		s.FlushOutbox(0)
 		testNode.Node = s
+	} else if nodeType == KV {
+		// KV Mode
+		s := kv.New(new(ecc.KeyPair), new(ecc.KeyPair))
+		if err := os.RemoveAll("kvtmp" + num); err != nil {
+			log.Printf("error removing directory %s: %s\n", "kvtmp"+num, err.Error())
+		}
+		os.Mkdir("kvtmp"+num, os.FileMode(int(0755)))
+		dbfile := "kvtmp" + num + "/ratnet_test" + num + ".db"
+		s.BootstrapDB(dbfile)
+		s.FlushOutbox(0)
+		testNode.Node = s
 	} else if nodeType == FS {
 		testNode.Node = fs.New(new(ecc.KeyPair), new(ecc.KeyPair), "queue")
 	}
@@ -149,6 +162,11 @@ func (n *TestNode) Destroy(t *testing.T) {
 		if err := os.RemoveAll(dirName); err != nil {
 			t.Errorf("error removing directory %s: %s\n", dirName, err.Error())
 		}
+	case KV:
+		dirName := "kvtmp" + strconv.Itoa(n.Number)
+		if err := os.RemoveAll(dirName); err != nil {
+			t.Errorf("error removing directory %s: %s\n", dirName, err.Error())
+		}
 	case FS:
 		dirName := "queue"
 		if err := os.RemoveAll(dirName); err != nil {
@@ -2,68 +2,204 @@ package router
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
-	"hash/crc32"
-	"math"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+	"github.com/awgh/ratnet/api/events"
 )
 
-const (
-	cacheSize     = 4 * 1024
-	cacheDiscount = int(0.25 * cacheSize)
-	nonceSize     = 32
-)
+const nonceSize = 32
+
+// DefaultSeenSize - how many message nonces a router remembers for loop detection, at most
+var DefaultSeenSize = 64 * 1024
+
+// DefaultSeenWindow - how long a router remembers a message nonce for loop detection,
+// as long as the default OutboxTTL, since peers can hand a message back until it leaves their outboxes
+var DefaultSeenWindow = 5 * time.Minute
+
+// SeenStats - loop detection counters of a RecentBuffer
+type SeenStats struct {
+	Checked uint64 // messages checked
+	Seen    uint64 // messages filtered out as seen recently
+	Evicted uint64 // nonces forgotten before the end of the window, because the buffer was full
+	Entries int    // nonces remembered now
+}
+
+// HitRate - the fraction of checked messages that were filtered out as seen recently
+func (s SeenStats) HitRate() float64 {
+	if s.Checked == 0 {
+		return 0
+	}
+	return float64(s.Seen) / float64(s.Checked)
+}
 
-// RecentBuffer - Used for tracking recently seen messages
+// seenBatchSize - newly seen nonces are saved to the store in batches of this many,
+// or of however many were seen within seenSaveInterval
+const seenBatchSize = 64
+
+// seenSaveInterval - the longest newly seen nonces wait to be saved to the store
+const seenSaveInterval = time.Second
+
+// RecentBuffer - Used for tracking recently seen messages, by a SHA-256 of their nonce,
+// for a time window and up to a maximum number of nonces
 type RecentBuffer struct {
-	mtx           sync.Mutex
-	recentBuffer  map[uint32]int
-	reverseBuffer map[int]uint32
-	counter       int
+	mtx    sync.Mutex
+	seen   map[[sha256.Size]byte]struct{}
+	queue  []api.SeenEntry // oldest first, from head
+	head   int
+	size   int
+	window time.Duration
+	stats  SeenStats
+
+	store      api.SeenStore
+	pending    []api.SeenEntry // seen, but not saved to the store yet
+	lastSave   int64
+	lastForget int64
 }
 
 func newRecentBuffer() (r RecentBuffer) {
-	r.recentBuffer = make(map[uint32]int, cacheSize)
-	r.reverseBuffer = make(map[int]uint32, cacheSize)
-	r.counter = 0
+	r.seen = make(map[[sha256.Size]byte]struct{})
+	r.size = DefaultSeenSize
+	r.window = DefaultSeenWindow
 	return
 }
 
+// SetSeenLimits : Sets how many nonces are remembered for loop detection and for how long,
+// zero values keep the current setting
+func (r *RecentBuffer) SetSeenLimits(size int, window time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if size > 0 {
+		r.size = size
+	}
+	if window > 0 {
+		r.window = window
+	}
+	r.expire(time.Now().UnixNano())
+}
+
+// SeenStats : Returns the loop detection counters
+func (r *RecentBuffer) SeenStats() SeenStats {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	stats := r.stats
+	stats.Entries = len(r.seen)
+	return stats
+}
+
 // SeenRecently : Returns whether this message should be filtered out by loop detection
 func (r *RecentBuffer) SeenRecently(nonce []byte) bool {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
-	nonceHash := crc32.ChecksumIEEE(nonce)
-
-	_, seen := r.recentBuffer[nonceHash]
-	if !seen {
-		r.recentBuffer[nonceHash] = r.counter
-		r.reverseBuffer[r.counter] = nonceHash
-		if r.counter == math.MaxInt32 { // todo doc: cacheSize is limited to MaxInt32
-			r.counter = 0
-		} else {
-			r.counter++
+	now := time.Now().UnixNano()
+	r.expire(now)
+
+	r.stats.Checked++
+	nonceHash := sha256.Sum256(nonce)
+	if _, seen := r.seen[nonceHash]; seen {
+		r.stats.Seen++
+		return true
+	}
+	r.seen[nonceHash] = struct{}{}
+	r.queue = append(r.queue, api.SeenEntry{Hash: nonceHash, Time: now})
+	if r.store != nil {
+		r.pending = append(r.pending, api.SeenEntry{Hash: nonceHash, Time: now})
+	}
+	r.expire(now)
+	return false
+}
+
+// seenAlready - whether SeenRecently would filter out this message, without remembering it if not
+func (r *RecentBuffer) seenAlready(nonce []byte) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.expire(time.Now().UnixNano())
+	if _, seen := r.seen[sha256.Sum256(nonce)]; seen {
+		r.stats.Checked++
+		r.stats.Seen++
+		return true
+	}
+	return false
+}
+
+// UseStore : reloads the nonces seen within the window from store, and saves newly seen nonces to it from then on
+func (r *RecentBuffer) UseStore(store api.SeenStore) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now().UnixNano()
+	entries, err := store.LoadSeen(now - int64(r.window))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, seen := r.seen[entry.Hash]; !seen {
+			r.seen[entry.Hash] = struct{}{}
+			r.queue = append(r.queue, entry)
 		}
 	}
-	// garbage collection
-	m := len(r.recentBuffer)
-	if m >= cacheSize {
-		values := make([]int, 0, m)
-		for _, v := range r.recentBuffer {
-			values = append(values, v)
+	queue := r.queue[r.head:]
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].Time < queue[j].Time })
+	r.expire(now)
+	r.store = store
+	r.lastSave = now
+	return r.save(now, true)
+}
+
+// FlushSeen : saves the nonces seen since the last save to the store, if there is one
+func (r *RecentBuffer) FlushSeen() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.save(time.Now().UnixNano(), true)
+}
+
+// saveSeen - saves newly seen nonces to the store once a batch is due
+func (r *RecentBuffer) saveSeen() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.save(time.Now().UnixNano(), false)
+}
+
+// save - saves pending nonces to the store, if a batch is due or force is set,
+// and deletes nonces older than the window from it now and then, call with mtx held
+func (r *RecentBuffer) save(now int64, force bool) error {
+	if r.store == nil {
+		return nil
+	}
+	if len(r.pending) > 0 && (force || len(r.pending) >= seenBatchSize || now-r.lastSave >= int64(seenSaveInterval)) {
+		pending := r.pending
+		r.pending = nil
+		r.lastSave = now
+		if err := r.store.SaveSeen(pending...); err != nil {
+			return err
 		}
-		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
-		discount := (cacheSize - m) + cacheDiscount
-		for i := 0; i < discount; i++ {
-			nh := r.reverseBuffer[values[i]]
-			delete(r.reverseBuffer, values[i])
-			delete(r.recentBuffer, nh)
+	}
+	if now-r.lastForget >= int64(r.window)/4 {
+		r.lastForget = now
+		return r.store.ForgetSeen(now - int64(r.window))
+	}
+	return nil
+}
+
+// expire - forgets nonces older than the window, then the oldest ones over the size, call with mtx held
+func (r *RecentBuffer) expire(now int64) {
+	cutoff := now - int64(r.window)
+	for r.head < len(r.queue) && (r.queue[r.head].Time < cutoff || len(r.seen) > r.size) {
+		if r.queue[r.head].Time >= cutoff {
+			r.stats.Evicted++
 		}
+		delete(r.seen, r.queue[r.head].Hash)
+		r.head++
+	}
+	// reclaim the front of the queue once it is mostly spent
+	if r.head > 1024 && r.head > len(r.queue)/2 {
+		r.queue = append([]api.SeenEntry(nil), r.queue[r.head:]...)
+		r.head = 0
 	}
-	return seen
 }
 
 // DefaultRouter - The Default router makes no changes at all,
@@ -73,8 +209,18 @@ type DefaultRouter struct {
 	// Internal
 	RecentBuffer
 
+	// Patches - the patches, in the order they were added
+	// Deprecated: use Patch, Unpatch, SetPatches and GetPatches, which are safe while the router is in use.
+	// A slice assigned or appended to Patches directly is still indexed before the next message is routed,
+	// but patches changed in place are not.
 	Patches []api.Patch
 
+	patchMutex sync.RWMutex
+	indexed    []api.Patch    // Patches as it was when patchIndex was built
+	patchIndex map[string]int // From of each patch to its index in Patches
+
+	fragments *chunking.Defragmenter
+
 	// Configuration Settings
 
 	// CheckContent - Check if incoming messages are for the contentKey
@@ -97,6 +243,9 @@ type DefaultRouter struct {
 	ForwardUnknownChannels bool
 	// ForwardUnknownProfile - Should node forward non-consumed messages that matched a profile key
 	ForwardUnknownProfiles bool
+
+	// PersistSeen - Should loop detection state be kept in the node, for nodes that can store it
+	PersistSeen bool
 }
 
 // NewDefaultRouter - returns a new instance of DefaultRouter
@@ -113,35 +262,155 @@ func NewDefaultRouter() *DefaultRouter {
 	r.ForwardConsumedProfiles = false
 	// init page maps
 	r.RecentBuffer = newRecentBuffer()
+	r.fragments = chunking.NewDefragmenter()
+	r.patchIndex = make(map[string]int)
 	return r
 }
 
-// Patch : Redirect messages from one input to different outputs
+// SetFragmentLimits : sets how long incomplete fragmented messages are kept, and how many bytes
+// and messages may be buffered for reassembly, zero restores the default
+func (r *DefaultRouter) SetFragmentLimits(maxAge time.Duration, maxBytes int64, maxSets int) {
+	r.fragments.SetLimits(maxAge, maxBytes, maxSets)
+}
+
+// RestoreSeen : if PersistSeen is set and node is an api.SeenStore, reloads the loop detection state
+// saved in node and keeps saving it there.  Nodes call this from Start.
+func (r *DefaultRouter) RestoreSeen(node api.Node) error {
+	store, ok := node.(api.SeenStore)
+	if !r.PersistSeen || !ok {
+		return nil
+	}
+	return r.UseStore(store)
+}
+
+// Patch : Redirect messages from one input to different outputs, replaces any patch from the same input
 func (r *DefaultRouter) Patch(patch api.Patch) {
+	r.patchMutex.Lock()
+	defer r.patchMutex.Unlock()
+	r.reindex()
+	patch.To = append([]string(nil), patch.To...) // forward reads To without the lock, so it is never modified in place
+	if i, ok := r.patchIndex[patch.From]; ok {
+		r.Patches[i] = patch
+		return
+	}
+	r.patchIndex[patch.From] = len(r.Patches)
 	r.Patches = append(r.Patches, patch)
+	r.indexed = r.Patches
+}
+
+// Unpatch : Removes the patch from the given input, if there is one
+func (r *DefaultRouter) Unpatch(from string) {
+	r.patchMutex.Lock()
+	defer r.patchMutex.Unlock()
+	r.reindex()
+	i, ok := r.patchIndex[from]
+	if !ok {
+		return
+	}
+	r.Patches = append(r.Patches[:i:i], r.Patches[i+1:]...)
+	r.indexed = r.Patches
+	delete(r.patchIndex, from)
+	for ; i < len(r.Patches); i++ {
+		r.patchIndex[r.Patches[i].From] = i
+	}
+}
+
+// SetPatches : Replaces all of the patches, later patches from the same input replace earlier ones
+func (r *DefaultRouter) SetPatches(patches []api.Patch) {
+	// build the new set first, so routing never sees it half done
+	var set []api.Patch
+	index := make(map[string]int)
+	for _, patch := range patches {
+		patch.To = append([]string(nil), patch.To...)
+		if i, ok := index[patch.From]; ok {
+			set[i] = patch
+			continue
+		}
+		index[patch.From] = len(set)
+		set = append(set, patch)
+	}
+	r.patchMutex.Lock()
+	r.Patches = set
+	r.indexed = set
+	r.patchIndex = index
+	r.patchMutex.Unlock()
 }
 
 // GetPatches : Returns an array with the mappings of incoming channels to destination channels
 func (r *DefaultRouter) GetPatches() []api.Patch {
-	return r.Patches
-}
-
-func (r *DefaultRouter) forward(node api.Node, msg api.Msg) error {
-	for _, p := range r.Patches { // todo: this could be constant-time
-		if msg.Name == p.From { // we don't check for IsChan here, we allow forwarding from "" chan to channels
-			for i := 0; i < len(p.To); i++ {
-				msg.Name = p.To[i]
-				if msg.Name == "" {
-					msg.IsChan = false
-				} else {
-					msg.IsChan = true
-				}
-				if err := node.Forward(msg); err != nil {
-					return err
-				}
+	r.patchMutex.RLock()
+	defer r.patchMutex.RUnlock()
+	return append([]api.Patch(nil), r.Patches...)
+}
+
+// reindex : rebuilds patchIndex if Patches was assigned or appended to directly, the first patch from an input wins,
+// call with patchMutex held for writing
+func (r *DefaultRouter) reindex() {
+	if samePatches(r.Patches, r.indexed) {
+		return
+	}
+	r.patchIndex = make(map[string]int)
+	for i, patch := range r.Patches {
+		if _, ok := r.patchIndex[patch.From]; !ok {
+			r.patchIndex[patch.From] = i
+		}
+	}
+	r.indexed = r.Patches
+}
+
+// samePatches : returns true if a and b are the same slice, not just equal ones
+func samePatches(a, b []api.Patch) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// patched : Returns the destination channels of the patch from the given input, or nil if it is not patched
+func (r *DefaultRouter) patched(from string) []string {
+	r.patchMutex.RLock()
+	stale := !samePatches(r.Patches, r.indexed)
+	r.patchMutex.RUnlock()
+	if stale {
+		r.patchMutex.Lock()
+		r.reindex()
+		r.patchMutex.Unlock()
+	}
+	r.patchMutex.RLock()
+	defer r.patchMutex.RUnlock()
+	if i, ok := r.patchIndex[from]; ok {
+		if r.Patches[i].To == nil {
+			return []string{}
+		}
+		return r.Patches[i].To
+	}
+	return nil
+}
+
+// forward - forwards msg to the channels in to, or if to is nil, as patched or on the channel it came in on
+func (r *DefaultRouter) forward(node api.Node, msg api.Msg, to []string) error {
+	// enforce the TTL header, the hop to the next node uses up one of the hops left
+	if msg.Expires > 0 && time.Now().UnixNano() > msg.Expires {
+		return nil
+	}
+	if msg.HopLimit == 1 {
+		return nil
+	} else if msg.HopLimit > 1 {
+		msg.HopLimit--
+	}
+	if to == nil { // we don't check for IsChan here, we allow forwarding from "" chan to channels
+		to = r.patched(msg.Name)
+	}
+	if to != nil {
+		for i := 0; i < len(to); i++ {
+			msg.Name = to[i]
+			if msg.Name == "" {
+				msg.IsChan = false
+			} else {
+				msg.IsChan = true
+			}
+			if err := node.Forward(msg); err != nil {
+				return err
 			}
-			return nil
 		}
+		return nil
 	}
 	if err := node.Forward(msg); err != nil {
 		return err
@@ -150,33 +419,77 @@ func (r *DefaultRouter) forward(node api.Node, msg api.Msg) error {
 }
 
 // Route - Router that does default behavior
-func (r *DefaultRouter) Route(node api.Node, message []byte) error {
+func (r *DefaultRouter) Route(node api.Node, message []byte, ingress api.Ingress) error {
+	return r.route(node, message, ingress, nil)
+}
+
+// verdictFunc - decides what happens to a routed message after loop detection, before it is handled
+// or remembered as seen:
+// dropped, or forwarded to the channels in to, or as the DefaultRouter would if to is nil.
+// msg.Content is the message after its headers, still encrypted.
+type verdictFunc func(msg api.Msg, size int) (drop bool, to []string)
+
+// route - does the default behavior, after asking verdict what to do with the message if it is not nil
+func (r *DefaultRouter) route(node api.Node, message []byte, ingress api.Ingress, verdict verdictFunc) error {
 	//  Stuff Everything will need just about every time...
 	//
 	var msg api.Msg
+	var err error
 	flags := message[0]
+	if (flags & api.FragmentFlag) != 0 { // reassemble messages that were split to fit the last hop's transport
+		whole, err := r.fragments.Add(ingress, message[1:])
+		if err != nil || whole == nil {
+			return err
+		}
+		return r.route(node, whole, ingress, verdict)
+	}
 	idx := 1
+	msg.Ingress = ingress
 	msg.IsChan = ((flags & api.ChannelFlag) != 0)
 	msg.Chunked = ((flags & api.ChunkedFlag) != 0)
 	msg.StreamHeader = ((flags & api.StreamHeaderFlag) != 0)
+	msg.Nack = ((flags & api.NackFlag) != 0)
+	msg.Receipt = ((flags & api.ReceiptFlag) != 0)
+	msg.Multicast = ((flags & api.MulticastFlag) != 0)
+	msg.Priority = msg.DefaultPriority() // unless the TTL header says otherwise
 	var channelLen uint16 // beginning uint16 of message is channel name length
 	if msg.IsChan {
 		channelLen = (uint16(message[1]) << 8) | uint16(message[2])
 		msg.Name = string(message[3 : 3+channelLen]) // flags[0], chan name length[1,2]
 		idx += 2 + int(channelLen)                   // skip over the channel name
 	}
+	if (flags & api.TTLFlag) != 0 { // hop limit, expiry time and priority follow the channel name
+		msg.HopLimit, msg.Expires, msg.Priority, err = api.ParseTTLHeader(message[idx:])
+		if err != nil {
+			return errors.New("Malformed message")
+		}
+		idx += api.TTLHeaderSize
+	}
 	if idx+16 >= len(message) {
 		return errors.New("Malformed message")
 	}
 	nonce := message[idx : idx+nonceSize]
-	if r.SeenRecently(nonce) { // LOOP PREVENTION before handling or forwarding
+	if r.seenAlready(nonce) { // LOOP PREVENTION before handling or forwarding
+		return nil
+	}
+	msg.Content = bytes.NewBuffer(message[idx:])
+	var to []string
+	if verdict != nil {
+		var drop bool
+		if drop, to = verdict(msg, len(message)); drop { // not remembered, so a retransmit can still get through
+			return nil
+		}
+	}
+	if r.SeenRecently(nonce) { // remember it, unless it raced in again meanwhile
 		return nil
 	}
+	if err := r.saveSeen(); err != nil {
+		events.Warning(node, "Could not save seen messages: "+err.Error())
+	}
 	cid, err := node.CID() // we need this for cloning
 	if err != nil {
 		return err
 	}
-	msg.Content = bytes.NewBuffer(message[idx:])
 
 	// Routing Logic
 	if msg.IsChan { // channel message
@@ -193,7 +506,7 @@ func (r *DefaultRouter) Route(node api.Node, message []byte) error {
 			}
 		}
 		if (!consumed && r.ForwardUnknownChannels) || (consumed && r.ForwardConsumedChannels) {
-			if err := r.forward(node, msg); err != nil {
+			if err := r.forward(node, msg, to); err != nil {
 				return err
 			}
 		}
@@ -231,7 +544,7 @@ func (r *DefaultRouter) Route(node api.Node, message []byte) error {
 		if (!consumedContent && !consumedProfile && fwdUnknowns) ||
 			(consumedContent && r.ForwardConsumedContent) ||
 			(consumedProfile && r.ForwardConsumedProfiles) {
-			if err := r.forward(node, msg); err != nil {
+			if err := r.forward(node, msg, to); err != nil {
 				return err
 			}
 		}
@@ -15,7 +15,17 @@ func init() {
 
 // NewRouterFromMap : Makes a new instance of this module from a map of arguments (for deserialization support)
 func NewRouterFromMap(r map[string]interface{}) api.Router {
-	return NewDefaultRouter()
+	router := NewDefaultRouter()
+	if persistSeen, ok := r["PersistSeen"].(bool); ok {
+		router.PersistSeen = persistSeen
+	}
+	if patches, ok := r["Patches"]; ok && patches != nil {
+		var p []api.Patch
+		if b, err := json.Marshal(patches); err == nil && json.Unmarshal(b, &p) == nil {
+			router.SetPatches(p)
+		}
+	}
+	return router
 }
 
 // MarshalJSON : Create a serialized JSON blob out of the config of this router
@@ -31,6 +41,7 @@ func (r *DefaultRouter) MarshalJSON() (b []byte, e error) {
 		"CheckChannels":           r.CheckChannels,
 		"ForwardConsumedChannels": r.ForwardConsumedChannels,
 		"ForwardUnknownChannels":  r.ForwardUnknownChannels,
-		"Patches":                 r.Patches,
+		"PersistSeen":             r.PersistSeen,
+		"Patches":                 r.GetPatches(),
 	})
 }
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/chunking"
+)
+
+// fragmentsOf - splits msg into fragments of at most maxBytes, without their flags byte
+func fragmentsOf(t *testing.T, msg []byte, maxBytes int64) [][]byte {
+	f := chunking.NewFragmenter()
+	if err := f.Split("consumer", msg, maxBytes, 0, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := f.Pending("consumer", 0, 1<<20)
+	var fragments [][]byte
+	for _, fragment := range pending {
+		fragments = append(fragments, fragment[1:])
+	}
+	return fragments
+}
+
+func Test_Fragment_Peers_1(t *testing.T) {
+	msg := bytes.Repeat([]byte("fragment me "), 100)
+	fragments := fragmentsOf(t, msg, 256)
+	a, b := api.Ingress{Peer: "a"}, api.Ingress{Peer: "b"}
+
+	d := chunking.NewDefragmenter()
+	for i, fragment := range fragments[:len(fragments)-1] {
+		if whole, err := d.Add(a, fragment); err != nil || whole != nil {
+			t.Fatal("Reassembled early at fragment", i, err)
+		}
+	}
+	// the same fragment ID from another peer is another message
+	if whole, err := d.Add(b, fragments[len(fragments)-1]); err != nil || whole != nil {
+		t.Fatal("Fragments from different peers were mixed", err)
+	}
+	whole, err := d.Add(a, fragments[len(fragments)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(whole, msg) {
+		t.Fatal("Reassembled message does not match")
+	}
+}
+
+func Test_Fragment_Limits_1(t *testing.T) {
+	msg := bytes.Repeat([]byte("fragment me "), 100)
+	peer := api.Ingress{Peer: "a"}
+
+	d := chunking.NewDefragmenter()
+	d.SetLimits(0, 0, 2)
+	var sets [][][]byte
+	for i := 0; i < 3; i++ {
+		fragments := fragmentsOf(t, msg, 256)
+		if _, err := d.Add(peer, fragments[0]); err != nil {
+			t.Fatal(err)
+		}
+		sets = append(sets, fragments)
+	}
+	// the first message was discarded to make room for the third
+	for i := len(sets) - 1; i >= 0; i-- {
+		var whole []byte
+		for _, fragment := range sets[i][1:] {
+			var err error
+			if whole, err = d.Add(peer, fragment); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if complete := whole != nil; complete != (i > 0) {
+			t.Error("Message", i, "reassembled:", complete)
+		}
+	}
+}
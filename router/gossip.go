@@ -0,0 +1,364 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/api/events"
+)
+
+// GossipChannel - channel reachability advertisements are sent on, to direct neighbours only
+const GossipChannel = "_reach"
+
+var (
+	// DefaultGossipInterval - how often a GossipRouter advertises the channels it can reach
+	DefaultGossipInterval = time.Minute
+	// DefaultGossipHops - how many hops away a channel may be and still be advertised
+	DefaultGossipHops uint8 = 8
+)
+
+// GossipRouter : a DefaultRouter that learns which neighbours lead to which channels, and hands channel messages
+// only to those neighbours when they Pickup, instead of to every peer.  Every GossipRouter sends its neighbours
+// advertisements on GossipChannel, signed with its signing key, listing the channels its node has keys for
+// and the channels it has trusted routes to, with how many hops away they are.
+// Channels are listed by the SHA-256 of their names, see ChannelHash, so advertisements do not give the names away,
+// though a name that is easy to guess can still be found by hashing guesses.
+// Advertisements go one hop and name the routing key of the node that signed them, so a route leads to the signer,
+// never to whichever peer claims to have passed the advertisement on, see api.Ingress.
+// Once TrustedKeys is set, routes are only learned from advertisements signed by one of them, and narrow down
+// where messages go as long as they lead to a peer that has picked up from this node within RouteTTL.
+// Without TrustedKeys, routes are learned from any valid signature for Routes, but nothing is pruned
+// and every message floods as with the DefaultRouter, since anyone could otherwise attract or blackhole a channel.
+// A node that should get a channel must then advertise it with a trusted key, or be reached by flooding only.
+// Messages on channels with no trusted route are flooded as usual.
+// Direct messages do not show who they are for, so they are always flooded.
+type GossipRouter struct {
+	*DefaultRouter
+
+	// Interval : time between advertisements
+	Interval time.Duration
+	// RouteTTL : how long a route is kept without hearing an advertisement for it, and how old advertisements may get
+	RouteTTL time.Duration
+	// MaxHops : how many hops away a channel may be and still be advertised
+	MaxHops uint8
+	// TrustedKeys : base64 ed25519 keys to learn routes from.  If empty, routes are learned from anyone's advertisements
+	// for Routes, but messages are still flooded.
+	TrustedKeys []string
+
+	signingKey ed25519.PrivateKey
+
+	mutex     sync.Mutex
+	routes    map[[sha256.Size]byte]map[string]route // channel hash to peer routing key to what was heard
+	consumers map[string]int64                       // routing key of each peer that picked up to when it last did
+	lastAd    time.Time
+}
+
+// route : when a route was last heard, how many hops it is, and whether it was heard from a trusted key
+type route struct {
+	heard   int64 // UnixNano
+	hops    uint8
+	trusted bool // learned while TrustedKeys was set, so it may prune flooding
+}
+
+// NewGossipRouter : returns a new GossipRouter with the default settings of the DefaultRouter and a new signing key
+func NewGossipRouter() *GossipRouter {
+	r := new(GossipRouter)
+	r.DefaultRouter = NewDefaultRouter()
+	r.Interval = DefaultGossipInterval
+	r.RouteTTL = 3 * DefaultGossipInterval
+	r.MaxHops = DefaultGossipHops
+	_, r.signingKey, _ = ed25519.GenerateKey(nil)
+	r.routes = make(map[[sha256.Size]byte]map[string]route)
+	r.consumers = make(map[string]int64)
+	return r
+}
+
+// ChannelHash : returns the hex SHA-256 of a channel name, which advertisements and Routes list channels by
+func ChannelHash(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:])
+}
+
+// PublicKey : returns the base64 key the advertisements of this router are signed with, for TrustedKeys
+func (r *GossipRouter) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(r.signingKey.Public().(ed25519.PublicKey))
+}
+
+// SigningKey : returns the base64 private key advertisements are signed with.
+// Nodes export it with their other secret keys, see api.SigningRouter.
+func (r *GossipRouter) SigningKey() string {
+	return base64.StdEncoding.EncodeToString(r.signingKey)
+}
+
+// SetSigningKey : sets the private key advertisements are signed with, from base64
+func (r *GossipRouter) SetSigningKey(b64 string) error {
+	key, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return errors.New("Invalid signing key length")
+	}
+	r.signingKey = ed25519.PrivateKey(key)
+	return nil
+}
+
+// Route : routes the message as the DefaultRouter would, learning routes from advertisements on the way
+func (r *GossipRouter) Route(node api.Node, message []byte, ingress api.Ingress) error {
+	return r.route(node, message, ingress, r.verdict)
+}
+
+// verdict : learns from advertisements, which are for this node only and never forwarded, leaves everything else alone
+func (r *GossipRouter) verdict(msg api.Msg, size int) (bool, []string) {
+	if !msg.IsChan || msg.Name != GossipChannel {
+		return false, nil
+	}
+	ad, err := parseAd(msg.Content.Bytes())
+	if err != nil || bytes.Equal(ad.origin, r.signingKey.Public().(ed25519.PublicKey)) { // or our own, come back around
+		return true, nil
+	}
+	now := time.Now()
+	if ad.ts < now.Add(-r.RouteTTL).UnixNano() || ad.ts > now.Add(r.RouteTTL).UnixNano() {
+		return true, nil
+	}
+	// the route leads to the signer, a peer passing on someone else's advertisement is not believed
+	if ad.peer == "" || (msg.Ingress.Peer != "" && msg.Ingress.Peer != ad.peer) {
+		return true, nil
+	}
+	trusted := r.trusted(ad.origin)
+	if len(r.TrustedKeys) > 0 && !trusted {
+		return true, nil
+	}
+	r.mutex.Lock()
+	for hash, hops := range ad.channels {
+		if hops >= r.MaxHops {
+			continue
+		}
+		peers, ok := r.routes[hash]
+		if !ok {
+			peers = make(map[string]route)
+			r.routes[hash] = peers
+		}
+		peers[ad.peer] = route{heard: now.UnixNano(), hops: hops + 1, trusted: trusted}
+	}
+	r.mutex.Unlock()
+	return true, nil
+}
+
+// trusted : returns true if origin is one of TrustedKeys
+func (r *GossipRouter) trusted(origin ed25519.PublicKey) bool {
+	b64 := base64.StdEncoding.EncodeToString(origin)
+	for _, k := range r.TrustedKeys {
+		if k == b64 {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterPickup : leaves out the channel messages that have trusted routes which do not go through consumer,
+// and sends an advertisement first if one is due
+func (r *GossipRouter) FilterPickup(node api.Node, consumer string, msgs [][]byte) [][]byte {
+	r.mutex.Lock()
+	now := time.Now()
+	r.consumers[consumer] = now.UnixNano()
+	due := now.Sub(r.lastAd) >= r.Interval
+	if due {
+		r.lastAd = now
+	}
+	r.mutex.Unlock()
+	if due {
+		if err := r.Advertise(node); err != nil {
+			events.Warning(node, "Could not send reachability advertisement: "+err.Error())
+		}
+	}
+
+	if len(r.TrustedKeys) == 0 { // routes from just anyone only get a look in Routes
+		return msgs
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cutoff := now.Add(-r.RouteTTL).UnixNano()
+	kept := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		channel, ok := channelName(msg)
+		if !ok || channel == GossipChannel {
+			kept = append(kept, msg)
+			continue
+		}
+		known, toward := false, false
+		for peer, heard := range r.routes[sha256.Sum256([]byte(channel))] {
+			// a route toward a peer that never picks up from us would be a blackhole, a replayed advertisement maybe
+			if heard.trusted && heard.heard >= cutoff && r.consumers[peer] >= cutoff {
+				known = true
+				toward = toward || peer == consumer
+			}
+		}
+		if !known || toward {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// Advertise : sends the neighbours of node an advertisement of the channels node has keys for and the channels
+// this router has trusted routes to, FilterPickup calls this every Interval
+func (r *GossipRouter) Advertise(node api.Node) error {
+	chans, err := node.GetChannels()
+	if err != nil {
+		return err
+	}
+	r.expire()
+	channels := make(map[[sha256.Size]byte]uint8)
+	for _, c := range chans {
+		channels[sha256.Sum256([]byte(c.Name))] = 0
+	}
+	r.mutex.Lock()
+	for hash, peers := range r.routes {
+		for _, heard := range peers {
+			if hops, ok := channels[hash]; heard.trusted && heard.hops < r.MaxHops && (!ok || heard.hops < hops) {
+				channels[hash] = heard.hops
+			}
+		}
+	}
+	r.mutex.Unlock()
+	if len(channels) == 0 {
+		return nil
+	}
+	id, err := node.ID()
+	if err != nil {
+		return err
+	}
+	ad, err := r.signAd(id.ToB64(), time.Now().UnixNano(), channels)
+	if err != nil {
+		return err
+	}
+	r.SeenRecently(ad[:nonceSize]) // so it is dropped if it comes back
+	return node.Forward(api.Msg{Name: GossipChannel, IsChan: true, Content: bytes.NewBuffer(ad),
+		HopLimit: 1, Expires: time.Now().Add(r.RouteTTL).UnixNano()})
+}
+
+// Routes : returns the channels with known routes, by ChannelHash, and the routing keys of the peers they go through
+func (r *GossipRouter) Routes() map[string][]string {
+	r.expire()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	routes := make(map[string][]string, len(r.routes))
+	for hash, peers := range r.routes {
+		channel := hex.EncodeToString(hash[:])
+		for peer := range peers {
+			routes[channel] = append(routes[channel], peer)
+		}
+		sort.Strings(routes[channel])
+	}
+	return routes
+}
+
+// expire : forgets routes that have not been heard for RouteTTL, and peers that have not picked up for as long
+func (r *GossipRouter) expire() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cutoff := time.Now().Add(-r.RouteTTL).UnixNano()
+	for hash, peers := range r.routes {
+		for peer, heard := range peers {
+			if heard.heard < cutoff {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(r.routes, hash)
+		}
+	}
+	for peer, last := range r.consumers {
+		if last < cutoff {
+			delete(r.consumers, peer)
+		}
+	}
+}
+
+// channelName : returns the channel name of an outbox message, and false if it is not a channel message
+func channelName(msg []byte) (string, bool) {
+	if len(msg) < 3 || msg[0]&api.ChannelFlag == 0 {
+		return "", false
+	}
+	n := int(binary.BigEndian.Uint16(msg[1:]))
+	if len(msg) < 3+n {
+		return "", false
+	}
+	return string(msg[3 : 3+n]), true
+}
+
+// advertisement layout: nonce, origin ed25519 key, uint16 length and base64 routing key of the signing node,
+// int64 UnixNano time, uint16 channel count, SHA-256 of the name and uint8 hops of each channel,
+// then the signature of all of that by the origin key
+
+// advertisement : a parsed advertisement with a valid signature
+type advertisement struct {
+	origin   ed25519.PublicKey
+	peer     string // routing key of the node that signed it
+	ts       int64
+	channels map[[sha256.Size]byte]uint8
+}
+
+func (r *GossipRouter) signAd(peer string, ts int64, channels map[[sha256.Size]byte]uint8) ([]byte, error) {
+	nonce, err := bc.GenerateRandomBytes(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	ad := bytes.NewBuffer(nonce)
+	ad.Write(r.signingKey.Public().(ed25519.PublicKey))
+	binary.Write(ad, binary.BigEndian, uint16(len(peer)))
+	ad.WriteString(peer)
+	binary.Write(ad, binary.BigEndian, ts)
+	binary.Write(ad, binary.BigEndian, uint16(len(channels)))
+	for hash, hops := range channels {
+		ad.Write(hash[:])
+		ad.WriteByte(hops)
+	}
+	ad.Write(ed25519.Sign(r.signingKey, ad.Bytes()))
+	return ad.Bytes(), nil
+}
+
+func parseAd(b []byte) (advertisement, error) {
+	var ad advertisement
+	errMalformed := errors.New("Malformed advertisement")
+	if len(b) < nonceSize+ed25519.PublicKeySize+2+10+ed25519.SignatureSize {
+		return ad, errMalformed
+	}
+	signed, sig := b[:len(b)-ed25519.SignatureSize], b[len(b)-ed25519.SignatureSize:]
+	ad.origin = ed25519.PublicKey(signed[nonceSize : nonceSize+ed25519.PublicKeySize])
+	if !ed25519.Verify(ad.origin, signed, sig) {
+		return ad, errors.New("Invalid advertisement signature")
+	}
+	b = signed[nonceSize+ed25519.PublicKeySize:]
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n+10 {
+		return ad, errMalformed
+	}
+	ad.peer = string(b[2 : 2+n])
+	b = b[2+n:]
+	ad.ts = int64(binary.BigEndian.Uint64(b))
+	count := int(binary.BigEndian.Uint16(b[8:]))
+	b = b[10:]
+	if len(b) != count*(sha256.Size+1) {
+		return ad, errMalformed
+	}
+	ad.channels = make(map[[sha256.Size]byte]uint8, count)
+	for i := 0; i < count; i++ {
+		var hash [sha256.Size]byte
+		copy(hash[:], b)
+		ad.channels[hash] = b[sha256.Size]
+		b = b[sha256.Size+1:]
+	}
+	return ad, nil
+}
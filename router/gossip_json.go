@@ -0,0 +1,75 @@
+// +build !no_json
+
+package router
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/awgh/ratnet"
+	"github.com/awgh/ratnet/api"
+)
+
+func init() {
+	ratnet.Routers["gossip"] = NewGossipRouterFromMap // register this module by name (for deserialization support)
+}
+
+// NewGossipRouterFromMap : Makes a new instance of this module from a map of arguments (for deserialization support)
+func NewGossipRouterFromMap(r map[string]interface{}) api.Router {
+	router := NewGossipRouter()
+	if persistSeen, ok := r["PersistSeen"].(bool); ok {
+		router.PersistSeen = persistSeen
+	}
+	if patches, ok := r["Patches"]; ok && patches != nil {
+		var p []api.Patch
+		if b, err := json.Marshal(patches); err == nil && json.Unmarshal(b, &p) == nil {
+			router.SetPatches(p)
+		}
+	}
+	if interval, ok := r["Interval"].(string); ok {
+		if d, err := time.ParseDuration(interval); err == nil {
+			router.Interval = d
+		}
+	}
+	if routeTTL, ok := r["RouteTTL"].(string); ok {
+		if d, err := time.ParseDuration(routeTTL); err == nil {
+			router.RouteTTL = d
+		}
+	}
+	if maxHops, ok := r["MaxHops"].(float64); ok {
+		router.MaxHops = uint8(maxHops)
+	}
+	if trustedKeys, ok := r["TrustedKeys"].([]interface{}); ok {
+		for _, k := range trustedKeys {
+			if s, ok := k.(string); ok {
+				router.TrustedKeys = append(router.TrustedKeys, s)
+			}
+		}
+	}
+	if signingKey, ok := r["SigningKey"].(string); ok { // older configs kept it here, nodes now export it with their keys
+		router.SetSigningKey(signingKey) // keeps the new key if this one is no good
+	}
+	return router
+}
+
+// MarshalJSON : Create a serialized JSON blob out of the config of this router
+func (r *GossipRouter) MarshalJSON() (b []byte, e error) {
+	return json.Marshal(map[string]interface{}{
+		"Router":                  "gossip",
+		"CheckContent":            r.CheckContent,
+		"ForwardConsumedContent":  r.ForwardConsumedContent,
+		"ForwardUnknownContent":   r.ForwardUnknownContent,
+		"CheckProfiles":           r.CheckProfiles,
+		"ForwardConsumedProfiles": r.ForwardConsumedProfiles,
+		"ForwardUnknownProfiles":  r.ForwardUnknownProfiles,
+		"CheckChannels":           r.CheckChannels,
+		"ForwardConsumedChannels": r.ForwardConsumedChannels,
+		"ForwardUnknownChannels":  r.ForwardUnknownChannels,
+		"PersistSeen":             r.PersistSeen,
+		"Patches":                 r.GetPatches(),
+		"Interval":                r.Interval.String(),
+		"RouteTTL":                r.RouteTTL.String(),
+		"MaxHops":                 r.MaxHops,
+		"TrustedKeys":             r.TrustedKeys,
+	})
+}
@@ -0,0 +1,285 @@
+package router_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+	"github.com/awgh/ratnet/router"
+)
+
+// exchange - picks up what from has for to and drops it off at to, as a policy would
+func exchange(t *testing.T, from, to *ram.Node) {
+	fromID, _ := from.ID()
+	exchangeAs(t, from, to, fromID.ToB64())
+}
+
+// exchangeAs - exchange, with the dropping peer claiming to be the peer with the given routing key
+func exchangeAs(t *testing.T, from, to *ram.Node, claimed string) {
+	toID, _ := to.ID()
+	bundle, err := from.Pickup(toID, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Data == nil {
+		return
+	}
+	bundle.Ingress = api.Ingress{Peer: claimed}
+	if err := to.Dropoff(bundle); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pickupOf - returns the messages the peer with routingKey gets when it picks up from node
+func pickupOf(t *testing.T, node *ram.Node, routingKey bc.KeyPair) [][]byte {
+	bundle, err := node.Pickup(routingKey.GetPubKey(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Data == nil {
+		return nil
+	}
+	_, data, err := routingKey.DecryptMessage(bundle.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := api.BytesBytesFromBytes(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *msgs
+}
+
+// gossiped - has a relay learn the route to news from origin, then returns the channels origin and a bystander
+// get from the relay when a sender has sent on news and other.  The relay trusts origin's key if trust is set.
+// The bystander picks up before origin if bystanderFirst is set.
+func gossiped(t *testing.T, trust, bystanderFirst bool) (toOrigin, toBystander string) {
+	originKey, bystanderKey := new(ecc.KeyPair), new(ecc.KeyPair)
+	origin, relay, sender := ram.New(nil, originKey), ram.New(nil, nil), ram.New(nil, nil)
+	originRouter, relayRouter := router.NewGossipRouter(), router.NewGossipRouter()
+	if trust {
+		relayRouter.TrustedKeys = []string{originRouter.PublicKey()}
+	}
+	origin.SetRouter(originRouter)
+	relay.SetRouter(relayRouter)
+
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := origin.AddChannel("news", key.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first pickup queues an advertisement, the next one hands it over
+	exchange(t, origin, relay)
+	exchange(t, origin, relay)
+	originID, _ := origin.ID()
+	routes := relayRouter.Routes()
+	if news := routes[router.ChannelHash("news")]; len(news) != 1 || news[0] != originID.ToB64() {
+		t.Fatalf("Relay did not learn the route to news through origin: %v", routes)
+	}
+	if len(originRouter.Routes()) != 0 {
+		t.Error("Origin learned a route from its own advertisement")
+	}
+
+	for _, channel := range []string{"news", "other"} {
+		if _, err := sender.SendMsg(api.Msg{Name: channel, IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exchange(t, sender, relay)
+
+	bystanderKey.GenerateKey()
+	channels := func(consumer bc.KeyPair) string {
+		var got []string
+		for _, m := range pickupOf(t, relay, consumer) {
+			if name := channelOf(m); m[0]&api.ChannelFlag != 0 && name != router.GossipChannel {
+				got = append(got, name)
+			}
+		}
+		return strings.Join(got, ",")
+	}
+	if bystanderFirst {
+		toBystander = channels(bystanderKey)
+		return channels(originKey), toBystander
+	}
+	return channels(originKey), channels(bystanderKey)
+}
+
+func Test_Gossip_Routes_1(t *testing.T) {
+	// messages on news only go toward origin, other channels still flood
+	if toOrigin, toBystander := gossiped(t, true, false); toOrigin != "news,other" || toBystander != "other" {
+		t.Errorf("Expected news,other for origin and other for the bystander, got %s and %s", toOrigin, toBystander)
+	}
+}
+
+func Test_Gossip_Flood_1(t *testing.T) {
+	// routes from keys nobody vouched for are learned, but everything still floods
+	if toOrigin, toBystander := gossiped(t, false, false); toOrigin != "news,other" || toBystander != "news,other" {
+		t.Errorf("Expected news,other for both, got %s and %s", toOrigin, toBystander)
+	}
+}
+
+func Test_Gossip_Live_1(t *testing.T) {
+	// origin has never picked up from the relay, so its route could be a replayed advertisement, and is not used yet
+	if toOrigin, toBystander := gossiped(t, true, true); toOrigin != "news,other" || toBystander != "news,other" {
+		t.Errorf("Expected news,other for both, got %s and %s", toOrigin, toBystander)
+	}
+}
+
+func Test_Gossip_Expiry_1(t *testing.T) {
+	origin, relay := ram.New(nil, nil), ram.New(nil, nil)
+	originRouter, relayRouter := router.NewGossipRouter(), router.NewGossipRouter()
+	originRouter.RouteTTL = 50 * time.Millisecond
+	relayRouter.RouteTTL = 50 * time.Millisecond
+	origin.SetRouter(originRouter)
+	relay.SetRouter(relayRouter)
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := origin.AddChannel("news", key.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, origin, relay)
+	exchange(t, origin, relay)
+	if len(relayRouter.Routes()[router.ChannelHash("news")]) != 1 {
+		t.Fatal("Relay did not learn the route to news")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(relayRouter.Routes()) != 0 {
+		t.Error("Route outlived its RouteTTL")
+	}
+}
+
+func Test_Gossip_Trust_1(t *testing.T) {
+	origin, relay := ram.New(nil, nil), ram.New(nil, nil)
+	origin.SetRouter(router.NewGossipRouter())
+	relayRouter := router.NewGossipRouter()
+	relayRouter.TrustedKeys = []string{router.NewGossipRouter().PublicKey()}
+	relay.SetRouter(relayRouter)
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := origin.AddChannel("news", key.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, origin, relay)
+	exchange(t, origin, relay)
+	if len(relayRouter.Routes()) != 0 {
+		t.Error("Relay learned a route from an untrusted advertisement")
+	}
+}
+
+func Test_Gossip_JSON_1(t *testing.T) {
+	r := router.NewGossipRouter()
+	r.Interval = 10 * time.Second
+	r.MaxHops = 3
+	r.TrustedKeys = []string{r.PublicKey()}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	r2, ok := ratnet.Routers[m["Router"].(string)](m).(*router.GossipRouter)
+	if !ok {
+		t.Fatal("Wrong router type")
+	}
+	if r2.Interval != r.Interval || r2.RouteTTL != r.RouteTTL || r2.MaxHops != 3 ||
+		len(r2.TrustedKeys) != 1 || r2.TrustedKeys[0] != r.PublicKey() {
+		t.Error("Router settings were not restored")
+	}
+	if strings.Contains(string(b), r.SigningKey()) || r2.PublicKey() == r.PublicKey() {
+		t.Error("Signing key was exported with the router config")
+	}
+
+	// nodes keep it with their other secret keys
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	node.SetRouter(r)
+	j, err := node.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	imported.SetRouter(router.NewGossipRouter())
+	if err := imported.Import(j); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Router().(*router.GossipRouter).PublicKey() != r.PublicKey() {
+		t.Error("Signing key was not imported with the node")
+	}
+}
+
+func Test_Gossip_Hashed_1(t *testing.T) {
+	origin, relay := ram.New(nil, nil), ram.New(nil, nil)
+	origin.SetRouter(router.NewGossipRouter())
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := origin.AddChannel("secretchannel", key.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	relayID, _ := relay.ID()
+	origin.Pickup(relayID, 0, 0) // queues the advertisement
+	ads, _, err := origin.Outbox().MsgsSince(0, 0)
+	if err != nil || len(ads) != 1 {
+		t.Fatal("Expected one advertisement", err)
+	}
+	if bytes.Contains(ads[0], []byte("secretchannel")) {
+		t.Error("Advertisement gives away the channel name")
+	}
+	if ads[0][0]&api.TTLFlag == 0 {
+		t.Error("Advertisement was sent without a hop limit")
+	}
+}
+
+func Test_Gossip_Ingress_1(t *testing.T) {
+	// a peer passing on an advertisement that another node signed is not believed
+	origin, relay, liar := ram.New(nil, nil), ram.New(nil, nil), ram.New(nil, nil)
+	originRouter, relayRouter := router.NewGossipRouter(), router.NewGossipRouter()
+	relayRouter.TrustedKeys = []string{originRouter.PublicKey()}
+	origin.SetRouter(originRouter)
+	relay.SetRouter(relayRouter)
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := origin.AddChannel("news", key.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	liarID, _ := liar.ID()
+	exchangeAs(t, origin, relay, liarID.ToB64())
+	exchangeAs(t, origin, relay, liarID.ToB64())
+	if routes := relayRouter.Routes(); len(routes) != 0 {
+		t.Errorf("Relay learned a route through the peer that passed the advertisement on: %v", routes)
+	}
+}
+
+func Test_Gossip_MultiHop_1(t *testing.T) {
+	origin, relay1, relay2 := ram.New(nil, nil), ram.New(nil, nil), ram.New(nil, nil)
+	originRouter, relay1Router, relay2Router := router.NewGossipRouter(), router.NewGossipRouter(), router.NewGossipRouter()
+	relay1Router.TrustedKeys = []string{originRouter.PublicKey()}
+	relay2Router.TrustedKeys = []string{relay1Router.PublicKey()}
+	origin.SetRouter(originRouter)
+	relay1.SetRouter(relay1Router)
+	relay2.SetRouter(relay2Router)
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := origin.AddChannel("news", key.ToB64()); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, origin, relay1)
+	exchange(t, origin, relay1)
+	exchange(t, relay1, relay2)
+	exchange(t, relay1, relay2)
+	relay1ID, _ := relay1.ID()
+	if news := relay2Router.Routes()[router.ChannelHash("news")]; len(news) != 1 || news[0] != relay1ID.ToB64() {
+		t.Errorf("Second relay did not learn the route to news through the first: %v", news)
+	}
+	if len(originRouter.Routes()) != 0 || len(relay2.Router().(*router.GossipRouter).Routes()) != 1 {
+		t.Error("Advertisements went further than one hop")
+	}
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"testing"
+	"time"
 
 	"github.com/awgh/bencrypt/bc"
 )
@@ -62,3 +63,53 @@ func Test_Loop_Fixed_1(t *testing.T) {
 		t.Fatal("SeenRecently never returned true on fixed loop test")
 	}
 }
+
+func Test_Loop_Window_1(t *testing.T) {
+	recentBuffer := newRecentBuffer()
+	recentBuffer.SetSeenLimits(0, 50*time.Millisecond)
+	b, err := bc.GenerateRandomBytes(nonceSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recentBuffer.SeenRecently(b) {
+		t.Fatal("SeenRecently returned true on a new message")
+	}
+	if !recentBuffer.SeenRecently(b) {
+		t.Fatal("SeenRecently returned false on a repeated message")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if recentBuffer.SeenRecently(b) {
+		t.Fatal("SeenRecently returned true on a message seen before the window")
+	}
+	stats := recentBuffer.SeenStats()
+	if stats.Checked != 3 || stats.Seen != 1 || stats.Evicted != 0 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func Test_Loop_Size_1(t *testing.T) {
+	recentBuffer := newRecentBuffer()
+	recentBuffer.SetSeenLimits(10, 0)
+	var sendBuffers [][]byte
+	for i := 0; i < 20; i++ {
+		b, err := bc.GenerateRandomBytes(nonceSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendBuffers = append(sendBuffers, b)
+		recentBuffer.SeenRecently(b)
+	}
+	if recentBuffer.SeenRecently(sendBuffers[0]) {
+		t.Error("SeenRecently remembered a message past the buffer size")
+	}
+	if !recentBuffer.SeenRecently(sendBuffers[19]) {
+		t.Error("SeenRecently forgot the newest message")
+	}
+	stats := recentBuffer.SeenStats()
+	if stats.Entries != 10 || stats.Evicted != 11 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if rate := stats.HitRate(); rate != 1.0/22 {
+		t.Errorf("Expected a hit rate of 1/22, got %f", rate)
+	}
+}
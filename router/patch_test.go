@@ -0,0 +1,164 @@
+package router_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+	"github.com/awgh/ratnet/router"
+)
+
+func Test_Patch_Unpatch_1(t *testing.T) {
+	r := router.NewDefaultRouter()
+	r.Patch(api.Patch{From: "a", To: []string{"b"}})
+	r.Patch(api.Patch{From: "c", To: []string{"d"}})
+	r.Patch(api.Patch{From: "a", To: []string{"e", "f"}}) // replaces the first patch
+	patches := r.GetPatches()
+	if len(patches) != 2 || patches[0].From != "a" || strings.Join(patches[0].To, ",") != "e,f" || patches[1].From != "c" {
+		t.Fatalf("Unexpected patches: %+v", patches)
+	}
+	r.Unpatch("a")
+	r.Unpatch("nothing")
+	if patches := r.GetPatches(); len(patches) != 1 || patches[0].From != "c" {
+		t.Fatalf("Unexpected patches after Unpatch: %+v", patches)
+	}
+	r.SetPatches([]api.Patch{{From: "x", To: []string{"y"}}})
+	if patches := r.GetPatches(); len(patches) != 1 || patches[0].From != "x" {
+		t.Fatalf("Unexpected patches after SetPatches: %+v", patches)
+	}
+}
+
+// Test_Patch_Field_1 - patches set through the deprecated Patches field still route, and the methods see them
+func Test_Patch_Field_1(t *testing.T) {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	relay := ram.New(nil, nil)
+	r := router.NewDefaultRouter()
+	var lastTime int64
+
+	route := func() []string {
+		if _, err := src.SendMsg(api.Msg{Name: "in", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		sent, _, err := src.Outbox().MsgsSince(0, 0)
+		if err != nil || len(sent) == 0 {
+			t.Fatal("Expected a message to be sent", err)
+		}
+		if err := r.Route(relay, sent[len(sent)-1], api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+		forwarded, last, err := relay.Outbox().MsgsSince(lastTime, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastTime = last
+		var names []string
+		for _, m := range forwarded {
+			names = append(names, channelOf(m))
+		}
+		return names
+	}
+
+	r.Patches = append(r.Patches, api.Patch{From: "in", To: []string{"out1"}})
+	if names := route(); strings.Join(names, ",") != "out1" {
+		t.Errorf("Expected the message to be patched to out1, got %v", names)
+	}
+	r.Patches = []api.Patch{{From: "other", To: []string{"x"}}, {From: "in", To: []string{"out2"}}}
+	if names := route(); strings.Join(names, ",") != "out2" {
+		t.Errorf("Expected the message to be patched to out2, got %v", names)
+	}
+	r.Unpatch("in")
+	if len(r.Patches) != 1 || r.Patches[0].From != "other" {
+		t.Fatalf("Patches field out of sync after Unpatch: %+v", r.Patches)
+	}
+	if names := route(); strings.Join(names, ",") != "in" {
+		t.Errorf("Expected the unpatched message to be forwarded on in, got %v", names)
+	}
+}
+
+// Test_Patch_Live_1 - repatches a relay through the admin RPC between messages
+func Test_Patch_Live_1(t *testing.T) {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	relay := ram.New(nil, nil)
+	var lastTime int64
+
+	// route - routes a new message on channel "in" through the relay and returns the channels it was forwarded on
+	route := func() []string {
+		if _, err := src.SendMsg(api.Msg{Name: "in", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		sent, _, err := src.Outbox().MsgsSince(0, 0)
+		if err != nil || len(sent) == 0 {
+			t.Fatal("Expected a message to be sent", err)
+		}
+		if err := relay.Router().Route(relay, sent[len(sent)-1], api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+		forwarded, last, err := relay.Outbox().MsgsSince(lastTime, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastTime = last
+		var names []string
+		for _, m := range forwarded {
+			names = append(names, channelOf(m))
+		}
+		return names
+	}
+
+	if _, err := relay.AdminRPC(nil, api.RemoteCall{Action: api.AddPatch, Args: []interface{}{"in", "out1", "out2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if names := route(); strings.Join(names, ",") != "out1,out2" {
+		t.Errorf("Expected the message to be patched to out1 and out2, got %v", names)
+	}
+	if _, err := relay.AdminRPC(nil, api.RemoteCall{Action: api.SetPatches, Args: []interface{}{[]api.Patch{{From: "in", To: []string{"out3"}}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if names := route(); strings.Join(names, ",") != "out3" {
+		t.Errorf("Expected the message to be patched to out3, got %v", names)
+	}
+	if _, err := relay.AdminRPC(nil, api.RemoteCall{Action: api.Unpatch, Args: []interface{}{"in"}}); err != nil {
+		t.Fatal(err)
+	}
+	if names := route(); strings.Join(names, ",") != "in" {
+		t.Errorf("Expected the unpatched message to be forwarded on in, got %v", names)
+	}
+	v, err := relay.AdminRPC(nil, api.RemoteCall{Action: api.GetPatches})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patches, ok := v.([]api.Patch); !ok || len(patches) != 0 {
+		t.Errorf("Expected no patches, got %+v", v)
+	}
+}
+
+// Test_Patch_Swap_1 - routing never sees an empty or partial set while SetPatches replaces it
+func Test_Patch_Swap_1(t *testing.T) {
+	r := router.NewDefaultRouter()
+	patches := []api.Patch{{From: "a", To: []string{"b"}}, {From: "c", To: []string{"d"}}, {From: "a", To: []string{"e"}}}
+	r.SetPatches(patches)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			r.SetPatches(patches)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if got := r.GetPatches(); len(got) != 2 || got[0].To[0] != "e" {
+			t.Fatalf("Saw patches mid-swap: %+v", got)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package router
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+)
+
+// RuleAction : what a RulesRouter does with a message that matches a Rule
+type RuleAction string
+
+const (
+	// RuleForward : handle and forward the message as the DefaultRouter would
+	RuleForward RuleAction = "forward"
+	// RuleDrop : neither handle nor forward the message, unless the Rule is ForwardOnly
+	RuleDrop RuleAction = "drop"
+	// RulePatch : handle the message, then forward it to the channels in the Rule's To instead
+	RulePatch RuleAction = "patch"
+	// RuleRateLimit : forward like RuleForward up to Rate messages per second with bursts of Burst,
+	// drop the rest like RuleDrop
+	RuleRateLimit RuleAction = "ratelimit"
+)
+
+// Rule : a match on routed messages and the action to take on them.
+// Matchers left at their zero value match every message.
+type Rule struct {
+	// Channel : glob on the channel name, in path.Match syntax, direct messages have the name ""
+	Channel string `json:",omitempty"`
+	// Direct : if set, only matches direct (true) or channel (false) messages
+	Direct *bool `json:",omitempty"`
+	// Chunked : if set, only matches chunked (true) or unchunked (false) messages
+	Chunked *bool `json:",omitempty"`
+	// StreamHeader : if set, only matches stream headers (true) or other messages (false)
+	StreamHeader *bool `json:",omitempty"`
+	// MinSize : if set, only matches messages of at least this many bytes on the wire
+	MinSize int `json:",omitempty"`
+	// MaxSize : if set, only matches messages of at most this many bytes on the wire
+	MaxSize int `json:",omitempty"`
+	// Peer : glob on the base64 routing key or the URI of the peer the message came in from,
+	// see api.Ingress, messages from unknown peers only match "*".
+	// Peers that drop off messages name their own routing key, so a lying peer can dodge or borrow a rule on keys,
+	// URIs are the ones this node's policies fetched from.
+	Peer string `json:",omitempty"`
+
+	Action RuleAction
+	// To : destination channels for RulePatch, "" for a direct message
+	To []string `json:",omitempty"`
+	// Rate : messages per second for RuleRateLimit
+	Rate float64 `json:",omitempty"`
+	// Burst : messages RuleRateLimit lets through at once, at least 1
+	Burst int `json:",omitempty"`
+	// ForwardOnly : RuleDrop and RuleRateLimit only keep the message from being forwarded, it is still handled here.
+	// Otherwise they drop it before it is handled, so it is not delivered to this node either.
+	// A message kept from being forwarded is remembered as seen, so a retransmit of it is not forwarded either.
+	ForwardOnly bool `json:",omitempty"`
+}
+
+// Match : returns true if the routed message msg of the given size matches the Rule
+func (rule *Rule) Match(msg api.Msg, size int) bool {
+	if rule.Channel != "" {
+		if ok, err := path.Match(rule.Channel, msg.Name); !ok || err != nil {
+			return false
+		}
+	}
+	if rule.Direct != nil && *rule.Direct == msg.IsChan {
+		return false
+	}
+	if rule.Chunked != nil && *rule.Chunked != msg.Chunked {
+		return false
+	}
+	if rule.StreamHeader != nil && *rule.StreamHeader != msg.StreamHeader {
+		return false
+	}
+	if rule.MinSize > 0 && size < rule.MinSize {
+		return false
+	}
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		return false
+	}
+	if rule.Peer != "" {
+		byKey, err := path.Match(rule.Peer, msg.Ingress.Peer)
+		if err != nil {
+			return false
+		}
+		byURI, _ := path.Match(rule.Peer, msg.Ingress.URI)
+		if !byKey && !byURI {
+			return false
+		}
+	}
+	return true
+}
+
+// RulesRouter : a DefaultRouter that checks each message against an ordered list of Rules first.
+// The first Rule that matches decides what happens to the message, messages no Rule matches
+// are routed as by the DefaultRouter, Patches included.
+// Rules are checked before a message is handled, so RuleDrop and RuleRateLimit keep the messages they drop
+// from this node too, unless the Rule is ForwardOnly.
+type RulesRouter struct {
+	*DefaultRouter
+
+	// Rules : the rules, in the order they are checked.  Change them with SetRules once the router is in use.
+	Rules []Rule
+
+	rulesMutex sync.Mutex      // guards Rules and buckets
+	buckets    map[int]*bucket // token buckets of the RuleRateLimit rules, by index in Rules
+}
+
+// bucket : token bucket for a RuleRateLimit rule
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRulesRouter : returns a new RulesRouter with the default settings of the DefaultRouter and the given rules
+func NewRulesRouter(rules ...Rule) *RulesRouter {
+	r := new(RulesRouter)
+	r.DefaultRouter = NewDefaultRouter()
+	r.Rules = rules
+	r.buckets = make(map[int]*bucket)
+	return r
+}
+
+// SetRules : replaces the rules of this router, and resets the rate limits
+func (r *RulesRouter) SetRules(rules []Rule) {
+	r.rulesMutex.Lock()
+	defer r.rulesMutex.Unlock()
+	r.Rules = rules
+	r.buckets = make(map[int]*bucket)
+}
+
+// Route : routes the message as the DefaultRouter would, after applying the first Rule that matches it
+func (r *RulesRouter) Route(node api.Node, message []byte, ingress api.Ingress) error {
+	return r.route(node, message, ingress, r.verdict)
+}
+
+// GetRules : returns a copy of the rules of this router
+func (r *RulesRouter) GetRules() []Rule {
+	r.rulesMutex.Lock()
+	defer r.rulesMutex.Unlock()
+	return append([]Rule(nil), r.Rules...)
+}
+
+// verdict : applies the first Rule that matches msg, returns true to drop it, or the channels to patch it to
+func (r *RulesRouter) verdict(msg api.Msg, size int) (bool, []string) {
+	r.rulesMutex.Lock()
+	defer r.rulesMutex.Unlock()
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if !rule.Match(msg, size) {
+			continue
+		}
+		drop := false
+		switch rule.Action {
+		case RuleDrop:
+			drop = true
+		case RulePatch:
+			if rule.To == nil {
+				return false, []string{}
+			}
+			return false, rule.To
+		case RuleRateLimit:
+			drop = !r.allow(i, rule)
+		}
+		if drop && rule.ForwardOnly {
+			return false, []string{} // handled, then forwarded nowhere
+		}
+		return drop, nil
+	}
+	return false, nil
+}
+
+// allow : takes a token from the bucket of the RuleRateLimit rule at index i in Rules, if there is one,
+// call with rulesMutex held
+func (r *RulesRouter) allow(i int, rule *Rule) bool {
+	burst := float64(rule.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	b, ok := r.buckets[i]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		r.buckets[i] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rule.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,78 @@
+// +build !no_json
+
+package router
+
+import (
+	"encoding/json"
+
+	"github.com/awgh/ratnet"
+	"github.com/awgh/ratnet/api"
+)
+
+func init() {
+	ratnet.Routers["rules"] = NewRulesRouterFromMap // register this module by name (for deserialization support)
+}
+
+// NewRulesRouterFromMap : Makes a new instance of this module from a map of arguments (for deserialization support)
+func NewRulesRouterFromMap(r map[string]interface{}) api.Router {
+	router := NewRulesRouter()
+	// the settings have the same names as the fields, so let encoding/json sort them out
+	b, err := json.Marshal(r)
+	if err != nil {
+		return router
+	}
+	var config struct {
+		CheckContent            *bool
+		CheckChannels           *bool
+		CheckProfiles           *bool
+		ForwardConsumedContent  *bool
+		ForwardConsumedChannels *bool
+		ForwardConsumedProfiles *bool
+		ForwardUnknownContent   *bool
+		ForwardUnknownChannels  *bool
+		ForwardUnknownProfiles  *bool
+		PersistSeen             *bool
+		Patches                 []api.Patch
+		Rules                   []Rule
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return router
+	}
+	set := func(dst *bool, src *bool) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&router.CheckContent, config.CheckContent)
+	set(&router.CheckChannels, config.CheckChannels)
+	set(&router.CheckProfiles, config.CheckProfiles)
+	set(&router.ForwardConsumedContent, config.ForwardConsumedContent)
+	set(&router.ForwardConsumedChannels, config.ForwardConsumedChannels)
+	set(&router.ForwardConsumedProfiles, config.ForwardConsumedProfiles)
+	set(&router.ForwardUnknownContent, config.ForwardUnknownContent)
+	set(&router.ForwardUnknownChannels, config.ForwardUnknownChannels)
+	set(&router.ForwardUnknownProfiles, config.ForwardUnknownProfiles)
+	set(&router.PersistSeen, config.PersistSeen)
+	router.SetPatches(config.Patches)
+	router.SetRules(config.Rules)
+	return router
+}
+
+// MarshalJSON : Create a serialized JSON blob out of the config of this router
+func (r *RulesRouter) MarshalJSON() (b []byte, e error) {
+	return json.Marshal(map[string]interface{}{
+		"Router":                  "rules",
+		"CheckContent":            r.CheckContent,
+		"ForwardConsumedContent":  r.ForwardConsumedContent,
+		"ForwardUnknownContent":   r.ForwardUnknownContent,
+		"CheckProfiles":           r.CheckProfiles,
+		"ForwardConsumedProfiles": r.ForwardConsumedProfiles,
+		"ForwardUnknownProfiles":  r.ForwardUnknownProfiles,
+		"CheckChannels":           r.CheckChannels,
+		"ForwardConsumedChannels": r.ForwardConsumedChannels,
+		"ForwardUnknownChannels":  r.ForwardUnknownChannels,
+		"PersistSeen":             r.PersistSeen,
+		"Patches":                 r.GetPatches(),
+		"Rules":                   r.GetRules(),
+	})
+}
@@ -0,0 +1,237 @@
+package router_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+	"github.com/awgh/ratnet/router"
+)
+
+// ruled - sends n messages on channel from a new node, routes them through a new relay with r, and returns what the relay forwarded
+func ruled(t *testing.T, r api.Router, channel string, n int) [][]byte {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	for i := 0; i < n; i++ {
+		msg := api.Msg{Name: channel, IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}
+		if _, err := src.SendMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent, _, err := src.Outbox().MsgsSince(0, 0)
+	if err != nil || len(sent) != n {
+		t.Fatal("Expected messages to be sent", err)
+	}
+	relay := ram.New(nil, nil)
+	for _, m := range sent {
+		if err := r.Route(relay, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forwarded, _, err := relay.Outbox().MsgsSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwarded
+}
+
+func channelOf(m []byte) string {
+	n := int(m[1])<<8 | int(m[2])
+	return string(m[3 : 3+n])
+}
+
+func Test_Rules_FirstMatch_1(t *testing.T) {
+	r := router.NewRulesRouter(
+		router.Rule{Channel: "spam*", Action: router.RuleDrop},
+		router.Rule{Channel: "news", Action: router.RulePatch, To: []string{"a", "b"}},
+		router.Rule{Action: router.RuleDrop, MinSize: 1024},
+	)
+	if forwarded := ruled(t, r, "spammer", 1); len(forwarded) != 0 {
+		t.Error("Message matching a drop rule was forwarded")
+	}
+	forwarded := ruled(t, r, "news", 1)
+	if len(forwarded) != 2 || channelOf(forwarded[0]) != "a" || channelOf(forwarded[1]) != "b" {
+		t.Error("Message matching a patch rule was not patched")
+	}
+	if forwarded := ruled(t, r, "other", 1); len(forwarded) != 1 || channelOf(forwarded[0]) != "other" {
+		t.Error("Message matching no rule was not forwarded")
+	}
+
+	chunked := true
+	r = router.NewRulesRouter(router.Rule{Chunked: &chunked, Action: router.RuleDrop}, router.Rule{Peer: "somepeer", Action: router.RuleDrop})
+	if forwarded := ruled(t, r, "other", 1); len(forwarded) != 1 {
+		t.Error("Unchunked message matched a chunked rule")
+	}
+}
+
+func Test_Rules_Peer_1(t *testing.T) {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	if _, err := src.SendMsg(api.Msg{Name: "chan", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err := src.Outbox().MsgsSince(0, 0)
+	if err != nil || len(sent) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	for _, test := range []struct {
+		ingress api.Ingress
+		dropped bool
+	}{
+		{api.Ingress{}, false},
+		{api.Ingress{Peer: "badkey", Transport: "udp"}, true},
+		{api.Ingress{Peer: "goodkey", URI: "bad.example.com:20001"}, true},
+		{api.Ingress{Peer: "goodkey", URI: "good.example.com:20001"}, false},
+	} {
+		r := router.NewRulesRouter(router.Rule{Peer: "bad*", Action: router.RuleDrop})
+		relay := ram.New(nil, nil)
+		if err := r.Route(relay, sent[0], test.ingress); err != nil {
+			t.Fatal(err)
+		}
+		forwarded, _, err := relay.Outbox().MsgsSince(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped := len(forwarded) == 0; dropped != test.dropped {
+			t.Errorf("Message from %+v dropped: %v, expected %v", test.ingress, dropped, test.dropped)
+		}
+	}
+}
+
+func Test_Rules_RateLimit_1(t *testing.T) {
+	r := router.NewRulesRouter(router.Rule{Channel: "busy", Action: router.RuleRateLimit, Rate: 0.001, Burst: 3})
+	if forwarded := ruled(t, r, "busy", 5); len(forwarded) != 3 {
+		t.Errorf("Expected a burst of 3 messages to be forwarded, got %d", len(forwarded))
+	}
+}
+
+func Test_Rules_RateLimit_Retransmit_1(t *testing.T) {
+	r := router.NewRulesRouter(router.Rule{Channel: "busy", Action: router.RuleRateLimit, Rate: 20, Burst: 1})
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := src.SendMsg(api.Msg{Name: "busy", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent, _, err := src.Outbox().MsgsSince(0, 0)
+	if err != nil || len(sent) != 2 {
+		t.Fatal("Expected two messages to be sent", err)
+	}
+	relay := ram.New(nil, nil)
+	for _, m := range sent {
+		if err := r.Route(relay, m, api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the message that was over the limit is let through when it is sent again later
+	time.Sleep(100 * time.Millisecond)
+	if err := r.Route(relay, sent[1], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	forwarded, _, err := relay.Outbox().MsgsSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded) != 2 {
+		t.Errorf("Expected the retransmitted message to be forwarded, got %d messages", len(forwarded))
+	}
+}
+
+func Test_Rules_Direct_1(t *testing.T) {
+	direct := true
+	r := router.NewRulesRouter(router.Rule{Direct: &direct, Action: router.RuleDrop})
+	if forwarded := ruled(t, r, "chan", 1); len(forwarded) != 1 {
+		t.Error("Channel message matched a direct-only rule")
+	}
+
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	if _, err := src.SendMsg(api.Msg{PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err := src.Outbox().MsgsSince(0, 0)
+	if err != nil || len(sent) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	relay := ram.New(nil, nil)
+	if err := r.Route(relay, sent[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded, _, _ := relay.Outbox().MsgsSince(0, 0); len(forwarded) != 0 {
+		t.Error("Direct message matching a direct-only drop rule was forwarded")
+	}
+}
+
+func Test_Rules_ForwardOnly_1(t *testing.T) {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	src := ram.New(nil, nil)
+	if _, err := src.SendMsg(api.Msg{Name: "local", IsChan: true, PubKey: key.GetPubKey(), Content: bytes.NewBufferString("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err := src.Outbox().MsgsSince(0, 0)
+	if err != nil || len(sent) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	for _, forwardOnly := range []bool{false, true} {
+		r := router.NewRulesRouter(router.Rule{Channel: "local", Action: router.RuleDrop, ForwardOnly: forwardOnly})
+		relay := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+		if err := relay.AddChannel("local", key.ToB64()); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Route(relay, sent[0], api.Ingress{}); err != nil {
+			t.Fatal(err)
+		}
+		if forwarded, _, _ := relay.Outbox().MsgsSince(0, 0); len(forwarded) != 0 {
+			t.Error("Message matching a drop rule was forwarded, ForwardOnly:", forwardOnly)
+		}
+		if handled := len(relay.Out()) == 1; handled != forwardOnly {
+			t.Errorf("Message handled: %v, expected %v", handled, forwardOnly)
+		}
+	}
+}
+
+func Test_Rules_JSON_1(t *testing.T) {
+	chunked, direct := false, false
+	r := router.NewRulesRouter(
+		router.Rule{Channel: "spam*", Chunked: &chunked, MaxSize: 100, Action: router.RuleDrop},
+		router.Rule{Direct: &direct, Action: router.RuleRateLimit, Rate: 2, Burst: 4, ForwardOnly: true},
+	)
+	r.ForwardUnknownContent = false
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	newRouter, ok := ratnet.Routers[m["Router"].(string)]
+	if !ok {
+		t.Fatal("Rules router is not registered")
+	}
+	r2, ok := newRouter(m).(*router.RulesRouter)
+	if !ok {
+		t.Fatal("Wrong router type")
+	}
+	if r2.ForwardUnknownContent || len(r2.Rules) != 2 {
+		t.Fatal("Router settings were not restored")
+	}
+	if rule := r2.Rules[0]; rule.Channel != "spam*" || rule.Chunked == nil || *rule.Chunked || rule.MaxSize != 100 || rule.Action != router.RuleDrop {
+		t.Error("Drop rule was not restored", rule)
+	}
+	if rule := r2.Rules[1]; rule.Rate != 2 || rule.Burst != 4 || rule.Action != router.RuleRateLimit ||
+		rule.Direct == nil || *rule.Direct || !rule.ForwardOnly {
+		t.Error("Rate limit rule was not restored", rule)
+	}
+}
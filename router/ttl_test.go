@@ -0,0 +1,100 @@
+package router_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+	"github.com/awgh/ratnet/router"
+)
+
+// routed - sends msg from a new node, routes it through a new relay, and returns what the relay forwarded
+func routed(t *testing.T, msg api.Msg) [][]byte {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	msg.Name = "ttltest"
+	msg.IsChan = true
+	msg.PubKey = key.GetPubKey()
+
+	src := ram.New(nil, nil)
+	if _, err := src.SendMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err := src.Outbox().MsgsSince(0, 0)
+	if err != nil || len(sent) != 1 {
+		t.Fatal("Expected one message to be sent", err)
+	}
+	relay := ram.New(nil, nil)
+	if err := router.NewDefaultRouter().Route(relay, sent[0], api.Ingress{}); err != nil {
+		t.Fatal(err)
+	}
+	forwarded, _, err := relay.Outbox().MsgsSince(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwarded
+}
+
+func Test_TTL_NoHeader_1(t *testing.T) {
+	forwarded := routed(t, api.Msg{Content: bytes.NewBufferString("hello")})
+	if len(forwarded) != 1 {
+		t.Fatalf("Expected the message to be forwarded, got %d", len(forwarded))
+	}
+	if forwarded[0][0]&api.TTLFlag != 0 {
+		t.Error("Message without a TTL was forwarded with a TTL header")
+	}
+}
+
+func Test_TTL_HopLimit_1(t *testing.T) {
+	forwarded := routed(t, api.Msg{Content: bytes.NewBufferString("hello"), HopLimit: 3})
+	if len(forwarded) != 1 {
+		t.Fatalf("Expected the message to be forwarded, got %d", len(forwarded))
+	}
+	m := forwarded[0]
+	if m[0]&api.TTLFlag == 0 {
+		t.Fatal("TTL header was not forwarded")
+	}
+	hopLimit, _, _, err := api.ParseTTLHeader(m[3+len("ttltest"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hopLimit != 2 {
+		t.Errorf("Expected hop limit 2 after one hop, got %d", hopLimit)
+	}
+
+	if forwarded := routed(t, api.Msg{Content: bytes.NewBufferString("hello"), HopLimit: 1}); len(forwarded) != 0 {
+		t.Error("Message on its last hop was forwarded")
+	}
+}
+
+func Test_TTL_Expires_1(t *testing.T) {
+	future := time.Now().Add(time.Hour).UnixNano()
+	if forwarded := routed(t, api.Msg{Content: bytes.NewBufferString("hello"), Expires: future}); len(forwarded) != 1 {
+		t.Errorf("Expected the unexpired message to be forwarded, got %d", len(forwarded))
+	}
+	past := time.Now().Add(-time.Second).UnixNano()
+	if forwarded := routed(t, api.Msg{Content: bytes.NewBufferString("hello"), Expires: past}); len(forwarded) != 0 {
+		t.Error("Expired message was forwarded")
+	}
+}
+
+func Test_TTL_Priority_1(t *testing.T) {
+	forwarded := routed(t, api.Msg{Content: bytes.NewBufferString("hello"), Priority: api.PriorityUrgent})
+	if len(forwarded) != 1 {
+		t.Fatalf("Expected the message to be forwarded, got %d", len(forwarded))
+	}
+	m := forwarded[0]
+	if m[0]&api.TTLFlag == 0 {
+		t.Fatal("Priority was not carried in a TTL header")
+	}
+	_, _, priority, err := api.ParseTTLHeader(m[3+len("ttltest"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priority != api.PriorityUrgent {
+		t.Errorf("Expected the relay to keep the urgent priority, got %d", priority)
+	}
+}
@@ -5,6 +5,7 @@ rm -f ratnet/tmp/ratnet_p2p_test1.ql
 rm -f ratnet/tmp/ratnet_p2p_test2.ql
 rm -f ratnet/tmp/ratnet_test1.ql
 rm -rf nodes/fs/tmp
+rm -rf nodes/kv/kvtmp
 
 go test -v github.com/awgh/bencrypt/bc
 go test -v github.com/awgh/bencrypt/ecc
@@ -12,4 +13,5 @@ go test -v github.com/awgh/bencrypt/rsa
 go test -v github.com/awgh/ratnet/nodes/qldb
 go test -v github.com/awgh/ratnet/nodes/ram
 go test -v github.com/awgh/ratnet/nodes/fs
+go test -v github.com/awgh/ratnet/nodes/kv
 go test -v github.com/awgh/ratnet/ratnet